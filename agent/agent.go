@@ -1,9 +1,12 @@
 package agent
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"os/signal"
+	"strings"
+	"sync"
 	"syscall"
 	"time"
 
@@ -15,7 +18,10 @@ import (
 	containersFactory "github.com/MustWin/cmeter/containers/factory"
 	"github.com/MustWin/cmeter/context"
 	"github.com/MustWin/cmeter/reporting"
+	"github.com/MustWin/cmeter/reporting/ctoll"
 	reportingFactory "github.com/MustWin/cmeter/reporting/factory"
+	"github.com/MustWin/cmeter/reporting/redact"
+	"github.com/MustWin/cmeter/reporting/spool"
 	"github.com/MustWin/cmeter/shared/disposer"
 )
 
@@ -32,24 +38,61 @@ type Agent struct {
 
 	registry *containers.Registry
 
-	reporting reporting.Driver
+	reporting *reporter
+
+	spool *spool.Spool
+
+	redactor *redact.Redactor
+
+	dispatcher *dispatcher
+
+	stops chan *reporting.Event
 
 	dispose *disposer.Disposer
+
+	processors sync.WaitGroup
+
+	// arguments the configuration is reloaded from, reloads are disabled
+	// when nil
+	configArgs []string
+
+	reloads chan struct{}
+
+	// guards what reloads swap: the config, reporting driver and redactor
+	mutex sync.RWMutex
 }
 
 func (agent *Agent) Run() error {
 	context.GetLogger(agent).Info("starting agent")
 	defer context.GetLogger(agent).Info("shutting down agent")
+
+	// what the previous run left in the spool is queued before the starts of
+	// the active containers, so their stops from that run are reported first
+	agent.dispatcher.Start()
+	if agent.spool != nil {
+		agent.replaySpool()
+	}
+
 	err := agent.InitializeContainers()
 	if err != nil {
+		agent.dispatcher.Stop()
 		return fmt.Errorf("error initializing container states: %v", err)
 	}
 
 	agent.bootstrapSignalHandler()
 
-	go agent.ProcessSamples(agent.dispose.Quitter())
-	go agent.ProcessHostSamples(agent.dispose.Quitter())
-	go agent.ProcessEvents(agent.dispose.Quitter())
+	agent.process(agent.ProcessSamples)
+	agent.process(agent.ProcessHostSamples)
+	agent.process(agent.ProcessEvents)
+	if agent.spool != nil {
+		agent.process(agent.ProcessSpool)
+	}
+
+	if agent.configArgs != nil {
+		agent.process(agent.ProcessReloads)
+	}
+
+	agent.process(agent.ProcessDispatch)
 
 	agent.dispose.Wait()
 	agent.Shutdown()
@@ -69,18 +112,54 @@ func (agent *Agent) Shutdown() error {
 		}, true)
 	}
 
+	// the processors report what they still hold when quitting, so the
+	// dispatcher is stopped once they returned and the spool once the
+	// dispatcher delivered everything
 	agent.dispose.QuitAll()
+	agent.processors.Wait()
+	agent.dispatcher.Stop()
+	context.GetLogger(agent).Info("report dispatcher stopped")
+	if agent.spool != nil {
+		if err := agent.spool.Close(); err != nil {
+			context.GetLogger(agent).Errorf("error closing spool: %v", err)
+		}
+	}
+
 	return nil
 }
 
+// process runs the processor until the agent quits, Shutdown waits for it
+// to return.
+func (agent *Agent) process(processor func(quitCh <-chan struct{})) {
+	quitCh := agent.dispose.Quitter()
+	agent.processors.Add(1)
+	go func() {
+		defer agent.processors.Done()
+		processor(quitCh)
+	}()
+}
+
 func (agent *Agent) bootstrapSignalHandler() {
 	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt, os.Kill, syscall.SIGTERM)
+	signal.Notify(c, os.Interrupt, os.Kill, syscall.SIGTERM, syscall.SIGHUP)
 
 	go func() {
-		sig := <-c
-		context.GetLogger(agent).Infof("detected signal %v: shutting down", sig)
-		agent.dispose.Dispose()
+		for sig := range c {
+			if sig == syscall.SIGHUP {
+				if agent.configArgs == nil {
+					context.GetLogger(agent).Warn("detected signal hangup: configuration reloads are disabled")
+				} else {
+					context.GetLogger(agent).Info("detected signal hangup: reloading configuration")
+					agent.requestReload()
+				}
+
+				continue
+			}
+
+			context.GetLogger(agent).Infof("detected signal %v: shutting down", sig)
+			agent.dispose.Dispose()
+			return
+		}
 	}()
 }
 
@@ -90,7 +169,7 @@ func (agent *Agent) InitializeContainers() error {
 		return err
 	}
 
-	agent.machineCollector = collector.NewMachine(agent, feed, agent.config.Collector)
+	agent.machineCollector = collector.NewMachine(agent, feed, agent.currentConfig().Collector)
 	active, err := agent.containers.GetContainers(agent)
 	if err != nil {
 		return err
@@ -128,16 +207,7 @@ func (agent *Agent) ProcessHostSamples(quitCh <-chan struct{}) {
 		case <-quitCh:
 			return
 		case sample := <-agent.machineCollector.GetChannel():
-			e := reporting.Generate(agent, reporting.EventMachineSample, sample)
-			go func() {
-				_, err := agent.reporting.Report(agent, e)
-				if err != nil {
-					context.GetLogger(agent).Errorf("error reporting machine usage: %v", err)
-				} else {
-					context.GetLogger(agent).Debug("machine usage reported")
-				}
-			}()
-
+			agent.report(reporting.Generate(agent, reporting.EventMachineSample, sample))
 		}
 	}
 }
@@ -145,8 +215,12 @@ func (agent *Agent) ProcessHostSamples(quitCh <-chan struct{}) {
 // TODO: break-out
 func (agent *Agent) ProcessStateChange(c *containers.StateChange, registered bool) {
 	if !registered {
+		// registrations of the events, tracking changes and the containers
+		// found at start may race, only the first one starts metering
 		if err := agent.registry.Register(agent, c.Container); err != nil {
-			if err != containers.ErrNotTrackable {
+			if err == containers.ErrAlreadyRegistered {
+				context.GetLogger(agent).Debugf("container %q already metered", c.Container.Name)
+			} else if err != containers.ErrNotTrackable {
 				context.GetLogger(agent).Errorf("error registering container: %v", err)
 			}
 
@@ -156,7 +230,12 @@ func (agent *Agent) ProcessStateChange(c *containers.StateChange, registered boo
 
 	if c.State == containers.StateStopped {
 		if err := agent.registry.Drop(agent, c.Container.Name); err != nil {
-			context.GetLogger(agent).Errorf("error dropping container: %v", err)
+			if err == containers.ErrNotRegistered {
+				context.GetLogger(agent).Debugf("container %q already stopped metering", c.Container.Name)
+			} else {
+				context.GetLogger(agent).Errorf("error dropping container: %v", err)
+			}
+
 			return
 		}
 
@@ -164,26 +243,23 @@ func (agent *Agent) ProcessStateChange(c *containers.StateChange, registered boo
 			context.GetLogger(agent).Errorf("error stopping container usage collection: %v", err)
 			return
 		}
-	} else {
-		ch, err := agent.containers.GetContainerUsage(agent, c.Container.Name)
-		if err != nil {
-			context.GetLogger(agent).Errorf("error opening usage channel: %v", err)
-			return
-		} else if err = agent.collector.Collect(agent, ch); err != nil {
-			context.GetLogger(agent).Errorf("error starting container usage collection: %v", err)
-			return
-		}
+
+		// handed to the sample processor so it's reported after the container's pending samples
+		agent.stops <- reporting.Generate(agent, reporting.EventStateChange, c)
+		return
 	}
 
-	e := reporting.Generate(agent, reporting.EventStateChange, c)
-	go func() {
-		_, err := agent.reporting.Report(agent, e)
-		if err != nil {
-			context.GetLogger(agent).Errorf("error reporting state change: %v", err)
-		} else {
-			context.GetLogger(agent).Debug("state change reported")
-		}
-	}()
+	ch, err := agent.containers.GetContainerUsage(agent, c.Container.Name)
+	if err != nil {
+		context.GetLogger(agent).Errorf("error opening usage channel: %v", err)
+		return
+	}
+
+	// reported before collection starts so it precedes the container's samples
+	agent.report(reporting.Generate(agent, reporting.EventStateChange, c))
+	if err = agent.collector.Collect(agent, ch); err != nil {
+		context.GetLogger(agent).Errorf("error starting container usage collection: %v", err)
+	}
 }
 
 // TODO: break-out
@@ -253,19 +329,82 @@ func (agent *Agent) ProcessSamples(quitCh <-chan struct{}) {
 	for {
 		select {
 		case <-quitCh:
-			return
-		case sample := <-agent.collector.GetChannel():
-			e := reporting.Generate(agent, reporting.EventSample, sample)
-			go func() {
-				_, err := agent.reporting.Report(agent, e)
-				if err != nil {
-					context.GetLogger(agent).Errorf("error reporting usage: %v", err)
-				} else {
-					context.GetLogger(agent).Debug("usage reported")
+			agent.reportPendingSamples()
+			for {
+				select {
+				case e := <-agent.stops:
+					agent.report(e)
+				default:
+					return
 				}
-			}()
+			}
+
+		case sample := <-agent.collector.GetChannel():
+			agent.report(reporting.Generate(agent, reporting.EventSample, sample))
+		case e := <-agent.stops:
+			agent.reportPendingSamples()
+			agent.report(e)
+		}
+	}
+}
+
+// reportPendingSamples reports the samples already collected, so a stopped
+// container's samples precede its stop event.
+func (agent *Agent) reportPendingSamples() {
+	for {
+		select {
+		case sample := <-agent.collector.GetChannel():
+			agent.report(reporting.Generate(agent, reporting.EventSample, sample))
+		default:
+			return
+		}
+	}
+}
+
+// CheckConfig returns the problems of a configuration that span several of
+// its sections, the drivers can't detect them on their own.
+func CheckConfig(config *configuration.Config) []error {
+	var problems []error
+	// invalid redaction settings are reported by the redactor
+	redactor, _ := redact.New(config.Redaction)
+	for _, params := range config.ReportingParameters("ctoll") {
+		if config.Spool.Directory == "" && strings.ToLower(params.String("missing_key", "")) == ctoll.MISSING_KEY_HOLD {
+			problems = append(problems, errors.New("reporting: the ctoll missing_key `hold` requires a spool directory, held events would be lost"))
+		}
+
+		// the labels and env variables api keys are found with have to be
+		// reported
+		if redactor == nil {
+			continue
+		}
+
+		for _, name := range []string{"key_label", "tenant_label"} {
+			if label := params.String(name, ""); label != "" && !redactor.KeepsLabel(label) {
+				problems = append(problems, fmt.Errorf("redaction: label %q is removed or redacted, the ctoll driver wouldn't find api keys", label))
+			}
+		}
+
+		if env := params.String("key_env", ""); env != "" && !redactor.KeepsEnv(env) {
+			problems = append(problems, fmt.Errorf("redaction: env %q is removed or redacted, the ctoll driver wouldn't find api keys", env))
 		}
 	}
+
+	return problems
+}
+
+// checkConfig returns the problems of CheckConfig as a single error.
+func checkConfig(config *configuration.Config) error {
+	problems := CheckConfig(config)
+	if len(problems) == 0 {
+		return nil
+	}
+
+	messages := make([]string, len(problems))
+	for i, problem := range problems {
+		messages[i] = problem.Error()
+	}
+
+	return fmt.Errorf("invalid configuration: %s", strings.Join(messages, "; "))
 }
 
 func New(ctx context.Context, config *configuration.Config) (*Agent, error) {
@@ -274,6 +413,10 @@ func New(ctx context.Context, config *configuration.Config) (*Agent, error) {
 		return nil, fmt.Errorf("error configuring logging: %v", err)
 	}
 
+	if err := checkConfig(config); err != nil {
+		return nil, err
+	}
+
 	log := context.GetLogger(ctx)
 	log.Info("initializing agent")
 
@@ -297,6 +440,25 @@ func New(ctx context.Context, config *configuration.Config) (*Agent, error) {
 		return nil, err
 	}
 
+	var eventSpool *spool.Spool
+	if config.Spool.Directory != "" {
+		eventSpool, err = spool.New(config.Spool)
+		if err != nil {
+			return nil, fmt.Errorf("error opening spool: %v", err)
+		}
+
+		log.Infof("spooling events in %q (%d pending)", config.Spool.Directory, eventSpool.Len())
+	}
+
+	redactor, err := redact.New(config.Redaction)
+	if err != nil {
+		return nil, err
+	}
+
+	if config.Batch.MaxSize > 1 {
+		log.Infof("batching up to %d events", config.Batch.MaxSize)
+	}
+
 	log.Infof("using %q logging formatter", config.Log.Formatter)
 	log.Infof("using %q containers driver", config.Containers.Type())
 	log.Infof("using %q reporting driver", config.Reporting.Type())
@@ -305,16 +467,23 @@ func New(ctx context.Context, config *configuration.Config) (*Agent, error) {
 		log.Infof("monitoring containers with a %q env variable", config.Tracking.Marker.Env)
 	}
 
-	return &Agent{
+	agent := &Agent{
 		Context:    ctx,
 		config:     config,
 		dispose:    disposer.New(),
 		containers: containersDriver,
 		collector:  collector.New(config.Collector),
 		//machineCollector: collector.NewMachineCollector(config.Collector),
-		reporting: reportingDriver,
+		reporting: &reporter{Driver: reportingDriver},
+		spool:     eventSpool,
+		redactor:  redactor,
+		stops:     make(chan *reporting.Event, collector.CHANNEL_BUFFER_SIZE),
+		reloads:   make(chan struct{}, 1),
 		registry:  containers.NewRegistry(config.Tracking.Marker),
-	}, nil
+	}
+
+	agent.dispatcher = newDispatcher(agent, config.Dispatch, config.Batch)
+	return agent, nil
 }
 
 func configureLogging(ctx context.Context, config *configuration.Config) (context.Context, error) {
@@ -0,0 +1,219 @@
+package agent
+
+import (
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/MustWin/cmeter/collector"
+	"github.com/MustWin/cmeter/configuration"
+	"github.com/MustWin/cmeter/containers"
+	"github.com/MustWin/cmeter/context"
+	"github.com/MustWin/cmeter/reporting"
+)
+
+const (
+	DEFAULT_DISPATCH_WORKERS    = 4
+	DEFAULT_DISPATCH_QUEUE_SIZE = 1000
+	DEFAULT_BATCH_DELAY         = time.Second
+)
+
+// DispatchStats is a snapshot of the report dispatcher's counters.
+type DispatchStats struct {
+	Queued    []int
+	Delivered uint64
+	Failed    uint64
+}
+
+func (s DispatchStats) TotalQueued() int {
+	total := 0
+	for _, n := range s.Queued {
+		total += n
+	}
+
+	return total
+}
+
+// dispatcher reports events with a fixed number of workers. Events are
+// assigned to workers by container, so the events of a container are
+// reported in the order they were dispatched.
+type dispatcher struct {
+	agent     *Agent
+	queues    []chan *pendingEvent
+	maxBatch  int
+	maxDelay  time.Duration
+	done      chan struct{}
+	wg        sync.WaitGroup
+	delivered uint64
+	failed    uint64
+}
+
+func newDispatcher(agent *Agent, dispatch configuration.DispatchConfig, batch configuration.BatchConfig) *dispatcher {
+	workers := dispatch.Workers
+	if workers <= 0 {
+		workers = DEFAULT_DISPATCH_WORKERS
+	}
+
+	queueSize := dispatch.QueueSize
+	if queueSize <= 0 {
+		queueSize = DEFAULT_DISPATCH_QUEUE_SIZE
+	}
+
+	maxBatch := batch.MaxSize
+	if maxBatch < 1 {
+		maxBatch = 1
+	}
+
+	maxDelay := batch.MaxDelay
+	if maxDelay <= 0 {
+		maxDelay = DEFAULT_BATCH_DELAY
+	}
+
+	d := &dispatcher{
+		agent:    agent,
+		queues:   make([]chan *pendingEvent, workers),
+		maxBatch: maxBatch,
+		maxDelay: maxDelay,
+		done:     make(chan struct{}),
+	}
+
+	for i := range d.queues {
+		d.queues[i] = make(chan *pendingEvent, queueSize)
+	}
+
+	return d
+}
+
+func eventKey(e *reporting.Event) string {
+	switch data := e.Data.(type) {
+	case *collector.Sample:
+		if data.Container != nil {
+			return data.Container.Name
+		}
+	case *containers.StateChange:
+		if data.Container != nil {
+			return data.Container.Name
+		}
+	case *collector.MachineSample:
+		if data.Machine != nil {
+			return "machine:" + data.Machine.SystemUuid
+		}
+	}
+
+	return e.Type
+}
+
+// Dispatch queues the event on its container's worker, blocking while that
+// worker's queue is full.
+func (d *dispatcher) Dispatch(p *pendingEvent) {
+	h := fnv.New32a()
+	h.Write([]byte(eventKey(p.event)))
+	d.queues[h.Sum32()%uint32(len(d.queues))] <- p
+}
+
+func (d *dispatcher) Stats() DispatchStats {
+	stats := DispatchStats{
+		Queued:    make([]int, len(d.queues)),
+		Delivered: atomic.LoadUint64(&d.delivered),
+		Failed:    atomic.LoadUint64(&d.failed),
+	}
+
+	for i, q := range d.queues {
+		stats.Queued[i] = len(q)
+	}
+
+	return stats
+}
+
+func (d *dispatcher) Start() {
+	for _, q := range d.queues {
+		d.wg.Add(1)
+		go d.work(q)
+	}
+}
+
+// Stop makes the workers report what is still queued and waits for them.
+// Nothing may be dispatched once it's called.
+func (d *dispatcher) Stop() {
+	close(d.done)
+	d.wg.Wait()
+}
+
+func (d *dispatcher) deliver(batch []*pendingEvent) {
+	delivered := d.agent.deliver(batch...)
+	atomic.AddUint64(&d.delivered, uint64(delivered))
+	atomic.AddUint64(&d.failed, uint64(len(batch)-delivered))
+}
+
+func (d *dispatcher) work(q chan *pendingEvent) {
+	defer d.wg.Done()
+
+	batch := make([]*pendingEvent, 0, d.maxBatch)
+	timer := time.NewTimer(d.maxDelay)
+	timer.Stop()
+
+	flush := func() {
+		timer.Stop()
+		if len(batch) > 0 {
+			d.deliver(batch)
+			batch = make([]*pendingEvent, 0, d.maxBatch)
+		}
+	}
+
+	for {
+		select {
+		case <-d.done:
+		drain:
+			for {
+				select {
+				case p := <-q:
+					batch = append(batch, p)
+					if len(batch) >= d.maxBatch {
+						flush()
+					}
+				default:
+					break drain
+				}
+			}
+
+			flush()
+			return
+		case p := <-q:
+			if len(batch) == 0 && d.maxBatch > 1 {
+				timer.Reset(d.maxDelay)
+			}
+
+			batch = append(batch, p)
+			if len(batch) >= d.maxBatch {
+				flush()
+			}
+
+		case <-timer.C:
+			flush()
+		}
+	}
+}
+
+// TODO: break-out
+func (agent *Agent) ProcessDispatch(quitCh <-chan struct{}) {
+	context.GetLogger(agent).Infof("report dispatcher started with %d workers", len(agent.dispatcher.queues))
+
+	interval := agent.currentConfig().Dispatch.StatsInterval
+	var statsCh <-chan time.Time
+	if interval > 0 {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		statsCh = t.C
+	}
+
+	for {
+		select {
+		case <-quitCh:
+			return
+		case <-statsCh:
+			stats := agent.dispatcher.Stats()
+			context.GetLogger(agent).Infof("report queue depth: %d %v, delivered: %d, failed: %d", stats.TotalQueued(), stats.Queued, stats.Delivered, stats.Failed)
+		}
+	}
+}
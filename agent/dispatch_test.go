@@ -0,0 +1,178 @@
+package agent
+
+import (
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/MustWin/cmeter/collector"
+	"github.com/MustWin/cmeter/configuration"
+	"github.com/MustWin/cmeter/containers"
+	"github.com/MustWin/cmeter/context"
+	"github.com/MustWin/cmeter/reporting"
+)
+
+var errRejected = errors.New("rejected")
+
+// recordingDriver records the batches it's given and rejects the events of
+// the container `bad`.
+type recordingDriver struct {
+	mutex   sync.Mutex
+	batches [][]*reporting.Event
+}
+
+func (d *recordingDriver) Report(ctx context.Context, e *reporting.Event) (reporting.Receipt, error) {
+	receipts, err := d.ReportBatch(ctx, []*reporting.Event{e})
+	if err != nil {
+		return reporting.EmptyReceipt, err
+	}
+
+	return receipts[0], nil
+}
+
+func (d *recordingDriver) ReportBatch(ctx context.Context, events []*reporting.Event) ([]reporting.Receipt, error) {
+	d.mutex.Lock()
+	d.batches = append(d.batches, events)
+	d.mutex.Unlock()
+
+	receipts := make([]reporting.Receipt, 0, len(events))
+	for _, e := range events {
+		if eventKey(e) == "bad" {
+			return receipts, errRejected
+		}
+
+		receipts = append(receipts, reporting.EmptyReceipt)
+	}
+
+	return receipts, nil
+}
+
+func (d *recordingDriver) sizes() []int {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	sizes := make([]int, len(d.batches))
+	for i, batch := range d.batches {
+		sizes[i] = len(batch)
+	}
+
+	return sizes
+}
+
+func newTestDispatcher(dispatch configuration.DispatchConfig, batch configuration.BatchConfig) (*dispatcher, *recordingDriver) {
+	driver := &recordingDriver{}
+	agent := &Agent{
+		Context:   context.Background(),
+		reporting: &reporter{Driver: driver},
+	}
+
+	agent.dispatcher = newDispatcher(agent, dispatch, batch)
+	return agent.dispatcher, driver
+}
+
+func sample(name string, timestamp int64) *pendingEvent {
+	return &pendingEvent{event: &reporting.Event{
+		Type:      reporting.EventSample,
+		Timestamp: timestamp,
+		Data:      &collector.Sample{Container: &containers.ContainerInfo{Name: name}},
+	}}
+}
+
+func TestDispatchOrder(t *testing.T) {
+	d, driver := newTestDispatcher(configuration.DispatchConfig{Workers: 4, QueueSize: 10}, configuration.BatchConfig{})
+	d.Start()
+
+	names := []string{"web", "db", "cache", "queue", "worker"}
+	for i := 0; i < 100; i++ {
+		d.Dispatch(sample(names[i%len(names)], int64(i)))
+	}
+
+	d.Stop()
+
+	// the events of a container are reported in order, by a single worker
+	last := make(map[string]int64)
+	for _, batch := range driver.batches {
+		for _, e := range batch {
+			name := eventKey(e)
+			if previous, ok := last[name]; ok && e.Timestamp <= previous {
+				t.Fatalf("expected the events of %s in order, got %d after %d", name, e.Timestamp, previous)
+			}
+
+			last[name] = e.Timestamp
+		}
+	}
+
+	stats := d.Stats()
+	if stats.Delivered != 100 || stats.Failed != 0 || stats.TotalQueued() != 0 || len(stats.Queued) != 4 {
+		t.Fatalf("expected 100 events delivered by 4 workers, got %+v", stats)
+	}
+}
+
+func TestBatching(t *testing.T) {
+	d, driver := newTestDispatcher(configuration.DispatchConfig{Workers: 1}, configuration.BatchConfig{
+		MaxSize:  3,
+		MaxDelay: 50 * time.Millisecond,
+	})
+
+	d.Start()
+	for i := 0; i < 7; i++ {
+		d.Dispatch(sample("web", int64(i)))
+	}
+
+	// full batches are sent at once, the rest after the delay
+	for deadline := time.Now().Add(5 * time.Second); len(driver.sizes()) < 3; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the partial batch to be sent after the delay, got %v", driver.sizes())
+		}
+	}
+
+	// stopping sends what is still queued
+	d.Dispatch(sample("web", 7))
+	d.Dispatch(sample("web", 8))
+	d.Stop()
+
+	if sizes := driver.sizes(); !reflect.DeepEqual(sizes, []int{3, 3, 1, 2}) {
+		t.Fatalf("expected batches of 3, 3, 1 and 2 events, got %v", sizes)
+	}
+
+	if stats := d.Stats(); stats.Delivered != 9 {
+		t.Fatalf("expected 9 events delivered, got %+v", stats)
+	}
+}
+
+func TestDispatchFailures(t *testing.T) {
+	d, _ := newTestDispatcher(configuration.DispatchConfig{Workers: 1}, configuration.BatchConfig{MaxSize: 4, MaxDelay: time.Hour})
+	d.Start()
+
+	// events after the rejected one aren't delivered
+	for i, name := range []string{"web", "bad", "web", "db"} {
+		d.Dispatch(sample(name, int64(i)))
+	}
+
+	d.Dispatch(sample("bad", 4))
+	d.Stop()
+
+	if stats := d.Stats(); stats.Delivered != 1 || stats.Failed != 4 {
+		t.Fatalf("expected 1 event delivered and 4 failed, got %+v", stats)
+	}
+}
+
+func TestEventKey(t *testing.T) {
+	cases := []struct {
+		event    *reporting.Event
+		expected string
+	}{
+		{sample("web", 0).event, "web"},
+		{&reporting.Event{Data: &containers.StateChange{Container: &containers.ContainerInfo{Name: "db"}}}, "db"},
+		{&reporting.Event{Data: &collector.MachineSample{Machine: &containers.MachineInfo{SystemUuid: "uuid"}}}, "machine:uuid"},
+		{&reporting.Event{Type: reporting.EventSample, Data: &collector.Sample{}}, reporting.EventSample},
+	}
+
+	for _, c := range cases {
+		if key := eventKey(c.event); key != c.expected {
+			t.Errorf("expected key %s, got %s", c.expected, key)
+		}
+	}
+}
@@ -0,0 +1,348 @@
+package agent
+
+import (
+	"crypto/sha256"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/fsnotify/fsnotify"
+
+	"github.com/MustWin/cmeter/configuration"
+	"github.com/MustWin/cmeter/containers"
+	"github.com/MustWin/cmeter/context"
+	"github.com/MustWin/cmeter/reporting"
+	reportingFactory "github.com/MustWin/cmeter/reporting/factory"
+	"github.com/MustWin/cmeter/reporting/redact"
+)
+
+// editors and config management usually write files in several steps, so
+// reloads wait for the changes to settle
+const configReloadDelay = 500 * time.Millisecond
+
+// ReloadFrom enables configuration reloads: on SIGHUP, and when the file
+// changes, the configuration is resolved again from the arguments and its
+// changes are applied without restarting the agent.
+func (agent *Agent) ReloadFrom(args []string) {
+	if args == nil {
+		args = []string{}
+	}
+
+	agent.configArgs = args
+}
+
+func (agent *Agent) currentConfig() *configuration.Config {
+	agent.mutex.RLock()
+	defer agent.mutex.RUnlock()
+	return agent.config
+}
+
+// requestReload queues a reload, requests made while one is already queued
+// are merged into it.
+func (agent *Agent) requestReload() {
+	select {
+	case agent.reloads <- struct{}{}:
+	default:
+	}
+}
+
+// configSum returns the checksum of the configuration files, adding or
+// removing files changes it too.
+func configSum(args []string) ([sha256.Size]byte, error) {
+	paths, err := configuration.Paths(args)
+	if err != nil {
+		return [sha256.Size]byte{}, err
+	}
+
+	files, err := configuration.Files(paths)
+	if err != nil {
+		return [sha256.Size]byte{}, err
+	}
+
+	sum := sha256.New()
+	for _, file := range files {
+		blob, err := ioutil.ReadFile(file)
+		if err != nil {
+			return [sha256.Size]byte{}, err
+		}
+
+		sum.Write([]byte(file))
+		sum.Write(blob)
+	}
+
+	var checksum [sha256.Size]byte
+	copy(checksum[:], sum.Sum(nil))
+	return checksum, nil
+}
+
+// configDirs returns the directories holding the configuration files.
+func configDirs(paths []string) []string {
+	seen := make(map[string]bool)
+	var dirs []string
+	for _, path := range paths {
+		dir := filepath.Dir(path)
+		if info, err := os.Stat(path); err == nil && info.IsDir() {
+			dir = path
+		}
+
+		if !seen[dir] {
+			seen[dir] = true
+			dirs = append(dirs, dir)
+		}
+	}
+
+	return dirs
+}
+
+// TODO: break-out
+func (agent *Agent) ProcessReloads(quitCh <-chan struct{}) {
+	context.GetLogger(agent).Info("configuration reloader started")
+	defer context.GetLogger(agent).Info("configuration reloader stopped")
+
+	paths, err := configuration.Paths(agent.configArgs)
+	if err != nil {
+		context.GetLogger(agent).Errorf("error resolving configuration path: %v", err)
+	}
+
+	sum, _ := configSum(agent.configArgs)
+
+	// the directories are watched, which also covers files replaced by
+	// renames or symlink swaps and files added to configuration directories,
+	// and reloads happen only when the content changed
+	var events <-chan fsnotify.Event
+	var errs <-chan error
+	if len(paths) > 0 {
+		watcher, err := fsnotify.NewWatcher()
+		if err == nil {
+			for _, dir := range configDirs(paths) {
+				if err = watcher.Add(dir); err != nil {
+					watcher.Close()
+					break
+				}
+			}
+		}
+
+		if err != nil {
+			context.GetLogger(agent).Warnf("not watching the configuration file, reloads only on SIGHUP: %v", err)
+		} else {
+			defer watcher.Close()
+			events = watcher.Events
+			errs = watcher.Errors
+		}
+	}
+
+	// changes are checked after a delay that isn't extended by further
+	// events, so busy directories can't postpone reloads
+	settle := time.NewTimer(configReloadDelay)
+	settle.Stop()
+	settling := false
+	for {
+		select {
+		case <-quitCh:
+			return
+		case <-agent.reloads:
+			sum, _ = configSum(agent.configArgs)
+			agent.reload()
+		case _, ok := <-events:
+			if !ok {
+				events = nil
+				continue
+			}
+
+			if !settling {
+				settling = true
+				settle.Reset(configReloadDelay)
+			}
+
+		case <-settle.C:
+			settling = false
+			changed, err := configSum(agent.configArgs)
+			if err != nil {
+				context.GetLogger(agent).Warnf("error reading configuration file: %v", err)
+			} else if changed != sum {
+				sum = changed
+				context.GetLogger(agent).Info("configuration file changed: reloading configuration")
+				agent.reload()
+			}
+
+		case err, ok := <-errs:
+			if !ok {
+				errs = nil
+				continue
+			}
+
+			context.GetLogger(agent).Warnf("configuration watcher error: %v", err)
+		}
+	}
+}
+
+// reload resolves the configuration again and applies the changes of the
+// reporting driver, redaction, tracking markers, collector rate and log
+// level. Other changes require a restart and are ignored. An invalid
+// configuration changes nothing.
+func (agent *Agent) reload() {
+	logger := context.GetLogger(agent)
+	config, err := configuration.Resolve(agent.configArgs)
+	if err != nil {
+		logger.Errorf("error reloading configuration, keeping the current one: %v", err)
+		return
+	}
+
+	current := agent.currentConfig()
+	var applied []string
+
+	// everything is created before anything is applied, the current driver
+	// is kept when its configuration didn't change
+	var driver reporting.Driver
+	if !reflect.DeepEqual(current.Reporting, config.Reporting) {
+		params := config.Reporting.Parameters()
+		if params == nil {
+			params = make(configuration.Parameters)
+		}
+
+		if driver, err = reportingFactory.Create(config.Reporting.Type(), params); err != nil {
+			logger.Errorf("error reloading configuration, keeping the current one: %v", err)
+			return
+		}
+
+		applied = append(applied, "reporting")
+	}
+
+	redactor := agent.redactor
+	if !reflect.DeepEqual(current.Redaction, config.Redaction) {
+		if redactor, err = redact.New(config.Redaction); err != nil {
+			logger.Errorf("error reloading configuration, keeping the current one: %v", err)
+			reporting.Close(driver)
+			return
+		}
+
+		applied = append(applied, "redaction")
+	}
+
+	if config.Collector.Rate <= 0 {
+		logger.Errorf("error reloading configuration, keeping the current one: invalid collector rate %d", config.Collector.Rate)
+		reporting.Close(driver)
+		return
+	}
+
+	restart := map[string]bool{
+		"containers": !reflect.DeepEqual(current.Containers, config.Containers),
+		"spool":      !reflect.DeepEqual(current.Spool, config.Spool),
+		"batch":      !reflect.DeepEqual(current.Batch, config.Batch),
+		"dispatch":   !reflect.DeepEqual(current.Dispatch, config.Dispatch),
+		"log":        current.Log.Formatter != config.Log.Formatter || !reflect.DeepEqual(current.Log.Fields, config.Log.Fields),
+	}
+
+	for _, section := range []string{"containers", "spool", "batch", "dispatch", "log"} {
+		if restart[section] {
+			logger.Warnf("ignoring changes to %q, they require a restart", section)
+		}
+	}
+
+	// the agent keeps reporting what it runs with
+	config.Containers = current.Containers
+	config.Spool = current.Spool
+	config.Batch = current.Batch
+	config.Dispatch = current.Dispatch
+	config.Log.Formatter = current.Log.Formatter
+	config.Log.Fields = current.Log.Fields
+	if err := checkConfig(config); err != nil {
+		logger.Errorf("error reloading configuration, keeping the current one: %v", err)
+		reporting.Close(driver)
+		return
+	}
+
+	agent.mutex.Lock()
+	previous := agent.reporting
+	agent.config = config
+	agent.redactor = redactor
+	if driver != nil {
+		agent.reporting = &reporter{Driver: driver}
+	}
+
+	agent.mutex.Unlock()
+
+	if driver != nil {
+		logger.Infof("using %q reporting driver", config.Reporting.Type())
+
+		// deliveries in progress finish with the previous driver
+		go func() {
+			if err := previous.close(); err != nil {
+				logger.Errorf("error closing the previous reporting driver: %v", err)
+			}
+		}()
+	}
+
+	if current.Log.Level != config.Log.Level {
+		log.SetLevel(logLevel(config.Log.Level))
+		applied = append(applied, "log level")
+	}
+
+	if current.Collector.Rate != config.Collector.Rate {
+		rate := time.Duration(config.Collector.Rate) * time.Millisecond
+		agent.collector.SetRate(rate)
+		if agent.machineCollector != nil {
+			agent.machineCollector.SetRate(rate)
+		}
+
+		applied = append(applied, "collector")
+	}
+
+	if current.Tracking != config.Tracking {
+		agent.registry.SetMarkers(config.Tracking.Marker)
+		agent.retrack()
+		applied = append(applied, "tracking")
+	}
+
+	if len(applied) == 0 {
+		logger.Info("configuration reloaded without changes to apply")
+	} else {
+		logger.Infof("configuration reloaded, applied changes to %s", strings.Join(applied, ", "))
+	}
+}
+
+// retrack re-evaluates the tracking markers: registered containers without
+// them stop being metered and active containers with them start being
+// metered.
+func (agent *Agent) retrack() {
+	for _, c := range agent.registry.List() {
+		if agent.registry.IsTrackable(c) {
+			continue
+		}
+
+		agent.ProcessStateChange(&containers.StateChange{
+			Container: c,
+			Source: &containers.Event{
+				Container: c,
+				Timestamp: time.Now().Unix(),
+				Type:      containers.EventTrackingChanged,
+			},
+			State: containers.StateStopped,
+		}, true)
+	}
+
+	active, err := agent.containers.GetContainers(agent)
+	if err != nil {
+		context.GetLogger(agent).Errorf("error listing containers: %v", err)
+		return
+	}
+
+	for _, c := range active {
+		if agent.registry.IsRegistered(c.Name) || !agent.registry.IsTrackable(c) {
+			continue
+		}
+
+		go agent.ProcessStateChange(&containers.StateChange{
+			State: containers.StateRunning,
+			Source: &containers.Event{
+				Type:      containers.EventTrackingChanged,
+				Timestamp: time.Now().Unix(),
+			},
+			Container: c,
+		}, false)
+	}
+}
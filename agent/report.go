@@ -0,0 +1,171 @@
+package agent
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/MustWin/cmeter/context"
+	"github.com/MustWin/cmeter/reporting"
+	"github.com/MustWin/cmeter/reporting/retry"
+	"github.com/MustWin/cmeter/reporting/spool"
+)
+
+// reporter is a reporting driver and the deliveries using it, a reload
+// closes the driver it replaces once they are done.
+type reporter struct {
+	reporting.Driver
+	deliveries sync.WaitGroup
+}
+
+// close waits for the deliveries using the driver and closes it.
+func (r *reporter) close() error {
+	r.deliveries.Wait()
+	return reporting.Close(r.Driver)
+}
+
+type pendingEvent struct {
+	event   *reporting.Event
+	id      uint64
+	spooled bool
+}
+
+func describeEvent(e *reporting.Event) string {
+	switch e.Type {
+	case reporting.EventSample:
+		return "usage"
+	case reporting.EventStateChange:
+		return "state change"
+	case reporting.EventMachineSample:
+		return "machine usage"
+	}
+
+	return e.Type
+}
+
+// report redacts the event's metadata, persists the event in the spool, when
+// enabled, and hands it to the dispatcher.
+func (agent *Agent) report(e *reporting.Event) {
+	agent.mutex.RLock()
+	redactor := agent.redactor
+	agent.mutex.RUnlock()
+
+	if redactor != nil {
+		e = redactor.Event(e)
+	}
+
+	p := &pendingEvent{event: e}
+	if agent.spool != nil {
+		id, err := agent.spool.Append(e)
+		if err != nil {
+			context.GetLogger(agent).Errorf("error spooling %s: %v", describeEvent(e), err)
+		} else {
+			p.id = id
+			p.spooled = true
+		}
+	}
+
+	agent.dispatcher.Dispatch(p)
+}
+
+// deliver sends the events through the reporting driver and settles their
+// spool records. It returns the number of events delivered.
+func (agent *Agent) deliver(pending ...*pendingEvent) int {
+	events := make([]*reporting.Event, len(pending))
+	for i, p := range pending {
+		events[i] = p.event
+	}
+
+	// the lock isn't held while reporting, retries and backoffs of a slow
+	// endpoint would block reloads and, behind them, every report
+	agent.mutex.RLock()
+	driver := agent.reporting
+	driver.deliveries.Add(1)
+	agent.mutex.RUnlock()
+
+	var err error
+	var receipts []reporting.Receipt
+	if len(events) == 1 {
+		var receipt reporting.Receipt
+		if receipt, err = driver.Report(agent, events[0]); err == nil {
+			receipts = []reporting.Receipt{receipt}
+		}
+	} else {
+		receipts, err = reporting.ReportBatch(agent, driver.Driver, events)
+	}
+
+	driver.deliveries.Done()
+
+	// the held events of a batch are covered by the receipts of the others
+	held := make(map[int]bool)
+	var heldErr reporting.HeldError
+	isHeld := errors.As(err, &heldErr)
+	for _, i := range heldErr.Held {
+		held[i] = true
+	}
+
+	delivered := 0
+	for i, p := range pending {
+		if i < len(receipts) && !held[i] {
+			delivered++
+			context.GetLogger(agent).Debugf("%s reported", describeEvent(p.event))
+			if p.spooled {
+				if err := agent.spool.Ack(p.id); err != nil {
+					context.GetLogger(agent).Errorf("error acknowledging spooled %s: %v", describeEvent(p.event), err)
+				}
+			}
+		} else if p.spooled {
+			agent.spool.Release(p.id)
+		}
+	}
+
+	if err == nil {
+		return delivered
+	}
+
+	what := describeEvent(events[0])
+	if len(events) > 1 {
+		what = "event batch"
+	}
+
+	// held events are lost without a spool
+	if (isHeld && agent.spool != nil) || err == retry.ErrCircuitOpen {
+		context.GetLogger(agent).Debugf("%s not reported: %v", what, err)
+	} else {
+		context.GetLogger(agent).Errorf("error reporting %s: %v", what, err)
+	}
+
+	return delivered
+}
+
+// TODO: break-out
+func (agent *Agent) ProcessSpool(quitCh <-chan struct{}) {
+	context.GetLogger(agent).Info("spool replayer started")
+	defer context.GetLogger(agent).Info("spool replayer stopped")
+
+	interval := agent.currentConfig().Spool.ReplayInterval
+	if interval <= 0 {
+		interval = spool.DEFAULT_REPLAY_INTERVAL
+	}
+
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-quitCh:
+			return
+		case <-t.C:
+			agent.replaySpool()
+		}
+	}
+}
+
+func (agent *Agent) replaySpool() {
+	err := agent.spool.Replay(func(id uint64, e *reporting.Event) {
+		agent.dispatcher.Dispatch(&pendingEvent{event: e, id: id, spooled: true})
+	})
+
+	if err != nil && err != spool.ErrClosed {
+		context.GetLogger(agent).Errorf("error replaying spool: %v", err)
+	}
+}
@@ -22,6 +22,7 @@ func run(ctx context.Context, args []string) error {
 		return err
 	}
 
+	agent.ReloadFrom(args)
 	return agent.Run()
 }
 
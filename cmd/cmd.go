@@ -2,6 +2,7 @@ package cmd
 
 import (
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 
 	"github.com/MustWin/cmeter/context"
 )
@@ -13,6 +14,10 @@ type Info struct {
 	Short string
 	Long  string
 	Run   ExecutorFunc
+	// registers the command's flags, e.g. `-o` of `config migrate`
+	Flags func(flags *pflag.FlagSet)
+	// subcommands, e.g. `validate` of `config validate`
+	Commands []*Info
 }
 
 var registry map[string]*Info = make(map[string]*Info)
@@ -50,5 +55,13 @@ func makeCobraCommand(ctx context.Context, info *Info) *cobra.Command {
 		cmd.RunE = makeCobraRunner(ctx, info.Run)
 	}
 
+	if info.Flags != nil {
+		info.Flags(cmd.Flags())
+	}
+
+	for _, sub := range info.Commands {
+		cmd.AddCommand(makeCobraCommand(ctx, sub))
+	}
+
 	return cmd
 }
@@ -0,0 +1,206 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/spf13/pflag"
+
+	"github.com/MustWin/cmeter/agent"
+	"github.com/MustWin/cmeter/cmd"
+	"github.com/MustWin/cmeter/configuration"
+	containersFactory "github.com/MustWin/cmeter/containers/factory"
+	"github.com/MustWin/cmeter/context"
+	reportingFactory "github.com/MustWin/cmeter/reporting/factory"
+	"github.com/MustWin/cmeter/reporting/redact"
+)
+
+var ErrInvalidConfig = errors.New("invalid configuration")
+
+func init() {
+	cmd.Register("config", Info)
+}
+
+func driverParameters(driver configuration.Driver) configuration.Parameters {
+	params := driver.Parameters()
+	if params == nil {
+		params = make(configuration.Parameters)
+	}
+
+	return params
+}
+
+// validate returns the problems of a parsed configuration.
+func validate(config *configuration.Config) []error {
+	var problems []error
+	if err := containersFactory.Validate(config.Containers.Type(), driverParameters(config.Containers)); err != nil {
+		problems = append(problems, fmt.Errorf("containers: %v", err))
+	}
+
+	if config.Reporting.Type() == "" {
+		problems = append(problems, errors.New("reporting: no reporting driver provided"))
+	} else if err := reportingFactory.Validate(config.Reporting.Type(), driverParameters(config.Reporting)); err != nil {
+		problems = append(problems, fmt.Errorf("reporting: %v", err))
+	}
+
+	if config.Collector.Rate <= 0 {
+		problems = append(problems, fmt.Errorf("collector: invalid rate %d", config.Collector.Rate))
+	}
+
+	if config.Tracking.Marker.Label == "" && config.Tracking.Marker.Env == "" {
+		problems = append(problems, errors.New("tracking: no marker label or env provided"))
+	}
+
+	if _, err := redact.New(config.Redaction); err != nil {
+		problems = append(problems, fmt.Errorf("redaction: %v", err))
+	}
+
+	return append(problems, agent.CheckConfig(config)...)
+}
+
+func runValidate(ctx context.Context, args []string) error {
+	config, err := configuration.Resolve(args)
+	if err != nil {
+		return err
+	}
+
+	problems := validate(config)
+	for _, problem := range problems {
+		fmt.Fprintln(os.Stderr, problem)
+	}
+
+	if len(problems) > 0 {
+		return ErrInvalidConfig
+	}
+
+	fmt.Println("configuration is valid")
+	return nil
+}
+
+func runPrint(ctx context.Context, args []string) error {
+	config, overrides, err := configuration.ResolveWithOverrides(args)
+	if err != nil {
+		return err
+	}
+
+	return configuration.Print(os.Stdout, config, overrides)
+}
+
+// migrateOutput is the output path of `config migrate`.
+var migrateOutput string
+
+// runMigrate converts the configuration files to the current version. The
+// files are rewritten, keeping the originals next to them, unless an output
+// path is given for a single file.
+func runMigrate(ctx context.Context, args []string) error {
+	paths, err := configuration.Paths(args)
+	if err != nil {
+		return err
+	}
+
+	files, err := configuration.Files(paths)
+	if err != nil {
+		return err
+	}
+
+	configPath := strings.Join(paths, ", ")
+	if len(files) == 0 {
+		return fmt.Errorf("no configuration files found in %s", configPath)
+	}
+
+	if migrateOutput != "" && len(files) > 1 {
+		return fmt.Errorf("%s holds %d configuration files, they can only be migrated in place", configPath, len(files))
+	}
+
+	migrated, err := configuration.MigrateFiles(files)
+	if err != nil {
+		return err
+	}
+
+	if len(migrated) == 0 {
+		fmt.Printf("%s is already at version %s\n", configPath, configuration.CurrentVersion)
+		return nil
+	}
+
+	// every file is migrated before any is written
+	renamedEnv := make(map[string]string)
+	for _, file := range migrated {
+		info, err := os.Stat(file.Path)
+		if err != nil {
+			return err
+		}
+
+		outputPath := file.Path
+		if migrateOutput != "" {
+			outputPath = migrateOutput
+		} else {
+			in, err := ioutil.ReadFile(file.Path)
+			if err != nil {
+				return err
+			}
+
+			backupPath := file.Path + ".bak"
+			if err := ioutil.WriteFile(backupPath, in, info.Mode()); err != nil {
+				return err
+			}
+
+			fmt.Printf("kept the version %s configuration in %s\n", file.Version, backupPath)
+		}
+
+		if err := ioutil.WriteFile(outputPath, file.Out, info.Mode()); err != nil {
+			return err
+		}
+
+		fmt.Printf("migrated %s from version %s to %s\n", outputPath, file.Version, configuration.CurrentVersion)
+		for name, renamed := range file.RenamedEnv {
+			renamedEnv[name] = renamed
+		}
+	}
+
+	names := make([]string, 0, len(renamedEnv))
+	for name := range renamedEnv {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "warning: %s no longer applies after the migration, rename it to %s\n", name, renamedEnv[name])
+	}
+
+	return nil
+}
+
+var (
+	Info = &cmd.Info{
+		Use:   "config",
+		Short: "`config`",
+		Long:  "`config`",
+		Commands: []*cmd.Info{
+			{
+				Use:   "validate [config_path...]",
+				Short: "validate the configuration",
+				Long:  "Parses the configuration files and environment, and checks that the drivers exist and their parameters are valid.",
+				Run:   cmd.ExecutorFunc(runValidate),
+			},
+			{
+				Use:   "print [config_path...]",
+				Short: "print the effective configuration",
+				Long:  "Prints the configuration files merged with the environment as YAML, with secrets masked and values set by environment variables annotated.",
+				Run:   cmd.ExecutorFunc(runPrint),
+			},
+			{
+				Use:   "migrate [config_path...]",
+				Short: "migrate the configuration to the current version",
+				Long:  "Converts the configuration files to the current schema version. Every file, including those of configuration directories, is rewritten, keeping the original in `<file>.bak`, unless an output path is given for a single file. Environment variables overriding moved values are listed with their new name. Comments are not preserved.",
+				Run:   cmd.ExecutorFunc(runMigrate),
+				Flags: func(flags *pflag.FlagSet) {
+					flags.StringVarP(&migrateOutput, "output", "o", "", "write the migrated configuration to this path, for a single configuration file")
+				},
+			},
+		},
+	}
+)
@@ -0,0 +1,138 @@
+package drivers
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/MustWin/cmeter/cmd"
+	"github.com/MustWin/cmeter/configuration"
+	containersFactory "github.com/MustWin/cmeter/containers/factory"
+	"github.com/MustWin/cmeter/context"
+	reportingFactory "github.com/MustWin/cmeter/reporting/factory"
+)
+
+var ErrMissingDriver = errors.New("a driver name is required")
+
+func init() {
+	cmd.Register("drivers", Info)
+}
+
+// describeParameters writes a parameter per line, with its type, default and
+// allowed values, followed by its description and nested parameters.
+func describeParameters(buf *bytes.Buffer, indent int, params []configuration.Parameter) {
+	for _, param := range params {
+		details := []string{string(param.Type)}
+		if param.Type == configuration.TypeMap && param.Parameters != nil {
+			details[0] = "map of sections"
+		}
+
+		if param.Required {
+			details = append(details, "required")
+		}
+
+		if param.Default != "" {
+			details = append(details, fmt.Sprintf("default %q", param.Default))
+		}
+
+		if len(param.Values) > 0 {
+			details = append(details, "one of "+strings.Join(param.Values, ", "))
+		}
+
+		prefix := strings.Repeat("  ", indent)
+		fmt.Fprintf(buf, "%s%s (%s)\n", prefix, param.Name, strings.Join(details, ", "))
+		if param.Description != "" {
+			fmt.Fprintf(buf, "%s    %s\n", prefix, param.Description)
+		}
+
+		describeParameters(buf, indent+1, param.Parameters)
+	}
+}
+
+func runList(ctx context.Context, args []string) error {
+	var buf bytes.Buffer
+	kinds := []struct {
+		name   string
+		names  []string
+		schema func(string) (configuration.Schema, bool, error)
+	}{
+		{"reporting", reportingFactory.Names(), reportingFactory.Schema},
+		{"containers", containersFactory.Names(), containersFactory.Schema},
+	}
+
+	for _, kind := range kinds {
+		fmt.Fprintf(&buf, "%s:\n", kind.name)
+		for _, name := range kind.names {
+			schema, _, err := kind.schema(name)
+			if err != nil {
+				return err
+			}
+
+			fmt.Fprintf(&buf, "  %-12s %s\n", name, schema.Description)
+		}
+	}
+
+	_, err := os.Stdout.Write(buf.Bytes())
+	return err
+}
+
+func runDescribe(ctx context.Context, args []string) error {
+	if len(args) == 0 {
+		return ErrMissingDriver
+	}
+
+	name := args[0]
+	kind := "reporting"
+	schema, described, err := reportingFactory.Schema(name)
+	if _, ok := err.(reportingFactory.InvalidReportingDriverError); ok {
+		kind = "containers"
+		schema, described, err = containersFactory.Schema(name)
+	}
+
+	if err != nil {
+		return fmt.Errorf("driver not registered: %s", name)
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%s (%s driver)\n", name, kind)
+	if schema.Description != "" {
+		fmt.Fprintf(&buf, "  %s\n", schema.Description)
+	}
+
+	switch {
+	case !described:
+		buf.WriteString("\nparameters are not described\n")
+	case len(schema.Parameters) == 0:
+		buf.WriteString("\nno parameters\n")
+	default:
+		buf.WriteString("\nparameters:\n")
+		describeParameters(&buf, 1, schema.Parameters)
+	}
+
+	_, err = os.Stdout.Write(buf.Bytes())
+	return err
+}
+
+var (
+	Info = &cmd.Info{
+		Use:   "drivers",
+		Short: "`drivers`",
+		Long:  "`drivers`",
+		Commands: []*cmd.Info{
+			{
+				Use:   "list",
+				Short: "list the registered drivers",
+				Long:  "Lists the registered reporting and containers drivers.",
+				Run:   cmd.ExecutorFunc(runList),
+			},
+			{
+				Use:   "describe <name>",
+				Short: "describe a driver's parameters",
+				Long:  "Describes the parameters of a reporting or containers driver: their types, whether they are required, their defaults, allowed values and nested parameters.",
+				Run:   cmd.ExecutorFunc(runDescribe),
+			},
+		},
+	}
+)
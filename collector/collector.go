@@ -15,6 +15,9 @@ const CHANNEL_BUFFER_SIZE = 3000
 type collectorData struct {
 	ch     containers.UsageChannel
 	ticker *time.Ticker
+	// closed by Stop, held while a sample is sent
+	stopped chan struct{}
+	sending sync.Mutex
 }
 
 type Collector struct {
@@ -54,8 +57,9 @@ func (c *Collector) Collect(ctx context.Context, ch containers.UsageChannel) err
 	}
 
 	data := &collectorData{
-		ch:     ch,
-		ticker: time.NewTicker(c.Rate),
+		ch:      ch,
+		ticker:  time.NewTicker(c.Rate),
+		stopped: make(chan struct{}),
 	}
 
 	c.collections[ch.Container().Name] = data
@@ -86,41 +90,96 @@ func (c *Collector) doCollect(ctx context.Context, data *collectorData) {
 					Container: data.ch.Container(),
 					Usage:     usage,
 					Timestamp: time.Now().Unix(),
-					FrameSize: c.Rate,
+					FrameSize: c.rate(),
 				}
 
-				c.samples <- sample
+				if !c.send(data, sample) {
+					return
+				}
 			}
 		}
 	}
 }
 
-func (c *Collector) Stop(ctx context.Context, container *containers.ContainerInfo) (containers.UsageChannel, error) {
+// send only queues samples of active collections, so no samples of a
+// container follow a successful Stop. The collector isn't locked while the
+// sample waits for room, Stop interrupts the wait.
+func (c *Collector) send(data *collectorData, sample *Sample) bool {
+	data.sending.Lock()
+	defer data.sending.Unlock()
+
 	c.mutex.Lock()
-	defer c.mutex.Unlock()
+	active := c.collections[data.ch.Container().Name] == data
+	c.mutex.Unlock()
+	if !active {
+		return false
+	}
 
+	select {
+	case c.samples <- sample:
+		return true
+	case <-data.stopped:
+		return false
+	}
+}
+
+func (c *Collector) Stop(ctx context.Context, container *containers.ContainerInfo) (containers.UsageChannel, error) {
+	c.mutex.Lock()
 	data, ok := c.collections[container.Name]
 	if !ok {
+		c.mutex.Unlock()
 		return nil, fmt.Errorf("no collection for %s", container.Name)
 	}
 
 	data.ticker.Stop()
+	close(data.stopped)
 	delete(c.collections, container.Name)
+	c.mutex.Unlock()
+
+	// waits for a sample being sent
+	data.sending.Lock()
+	data.sending.Unlock()
+
 	context.GetLoggerWithField(ctx, "container.name", data.ch.Container().Name).Info("stopped container stats collection")
 	return data.ch, nil
 }
 
-func (c *Collector) StopAll() ([]containers.UsageChannel, error) {
+func (c *Collector) rate() time.Duration {
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
+	return c.Rate
+}
 
-	channels := make([]containers.UsageChannel, 0)
+// SetRate changes the collection rate, including the rate of the active
+// collections.
+func (c *Collector) SetRate(rate time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.Rate = rate
 	for _, data := range c.collections {
+		data.ticker.Reset(rate)
+	}
+}
+
+func (c *Collector) StopAll() ([]containers.UsageChannel, error) {
+	c.mutex.Lock()
+	stopped := c.collections
+	c.collections = make(map[string]*collectorData)
+	channels := make([]containers.UsageChannel, 0)
+	for _, data := range stopped {
 		data.ticker.Stop()
+		close(data.stopped)
 		channels = append(channels, data.ch)
 	}
 
-	c.collections = make(map[string]*collectorData)
+	c.mutex.Unlock()
+
+	for _, data := range stopped {
+		data.sending.Lock()
+		data.sending.Unlock()
+	}
+
 	return channels, nil
 }
 
@@ -136,6 +195,7 @@ type MachineCollector struct {
 	feed    containers.MachineUsageFeed
 	Rate    time.Duration
 	active  bool
+	ticker  *time.Ticker
 	mutex   sync.Mutex
 	samples chan *MachineSample
 }
@@ -165,7 +225,8 @@ func (c *MachineCollector) Start() error {
 	}
 
 	c.active = true
-	go c.doCollect()
+	c.ticker = time.NewTicker(c.Rate)
+	go c.doCollect(c.ticker)
 	context.GetLogger(c).Info("started machine stats collection")
 	return nil
 }
@@ -183,8 +244,25 @@ func (c *MachineCollector) Stop() error {
 	return nil
 }
 
-func (c *MachineCollector) doCollect() {
-	t := time.NewTicker(c.Rate)
+// SetRate changes the collection rate, including the rate of an active
+// collection.
+func (c *MachineCollector) SetRate(rate time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.Rate = rate
+	if c.active {
+		c.ticker.Reset(rate)
+	}
+}
+
+func (c *MachineCollector) rate() time.Duration {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.Rate
+}
+
+func (c *MachineCollector) doCollect(t *time.Ticker) {
 	for _ = range t.C {
 		if !c.Active() {
 			t.Stop()
@@ -200,7 +278,7 @@ func (c *MachineCollector) doCollect() {
 		sample := &MachineSample{
 			Machine:   c.feed.Machine(),
 			Usage:     usage,
-			FrameSize: c.Rate,
+			FrameSize: c.rate(),
 			Timestamp: time.Now().Unix(),
 		}
 
@@ -5,7 +5,9 @@ import (
 	"io"
 	"io/ioutil"
 	"reflect"
+	"sort"
 	"strings"
+	"time"
 )
 
 func (version *Version) UnmarshalYAML(unmarshal func(interface{}) error) error {
@@ -134,20 +136,223 @@ type TrackerConfig struct {
 	Marker Marker `yaml:"marker,omitempty"`
 }
 
+type SpoolConfig struct {
+	// directory holding the spool segments, spooling is disabled when empty
+	Directory string `yaml:"directory,omitempty"`
+
+	// maximum total size of the spool in bytes, oldest segments are dropped first
+	MaxSize int64 `yaml:"max_size,omitempty"`
+
+	// maximum age of a segment before it is dropped
+	MaxAge time.Duration `yaml:"max_age,omitempty"`
+
+	// size in bytes at which the active segment is rotated
+	SegmentSize int64 `yaml:"segment_size,omitempty"`
+
+	// how often unacknowledged events are re-sent
+	ReplayInterval time.Duration `yaml:"replay_interval,omitempty"`
+}
+
+type BatchConfig struct {
+	// maximum number of events sent together, batching is disabled below 2
+	MaxSize int `yaml:"max_size,omitempty"`
+
+	// maximum time an event waits for its batch to fill up
+	MaxDelay time.Duration `yaml:"max_delay,omitempty"`
+}
+
+type DispatchConfig struct {
+	// number of events reported concurrently
+	Workers int `yaml:"workers,omitempty"`
+
+	// events queued per worker before reporting blocks
+	QueueSize int `yaml:"queue_size,omitempty"`
+
+	// how often queue depths are logged, never when zero
+	StatsInterval time.Duration `yaml:"stats_interval,omitempty"`
+}
+
+type MetadataFilter struct {
+	// patterns of the names reported, every name when empty
+	Allow []string `yaml:"allow,omitempty"`
+
+	// patterns of the names never reported, even when allowed
+	Deny []string `yaml:"deny,omitempty"`
+
+	// patterns of the names whose values are redacted
+	Redact []string `yaml:"redact,omitempty"`
+
+	// patterns redacted wherever they occur in values
+	RedactValues []string `yaml:"redact_values,omitempty"`
+}
+
+type RedactionConfig struct {
+	// container and machine labels
+	Labels MetadataFilter `yaml:"labels,omitempty"`
+
+	// container environment variables
+	Envs MetadataFilter `yaml:"envs,omitempty"`
+
+	// how redacted values are replaced: `mask` or `hash`
+	Mode string `yaml:"mode,omitempty"`
+
+	// key of the HMAC used by the `hash` mode, required by that mode
+	HashKey string `yaml:"hash_key,omitempty"`
+}
+
 type Config struct {
 	Log        LogConfig       `yaml:"log"`
 	Containers Driver          `yaml:"containers"`
 	Reporting  Driver          `yaml:"reporting"`
 	Collector  CollectorConfig `yaml:"collector"`
 	Tracking   TrackerConfig   `yaml:"tracking"`
+	Spool      SpoolConfig     `yaml:"spool,omitempty"`
+	Batch      BatchConfig     `yaml:"batch,omitempty"`
+	Dispatch   DispatchConfig  `yaml:"dispatch,omitempty"`
+	Redaction  RedactionConfig `yaml:"redaction,omitempty"`
+}
+
+// ReporterConfig is a named reporter of the 1.1 configuration. Its routing
+// settings are those of the `multi` reporting driver's destinations.
+type ReporterConfig struct {
+	Driver     string     `yaml:"driver"`
+	Parameters Parameters `yaml:"parameters,omitempty"`
+
+	// event types routed to the reporter, all when empty
+	Events []string `yaml:"events,omitempty"`
+
+	// container labels required for an event to be routed to the reporter,
+	// `*` matches any value
+	Labels map[string]string `yaml:"labels,omitempty"`
+
+	// failures of optional reporters are only logged, reporters are
+	// required unless set to false
+	Required *bool `yaml:"required,omitempty"`
+}
+
+// destination returns the reporter as a `multi` driver destination.
+func (reporter *ReporterConfig) destination() Parameters {
+	dest := Parameters{"driver": reporter.Driver}
+	if reporter.Parameters != nil {
+		dest["parameters"] = reporter.Parameters
+	}
+
+	if len(reporter.Events) > 0 {
+		dest["events"] = reporter.Events
+	}
+
+	if len(reporter.Labels) > 0 {
+		labels := make(Parameters, len(reporter.Labels))
+		for k, v := range reporter.Labels {
+			labels[k] = v
+		}
+
+		dest["labels"] = labels
+	}
+
+	if reporter.Required != nil {
+		dest["required"] = *reporter.Required
+	}
+
+	return dest
+}
+
+// reportersDriver returns the reporting driver running the reporters: the
+// reporter's own driver for a single reporter named after its driver and
+// without routing settings, the `multi` driver otherwise.
+func reportersDriver(reporters map[string]*ReporterConfig) (Driver, error) {
+	driver := make(Driver)
+	if len(reporters) == 0 {
+		return driver, nil
+	}
+
+	destinations := make(Parameters, len(reporters))
+	for name, reporter := range reporters {
+		if reporter == nil || reporter.Driver == "" {
+			return nil, fmt.Errorf("no driver provided for reporter %q", name)
+		}
+
+		if len(reporters) == 1 && name == reporter.Driver && len(reporter.Events) == 0 && len(reporter.Labels) == 0 {
+			params := reporter.Parameters
+			if params == nil {
+				params = make(Parameters)
+			}
+
+			driver[reporter.Driver] = params
+			return driver, nil
+		}
+
+		destinations[name] = reporter.destination()
+	}
+
+	driver["multi"] = Parameters{"destinations": destinations}
+	return driver, nil
+}
+
+// ReportingParameters returns the parameters of the reporting drivers of the
+// given type: the reporting driver itself, or the destinations of a `multi`
+// reporting driver, ordered by name.
+func (config *Config) ReportingParameters(driverType string) []Parameters {
+	params := config.Reporting.Parameters()
+	if params == nil {
+		params = make(Parameters)
+	}
+
+	if config.Reporting.Type() == driverType {
+		return []Parameters{params}
+	}
+
+	if config.Reporting.Type() != "multi" {
+		return nil
+	}
+
+	// errors are reported by the validation of the driver
+	destinations, _ := params.Sub("destinations")
+	names := make([]string, 0, len(destinations))
+	for name := range destinations {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	var matches []Parameters
+	for _, name := range names {
+		dest, _ := destinations.Sub(name)
+		if dest.String("driver", "") != driverType {
+			continue
+		}
+
+		destParams, _ := dest.Sub("parameters")
+		if destParams == nil {
+			destParams = make(Parameters)
+		}
+
+		matches = append(matches, destParams)
+	}
+
+	return matches
 }
 
 type v1_0Config Config
 
+type v1_1Config struct {
+	Log        LogConfig                  `yaml:"log"`
+	Containers Driver                     `yaml:"containers"`
+	Reporters  map[string]*ReporterConfig `yaml:"reporters"`
+	Collector  CollectorConfig            `yaml:"collector"`
+	Tracking   TrackerConfig              `yaml:"tracking"`
+	Spool      SpoolConfig                `yaml:"spool,omitempty"`
+	Batch      BatchConfig                `yaml:"batch,omitempty"`
+	Dispatch   DispatchConfig             `yaml:"dispatch,omitempty"`
+	Redaction  RedactionConfig            `yaml:"redaction,omitempty"`
+}
+
+// CurrentVersion is the latest configuration schema version.
+var CurrentVersion = MajorMinorVersion(1, 1)
+
 func newConfig() *Config {
 	config := &Config{
 		Log: LogConfig{
-			Level:     "debug",
+			Level:     "info",
 			Formatter: "text",
 			Fields:    make(map[string]interface{}),
 		},
@@ -166,21 +371,47 @@ func newConfig() *Config {
 		Collector: CollectorConfig{
 			Rate: 10000,
 		},
+
+		Spool: SpoolConfig{
+			MaxAge:         7 * 24 * time.Hour,
+			ReplayInterval: 30 * time.Second,
+		},
+
+		Batch: BatchConfig{
+			MaxDelay: time.Second,
+		},
+
+		Dispatch: DispatchConfig{
+			Workers:       4,
+			QueueSize:     1000,
+			StatsInterval: time.Minute,
+		},
 	}
 
 	return config
 }
 
 func Parse(rd io.Reader) (*Config, error) {
+	config, _, err := ParseWithOverrides(rd)
+	return config, err
+}
+
+// ParseWithOverrides parses the configuration like Parse and also returns
+// the environment variables that overrode values, by the dot-separated path
+// of the values.
+func ParseWithOverrides(rd io.Reader) (*Config, map[string]string, error) {
 	in, err := ioutil.ReadAll(rd)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	p := NewParser("cmeter", []VersionedParseInfo{
 		{
 			Version: MajorMinorVersion(1, 0),
 			ParseAs: reflect.TypeOf(v1_0Config{}),
+			Defaults: func() interface{} {
+				return (*v1_0Config)(newConfig())
+			},
 			ConversionFunc: func(c interface{}) (interface{}, error) {
 				if v1_0, ok := c.(*v1_0Config); ok {
 					if v1_0.Containers.Type() == "" {
@@ -193,13 +424,56 @@ func Parse(rd io.Reader) (*Config, error) {
 				return nil, fmt.Errorf("Expected *v1_0Config, received %#v", c)
 			},
 		},
+		{
+			Version: MajorMinorVersion(1, 1),
+			ParseAs: reflect.TypeOf(v1_1Config{}),
+			Defaults: func() interface{} {
+				defaults := newConfig()
+				return &v1_1Config{
+					Log:        defaults.Log,
+					Containers: defaults.Containers,
+					Collector:  defaults.Collector,
+					Tracking:   defaults.Tracking,
+					Spool:      defaults.Spool,
+					Batch:      defaults.Batch,
+					Dispatch:   defaults.Dispatch,
+					Redaction:  defaults.Redaction,
+				}
+			},
+			ConversionFunc: func(c interface{}) (interface{}, error) {
+				if v1_1, ok := c.(*v1_1Config); ok {
+					if v1_1.Containers.Type() == "" {
+						return nil, fmt.Errorf("no containers configuration provided")
+					}
+
+					reporting, err := reportersDriver(v1_1.Reporters)
+					if err != nil {
+						return nil, err
+					}
+
+					return &Config{
+						Log:        v1_1.Log,
+						Containers: v1_1.Containers,
+						Reporting:  reporting,
+						Collector:  v1_1.Collector,
+						Tracking:   v1_1.Tracking,
+						Spool:      v1_1.Spool,
+						Batch:      v1_1.Batch,
+						Dispatch:   v1_1.Dispatch,
+						Redaction:  v1_1.Redaction,
+					}, nil
+				}
+
+				return nil, fmt.Errorf("Expected *v1_1Config, received %#v", c)
+			},
+		},
 	})
 
 	config := new(Config)
 	err = p.Parse(in, config)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	return config, nil
+	return config, p.Overrides(), nil
 }
@@ -0,0 +1,36 @@
+package configuration
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseDefaults(t *testing.T) {
+	for _, in := range []string{
+		"version: 1.0\ncontainers: 'embedded'\nreporting: 'stdout'\n",
+		"version: 1.1\ncontainers: 'embedded'\nreporters:\n  stdout:\n    driver: 'stdout'\n",
+	} {
+		config, err := Parse(strings.NewReader(in))
+		if err != nil {
+			t.Fatalf("error parsing %q: %v", in, err)
+		}
+
+		if config.Log.Level != "info" || config.Tracking.Marker.Label != "cmeter.tracking" || config.Tracking.Marker.Env != "CMETER_TRACKING" {
+			t.Errorf("expected the default log level and tracking markers for %q, got %+v", in, config)
+		}
+
+		if config.Spool.MaxAge != 7*24*time.Hour || config.Batch.MaxDelay != time.Second || config.Dispatch.Workers != 4 || config.Collector.Rate != 10000 {
+			t.Errorf("expected the defaults of the values left out of %q, got %+v", in, config)
+		}
+	}
+
+	config, err := Parse(strings.NewReader("version: 1.0\ncontainers: 'embedded'\nreporting: 'stdout'\nspool:\n  max_age: 1h\ndispatch:\n  queue_size: 10\n"))
+	if err != nil {
+		t.Fatalf("error parsing: %v", err)
+	}
+
+	if config.Spool.MaxAge != time.Hour || config.Spool.ReplayInterval != 30*time.Second || config.Dispatch.QueueSize != 10 || config.Dispatch.Workers != 4 {
+		t.Errorf("expected the values set to replace the defaults, got %+v", config)
+	}
+}
@@ -0,0 +1,309 @@
+package configuration
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/go-yaml/yaml"
+)
+
+// prefix of the secret values read from a file, e.g. `file:/run/secrets/apikey`
+const SECRET_FILE_PREFIX = "file:"
+
+// `${NAME}` or `${NAME:-default}`, `$${` is a literal `${`
+var envReference = regexp.MustCompile(`\$?\$\{([A-Za-z_][A-Za-z0-9_]*)(:-([^}]*))?\}`)
+
+// Files returns the configuration files of the paths in order, the files of
+// a directory are its `.yml` and `.yaml` files in name order.
+func Files(paths []string) ([]string, error) {
+	var files []string
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+
+		if !info.IsDir() {
+			files = append(files, path)
+			continue
+		}
+
+		entries, err := ioutil.ReadDir(path)
+		if err != nil {
+			return nil, err
+		}
+
+		var names []string
+		for _, entry := range entries {
+			ext := filepath.Ext(entry.Name())
+			if !entry.IsDir() && (ext == ".yml" || ext == ".yaml") {
+				names = append(names, entry.Name())
+			}
+		}
+
+		sort.Strings(names)
+		for _, name := range names {
+			files = append(files, filepath.Join(path, name))
+		}
+	}
+
+	return files, nil
+}
+
+// Load reads the configuration files, interpolates the environment
+// variables referenced in their values, reads the secret files they
+// reference and merges them in order: maps are merged, other values of
+// later files replace those of earlier ones, like drivers replace other
+// drivers. Files without a version take the version of the first file.
+func Load(files []string) ([]byte, error) {
+	var version Version
+	var merged yaml.MapSlice
+	for _, file := range files {
+		in, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+
+		// read as a string, a plain `1.0` is a float in the tree
+		var versioned struct {
+			Version Version
+		}
+
+		if err := yaml.Unmarshal(in, &versioned); err != nil {
+			return nil, fmt.Errorf("error parsing %s: %v", file, err)
+		}
+
+		if version == "" {
+			version = versioned.Version
+		} else if versioned.Version != "" && versioned.Version != version {
+			return nil, fmt.Errorf("version %s of %s doesn't match version %s", versioned.Version, file, version)
+		}
+
+		var tree yaml.MapSlice
+		if err := yaml.Unmarshal(in, &tree); err != nil {
+			return nil, fmt.Errorf("error parsing %s: %v", file, err)
+		}
+
+		interpolated, err := interpolate(nil, tree)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing %s: %v", file, err)
+		}
+
+		resolved, err := resolveSecretFiles(nil, interpolated)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing %s: %v", file, err)
+		}
+
+		merged = merge(nil, merged, resolved.(yaml.MapSlice))
+	}
+
+	for i := range merged {
+		if merged[i].Key == "version" {
+			merged[i].Value = version
+		}
+	}
+
+	return yaml.Marshal(merged)
+}
+
+// interpolate replaces the environment variable references in the string
+// values of a tree. Values made of a single reference are parsed like the
+// environment overrides, so they can be numbers or booleans.
+func interpolate(keys []string, value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case yaml.MapSlice:
+		m := make(yaml.MapSlice, len(v))
+		for i, item := range v {
+			interpolated, err := interpolate(child(keys, fmt.Sprint(item.Key)), item.Value)
+			if err != nil {
+				return nil, err
+			}
+
+			m[i] = yaml.MapItem{Key: item.Key, Value: interpolated}
+		}
+
+		return m, nil
+	case []interface{}:
+		list := make([]interface{}, len(v))
+		for i, item := range v {
+			interpolated, err := interpolate(child(keys, fmt.Sprint(i)), item)
+			if err != nil {
+				return nil, err
+			}
+
+			list[i] = interpolated
+		}
+
+		return list, nil
+	case string:
+		if !strings.Contains(v, "${") {
+			return v, nil
+		}
+
+		var missing string
+		s := envReference.ReplaceAllStringFunc(v, func(ref string) string {
+			if strings.HasPrefix(ref, "$$") {
+				return ref[1:]
+			}
+
+			match := envReference.FindStringSubmatch(ref)
+			if env, ok := os.LookupEnv(match[1]); ok {
+				return env
+			}
+
+			if match[2] == "" && missing == "" {
+				missing = match[1]
+			}
+
+			return match[3]
+		})
+
+		if missing != "" {
+			return nil, fmt.Errorf("value %q references the unset environment variable %s", strings.Join(keys, "."), missing)
+		}
+
+		if loc := envReference.FindStringIndex(v); loc != nil && loc[0] == 0 && loc[1] == len(v) && !strings.HasPrefix(v, "$$") {
+			var parsed interface{}
+			if err := yaml.Unmarshal([]byte(s), &parsed); err == nil {
+				switch parsed.(type) {
+				case string, int, int64, uint64, float64, bool:
+					return parsed, nil
+				}
+			}
+		}
+
+		return s, nil
+	}
+
+	return value, nil
+}
+
+// merge merges overlay into base, see Load. Driver sections naming another
+// driver replace the base section instead of being merged into it.
+func merge(keys []string, base yaml.MapSlice, overlay yaml.MapSlice) yaml.MapSlice {
+	merged := append(yaml.MapSlice{}, base...)
+	for _, item := range overlay {
+		found := false
+		for i := range merged {
+			if fmt.Sprint(merged[i].Key) != fmt.Sprint(item.Key) {
+				continue
+			}
+
+			path := child(keys, fmt.Sprint(item.Key))
+			baseMap, baseOk := merged[i].Value.(yaml.MapSlice)
+			overlayMap, overlayOk := item.Value.(yaml.MapSlice)
+			if baseOk && overlayOk && !switchesDriver(path, baseMap, overlayMap) {
+				merged[i].Value = merge(path, baseMap, overlayMap)
+			} else {
+				merged[i].Value = item.Value
+			}
+
+			found = true
+			break
+		}
+
+		if !found {
+			merged = append(merged, item)
+		}
+	}
+
+	return merged
+}
+
+// switchesDriver tells whether the overlay of a section holding a driver
+// names another driver than the base: the `reporting` and `containers`
+// sections, keyed by their driver, and the reporters of version 1.1 with
+// their `driver` value.
+func switchesDriver(keys []string, base yaml.MapSlice, overlay yaml.MapSlice) bool {
+	switch {
+	case len(keys) == 1 && (keys[0] == "reporting" || keys[0] == "containers"):
+		for _, item := range overlay {
+			for _, baseItem := range base {
+				if fmt.Sprint(item.Key) == fmt.Sprint(baseItem.Key) {
+					return false
+				}
+			}
+		}
+
+		return len(overlay) > 0
+	case len(keys) == 2 && keys[0] == "reporters":
+		var baseDriver, overlayDriver interface{}
+		for _, item := range base {
+			if item.Key == "driver" {
+				baseDriver = item.Value
+			}
+		}
+
+		for _, item := range overlay {
+			if item.Key == "driver" {
+				overlayDriver = item.Value
+			}
+		}
+
+		return overlayDriver != nil && fmt.Sprint(overlayDriver) != fmt.Sprint(baseDriver)
+	}
+
+	return false
+}
+
+// resolveSecretFiles replaces the secret values of a tree, see IsSecret,
+// referencing a file with the file's content without surrounding
+// whitespace, e.g. `apikey: 'file:/run/secrets/ctoll-apikey'`.
+func resolveSecretFiles(keys []string, value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case yaml.MapSlice:
+		m := make(yaml.MapSlice, len(v))
+		for i, item := range v {
+			name := fmt.Sprint(item.Key)
+			resolved := item.Value
+			var err error
+			if s, ok := item.Value.(string); ok && IsSecret(name) {
+				resolved, err = readSecretFile(strings.Join(child(keys, name), "."), s)
+			} else {
+				resolved, err = resolveSecretFiles(child(keys, name), item.Value)
+			}
+
+			if err != nil {
+				return nil, err
+			}
+
+			m[i] = yaml.MapItem{Key: item.Key, Value: resolved}
+		}
+
+		return m, nil
+	case []interface{}:
+		list := make([]interface{}, len(v))
+		for i, item := range v {
+			resolved, err := resolveSecretFiles(child(keys, fmt.Sprint(i)), item)
+			if err != nil {
+				return nil, err
+			}
+
+			list[i] = resolved
+		}
+
+		return list, nil
+	}
+
+	return value, nil
+}
+
+// readSecretFile returns the content of the file referenced by the value,
+// or the value when it doesn't reference a file.
+func readSecretFile(name string, value string) (string, error) {
+	if !strings.HasPrefix(value, SECRET_FILE_PREFIX) {
+		return value, nil
+	}
+
+	blob, err := ioutil.ReadFile(strings.TrimPrefix(value, SECRET_FILE_PREFIX))
+	if err != nil {
+		return "", fmt.Errorf("error reading the secret of %q: %v", name, err)
+	}
+
+	return strings.TrimSpace(string(blob)), nil
+}
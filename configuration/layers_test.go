@@ -0,0 +1,126 @@
+package configuration
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// loadLayers writes the files in order and parses their merged content.
+func loadLayers(t *testing.T, contents ...string) *Config {
+	dir, err := ioutil.TempDir("", "cmeter-layers")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	files := make([]string, len(contents))
+	for i, content := range contents {
+		files[i] = filepath.Join(dir, string(rune('a'+i))+".yml")
+		if err := ioutil.WriteFile(files[i], []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	merged, err := Load(files)
+	if err != nil {
+		t.Fatalf("error loading layers: %v", err)
+	}
+
+	config, err := Parse(bytes.NewReader(merged))
+	if err != nil {
+		t.Fatalf("error parsing merged layers: %v\n%s", err, merged)
+	}
+
+	return config
+}
+
+const baseLayer = `
+version: 1.0
+reporting:
+  ctoll:
+    endpoint: 'http://ctoll.example.org'
+    apikey: 'key'
+containers:
+  embedded:
+    envs: ['METER_TRACKING']
+`
+
+func TestMergeSameDriver(t *testing.T) {
+	config := loadLayers(t, baseLayer, `
+reporting:
+  ctoll:
+    endpoint: 'http://other.example.org'
+`)
+
+	if config.Reporting.Type() != "ctoll" {
+		t.Fatalf("expected the ctoll driver, got %q", config.Reporting.Type())
+	}
+
+	params := config.Reporting.Parameters()
+	if params["endpoint"] != "http://other.example.org" || params["apikey"] != "key" {
+		t.Fatalf("expected the parameters to be merged, got %v", params)
+	}
+}
+
+func TestMergeReplacesDriver(t *testing.T) {
+	config := loadLayers(t, baseLayer, `
+reporting:
+  http:
+    url: 'http://events.example.org'
+containers:
+  mock: {}
+`)
+
+	if config.Reporting.Type() != "http" {
+		t.Fatalf("expected the http driver, got %q", config.Reporting.Type())
+	}
+
+	if params := config.Reporting.Parameters(); len(params) != 1 || params["url"] != "http://events.example.org" {
+		t.Fatalf("expected only the http parameters, got %v", params)
+	}
+
+	if config.Containers.Type() != "mock" {
+		t.Fatalf("expected the mock containers driver, got %q", config.Containers.Type())
+	}
+}
+
+func TestMergeReplacesReporterDriver(t *testing.T) {
+	config := loadLayers(t, `
+version: 1.1
+reporters:
+  billing:
+    driver: 'ctoll'
+    parameters:
+      apikey: 'key'
+    events: ['usage_sample']
+  audit:
+    driver: 'file'
+    parameters:
+      path: '/var/log/cmeter/events.ndjson'
+containers: 'embedded'
+`, `
+reporters:
+  billing:
+    driver: 'http'
+    parameters:
+      url: 'http://events.example.org'
+  audit:
+    parameters:
+      compress: true
+`)
+
+	destinations, _ := config.Reporting.Parameters()["destinations"].(Parameters)
+	billing, _ := destinations["billing"].(Parameters)
+	if billing["driver"] != "http" || len(billing["parameters"].(Parameters)) != 1 || billing["events"] != nil {
+		t.Fatalf("expected the billing reporter to be replaced, got %v", billing)
+	}
+
+	audit, _ := destinations["audit"].(Parameters)
+	if audit["driver"] != "file" || len(audit["parameters"].(Parameters)) != 2 {
+		t.Fatalf("expected the audit reporter to be merged, got %v", audit)
+	}
+}
@@ -0,0 +1,240 @@
+package configuration
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/go-yaml/yaml"
+)
+
+// Migrate converts a configuration to the current version and returns it
+// with the version it had. Configurations already at the current version
+// are returned unchanged. The environment isn't applied and comments are
+// not preserved.
+func Migrate(in []byte) ([]byte, Version, error) {
+	out, version, _, err := migrate(in, "")
+	return out, version, err
+}
+
+// MigratedFile is a configuration file converted to the current version.
+type MigratedFile struct {
+	Path    string
+	Version Version
+	Out     []byte
+
+	// environment variables overriding values of the file that are moved,
+	// with the name addressing them after the migration
+	RenamedEnv map[string]string
+}
+
+// MigrateFiles converts layered configuration files, see Load, to the
+// current version. Files without a version are converted from the version
+// of the first file and left without one. Files already at the current
+// version are skipped. Fragments replacing the reporting driver of a 1.0
+// configuration are rejected, the reporter they would become is added to
+// the others instead of replacing them.
+func MigrateFiles(files []string) ([]*MigratedFile, error) {
+	var version Version
+	var reporting string
+	var migrated []*MigratedFile
+	for _, file := range files {
+		in, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+
+		out, fileVersion, moved, err := migrate(in, version)
+		if err != nil {
+			return nil, fmt.Errorf("error migrating %s: %v", file, err)
+		}
+
+		if version == "" {
+			version = fileVersion
+		}
+
+		if fileVersion == CurrentVersion {
+			continue
+		}
+
+		var layer v1_0Config
+		if err := yaml.Unmarshal(in, &layer); err != nil {
+			return nil, fmt.Errorf("error migrating %s: %v", file, err)
+		}
+
+		if driver := layer.Reporting.Type(); driver != "" {
+			if reporting != "" && driver != reporting {
+				return nil, fmt.Errorf("error migrating %s: its %q reporting driver replaces the %q driver of the files before it, which reporters can't express, merge them before migrating", file, driver, reporting)
+			}
+
+			reporting = driver
+		}
+
+		migrated = append(migrated, &MigratedFile{
+			Path:       file,
+			Version:    fileVersion,
+			Out:        out,
+			RenamedEnv: renamedEnv(moved, os.Environ()),
+		})
+	}
+
+	return migrated, nil
+}
+
+// migrate converts a configuration like Migrate, a configuration without a
+// version has the inherited version and is left without one. It also
+// returns the new paths of the moved values by their old path.
+func migrate(in []byte, inherited Version) ([]byte, Version, map[string]string, error) {
+	var versioned struct {
+		Version Version
+	}
+
+	if err := yaml.Unmarshal(in, &versioned); err != nil {
+		return nil, "", nil, err
+	}
+
+	version := versioned.Version
+	if version == "" {
+		version = inherited
+	}
+
+	var tree yaml.MapSlice
+	var moved map[string]string
+	switch version {
+	case CurrentVersion:
+		return in, version, nil, nil
+	case MajorMinorVersion(1, 0):
+		// fails on the values 1.0 doesn't accept
+		if err := yaml.Unmarshal(in, new(v1_0Config)); err != nil {
+			return nil, version, nil, err
+		}
+
+		if err := yaml.Unmarshal(in, &tree); err != nil {
+			return nil, version, nil, err
+		}
+
+		var err error
+		if tree, moved, err = migrateV1_0(tree); err != nil {
+			return nil, version, nil, err
+		}
+	default:
+		return nil, version, nil, fmt.Errorf("unsupported version: %q", version)
+	}
+
+	if versioned.Version != "" {
+		tree = append(yaml.MapSlice{{Key: "version", Value: CurrentVersion}}, tree...)
+	}
+
+	out, err := yaml.Marshal(tree)
+	if err != nil {
+		return nil, version, nil, err
+	}
+
+	return out, version, moved, nil
+}
+
+// renamedEnv returns the environment variables overriding moved values, by
+// name, with the name addressing the values once moved.
+func renamedEnv(moved map[string]string, environ []string) map[string]string {
+	renamed := make(map[string]string)
+	for _, env := range environ {
+		name := strings.SplitN(env, "=", 2)[0]
+		if !strings.HasPrefix(name, "CMETER_") {
+			continue
+		}
+
+		path := strings.ToLower(strings.Replace(strings.TrimPrefix(name, "CMETER_"), "_", ".", -1))
+		if newPath := movedPath(path, moved); newPath != path {
+			renamed[name] = "CMETER_" + strings.ToUpper(strings.Replace(newPath, ".", "_", -1))
+		}
+	}
+
+	return renamed
+}
+
+// migrateV1_0 converts a 1.0 configuration to 1.1, where the `reporting`
+// driver is replaced by the `reporters` section. The destinations of a
+// `multi` driver become reporters of their own, other drivers a reporter
+// named after the driver. It also returns the new paths of the moved values
+// by their old path.
+func migrateV1_0(tree yaml.MapSlice) (yaml.MapSlice, map[string]string, error) {
+	migrated := make(yaml.MapSlice, 0, len(tree))
+	moved := make(map[string]string)
+	for _, item := range tree {
+		switch fmt.Sprint(item.Key) {
+		case "version":
+			continue
+		case "reporting":
+			reporters, err := migrateReportingV1_0(item.Value, moved)
+			if err != nil {
+				return nil, nil, err
+			}
+
+			moved["reporting"] = "reporters"
+			item = yaml.MapItem{Key: "reporters", Value: reporters}
+		}
+
+		migrated = append(migrated, item)
+	}
+
+	return migrated, moved, nil
+}
+
+func migrateReportingV1_0(value interface{}, moved map[string]string) (yaml.MapSlice, error) {
+	var driverType string
+	var params interface{}
+	switch driver := value.(type) {
+	case nil:
+		return yaml.MapSlice{}, nil
+	case string:
+		driverType = driver
+	case yaml.MapSlice:
+		if len(driver) != 1 {
+			return nil, fmt.Errorf("must provide exactly one reporting driver, provided %d", len(driver))
+		}
+
+		driverType = fmt.Sprint(driver[0].Key)
+		params = driver[0].Value
+	default:
+		return nil, fmt.Errorf("invalid reporting driver %v", value)
+	}
+
+	if driverType == "" {
+		return yaml.MapSlice{}, nil
+	}
+
+	// destinations have the settings of reporters, unless the multi driver
+	// has parameters of its own, e.g. `retry`
+	if multi, ok := params.(yaml.MapSlice); ok && driverType == "multi" && len(multi) == 1 && multi[0].Key == "destinations" {
+		if destinations, ok := multi[0].Value.(yaml.MapSlice); ok {
+			moved["reporting.multi.destinations"] = "reporters"
+			return destinations, nil
+		}
+	}
+
+	reporter := yaml.MapSlice{{Key: "driver", Value: driverType}}
+	if m, ok := params.(yaml.MapSlice); ok && len(m) > 0 {
+		reporter = append(reporter, yaml.MapItem{Key: "parameters", Value: params})
+	}
+
+	moved["reporting."+driverType] = "reporters." + driverType + ".parameters"
+	return yaml.MapSlice{{Key: driverType, Value: reporter}}, nil
+}
+
+// movedPath returns the new path of a value, or its path when it wasn't
+// moved. The longest moved path containing the value applies.
+func movedPath(path string, moved map[string]string) string {
+	var from string
+	for old := range moved {
+		if (path == old || strings.HasPrefix(path, old+".")) && len(old) > len(from) {
+			from = old
+		}
+	}
+
+	if from == "" {
+		return path
+	}
+
+	return moved[from] + strings.TrimPrefix(path, from)
+}
@@ -0,0 +1,125 @@
+package configuration
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeLayers(t *testing.T, dir string, contents ...string) []string {
+	files := make([]string, len(contents))
+	for i, content := range contents {
+		files[i] = filepath.Join(dir, string(rune('a'+i))+".yml")
+		if err := ioutil.WriteFile(files[i], []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return files
+}
+
+func TestMigrateFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cmeter-migrate")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	files := writeLayers(t, dir, baseLayer, `
+reporting:
+  ctoll:
+    endpoint: 'http://other.example.org'
+`)
+
+	migrated, err := MigrateFiles(files)
+	if err != nil {
+		t.Fatalf("error migrating: %v", err)
+	}
+
+	if len(migrated) != 2 {
+		t.Fatalf("expected both files migrated, got %d", len(migrated))
+	}
+
+	if strings.Contains(string(migrated[1].Out), "version") {
+		t.Fatalf("expected the fragment to stay without a version, got:\n%s", migrated[1].Out)
+	}
+
+	for _, file := range migrated {
+		if err := ioutil.WriteFile(file.Path, file.Out, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	merged, err := Load(files)
+	if err != nil {
+		t.Fatalf("error loading the migrated files: %v", err)
+	}
+
+	config, err := Parse(bytes.NewReader(merged))
+	if err != nil {
+		t.Fatalf("error parsing the migrated files: %v\n%s", err, merged)
+	}
+
+	params := config.Reporting.Parameters()
+	if config.Reporting.Type() != "ctoll" || params["endpoint"] != "http://other.example.org" || params["apikey"] != "key" {
+		t.Fatalf("expected the fragment to still change the ctoll endpoint, got %q %v", config.Reporting.Type(), params)
+	}
+
+	// migrated files are skipped
+	if migrated, err := MigrateFiles(files); err != nil || len(migrated) != 0 {
+		t.Fatalf("expected nothing left to migrate, got %d files and %v", len(migrated), err)
+	}
+}
+
+func TestMigrateFilesRejectsDriverReplacement(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cmeter-migrate")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	files := writeLayers(t, dir, baseLayer, `
+reporting:
+  http:
+    url: 'http://events.example.org'
+`)
+
+	if _, err := MigrateFiles(files); err == nil {
+		t.Fatal("expected a fragment replacing the reporting driver to be rejected")
+	}
+}
+
+func TestRenamedEnv(t *testing.T) {
+	moved := map[string]string{
+		"reporting":                    "reporters",
+		"reporting.ctoll":              "reporters.ctoll.parameters",
+		"reporting.multi.destinations": "reporters",
+	}
+
+	renamed := renamedEnv(moved, []string{
+		"CMETER_REPORTING_CTOLL_APIKEY=key",
+		"CMETER_REPORTING_MULTI_DESTINATIONS_BILLING_REQUIRED=false",
+		"CMETER_LOG_LEVEL=info",
+		"HOME=/root",
+	})
+
+	expected := map[string]string{
+		"CMETER_REPORTING_CTOLL_APIKEY":                        "CMETER_REPORTERS_CTOLL_PARAMETERS_APIKEY",
+		"CMETER_REPORTING_MULTI_DESTINATIONS_BILLING_REQUIRED": "CMETER_REPORTERS_BILLING_REQUIRED",
+	}
+
+	if len(renamed) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, renamed)
+	}
+
+	for old, name := range expected {
+		if renamed[old] != name {
+			t.Errorf("expected %s to become %s, got %q", old, name, renamed[old])
+		}
+	}
+}
@@ -0,0 +1,217 @@
+package configuration
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ToParameters converts a nested parameter value, as decoded from yaml or
+// the environment, into Parameters.
+func ToParameters(v interface{}) (Parameters, bool) {
+	switch m := v.(type) {
+	case Parameters:
+		return m, true
+	case map[string]interface{}:
+		return Parameters(m), true
+	case map[interface{}]interface{}:
+		p := make(Parameters, len(m))
+		for k, v := range m {
+			p[fmt.Sprint(k)] = v
+		}
+
+		return p, true
+	}
+
+	return nil, false
+}
+
+// Sub returns the nested parameters found under key, or nil if there are none.
+func (p Parameters) Sub(key string) (Parameters, error) {
+	v, ok := p[key]
+	if !ok || v == nil {
+		return nil, nil
+	}
+
+	sub, ok := ToParameters(v)
+	if !ok {
+		return nil, fmt.Errorf("parameter %q must be a map", key)
+	}
+
+	return sub, nil
+}
+
+func (p Parameters) String(key string, def string) string {
+	switch v := p[key].(type) {
+	case string:
+		if v != "" {
+			return v
+		}
+	case nil:
+	default:
+		return fmt.Sprint(v)
+	}
+
+	return def
+}
+
+func (p Parameters) Int(key string, def int64) (int64, error) {
+	switch v := p[key].(type) {
+	case nil:
+		return def, nil
+	case int:
+		return int64(v), nil
+	case int64:
+		return v, nil
+	case uint64:
+		return int64(v), nil
+	case float64:
+		return int64(v), nil
+	case string:
+		if v == "" {
+			return def, nil
+		}
+
+		i, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return def, fmt.Errorf("parameter %q must be an integer: %v", key, err)
+		}
+
+		return i, nil
+	}
+
+	return def, fmt.Errorf("parameter %q must be an integer", key)
+}
+
+func (p Parameters) Float(key string, def float64) (float64, error) {
+	switch v := p[key].(type) {
+	case nil:
+		return def, nil
+	case float64:
+		return v, nil
+	case int:
+		return float64(v), nil
+	case int64:
+		return float64(v), nil
+	case string:
+		if v == "" {
+			return def, nil
+		}
+
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return def, fmt.Errorf("parameter %q must be a number: %v", key, err)
+		}
+
+		return f, nil
+	}
+
+	return def, fmt.Errorf("parameter %q must be a number", key)
+}
+
+func (p Parameters) Bool(key string, def bool) (bool, error) {
+	switch v := p[key].(type) {
+	case nil:
+		return def, nil
+	case bool:
+		return v, nil
+	case string:
+		if v == "" {
+			return def, nil
+		}
+
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return def, fmt.Errorf("parameter %q must be a boolean: %v", key, err)
+		}
+
+		return b, nil
+	}
+
+	return def, fmt.Errorf("parameter %q must be a boolean", key)
+}
+
+// Duration reads a duration string such as "1m30s"; plain integers are
+// taken as milliseconds like the collector rate.
+func (p Parameters) Duration(key string, def time.Duration) (time.Duration, error) {
+	switch v := p[key].(type) {
+	case nil:
+		return def, nil
+	case time.Duration:
+		return v, nil
+	case int:
+		return time.Duration(v) * time.Millisecond, nil
+	case int64:
+		return time.Duration(v) * time.Millisecond, nil
+	case string:
+		if v == "" {
+			return def, nil
+		}
+
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return def, fmt.Errorf("parameter %q must be a duration: %v", key, err)
+		}
+
+		return d, nil
+	}
+
+	return def, fmt.Errorf("parameter %q must be a duration", key)
+}
+
+// StringList reads either a list of strings or a comma delimited string.
+func (p Parameters) StringList(key string) ([]string, error) {
+	switch v := p[key].(type) {
+	case nil:
+		return nil, nil
+	case []string:
+		return v, nil
+	case string:
+		if v == "" {
+			return nil, nil
+		}
+
+		parts := strings.Split(v, ",")
+		for i := range parts {
+			parts[i] = strings.TrimSpace(parts[i])
+		}
+
+		return parts, nil
+	case []interface{}:
+		values := make([]string, 0, len(v))
+		for _, item := range v {
+			if item != nil {
+				values = append(values, fmt.Sprint(item))
+			}
+		}
+
+		return values, nil
+	}
+
+	return nil, fmt.Errorf("parameter %q must be a list", key)
+}
+
+// IntList reads either a list of integers or a comma delimited string.
+func (p Parameters) IntList(key string) ([]int, error) {
+	if values, ok := p[key].([]int); ok {
+		return values, nil
+	}
+
+	items, err := p.StringList(key)
+	if err != nil || items == nil {
+		return nil, err
+	}
+
+	values := make([]int, 0, len(items))
+	for _, item := range items {
+		i, err := strconv.Atoi(item)
+		if err != nil {
+			return nil, fmt.Errorf("parameter %q must be a list of integers: %v", key, err)
+		}
+
+		values = append(values, i)
+	}
+
+	return values, nil
+}
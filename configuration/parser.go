@@ -66,19 +66,25 @@ type VersionedParseInfo struct {
 
 	ParseAs reflect.Type
 
+	// Defaults returns a pointer to a ParseAs value holding the defaults of
+	// the values the configuration leaves out, zero values when nil
+	Defaults func() interface{}
+
 	ConversionFunc func(interface{}) (interface{}, error)
 }
 
 type Parser struct {
-	prefix  string
-	mapping map[Version]VersionedParseInfo
-	env     envVars
+	prefix    string
+	mapping   map[Version]VersionedParseInfo
+	env       envVars
+	overrides map[string]string
 }
 
 func NewParser(prefix string, parseInfos []VersionedParseInfo) *Parser {
 	p := Parser{
-		prefix:  prefix,
-		mapping: make(map[Version]VersionedParseInfo),
+		prefix:    prefix,
+		mapping:   make(map[Version]VersionedParseInfo),
+		overrides: make(map[string]string),
 	}
 
 	for _, parseInfo := range parseInfos {
@@ -109,6 +115,10 @@ func (p *Parser) Parse(in []byte, v interface{}) error {
 	}
 
 	parseAs := reflect.New(parseInfo.ParseAs)
+	if parseInfo.Defaults != nil {
+		parseAs = reflect.ValueOf(parseInfo.Defaults())
+	}
+
 	if err := yaml.Unmarshal(in, parseAs.Interface()); err != nil {
 		return err
 	}
@@ -117,7 +127,7 @@ func (p *Parser) Parse(in []byte, v interface{}) error {
 		pathPart := ev.name
 		if strings.HasPrefix(pathPart, strings.ToUpper(p.prefix)+"_") {
 			path := strings.Split(pathPart, "_")
-			if err := p.overwriteFields(parseAs, pathPart, path[1:], ev.value); err != nil {
+			if err := p.overwriteFields(parseAs, pathPart, path[1:], nil, ev.value); err != nil {
 				return err
 			}
 		}
@@ -132,7 +142,35 @@ func (p *Parser) Parse(in []byte, v interface{}) error {
 	return nil
 }
 
-func (p *Parser) overwriteFields(v reflect.Value, fullpath string, path []string, payload string) error {
+// Overrides returns the environment variables applied by Parse, by the
+// dot-separated path of the value they set, e.g. `reporting.http.url`.
+func (p *Parser) Overrides() map[string]string {
+	return p.overrides
+}
+
+// child returns the keys of a nested value, without sharing their storage
+// with sibling values.
+func child(keys []string, key string) []string {
+	return append(keys[:len(keys):len(keys)], key)
+}
+
+// secretPayload replaces the payload of a secret value referencing a file,
+// see Load, with the file's content.
+func secretPayload(fullpath string, name string, payload string) (string, error) {
+	if !IsSecret(name) || !strings.HasPrefix(payload, SECRET_FILE_PREFIX) {
+		return payload, nil
+	}
+
+	secret, err := readSecretFile(fullpath, payload)
+	if err != nil {
+		return "", err
+	}
+
+	blob, err := yaml.Marshal(secret)
+	return string(blob), err
+}
+
+func (p *Parser) overwriteFields(v reflect.Value, fullpath string, path []string, keys []string, payload string) error {
 	for v.Kind() == reflect.Ptr {
 		if v.IsNil() {
 			panic("encountered nil pointer when handling environment variable " + fullpath)
@@ -143,26 +181,26 @@ func (p *Parser) overwriteFields(v reflect.Value, fullpath string, path []string
 
 	switch v.Kind() {
 	case reflect.Struct:
-		return p.overwriteStruct(v, fullpath, path, payload)
+		return p.overwriteStruct(v, fullpath, path, keys, payload)
 	case reflect.Map:
-		return p.overwriteMap(v, fullpath, path, payload)
+		return p.overwriteMap(v, fullpath, path, keys, payload)
 	case reflect.Interface:
 		if v.NumMethod() == 0 {
 			if !v.IsNil() {
-				return p.overwriteFields(v.Elem(), fullpath, path, payload)
+				return p.overwriteFields(v.Elem(), fullpath, path, keys, payload)
 			}
 
 			var template map[string]interface{}
 			wrapped := reflect.MakeMap(reflect.TypeOf(template))
 			v.Set(wrapped)
-			return p.overwriteMap(wrapped, fullpath, path, payload)
+			return p.overwriteMap(wrapped, fullpath, path, keys, payload)
 		}
 	}
 
 	return nil
 }
 
-func (p *Parser) overwriteStruct(v reflect.Value, fullpath string, path []string, payload string) error {
+func (p *Parser) overwriteStruct(v reflect.Value, fullpath string, path []string, keys []string, payload string) error {
 	uppercase := make(map[string]int)
 	for i := 0; i < v.NumField(); i++ {
 		vf := v.Type().Field(i)
@@ -185,14 +223,25 @@ func (p *Parser) overwriteStruct(v reflect.Value, fullpath string, path []string
 
 	f := v.Field(fi)
 	vf := v.Type().Field(fi)
+	name := strings.Split(vf.Tag.Get("yaml"), ",")[0]
+	if name == "" {
+		name = strings.ToLower(vf.Name)
+	}
+
+	keys = child(keys, name)
 	if len(path) == 1 {
-		fv := reflect.New(vf.Type)
-		err := yaml.Unmarshal([]byte(payload), fv.Interface())
+		payload, err := secretPayload(fullpath, name, payload)
 		if err != nil {
 			return err
 		}
 
+		fv := reflect.New(vf.Type)
+		if err := yaml.Unmarshal([]byte(payload), fv.Interface()); err != nil {
+			return err
+		}
+
 		f.Set(reflect.Indirect(fv))
+		p.overrides[strings.Join(keys, ".")] = fullpath
 		return nil
 	}
 
@@ -208,7 +257,7 @@ func (p *Parser) overwriteStruct(v reflect.Value, fullpath string, path []string
 		}
 	}
 
-	err := p.overwriteFields(f, fullpath, path[1:], payload)
+	err := p.overwriteFields(f, fullpath, path[1:], keys, payload)
 	if err != nil {
 		return err
 	}
@@ -216,7 +265,7 @@ func (p *Parser) overwriteStruct(v reflect.Value, fullpath string, path []string
 	return nil
 }
 
-func (p *Parser) overwriteMap(m reflect.Value, fullpath string, path []string, payload string) error {
+func (p *Parser) overwriteMap(m reflect.Value, fullpath string, path []string, keys []string, payload string) error {
 	if m.Type().Key().Kind() != reflect.String {
 		logrus.Warnf("Ignoring environment variable %s involving map with non-string keys", fullpath)
 		return nil
@@ -233,28 +282,43 @@ func (p *Parser) overwriteMap(m reflect.Value, fullpath string, path []string, p
 					break
 				}
 
-				return p.overwriteFields(mv, fullpath, path[1:], payload)
+				return p.overwriteFields(mv, fullpath, path[1:], child(keys, k.String()), payload)
 			}
 		}
 	}
 
 	var mv reflect.Value
-	if m.Type().Elem().Kind() == reflect.Map {
+	switch m.Type().Elem().Kind() {
+	case reflect.Map:
 		mv = reflect.MakeMap(m.Type().Elem())
-	} else {
+	case reflect.Ptr:
+		mv = reflect.New(m.Type().Elem().Elem())
+	default:
 		mv = reflect.New(m.Type().Elem())
 	}
 
+	key := strings.ToLower(path[0])
 	if len(path) > 1 {
-		if err := p.overwriteFields(mv, fullpath, path[1:], payload); err != nil {
+		if err := p.overwriteFields(mv, fullpath, path[1:], child(keys, key), payload); err != nil {
 			return err
 		}
 	} else {
+		payload, err := secretPayload(fullpath, key, payload)
+		if err != nil {
+			return err
+		}
+
 		if err := yaml.Unmarshal([]byte(payload), mv.Interface()); err != nil {
 			return err
 		}
+
+		p.overrides[strings.Join(child(keys, key), ".")] = fullpath
+	}
+
+	if m.Type().Elem().Kind() != reflect.Ptr {
+		mv = reflect.Indirect(mv)
 	}
 
-	m.SetMapIndex(reflect.ValueOf(strings.ToLower(path[0])), reflect.Indirect(mv))
+	m.SetMapIndex(reflect.ValueOf(key), mv)
 	return nil
 }
@@ -1,33 +1,76 @@
 package configuration
 
 import (
+	"bytes"
 	"fmt"
 	"os"
+	"path/filepath"
+	"strings"
 )
 
-func Resolve(args []string) (*Config, error) {
-	var configPath string
-
+// Paths returns the configuration files and directories, the arguments or
+// the paths listed in the `CMETER_CONFIG_PATH` environment variable,
+// separated like `PATH`.
+func Paths(args []string) ([]string, error) {
+	var paths []string
 	if len(args) > 0 {
-		configPath = args[0]
+		paths = args
 	} else if os.Getenv("CMETER_CONFIG_PATH") != "" {
-		configPath = os.Getenv("CMETER_CONFIG_PATH")
+		paths = filepath.SplitList(os.Getenv("CMETER_CONFIG_PATH"))
 	}
 
-	if configPath == "" {
+	if len(paths) == 0 {
 		return nil, fmt.Errorf("configuration path not specified")
 	}
 
-	fp, err := os.Open(configPath)
+	return paths, nil
+}
+
+// Path returns the main configuration file's path, the first of Paths.
+func Path(args []string) (string, error) {
+	paths, err := Paths(args)
+	if err != nil {
+		return "", err
+	}
+
+	return paths[0], nil
+}
+
+// Resolve loads and merges the configuration files, see Load, and parses
+// them with the environment overrides.
+func Resolve(args []string) (*Config, error) {
+	config, _, err := ResolveWithOverrides(args)
+	return config, err
+}
+
+// ResolveWithOverrides resolves the configuration like Resolve and also
+// returns the environment variables that overrode values, see
+// ParseWithOverrides.
+func ResolveWithOverrides(args []string) (*Config, map[string]string, error) {
+	paths, err := Paths(args)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	files, err := Files(paths)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	configPath := strings.Join(paths, ", ")
+	if len(files) == 0 {
+		return nil, nil, fmt.Errorf("no configuration files found in %s", configPath)
+	}
+
+	in, err := Load(files)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	defer fp.Close()
-	config, err := Parse(fp)
+	config, overrides, err := ParseWithOverrides(bytes.NewReader(in))
 	if err != nil {
-		return nil, fmt.Errorf("error parsing %s: %v", configPath, err)
+		return nil, nil, fmt.Errorf("error parsing %s: %v", configPath, err)
 	}
 
-	return config, nil
+	return config, overrides, nil
 }
@@ -0,0 +1,208 @@
+package configuration
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ParameterType is the type of a driver parameter.
+type ParameterType string
+
+const (
+	TypeString     ParameterType = "string"
+	TypeInt        ParameterType = "integer"
+	TypeFloat      ParameterType = "number"
+	TypeBool       ParameterType = "boolean"
+	TypeDuration   ParameterType = "duration"
+	TypeStringList ParameterType = "string list"
+	TypeIntList    ParameterType = "integer list"
+	TypeStringMap  ParameterType = "string map"
+
+	// TypeSection is a nested set of declared parameters.
+	TypeSection ParameterType = "section"
+
+	// TypeMap is a map with arbitrary keys. When parameters are declared,
+	// every value is a section with those parameters, otherwise the values
+	// are passed on as they are, e.g. to another driver.
+	TypeMap ParameterType = "map"
+)
+
+// Parameter describes a driver parameter.
+type Parameter struct {
+	Name     string
+	Type     ParameterType
+	Required bool
+
+	// Default is applied when the parameter is missing, in its configuration
+	// form, e.g. `5s` for a duration
+	Default string
+
+	// Values are the allowed values, compared case insensitively
+	Values []string
+
+	Description string
+
+	// Parameters of sections and maps of sections
+	Parameters []Parameter
+}
+
+// Schema describes the parameters of a driver.
+type Schema struct {
+	Description string
+	Parameters  []Parameter
+}
+
+// Decode checks the parameters against the schema, applies the defaults and
+// converts the values to their types: string, int64, float64, bool,
+// time.Duration, []string, []int, and Parameters for string maps, sections
+// and maps. Unknown parameters are an error.
+func (s Schema) Decode(parameters map[string]interface{}) (Parameters, error) {
+	return decodeParameters(s.Parameters, nil, parameters)
+}
+
+func decodeParameters(declared []Parameter, keys []string, parameters map[string]interface{}) (Parameters, error) {
+	known := make(map[string]bool, len(declared))
+	decoded := make(Parameters, len(parameters))
+	for _, param := range declared {
+		known[param.Name] = true
+		path := strings.Join(child(keys, param.Name), ".")
+		raw, ok := parameters[param.Name]
+		if !ok || raw == nil || raw == "" {
+			if param.Required {
+				return nil, fmt.Errorf("parameter %q is required", path)
+			}
+
+			if param.Default == "" {
+				continue
+			}
+
+			raw = param.Default
+		}
+
+		v, err := param.decode(child(keys, param.Name), path, raw)
+		if err != nil {
+			return nil, err
+		}
+
+		decoded[param.Name] = v
+	}
+
+	var unknown []string
+	for name := range parameters {
+		if !known[name] {
+			unknown = append(unknown, strings.Join(child(keys, name), "."))
+		}
+	}
+
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return nil, fmt.Errorf("unknown parameter %q", unknown[0])
+	}
+
+	return decoded, nil
+}
+
+func (param Parameter) decode(keys []string, path string, raw interface{}) (interface{}, error) {
+	// the Parameters getters do the conversions, with errors naming the path
+	p := Parameters{path: raw}
+	var v interface{}
+	var err error
+	switch param.Type {
+	case TypeString:
+		switch raw.(type) {
+		case string, int, int64, uint64, float64, bool:
+			v = p.String(path, "")
+		default:
+			err = fmt.Errorf("parameter %q must be a string", path)
+		}
+	case TypeInt:
+		v, err = p.Int(path, 0)
+	case TypeFloat:
+		v, err = p.Float(path, 0)
+	case TypeBool:
+		v, err = p.Bool(path, false)
+	case TypeDuration:
+		v, err = p.Duration(path, 0)
+	case TypeStringList:
+		v, err = p.StringList(path)
+	case TypeIntList:
+		v, err = p.IntList(path)
+	case TypeStringMap:
+		v, err = decodeStringMap(path, raw)
+	case TypeSection:
+		var sub Parameters
+		if sub, err = p.Sub(path); err == nil {
+			v, err = decodeParameters(param.Parameters, keys, sub)
+		}
+	case TypeMap:
+		var sub Parameters
+		if sub, err = p.Sub(path); err == nil && param.Parameters != nil {
+			sections := make(Parameters, len(sub))
+			for name := range sub {
+				section, err := (Parameter{Type: TypeSection, Parameters: param.Parameters}).decode(child(keys, name), path+"."+name, sub[name])
+				if err != nil {
+					return nil, err
+				}
+
+				sections[name] = section
+			}
+
+			v = sections
+		} else {
+			v = sub
+		}
+	default:
+		err = fmt.Errorf("parameter %q has an unsupported type %q", path, param.Type)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(param.Values) > 0 {
+		values, ok := v.([]string)
+		if !ok {
+			values = []string{fmt.Sprint(v)}
+		}
+
+		for _, value := range values {
+			if !param.allows(value) {
+				return nil, fmt.Errorf("parameter %q must be one of %s, not %q", path, strings.Join(param.Values, ", "), value)
+			}
+		}
+	}
+
+	return v, nil
+}
+
+func (param Parameter) allows(value string) bool {
+	for _, allowed := range param.Values {
+		if strings.EqualFold(allowed, value) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func decodeStringMap(path string, raw interface{}) (Parameters, error) {
+	m, ok := ToParameters(raw)
+	if !ok {
+		return nil, fmt.Errorf("parameter %q must be a map", path)
+	}
+
+	decoded := make(Parameters, len(m))
+	for k, v := range m {
+		switch v.(type) {
+		case string, int, int64, uint64, float64, bool:
+			decoded[k] = fmt.Sprint(v)
+		case nil:
+			decoded[k] = ""
+		default:
+			return nil, fmt.Errorf("parameter %q must be a string", path+"."+k)
+		}
+	}
+
+	return decoded, nil
+}
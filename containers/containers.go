@@ -17,6 +17,7 @@ const (
 	EventContainerOomKill  EventType = "oomKill"
 	EventContainerExisted  EventType = "containerExisted"
 	EventMeterShutdown     EventType = "meterShutdown"
+	EventTrackingChanged   EventType = "trackingChanged"
 )
 
 type State string
@@ -17,6 +17,7 @@ import (
 	"github.com/google/cadvisor/manager"
 	"github.com/google/cadvisor/utils/sysfs"
 
+	"github.com/MustWin/cmeter/configuration"
 	"github.com/MustWin/cmeter/containers"
 	"github.com/MustWin/cmeter/containers/factory"
 	"github.com/MustWin/cmeter/context"
@@ -46,6 +47,16 @@ func init() {
 
 type driverFactory struct{}
 
+func (factory *driverFactory) Schema() configuration.Schema {
+	return configuration.Schema{
+		Description: "Tracks the local containers with an embedded cAdvisor.",
+		Parameters: []configuration.Parameter{
+			{Name: "envs", Type: configuration.TypeStringList, Description: "whitelist of container environment variables exposed to cmeter"},
+			{Name: "cpu_limit_label", Type: configuration.TypeString, Description: "container label overriding the tracked cpu limit, in cpu cores"},
+		},
+	}
+}
+
 func (factory *driverFactory) Create(parameters map[string]interface{}) (containers.Driver, error) {
 	if !flag.Parsed() {
 		parseOnce.Do(func() {
@@ -100,22 +111,8 @@ func (factory *driverFactory) Create(parameters map[string]interface{}) (contain
 }
 
 func getEnvWhiteList(parameters map[string]interface{}) []string {
-	if delimited, ok := parameters["envs"].(string); ok {
-		return strings.Split(delimited, ",")
-	}
-
-	if raw, ok := parameters["envs"].([]interface{}); ok {
-		envs := make([]string, 0)
-		for _, e := range raw {
-			if s, ok := e.(string); ok && s != "" {
-				envs = append(envs, s)
-			}
-		}
-
-		return envs
-	}
-
-	return nil
+	envs, _ := configuration.Parameters(parameters).StringList("envs")
+	return envs
 }
 
 func init() {
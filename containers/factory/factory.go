@@ -2,7 +2,9 @@ package factory
 
 import (
 	"fmt"
+	"sort"
 
+	"github.com/MustWin/cmeter/configuration"
 	"github.com/MustWin/cmeter/containers"
 )
 
@@ -26,12 +28,88 @@ func Register(name string, factory ContainersDriverFactory) {
 
 func Create(name string, parameters map[string]interface{}) (containers.Driver, error) {
 	if factory, ok := driverFactories[name]; ok {
+		parameters, err := decode(factory, parameters)
+		if err != nil {
+			return nil, err
+		}
+
 		return factory.Create(parameters)
 	}
 
 	return nil, InvalidContainersDriverError{name}
 }
 
+// Describer is implemented by factories describing their drivers'
+// parameters. Their parameters are checked against the schema, completed
+// with its defaults and converted to the declared types before drivers are
+// created.
+type Describer interface {
+	Schema() configuration.Schema
+}
+
+// Names returns the names of the registered drivers.
+func Names() []string {
+	names := make([]string, 0, len(driverFactories))
+	for name := range driverFactories {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+// Schema returns the schema of the named driver's parameters and whether
+// the driver describes its parameters.
+func Schema(name string) (configuration.Schema, bool, error) {
+	factory, ok := driverFactories[name]
+	if !ok {
+		return configuration.Schema{}, false, InvalidContainersDriverError{name}
+	}
+
+	describer, ok := factory.(Describer)
+	if !ok {
+		return configuration.Schema{}, false, nil
+	}
+
+	return describer.Schema(), true, nil
+}
+
+func decode(factory ContainersDriverFactory, parameters map[string]interface{}) (map[string]interface{}, error) {
+	describer, ok := factory.(Describer)
+	if !ok {
+		return parameters, nil
+	}
+
+	return describer.Schema().Decode(parameters)
+}
+
+// ParameterValidator is implemented by factories able to check their
+// parameters without creating a driver.
+type ParameterValidator interface {
+	Validate(parameters map[string]interface{}) error
+}
+
+// Validate checks that the driver is registered and that its parameters
+// match its schema and, when its factory is a ParameterValidator, are valid. Drivers are never
+// created, they connect to the container runtime.
+func Validate(name string, parameters map[string]interface{}) error {
+	factory, ok := driverFactories[name]
+	if !ok {
+		return InvalidContainersDriverError{name}
+	}
+
+	parameters, err := decode(factory, parameters)
+	if err != nil {
+		return err
+	}
+
+	if validator, ok := factory.(ParameterValidator); ok {
+		return validator.Validate(parameters)
+	}
+
+	return nil
+}
+
 type InvalidContainersDriverError struct {
 	Name string
 }
@@ -9,7 +9,11 @@ import (
 	"github.com/MustWin/cmeter/context"
 )
 
-var ErrNotTrackable = errors.New("the registry cannot track this container")
+var (
+	ErrNotTrackable      = errors.New("the registry cannot track this container")
+	ErrAlreadyRegistered = errors.New("the container is already registered")
+	ErrNotRegistered     = errors.New("the container is not registered")
+)
 
 type Registry struct {
 	mutex      sync.Mutex
@@ -34,6 +38,9 @@ func (registry *Registry) Get(containerName string) (*ContainerInfo, bool) {
 }
 
 func (registry *Registry) List() []*ContainerInfo {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+
 	results := make([]*ContainerInfo, len(registry.containers))
 	i := 0
 	for _, c := range registry.containers {
@@ -52,6 +59,9 @@ func (registry *Registry) IsRegistered(containerName string) bool {
 	return ok
 }
 
+// Register adds the container to the registry. Only one of concurrent
+// registrations of a container succeeds, the others fail with
+// ErrAlreadyRegistered.
 func (registry *Registry) Register(ctx context.Context, info *ContainerInfo) error {
 	if !registry.IsTrackable(info) {
 		return ErrNotTrackable
@@ -62,8 +72,7 @@ func (registry *Registry) Register(ctx context.Context, info *ContainerInfo) err
 
 	log := context.GetLoggerWithField(ctx, "container.name", info.Name)
 	if _, ok := registry.containers[info.Name]; ok {
-		log.Warnf("container name already registered, ignoring", info.Name)
-		return nil
+		return ErrAlreadyRegistered
 	}
 
 	registry.containers[info.Name] = info
@@ -71,14 +80,15 @@ func (registry *Registry) Register(ctx context.Context, info *ContainerInfo) err
 	return nil
 }
 
+// Drop removes the container from the registry. Only one of concurrent
+// drops of a container succeeds, the others fail with ErrNotRegistered.
 func (registry *Registry) Drop(ctx context.Context, containerName string) error {
 	registry.mutex.Lock()
 	defer registry.mutex.Unlock()
 
 	log := context.GetLoggerWithField(ctx, "container.name", containerName)
 	if _, ok := registry.containers[containerName]; !ok {
-		log.Warnf("container name not registered, ignoring", containerName)
-		return nil
+		return ErrNotRegistered
 	}
 
 	delete(registry.containers, containerName)
@@ -86,15 +96,29 @@ func (registry *Registry) Drop(ctx context.Context, containerName string) error
 	return nil
 }
 
+// SetMarkers changes the markers of trackable containers, registered
+// containers are left as they are.
+func (registry *Registry) SetMarkers(markers configuration.Marker) {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+
+	markers.Env = strings.ToLower(markers.Env)
+	registry.markers = markers
+}
+
 func (registry *Registry) IsTrackable(info *ContainerInfo) bool {
-	if registry.markers.Label != "" {
-		if _, ok := info.Labels[registry.markers.Label]; ok {
+	registry.mutex.Lock()
+	markers := registry.markers
+	registry.mutex.Unlock()
+
+	if markers.Label != "" {
+		if _, ok := info.Labels[markers.Label]; ok {
 			return true
 		}
 	}
 
-	if registry.markers.Env != "" {
-		if _, ok := info.Envs[registry.markers.Env]; ok {
+	if markers.Env != "" {
+		if _, ok := info.Envs[markers.Env]; ok {
 			return true
 		}
 	}
@@ -8,13 +8,25 @@ import (
 
 	"github.com/MustWin/cmeter/cmd"
 	_ "github.com/MustWin/cmeter/cmd/agent"
+	_ "github.com/MustWin/cmeter/cmd/config"
+	_ "github.com/MustWin/cmeter/cmd/drivers"
 	"github.com/MustWin/cmeter/cmd/root"
 	_ "github.com/MustWin/cmeter/cmd/version"
 	_ "github.com/MustWin/cmeter/containers/embedded"
 	"github.com/MustWin/cmeter/context"
+	_ "github.com/MustWin/cmeter/reporting/amqp"
 	_ "github.com/MustWin/cmeter/reporting/ctoll"
+	_ "github.com/MustWin/cmeter/reporting/file"
 	_ "github.com/MustWin/cmeter/reporting/http"
+	_ "github.com/MustWin/cmeter/reporting/influx"
+	_ "github.com/MustWin/cmeter/reporting/kafka"
 	_ "github.com/MustWin/cmeter/reporting/mock"
+	_ "github.com/MustWin/cmeter/reporting/multi"
+	_ "github.com/MustWin/cmeter/reporting/nats"
+	_ "github.com/MustWin/cmeter/reporting/otlp"
+	_ "github.com/MustWin/cmeter/reporting/prometheus"
+	_ "github.com/MustWin/cmeter/reporting/statsd"
+	_ "github.com/MustWin/cmeter/reporting/syslog"
 )
 
 var appVersion string
@@ -0,0 +1,549 @@
+package amqp
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// The driver speaks the parts of AMQP 0-9-1 a confirming publisher needs,
+// see https://www.rabbitmq.com/resources/specs/amqp0-9-1.pdf
+
+const (
+	frameMethod    = 1
+	frameHeader    = 2
+	frameBody      = 3
+	frameHeartbeat = 8
+	frameEnd       = 0xce
+
+	classConnection = 10
+	classChannel    = 20
+	classBasic      = 60
+	classConfirm    = 85
+
+	// property flags of the basic content header
+	flagContentType  = 1 << 15
+	flagHeaders      = 1 << 13
+	flagDeliveryMode = 1 << 12
+	flagMessageID    = 1 << 7
+	flagTimestamp    = 1 << 6
+	flagType         = 1 << 5
+	flagAppID        = 1 << 3
+
+	channelID = 1
+
+	DEFAULT_FRAME_MAX = 131072
+)
+
+var protocolHeader = []byte("AMQP\x00\x00\x09\x01")
+
+type method struct {
+	class uint16
+	id    uint16
+}
+
+var (
+	connectionStart   = method{classConnection, 10}
+	connectionStartOk = method{classConnection, 11}
+	connectionTune    = method{classConnection, 30}
+	connectionTuneOk  = method{classConnection, 31}
+	connectionOpen    = method{classConnection, 40}
+	connectionOpenOk  = method{classConnection, 41}
+	connectionClose   = method{classConnection, 50}
+	connectionCloseOk = method{classConnection, 51}
+	channelOpen       = method{classChannel, 10}
+	channelOpenOk     = method{classChannel, 11}
+	channelClose      = method{classChannel, 40}
+	channelCloseOk    = method{classChannel, 41}
+	confirmSelect     = method{classConfirm, 10}
+	confirmSelectOk   = method{classConfirm, 11}
+	basicPublish      = method{classBasic, 40}
+	basicReturn       = method{classBasic, 50}
+	basicAck          = method{classBasic, 80}
+	basicNack         = method{classBasic, 120}
+)
+
+var errUnexpectedFrame = errors.New("amqp: unexpected frame")
+
+// Error is a connection or channel exception raised by the broker.
+type Error struct {
+	Code int
+	Text string
+}
+
+func (err *Error) Error() string {
+	return fmt.Sprintf("amqp: %s (%d)", err.Text, err.Code)
+}
+
+type encoder struct {
+	bytes.Buffer
+}
+
+func (e *encoder) octet(v uint8) {
+	e.WriteByte(v)
+}
+
+func (e *encoder) short(v uint16) {
+	var buf [2]byte
+	binary.BigEndian.PutUint16(buf[:], v)
+	e.Write(buf[:])
+}
+
+func (e *encoder) long(v uint32) {
+	var buf [4]byte
+	binary.BigEndian.PutUint32(buf[:], v)
+	e.Write(buf[:])
+}
+
+func (e *encoder) longlong(v uint64) {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], v)
+	e.Write(buf[:])
+}
+
+func (e *encoder) shortstr(s string) {
+	if len(s) > 255 {
+		s = s[:255]
+	}
+
+	e.octet(uint8(len(s)))
+	e.WriteString(s)
+}
+
+func (e *encoder) longstr(s string) {
+	e.long(uint32(len(s)))
+	e.WriteString(s)
+}
+
+// table writes a field table of string values.
+func (e *encoder) table(fields [][2]string) {
+	t := &encoder{}
+	for _, f := range fields {
+		t.shortstr(f[0])
+		t.octet('S')
+		t.longstr(f[1])
+	}
+
+	e.long(uint32(t.Len()))
+	e.Write(t.Bytes())
+}
+
+type decoder struct {
+	buf []byte
+	err error
+}
+
+func (d *decoder) next(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+
+	if n < 0 || len(d.buf) < n {
+		d.err = errUnexpectedFrame
+		return nil
+	}
+
+	b := d.buf[:n]
+	d.buf = d.buf[n:]
+	return b
+}
+
+func (d *decoder) octet() uint8 {
+	if b := d.next(1); b != nil {
+		return b[0]
+	}
+
+	return 0
+}
+
+func (d *decoder) short() uint16 {
+	if b := d.next(2); b != nil {
+		return binary.BigEndian.Uint16(b)
+	}
+
+	return 0
+}
+
+func (d *decoder) long() uint32 {
+	if b := d.next(4); b != nil {
+		return binary.BigEndian.Uint32(b)
+	}
+
+	return 0
+}
+
+func (d *decoder) longlong() uint64 {
+	if b := d.next(8); b != nil {
+		return binary.BigEndian.Uint64(b)
+	}
+
+	return 0
+}
+
+func (d *decoder) shortstr() string {
+	return string(d.next(int(d.octet())))
+}
+
+func (d *decoder) longstr() string {
+	return string(d.next(int(d.long())))
+}
+
+type frame struct {
+	typ     uint8
+	channel uint16
+	payload []byte
+}
+
+type conn struct {
+	nc       net.Conn
+	r        *bufio.Reader
+	w        *bufio.Writer
+	timeout  time.Duration
+	frameMax uint32
+}
+
+type connectOptions struct {
+	Username    string
+	Password    string
+	VirtualHost string
+	Product     string
+	Version     string
+}
+
+func dial(addr string, opts connectOptions, timeout time.Duration) (*conn, error) {
+	nc, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to amqp broker %s: %w", addr, err)
+	}
+
+	c := &conn{
+		nc:       nc,
+		r:        bufio.NewReader(nc),
+		w:        bufio.NewWriter(nc),
+		timeout:  timeout,
+		frameMax: DEFAULT_FRAME_MAX,
+	}
+
+	if err := c.open(opts); err != nil {
+		nc.Close()
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// open negotiates the connection and opens the channel used to publish.
+func (c *conn) open(opts connectOptions) error {
+	c.nc.SetDeadline(time.Now().Add(c.timeout))
+	c.w.Write(protocolHeader)
+	if err := c.w.Flush(); err != nil {
+		return fmt.Errorf("error sending to amqp broker: %w", err)
+	}
+
+	if _, err := c.expect(connectionStart); err != nil {
+		return err
+	}
+
+	args := &encoder{}
+	args.table([][2]string{
+		{"product", opts.Product},
+		{"version", opts.Version},
+		{"platform", "Go"},
+	})
+	args.shortstr("PLAIN")
+	args.longstr("\x00" + opts.Username + "\x00" + opts.Password)
+	args.shortstr("en_US")
+	c.writeMethod(0, connectionStartOk, args.Bytes())
+	if err := c.w.Flush(); err != nil {
+		return fmt.Errorf("error sending to amqp broker: %w", err)
+	}
+
+	tune, err := c.expect(connectionTune)
+	if err != nil {
+		return err
+	}
+
+	channelMax := tune.short()
+	if frameMax := tune.long(); frameMax > 0 && frameMax < c.frameMax {
+		c.frameMax = frameMax
+	}
+
+	// heartbeats stay disabled, the connection is only used while reporting
+	args = &encoder{}
+	args.short(channelMax)
+	args.long(c.frameMax)
+	args.short(0)
+	c.writeMethod(0, connectionTuneOk, args.Bytes())
+
+	args = &encoder{}
+	args.shortstr(opts.VirtualHost)
+	args.shortstr("")
+	args.octet(0)
+	c.writeMethod(0, connectionOpen, args.Bytes())
+	if err := c.w.Flush(); err != nil {
+		return fmt.Errorf("error sending to amqp broker: %w", err)
+	}
+
+	if _, err := c.expect(connectionOpenOk); err != nil {
+		return err
+	}
+
+	args = &encoder{}
+	args.shortstr("")
+	c.writeMethod(channelID, channelOpen, args.Bytes())
+	if err := c.w.Flush(); err != nil {
+		return fmt.Errorf("error sending to amqp broker: %w", err)
+	}
+
+	_, err = c.expect(channelOpenOk)
+	return err
+}
+
+func (c *conn) confirmSelect() error {
+	c.writeMethod(channelID, confirmSelect, []byte{0})
+	if err := c.w.Flush(); err != nil {
+		return fmt.Errorf("error sending to amqp broker: %w", err)
+	}
+
+	_, err := c.expect(confirmSelectOk)
+	return err
+}
+
+type publishing struct {
+	exchange   string
+	routingKey string
+	mandatory  bool
+	persistent bool
+	messageID  string
+	eventType  string
+	timestamp  int64
+	headers    [][2]string
+	body       []byte
+}
+
+// publish buffers a message, it's sent with the next flush.
+func (c *conn) publish(p *publishing) {
+	args := &encoder{}
+	args.short(0)
+	args.shortstr(p.exchange)
+	args.shortstr(p.routingKey)
+	if p.mandatory {
+		args.octet(1)
+	} else {
+		args.octet(0)
+	}
+
+	c.writeMethod(channelID, basicPublish, args.Bytes())
+
+	deliveryMode := uint8(1)
+	if p.persistent {
+		deliveryMode = 2
+	}
+
+	header := &encoder{}
+	header.short(classBasic)
+	header.short(0)
+	header.longlong(uint64(len(p.body)))
+	header.short(flagContentType | flagHeaders | flagDeliveryMode | flagMessageID | flagTimestamp | flagType | flagAppID)
+	header.shortstr("application/json")
+	header.table(p.headers)
+	header.octet(deliveryMode)
+	header.shortstr(p.messageID)
+	header.longlong(uint64(p.timestamp))
+	header.shortstr(p.eventType)
+	header.shortstr("cmeter")
+	c.writeFrame(frameHeader, channelID, header.Bytes())
+
+	// frames carry 8 bytes besides their payload
+	max := int(c.frameMax) - 8
+	for body := p.body; len(body) > 0; {
+		n := len(body)
+		if n > max {
+			n = max
+		}
+
+		c.writeFrame(frameBody, channelID, body[:n])
+		body = body[n:]
+	}
+}
+
+func (c *conn) flush() error {
+	c.nc.SetDeadline(time.Now().Add(c.timeout))
+	if err := c.w.Flush(); err != nil {
+		return fmt.Errorf("error sending to amqp broker: %w", err)
+	}
+
+	return nil
+}
+
+func (c *conn) writeFrame(typ uint8, channel uint16, payload []byte) {
+	header := &encoder{}
+	header.octet(typ)
+	header.short(channel)
+	header.long(uint32(len(payload)))
+	c.w.Write(header.Bytes())
+	c.w.Write(payload)
+	c.w.WriteByte(frameEnd)
+}
+
+func (c *conn) writeMethod(channel uint16, m method, args []byte) {
+	payload := &encoder{}
+	payload.short(m.class)
+	payload.short(m.id)
+	payload.Write(args)
+	c.writeFrame(frameMethod, channel, payload.Bytes())
+}
+
+func (c *conn) readFrame() (*frame, error) {
+	var header [7]byte
+	if _, err := io.ReadFull(c.r, header[:]); err != nil {
+		return nil, fmt.Errorf("error reading from amqp broker: %w", err)
+	}
+
+	f := &frame{
+		typ:     header[0],
+		channel: binary.BigEndian.Uint16(header[1:3]),
+		payload: make([]byte, binary.BigEndian.Uint32(header[3:7])+1),
+	}
+
+	if _, err := io.ReadFull(c.r, f.payload); err != nil {
+		return nil, fmt.Errorf("error reading from amqp broker: %w", err)
+	}
+
+	if f.payload[len(f.payload)-1] != frameEnd {
+		return nil, errUnexpectedFrame
+	}
+
+	f.payload = f.payload[:len(f.payload)-1]
+	return f, nil
+}
+
+// readMethod reads the next method frame, skipping heartbeats. Exceptions
+// raised by the broker are returned as an *Error.
+func (c *conn) readMethod() (method, *decoder, error) {
+	for {
+		f, err := c.readFrame()
+		if err != nil {
+			return method{}, nil, err
+		}
+
+		if f.typ == frameHeartbeat {
+			continue
+		}
+
+		if f.typ != frameMethod {
+			return method{}, nil, errUnexpectedFrame
+		}
+
+		d := &decoder{buf: f.payload}
+		m := method{d.short(), d.short()}
+		if m == connectionClose || m == channelClose {
+			code := d.short()
+			text := d.shortstr()
+			if m == connectionClose {
+				c.writeMethod(0, connectionCloseOk, nil)
+			} else {
+				c.writeMethod(f.channel, channelCloseOk, nil)
+			}
+
+			c.w.Flush()
+			return m, nil, &Error{Code: int(code), Text: text}
+		}
+
+		return m, d, d.err
+	}
+}
+
+func (c *conn) expect(expected method) (*decoder, error) {
+	m, d, err := c.readMethod()
+	if err != nil {
+		return nil, err
+	}
+
+	if m != expected {
+		return nil, fmt.Errorf("amqp: expected method %d.%d, got %d.%d", expected.class, expected.id, m.class, m.id)
+	}
+
+	return d, nil
+}
+
+// returnedMessageID reads the content header following a basic.return and
+// returns the message id of the returned message. The body is skipped.
+func (c *conn) returnedMessageID() (string, error) {
+	f, err := c.readFrame()
+	if err != nil {
+		return "", err
+	}
+
+	if f.typ != frameHeader {
+		return "", errUnexpectedFrame
+	}
+
+	d := &decoder{buf: f.payload}
+	d.short() // class
+	d.short() // weight
+	remaining := d.longlong()
+	flags := d.short()
+	id := ""
+	if flags&flagContentType != 0 {
+		d.shortstr()
+	}
+
+	if flags&(1<<14) != 0 {
+		d.shortstr() // content encoding
+	}
+
+	if flags&flagHeaders != 0 {
+		d.next(int(d.long()))
+	}
+
+	if flags&flagDeliveryMode != 0 {
+		d.octet()
+	}
+
+	if flags&(1<<11) != 0 {
+		d.octet() // priority
+	}
+
+	for _, flag := range []uint16{1 << 10, 1 << 9, 1 << 8} {
+		if flags&flag != 0 {
+			d.shortstr() // correlation id, reply to, expiration
+		}
+	}
+
+	if flags&flagMessageID != 0 {
+		id = d.shortstr()
+	}
+
+	for remaining > 0 {
+		f, err := c.readFrame()
+		if err != nil {
+			return "", err
+		}
+
+		if f.typ != frameBody || uint64(len(f.payload)) > remaining {
+			return "", errUnexpectedFrame
+		}
+
+		remaining -= uint64(len(f.payload))
+	}
+
+	return id, d.err
+}
+
+func (c *conn) Close() error {
+	c.nc.SetDeadline(time.Now().Add(c.timeout))
+	args := &encoder{}
+	args.short(200)
+	args.shortstr("goodbye")
+	args.short(0)
+	args.short(0)
+	c.writeMethod(0, connectionClose, args.Bytes())
+	c.w.Flush()
+	return c.nc.Close()
+}
@@ -0,0 +1,387 @@
+package amqp
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/MustWin/cmeter/collector"
+	"github.com/MustWin/cmeter/context"
+	"github.com/MustWin/cmeter/reporting"
+	"github.com/MustWin/cmeter/reporting/reportingtest"
+)
+
+type message struct {
+	exchange     string
+	routingKey   string
+	mandatory    bool
+	contentType  string
+	headers      []byte
+	deliveryMode uint8
+	messageID    string
+	body         []byte
+}
+
+// broker is an AMQP broker speaking just enough of the protocol for the
+// driver. It confirms every message once confirms are selected, unless
+// nack returns true for it, and returns mandatory messages for which
+// unroutable returns true.
+type broker struct {
+	l        net.Listener
+	frameMax uint32
+
+	mutex      sync.Mutex
+	logins     []string
+	vhosts     []string
+	confirms   int
+	messages   []*message
+	nack       func(m *message) bool
+	unroutable func(m *message) bool
+}
+
+func newBroker(t *testing.T) *broker {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b := &broker{l: l, frameMax: 4096}
+	go func() {
+		for {
+			nc, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			go b.serve(nc)
+		}
+	}()
+
+	return b
+}
+
+func (b *broker) url(path string) string {
+	return "amqp://agent:secret@" + b.l.Addr().String() + path
+}
+
+func (b *broker) Close() {
+	b.l.Close()
+}
+
+func (b *broker) received() []*message {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return append([]*message(nil), b.messages...)
+}
+
+// expect reads the next method, failing on any other.
+func expect(c *conn, expected method) *decoder {
+	m, d, err := c.readMethod()
+	if err != nil || m != expected {
+		return nil
+	}
+
+	return d
+}
+
+func (b *broker) serve(nc net.Conn) {
+	defer nc.Close()
+
+	c := &conn{nc: nc, r: bufio.NewReader(nc), w: bufio.NewWriter(nc), timeout: time.Second, frameMax: b.frameMax}
+	header := make([]byte, len(protocolHeader))
+	if _, err := io.ReadFull(c.r, header); err != nil || !bytes.Equal(header, protocolHeader) {
+		return
+	}
+
+	args := &encoder{}
+	args.octet(0)
+	args.octet(9)
+	args.table(nil)
+	args.longstr("PLAIN")
+	args.longstr("en_US")
+	c.writeMethod(0, connectionStart, args.Bytes())
+	c.w.Flush()
+
+	d := expect(c, connectionStartOk)
+	if d == nil {
+		return
+	}
+
+	d.next(int(d.long())) // client properties
+	d.shortstr()          // mechanism
+	login := d.longstr()
+
+	args = &encoder{}
+	args.short(1)
+	args.long(b.frameMax)
+	args.short(0)
+	c.writeMethod(0, connectionTune, args.Bytes())
+	c.w.Flush()
+
+	if expect(c, connectionTuneOk) == nil {
+		return
+	}
+
+	if d = expect(c, connectionOpen); d == nil {
+		return
+	}
+
+	b.mutex.Lock()
+	b.logins = append(b.logins, login)
+	b.vhosts = append(b.vhosts, d.shortstr())
+	b.mutex.Unlock()
+
+	c.writeMethod(0, connectionOpenOk, []byte{0})
+	c.w.Flush()
+	if expect(c, channelOpen) == nil {
+		return
+	}
+
+	c.writeMethod(channelID, channelOpenOk, []byte{0, 0, 0, 0})
+	c.w.Flush()
+
+	confirming := false
+	tag := uint64(0)
+	for {
+		m, d, err := c.readMethod()
+		if err != nil {
+			return
+		}
+
+		switch m {
+		case confirmSelect:
+			confirming = true
+			b.mutex.Lock()
+			b.confirms++
+			b.mutex.Unlock()
+			c.writeMethod(channelID, confirmSelectOk, nil)
+		case basicPublish:
+			d.short()
+			msg := &message{exchange: d.shortstr(), routingKey: d.shortstr(), mandatory: d.octet()&1 != 0}
+			if !readContent(c, msg) {
+				return
+			}
+
+			b.mutex.Lock()
+			b.messages = append(b.messages, msg)
+			nack := b.nack != nil && b.nack(msg)
+			unroutable := msg.mandatory && b.unroutable != nil && b.unroutable(msg)
+			b.mutex.Unlock()
+
+			if !confirming {
+				continue
+			}
+
+			if unroutable {
+				args := &encoder{}
+				args.short(312)
+				args.shortstr("NO_ROUTE")
+				args.shortstr(msg.exchange)
+				args.shortstr(msg.routingKey)
+				c.writeMethod(channelID, basicReturn, args.Bytes())
+
+				header := &encoder{}
+				header.short(classBasic)
+				header.short(0)
+				header.longlong(uint64(len(msg.body)))
+				header.short(flagMessageID)
+				header.shortstr(msg.messageID)
+				c.writeFrame(frameHeader, channelID, header.Bytes())
+				c.writeFrame(frameBody, channelID, msg.body)
+			}
+
+			tag++
+			args := &encoder{}
+			args.longlong(tag)
+			args.octet(0)
+			if nack {
+				c.writeMethod(channelID, basicNack, args.Bytes())
+			} else {
+				c.writeMethod(channelID, basicAck, args.Bytes())
+			}
+		case connectionClose:
+			c.writeMethod(0, connectionCloseOk, nil)
+			c.w.Flush()
+			return
+		}
+
+		c.w.Flush()
+	}
+}
+
+// readContent reads the content header and body frames of a publication.
+func readContent(c *conn, msg *message) bool {
+	f, err := c.readFrame()
+	if err != nil || f.typ != frameHeader {
+		return false
+	}
+
+	d := &decoder{buf: f.payload}
+	d.short() // class
+	d.short() // weight
+	size := d.longlong()
+	if d.short() != flagContentType|flagHeaders|flagDeliveryMode|flagMessageID|flagTimestamp|flagType|flagAppID {
+		return false
+	}
+
+	msg.contentType = d.shortstr()
+	msg.headers = d.next(int(d.long()))
+	msg.deliveryMode = d.octet()
+	msg.messageID = d.shortstr()
+	for uint64(len(msg.body)) < size {
+		f, err := c.readFrame()
+		if err != nil || f.typ != frameBody || len(f.payload)+8 > int(c.frameMax) {
+			return false
+		}
+
+		msg.body = append(msg.body, f.payload...)
+	}
+
+	return d.err == nil
+}
+
+func events(names ...string) []*reporting.Event {
+	events := make([]*reporting.Event, len(names))
+	for i, name := range names {
+		events[i] = reportingtest.ContainerSample(name, int64(i+1))
+	}
+
+	return events
+}
+
+func TestPublishConfirmed(t *testing.T) {
+	b := newBroker(t)
+	defer b.Close()
+
+	d := reportingtest.NewDriver(t, &driverFactory{}, map[string]interface{}{
+		"url":         b.url("/metering"),
+		"exchange":    "usage",
+		"routing_key": "cmeter.{event_type}.{label:tenant}",
+	})
+
+	defer reporting.Close(d)
+
+	// bodies larger than the broker's frame size are split
+	large := events("web", "db")
+	large[1].Data.(*collector.Sample).Container.Labels = map[string]string{
+		"tenant": "acme",
+		"notes":  strings.Repeat("x", 10000),
+	}
+
+	receipts, err := d.(reporting.BatchDriver).ReportBatch(context.Background(), large)
+	if err != nil || len(receipts) != 2 {
+		t.Fatalf("expected 2 confirmed events, got %v and %v", receipts, err)
+	}
+
+	messages := b.received()
+	if len(messages) != 2 {
+		t.Fatalf("expected 2 messages, got %d", len(messages))
+	}
+
+	for i, msg := range messages {
+		blob, _ := json.Marshal(large[i])
+		if !bytes.Equal(msg.body, blob) {
+			t.Fatalf("expected message %d to hold the event JSON, got %d bytes", i, len(msg.body))
+		}
+
+		if msg.messageID != string(receipts[i]) || msg.exchange != "usage" || !msg.mandatory || msg.deliveryMode != 2 || msg.contentType != "application/json" {
+			t.Fatalf("expected a persistent mandatory message with the receipt as its id, got %+v", msg)
+		}
+
+		if !bytes.Contains(msg.headers, []byte("meter_id")) {
+			t.Fatalf("expected a meter_id header, got %q", msg.headers)
+		}
+	}
+
+	if messages[0].routingKey != "cmeter.usage_sample.none" || messages[1].routingKey != "cmeter.usage_sample.acme" {
+		t.Fatalf("expected routing keys from the template, got %s and %s", messages[0].routingKey, messages[1].routingKey)
+	}
+
+	if b.logins[0] != "\x00agent\x00secret" || b.vhosts[0] != "metering" {
+		t.Fatalf("expected the url's credentials and vhost, got %q and %q", b.logins[0], b.vhosts[0])
+	}
+}
+
+func TestRejectedMessages(t *testing.T) {
+	b := newBroker(t)
+	defer b.Close()
+
+	b.mutex.Lock()
+	b.nack = func(m *message) bool { return bytes.Contains(m.body, []byte(`"name":"db"`)) }
+	b.unroutable = func(m *message) bool { return bytes.Contains(m.body, []byte(`"name":"cache"`)) }
+	b.mutex.Unlock()
+
+	d := reportingtest.NewDriver(t, &driverFactory{}, map[string]interface{}{"url": b.url("/")})
+	defer reporting.Close(d)
+
+	// events up to the first rejected one are delivered
+	batch := d.(reporting.BatchDriver)
+	receipts, err := batch.ReportBatch(context.Background(), events("web", "db", "web"))
+	if err != ErrNacked || len(receipts) != 1 {
+		t.Fatalf("expected the first event delivered and %v, got %v and %v", ErrNacked, receipts, err)
+	}
+
+	receipts, err = batch.ReportBatch(context.Background(), events("web", "cache"))
+	if _, ok := err.(returnError); !ok || len(receipts) != 1 {
+		t.Fatalf("expected the unroutable event to be returned, got %v and %v", receipts, err)
+	}
+
+	// rejections keep the connection
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if len(b.logins) != 1 {
+		t.Fatalf("expected a single connection, got %d", len(b.logins))
+	}
+}
+
+func TestWithoutConfirms(t *testing.T) {
+	b := newBroker(t)
+	defer b.Close()
+
+	b.mutex.Lock()
+	b.nack = func(*message) bool { return true }
+	b.mutex.Unlock()
+
+	d := reportingtest.NewDriver(t, &driverFactory{}, map[string]interface{}{
+		"url":        b.url(""),
+		"confirm":    false,
+		"persistent": false,
+	})
+
+	if receipt, err := d.Report(context.Background(), events("web")[0]); err != nil || receipt != reporting.EmptyReceipt {
+		t.Fatalf("expected an empty receipt, got %q and %v", receipt, err)
+	}
+
+	// the broker handled the message by the time the connection is closed
+	reporting.Close(d)
+	for deadline := time.Now().Add(5 * time.Second); len(b.received()) == 0; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the message to be published")
+		}
+	}
+
+	msg := b.received()[0]
+	if msg.mandatory || msg.deliveryMode != 1 {
+		t.Fatalf("expected a transient message that isn't mandatory, got %+v", msg)
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.confirms != 0 || b.vhosts[0] != "/" {
+		t.Fatalf("expected the default vhost without confirms, got %q and %d", b.vhosts[0], b.confirms)
+	}
+}
+
+func TestInvalidURL(t *testing.T) {
+	for _, u := range []string{"http://127.0.0.1:5672", "amqp://", "://"} {
+		if _, err := (&driverFactory{}).Create(map[string]interface{}{"url": u}); err != ErrInvalidURL {
+			t.Errorf("expected %v for %s, got %v", ErrInvalidURL, u, err)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package bus
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/MustWin/cmeter/collector"
+	"github.com/MustWin/cmeter/containers"
+	"github.com/MustWin/cmeter/reporting"
+)
+
+const (
+	DEFAULT_MISSING_VALUE = "none"
+
+	LABEL_PREFIX = "label:"
+)
+
+var (
+	placeholderPattern = regexp.MustCompile(`\{([^{}]*)\}`)
+	invalidTokenChars  = regexp.MustCompile(`[^a-zA-Z0-9_-]`)
+
+	fields = map[string]bool{
+		"event_type": true,
+		"meter_id":   true,
+		"container":  true,
+		"image":      true,
+		"machine":    true,
+		"state":      true,
+	}
+)
+
+// Template builds subjects or routing keys for events, e.g:
+// `cmeter.sample.{label:tenant}`. Placeholders are `{event_type}`,
+// `{meter_id}`, `{container}`, `{image}`, `{machine}`, `{state}` and
+// `{label:<name>}` for container labels. Substituted values are restricted
+// to letters, digits, `_` and `-` so they can't add tokens or wildcards;
+// missing values are replaced with Missing.
+type Template struct {
+	Text    string
+	Missing string
+}
+
+func ParseTemplate(text string) (*Template, error) {
+	if text == "" {
+		return nil, fmt.Errorf("empty template")
+	}
+
+	for _, m := range placeholderPattern.FindAllStringSubmatch(text, -1) {
+		name := m[1]
+		if strings.HasPrefix(name, LABEL_PREFIX) && len(name) > len(LABEL_PREFIX) {
+			continue
+		}
+
+		if !fields[name] {
+			return nil, fmt.Errorf("unknown template placeholder %q", m[0])
+		}
+	}
+
+	return &Template{
+		Text:    text,
+		Missing: DEFAULT_MISSING_VALUE,
+	}, nil
+}
+
+func (t *Template) Execute(e *reporting.Event) string {
+	return placeholderPattern.ReplaceAllStringFunc(t.Text, func(placeholder string) string {
+		v := value(e, placeholder[1:len(placeholder)-1])
+		v = invalidTokenChars.ReplaceAllString(strings.Trim(v, "/"), "_")
+		if v == "" {
+			return t.Missing
+		}
+
+		return v
+	})
+}
+
+func value(e *reporting.Event, name string) string {
+	var info *containers.ContainerInfo
+	var machine *containers.MachineInfo
+	state := ""
+	switch data := e.Data.(type) {
+	case *collector.Sample:
+		info = data.Container
+	case *containers.StateChange:
+		info = data.Container
+		state = string(data.State)
+	case *collector.MachineSample:
+		machine = data.Machine
+	}
+
+	if info != nil {
+		machine = info.Machine
+	}
+
+	switch {
+	case name == "event_type":
+		return e.Type
+	case name == "meter_id":
+		return e.MeterID
+	case name == "state":
+		return state
+	case name == "machine":
+		if machine != nil {
+			return machine.SystemUuid
+		}
+	case info == nil:
+	case name == "container":
+		return info.Name
+	case name == "image":
+		return info.ImageName
+	case strings.HasPrefix(name, LABEL_PREFIX):
+		return info.Labels[strings.TrimPrefix(name, LABEL_PREFIX)]
+	}
+
+	return ""
+}
@@ -1,33 +1,102 @@
 package ctoll
 
 import (
+	"errors"
 	"fmt"
-	"net/http"
+	"io"
+	"strings"
+	"sync"
 
 	ctollclient "github.com/MustWin/ctoll/ctoll/api/client"
 	"github.com/MustWin/ctoll/ctoll/api/v1"
 
 	"github.com/MustWin/cmeter/collector"
+	"github.com/MustWin/cmeter/configuration"
 	"github.com/MustWin/cmeter/containers"
 	"github.com/MustWin/cmeter/context"
 	"github.com/MustWin/cmeter/reporting"
 	"github.com/MustWin/cmeter/reporting/factory"
+	"github.com/MustWin/cmeter/reporting/transport"
+)
+
+const (
+	MISSING_KEY_DEFAULT = "default"
+	MISSING_KEY_DROP    = "drop"
+	MISSING_KEY_HOLD    = "hold"
+
+	// TODO: default to whatever public url ctoll eventually gets
+	DEFAULT_ENDPOINT = "http://localhost:9180"
+)
+
+var (
+	ErrInvalidMissingKey = errors.New("invalid missing_key, must be `default`, `drop` or `hold`")
+	ErrMissingDefaultKey = errors.New("missing_key `default` requires an `apikey`")
 )
 
 type driverFactory struct{}
 
+func (factory *driverFactory) Schema() configuration.Schema {
+	params := []configuration.Parameter{
+		{Name: "endpoint", Type: configuration.TypeString, Default: DEFAULT_ENDPOINT, Description: "ctoll api url"},
+		{Name: "apikey", Type: configuration.TypeString, Description: "default api key, used when no key source resolves one"},
+		{Name: "key_sources", Type: configuration.TypeStringList, Values: []string{KEY_SOURCE_LABEL, KEY_SOURCE_ENV, KEY_SOURCE_MAPPING, KEY_SOURCE_SECRETS_DIR}, Description: "where the api key of a container comes from, tried in order, defaults to every configured source"},
+		{Name: "key_label", Type: configuration.TypeString, Description: "label with the api key of the container"},
+		{Name: "key_env", Type: configuration.TypeString, Description: "container environment variable with the api key"},
+		{Name: "tenant_label", Type: configuration.TypeString, Description: "label naming the tenant for the `mapping` and `secrets_dir` sources"},
+		{Name: "key_mapping_file", Type: configuration.TypeString, Description: "YAML file mapping tenants to api keys"},
+		{Name: "key_secrets_dir", Type: configuration.TypeString, Description: "directory with a file per tenant holding its api key"},
+		{Name: "missing_key", Type: configuration.TypeString, Values: []string{MISSING_KEY_DEFAULT, MISSING_KEY_DROP, MISSING_KEY_HOLD}, Description: "what happens to events without a key, defaults to `default` with an `apikey` and to `drop` without one"},
+	}
+
+	return configuration.Schema{
+		Description: "Reports usage to ctoll, with the api keys of the containers.",
+		Parameters:  append(params, transport.ClientParameters...),
+	}
+}
+
 func (factory *driverFactory) Create(parameters map[string]interface{}) (reporting.Driver, error) {
 	endpoint, ok := parameters["endpoint"].(string)
 	if !ok || endpoint == "" {
-		// TODO: default to whatever public url ctoll eventually gets
-		endpoint = "http://localhost:9180"
+		endpoint = DEFAULT_ENDPOINT
 	}
 
 	apiKey, _ := parameters["apikey"].(string)
-	keyLabel, _ := parameters["key_label"].(string)
+	params := configuration.Parameters(parameters)
+	resolvers, err := newKeyResolvers(params)
+	if err != nil {
+		return nil, err
+	}
+
+	// without a default key, events without one are dropped instead of
+	// being sent without a key
+	missingKey := MISSING_KEY_DROP
+	if apiKey != "" {
+		missingKey = MISSING_KEY_DEFAULT
+	}
+
+	missingKey = strings.ToLower(params.String("missing_key", missingKey))
+	switch missingKey {
+	case MISSING_KEY_DEFAULT:
+		if apiKey == "" {
+			return nil, ErrMissingDefaultKey
+		}
+	case MISSING_KEY_DROP, MISSING_KEY_HOLD:
+	default:
+		return nil, ErrInvalidMissingKey
+	}
+
+	httpClient, closer, err := transport.NewClient(parameters)
+	if err != nil {
+		return nil, err
+	}
+
 	return &Driver{
-		keyLabel: keyLabel,
-		client:   ctollclient.New(endpoint, apiKey, http.DefaultClient),
+		resolvers:  resolvers,
+		defaultKey: apiKey,
+		missingKey: missingKey,
+		client:     ctollclient.New(endpoint, apiKey, httpClient),
+		closer:     closer,
+		reported:   make(map[string]bool),
 	}, nil
 }
 
@@ -86,32 +155,162 @@ func calculateMachineUsage(u *containers.MachineUsage, m *containers.MachineInfo
 }
 
 type Driver struct {
-	keyLabel string
-	client   *ctollclient.Client
+	resolvers []keyResolver
+	// the key used by the `default` missing key policy
+	defaultKey string
+	// what happens to events without a key: `default`, `drop` or `hold`,
+	// held events stay in the spool until their key resolves
+	missingKey string
+	client     *ctollclient.Client
+	closer     io.Closer
+
+	mutex sync.Mutex
+	// owners already reported as missing a key, to log only once
+	reported map[string]bool
 }
 
 func (d *Driver) Report(ctx context.Context, e *reporting.Event) (reporting.Receipt, error) {
-	receiptData, err := d.sendEvent(e)
+	owner, labels, envs := eventOwner(e)
+	key, err := d.resolveKey(labels, envs)
 	if err != nil {
-		err = fmt.Errorf("error sending event: %v", err)
+		return reporting.EmptyReceipt, fmt.Errorf("error resolving api key: %v", err)
+	}
+
+	if key == "" {
+		switch d.missingKey {
+		case MISSING_KEY_DEFAULT:
+			key = d.defaultKey
+		case MISSING_KEY_DROP:
+			if d.reportMissing(owner) {
+				context.GetLogger(ctx).Warnf("dropping events of %q, no api key found", owner)
+			}
+
+			return reporting.EmptyReceipt, nil
+		case MISSING_KEY_HOLD:
+			if d.reportMissing(owner) {
+				context.GetLogger(ctx).Errorf("holding events of %q in the spool until its api key can be resolved", owner)
+			}
+
+			return reporting.EmptyReceipt, reporting.HeldError{Reason: fmt.Sprintf("no api key found for %q", owner)}
+		}
+	} else {
+		d.resolved(ctx, owner)
+	}
+
+	receiptData, err := d.sendEvent(key, e)
+	if err != nil {
+		err = fmt.Errorf("error sending event: %w", err)
 	}
 
 	return reporting.Receipt(string(receiptData)), err
 }
 
-func (d *Driver) apiKeyFromLabel(labels map[string]string) string {
-	if d.keyLabel == "" {
-		return ""
+// ReportBatch reports the events one by one. Held events don't stop the
+// batch, they are listed by the returned HeldError once the others were
+// reported.
+func (d *Driver) ReportBatch(ctx context.Context, events []*reporting.Event) ([]reporting.Receipt, error) {
+	receipts := make([]reporting.Receipt, 0, len(events))
+	var held []int
+	for i, e := range events {
+		receipt, err := d.Report(ctx, e)
+		if err != nil {
+			var heldErr reporting.HeldError
+			if !errors.As(err, &heldErr) {
+				if len(held) == 0 {
+					return receipts, err
+				}
+
+				// the events from here on aren't covered by the receipts
+				// and are reported again along with the held ones
+				context.GetLogger(ctx).Errorf("error reporting event: %v", err)
+				break
+			}
+
+			held = append(held, i)
+		}
+
+		receipts = append(receipts, receipt)
+	}
+
+	if len(held) > 0 {
+		return receipts, reporting.HeldError{
+			Reason: fmt.Sprintf("no api key found for %d of %d events", len(held), len(events)),
+			Held:   held,
+		}
+	}
+
+	return receipts, nil
+}
+
+// eventOwner returns the name, labels and environment of the container, or
+// machine, an event belongs to.
+func eventOwner(e *reporting.Event) (string, map[string]string, map[string]string) {
+	switch data := e.Data.(type) {
+	case *collector.Sample:
+		if data.Container != nil {
+			return data.Container.Name, data.Container.Labels, data.Container.Envs
+		}
+	case *containers.StateChange:
+		if data.Container != nil {
+			return data.Container.Name, data.Container.Labels, data.Container.Envs
+		}
+	case *collector.MachineSample:
+		if data.Machine != nil {
+			return data.Machine.Name, data.Machine.Labels, nil
+		}
+	}
+
+	return "", nil, nil
+}
+
+func (d *Driver) Close() error {
+	if d.closer == nil {
+		return nil
 	}
 
-	if v, ok := labels[d.keyLabel]; ok {
-		return v
+	return d.closer.Close()
+}
+
+// resolveKey tries the resolvers in order, the first key found is used.
+func (d *Driver) resolveKey(labels map[string]string, envs map[string]string) (string, error) {
+	for _, r := range d.resolvers {
+		key, err := r.Resolve(labels, envs)
+		if err != nil || key != "" {
+			return key, err
+		}
+	}
+
+	return "", nil
+}
+
+// reportMissing returns whether the owner's missing key wasn't reported yet.
+func (d *Driver) reportMissing(owner string) bool {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if d.reported[owner] {
+		return false
 	}
 
-	return ""
+	d.reported[owner] = true
+	return true
+}
+
+// resolved clears the owner's missing key, its held events are sent by the
+// next spool replay.
+func (d *Driver) resolved(ctx context.Context, owner string) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if d.reported[owner] {
+		delete(d.reported, owner)
+		if d.missingKey == MISSING_KEY_HOLD {
+			context.GetLogger(ctx).Infof("api key of %q resolved, its held events are sent with the next spool replay", owner)
+		}
+	}
 }
 
-func (d *Driver) sendMeterStart(me *v1.MeterEvent, ch *containers.StateChange) ([]byte, error) {
+func (d *Driver) sendMeterStart(key string, me *v1.MeterEvent, ch *containers.StateChange) ([]byte, error) {
 	me.Type = v1.MeterEventTypeStart
 
 	e := v1.StartMeterEvent{
@@ -123,20 +322,18 @@ func (d *Driver) sendMeterStart(me *v1.MeterEvent, ch *containers.StateChange) (
 		},
 	}
 
-	key := d.apiKeyFromLabel(ch.Container.Labels)
 	return []byte{}, d.client.MeterEvents().SendStartMeter(key, e)
 }
 
-func (d *Driver) sendMeterStop(me *v1.MeterEvent, ch *containers.StateChange) ([]byte, error) {
+func (d *Driver) sendMeterStop(key string, me *v1.MeterEvent, ch *containers.StateChange) ([]byte, error) {
 	me.Type = v1.MeterEventTypeStop
 
 	e := v1.StopMeterEvent{MeterEvent: me}
 	e.Container = convertContainerInfo(ch.Container)
-	key := d.apiKeyFromLabel(ch.Container.Labels)
 	return []byte{}, d.client.MeterEvents().SendStopMeter(key, e)
 }
 
-func (d *Driver) sendMeterSample(me *v1.MeterEvent, s *collector.Sample) ([]byte, error) {
+func (d *Driver) sendMeterSample(key string, me *v1.MeterEvent, s *collector.Sample) ([]byte, error) {
 	me.Type = v1.MeterEventTypeSample
 
 	e := v1.SampleMeterEvent{
@@ -145,11 +342,10 @@ func (d *Driver) sendMeterSample(me *v1.MeterEvent, s *collector.Sample) ([]byte
 		Container:  convertContainerInfo(s.Container),
 	}
 
-	key := d.apiKeyFromLabel(s.Container.Labels)
 	return []byte{}, d.client.MeterEvents().SendUsageSample(key, e)
 }
 
-func (d *Driver) sendMeterMachineSample(me *v1.MeterEvent, s *collector.MachineSample) ([]byte, error) {
+func (d *Driver) sendMeterMachineSample(key string, me *v1.MeterEvent, s *collector.MachineSample) ([]byte, error) {
 	me.Type = v1.MeterEventTypeMachineSample
 
 	e := v1.MachineSampleMeterEvent{
@@ -158,11 +354,10 @@ func (d *Driver) sendMeterMachineSample(me *v1.MeterEvent, s *collector.MachineS
 		Usage:      calculateMachineUsage(s.Usage, s.Machine),
 	}
 
-	key := d.apiKeyFromLabel(s.Machine.Labels)
 	return []byte{}, d.client.MeterEvents().SendMachineUsageSample(key, e)
 }
 
-func (d *Driver) sendEvent(e *reporting.Event) ([]byte, error) {
+func (d *Driver) sendEvent(key string, e *reporting.Event) ([]byte, error) {
 	me := &v1.MeterEvent{
 		MeterID:   e.MeterID,
 		Timestamp: e.Timestamp,
@@ -172,16 +367,16 @@ func (d *Driver) sendEvent(e *reporting.Event) ([]byte, error) {
 	case reporting.EventStateChange:
 		ch := e.Data.(*containers.StateChange)
 		if ch.State == containers.StateRunning {
-			return d.sendMeterStart(me, ch)
+			return d.sendMeterStart(key, me, ch)
 		} else {
-			return d.sendMeterStop(me, ch)
+			return d.sendMeterStop(key, me, ch)
 		}
 
 	case reporting.EventSample:
-		return d.sendMeterSample(me, e.Data.(*collector.Sample))
+		return d.sendMeterSample(key, me, e.Data.(*collector.Sample))
 
 	case reporting.EventMachineSample:
-		return d.sendMeterMachineSample(me, e.Data.(*collector.MachineSample))
+		return d.sendMeterMachineSample(key, me, e.Data.(*collector.MachineSample))
 	}
 
 	return []byte{}, fmt.Errorf("unsupported event type %q", e.Type)
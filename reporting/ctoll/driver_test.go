@@ -0,0 +1,213 @@
+package ctoll
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/MustWin/cmeter/collector"
+	"github.com/MustWin/cmeter/containers"
+	"github.com/MustWin/cmeter/context"
+	"github.com/MustWin/cmeter/reporting"
+	"github.com/MustWin/cmeter/reporting/reportingtest"
+)
+
+// meterServer records the api keys of the meter events it receives.
+type meterServer struct {
+	*httptest.Server
+
+	mutex sync.Mutex
+	keys  []string
+}
+
+func newMeterServer() *meterServer {
+	s := &meterServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/v1/meter/events" {
+			http.NotFound(w, r)
+			return
+		}
+
+		s.mutex.Lock()
+		s.keys = append(s.keys, r.Header.Get("CTOLL-API-KEY"))
+		s.mutex.Unlock()
+	}))
+
+	return s
+}
+
+func (s *meterServer) received() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]string(nil), s.keys...)
+}
+
+func tenantSample(tenant string) *reporting.Event {
+	return &reporting.Event{
+		MeterID:   "meter",
+		Type:      reporting.EventSample,
+		Timestamp: 1,
+		Data: &collector.Sample{
+			Timestamp: 1,
+			Container: &containers.ContainerInfo{
+				Name:    "web",
+				Labels:  map[string]string{"tenant": tenant},
+				Machine: &containers.MachineInfo{SystemUuid: "machine", Cores: 2},
+			},
+			Usage: &containers.Usage{
+				Cpu:     &containers.CpuUsage{Total: 1000},
+				Memory:  &containers.MemoryUsage{Bytes: 1024},
+				Network: &containers.NetworkUsage{},
+				Disk:    &containers.DiskUsage{},
+			},
+		},
+	}
+}
+
+func newTestDriver(t *testing.T, endpoint string, missingKey string, secretsDir string) reporting.Driver {
+	return reportingtest.NewDriver(t, &driverFactory{}, map[string]interface{}{
+		"endpoint":        endpoint,
+		"key_sources":     []interface{}{KEY_SOURCE_SECRETS_DIR},
+		"tenant_label":    "tenant",
+		"key_secrets_dir": secretsDir,
+		"missing_key":     missingKey,
+	})
+}
+
+func TestHoldUntilKeyResolves(t *testing.T) {
+	server := newMeterServer()
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "ctoll-keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	d := newTestDriver(t, server.URL, MISSING_KEY_HOLD, dir)
+	defer reporting.Close(d)
+
+	ctx := context.Background()
+	e := tenantSample("acme")
+
+	// held events fail, so the agent keeps them in the spool
+	_, err = d.Report(ctx, e)
+	if _, held := err.(reporting.HeldError); !held {
+		t.Fatalf("expected a held error, got %v", err)
+	}
+
+	if keys := server.received(); len(keys) != 0 {
+		t.Fatalf("expected no events sent while the key is missing, got %d", len(keys))
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "acme"), []byte("acme-key\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// a spool replay reports the held event again
+	if _, err := d.Report(ctx, e); err != nil {
+		t.Fatalf("error reporting the event once its key resolved: %v", err)
+	}
+
+	keys := server.received()
+	if len(keys) != 1 || keys[0] != "acme-key" {
+		t.Fatalf("expected the event sent once with key %q, got %q", "acme-key", keys)
+	}
+}
+
+func TestHoldSurvivesDriverReplacement(t *testing.T) {
+	server := newMeterServer()
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "ctoll-keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	// nothing is kept in the driver, a driver created by a reload sends the
+	// events held by the one it replaced
+	previous := newTestDriver(t, server.URL, MISSING_KEY_HOLD, dir)
+	e := tenantSample("acme")
+	if _, err := previous.Report(context.Background(), e); err == nil {
+		t.Fatal("expected the event to be held")
+	}
+
+	reporting.Close(previous)
+	if err := ioutil.WriteFile(filepath.Join(dir, "acme"), []byte("acme-key"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	d := newTestDriver(t, server.URL, MISSING_KEY_HOLD, dir)
+	defer reporting.Close(d)
+	if _, err := d.Report(context.Background(), e); err != nil {
+		t.Fatalf("error reporting the held event: %v", err)
+	}
+
+	if keys := server.received(); len(keys) != 1 {
+		t.Fatalf("expected the held event sent once, got %d", len(keys))
+	}
+}
+
+func TestDropWithoutKey(t *testing.T) {
+	server := newMeterServer()
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "ctoll-keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	d := newTestDriver(t, server.URL, MISSING_KEY_DROP, dir)
+	defer reporting.Close(d)
+	if _, err := d.Report(context.Background(), tenantSample("acme")); err != nil {
+		t.Fatalf("expected dropped events to succeed, got %v", err)
+	}
+
+	if keys := server.received(); len(keys) != 0 {
+		t.Fatalf("expected no events sent, got %d", len(keys))
+	}
+}
+
+func TestBatchSkipsHeldEvents(t *testing.T) {
+	server := newMeterServer()
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "ctoll-keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "acme"), []byte("acme-key"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	d := newTestDriver(t, server.URL, MISSING_KEY_HOLD, dir)
+	defer reporting.Close(d)
+
+	// a held tenant doesn't block the events of the others
+	events := []*reporting.Event{tenantSample("globex"), tenantSample("acme"), tenantSample("globex"), tenantSample("acme")}
+	receipts, err := d.(*Driver).ReportBatch(context.Background(), events)
+	held, ok := err.(reporting.HeldError)
+	if !ok || len(held.Held) != 2 || held.Held[0] != 0 || held.Held[1] != 2 {
+		t.Fatalf("expected the first and third events held, got %v", err)
+	}
+
+	if len(receipts) != len(events) {
+		t.Fatalf("expected receipts covering the batch, got %d", len(receipts))
+	}
+
+	if keys := server.received(); len(keys) != 2 || keys[0] != "acme-key" || keys[1] != "acme-key" {
+		t.Fatalf("expected the events of acme sent, got %q", keys)
+	}
+}
@@ -0,0 +1,203 @@
+package ctoll
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-yaml/yaml"
+
+	"github.com/MustWin/cmeter/configuration"
+)
+
+const (
+	KEY_SOURCE_LABEL       = "label"
+	KEY_SOURCE_ENV         = "env"
+	KEY_SOURCE_MAPPING     = "mapping"
+	KEY_SOURCE_SECRETS_DIR = "secrets_dir"
+)
+
+var ErrMissingTenantLabel = errors.New("the `mapping` and `secrets_dir` key sources require a `tenant_label`")
+
+// keyResolver finds the api key of a container, or machine, from its labels
+// and environment. An empty key means it has none.
+type keyResolver interface {
+	Resolve(labels map[string]string, envs map[string]string) (string, error)
+}
+
+// labelResolver reads the key from a label.
+type labelResolver struct {
+	label string
+}
+
+func (r *labelResolver) Resolve(labels map[string]string, envs map[string]string) (string, error) {
+	return labels[r.label], nil
+}
+
+// envResolver reads the key from an environment variable of the container,
+// the variable must be exposed through the container driver's `envs`.
+type envResolver struct {
+	name string
+}
+
+func (r *envResolver) Resolve(labels map[string]string, envs map[string]string) (string, error) {
+	return envs[r.name], nil
+}
+
+// mappingResolver looks the tenant label's value up in a YAML file mapping
+// tenants to keys. The file is reloaded when it changes.
+type mappingResolver struct {
+	path        string
+	tenantLabel string
+
+	mutex   sync.Mutex
+	modTime time.Time
+	size    int64
+	keys    map[string]string
+}
+
+func (r *mappingResolver) Resolve(labels map[string]string, envs map[string]string) (string, error) {
+	tenant := labels[r.tenantLabel]
+	if tenant == "" {
+		return "", nil
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if err := r.load(); err != nil {
+		return "", err
+	}
+
+	return r.keys[tenant], nil
+}
+
+func (r *mappingResolver) load() error {
+	info, err := os.Stat(r.path)
+	if err != nil {
+		return fmt.Errorf("error reading key mapping: %v", err)
+	}
+
+	if r.keys != nil && info.ModTime().Equal(r.modTime) && info.Size() == r.size {
+		return nil
+	}
+
+	blob, err := ioutil.ReadFile(r.path)
+	if err != nil {
+		return fmt.Errorf("error reading key mapping: %v", err)
+	}
+
+	keys := make(map[string]string)
+	if err := yaml.Unmarshal(blob, &keys); err != nil {
+		return fmt.Errorf("error parsing key mapping %q: %v", r.path, err)
+	}
+
+	r.keys = keys
+	r.modTime = info.ModTime()
+	r.size = info.Size()
+	return nil
+}
+
+// secretsDirResolver reads the key from the file named after the tenant
+// label's value in a directory, e.g. a mounted Kubernetes secret.
+type secretsDirResolver struct {
+	dir         string
+	tenantLabel string
+}
+
+func (r *secretsDirResolver) Resolve(labels map[string]string, envs map[string]string) (string, error) {
+	tenant := labels[r.tenantLabel]
+	if tenant == "" {
+		return "", nil
+	}
+
+	// tenants name files directly in the directory
+	if strings.ContainsAny(tenant, `/\`) || strings.HasPrefix(tenant, ".") {
+		return "", fmt.Errorf("invalid tenant name %q", tenant)
+	}
+
+	blob, err := ioutil.ReadFile(filepath.Join(r.dir, tenant))
+	if os.IsNotExist(err) {
+		return "", nil
+	} else if err != nil {
+		return "", fmt.Errorf("error reading api key: %v", err)
+	}
+
+	return strings.TrimSpace(string(blob)), nil
+}
+
+// newKeyResolvers creates the resolvers listed in `key_sources`, tried in
+// that order. Without `key_sources` every source with parameters is used,
+// in the order label, env, mapping and secrets_dir.
+func newKeyResolvers(params configuration.Parameters) ([]keyResolver, error) {
+	keyLabel := params.String("key_label", "")
+	keyEnv := params.String("key_env", "")
+	mappingFile := params.String("key_mapping_file", "")
+	secretsDir := params.String("key_secrets_dir", "")
+	tenantLabel := params.String("tenant_label", "")
+
+	sources, err := params.StringList("key_sources")
+	if err != nil {
+		return nil, err
+	}
+
+	if sources == nil {
+		configured := map[string]string{
+			KEY_SOURCE_LABEL:       keyLabel,
+			KEY_SOURCE_ENV:         keyEnv,
+			KEY_SOURCE_MAPPING:     mappingFile,
+			KEY_SOURCE_SECRETS_DIR: secretsDir,
+		}
+
+		for _, source := range []string{KEY_SOURCE_LABEL, KEY_SOURCE_ENV, KEY_SOURCE_MAPPING, KEY_SOURCE_SECRETS_DIR} {
+			if configured[source] != "" {
+				sources = append(sources, source)
+			}
+		}
+	}
+
+	resolvers := make([]keyResolver, 0, len(sources))
+	for _, source := range sources {
+		var missing string
+		source = strings.ToLower(source)
+		switch source {
+		case KEY_SOURCE_LABEL:
+			resolvers = append(resolvers, &labelResolver{label: keyLabel})
+			if keyLabel == "" {
+				missing = "key_label"
+			}
+		case KEY_SOURCE_ENV:
+			resolvers = append(resolvers, &envResolver{name: keyEnv})
+			if keyEnv == "" {
+				missing = "key_env"
+			}
+		case KEY_SOURCE_MAPPING:
+			resolvers = append(resolvers, &mappingResolver{path: mappingFile, tenantLabel: tenantLabel})
+			if mappingFile == "" {
+				missing = "key_mapping_file"
+			}
+		case KEY_SOURCE_SECRETS_DIR:
+			resolvers = append(resolvers, &secretsDirResolver{dir: secretsDir, tenantLabel: tenantLabel})
+			if secretsDir == "" {
+				missing = "key_secrets_dir"
+			}
+		default:
+			return nil, fmt.Errorf("invalid key source %q, must be `label`, `env`, `mapping` or `secrets_dir`", source)
+		}
+
+		if missing != "" {
+			return nil, fmt.Errorf("key source %q requires a `%s`", source, missing)
+		}
+
+		if (source == KEY_SOURCE_MAPPING || source == KEY_SOURCE_SECRETS_DIR) && tenantLabel == "" {
+			return nil, ErrMissingTenantLabel
+		}
+	}
+
+	return resolvers, nil
+}
@@ -0,0 +1,47 @@
+package reporting
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/MustWin/cmeter/collector"
+	"github.com/MustWin/cmeter/containers"
+)
+
+// Decode restores an event from its JSON form, typing the event data
+// according to the event type so drivers can handle it like a fresh event.
+func Decode(blob []byte) (*Event, error) {
+	var raw struct {
+		MeterID   string          `json:"meter_id"`
+		Type      string          `json:"event_type"`
+		Timestamp int64           `json:"timestamp"`
+		Data      json.RawMessage `json:"data"`
+	}
+
+	if err := json.Unmarshal(blob, &raw); err != nil {
+		return nil, err
+	}
+
+	var data interface{}
+	switch raw.Type {
+	case EventSample:
+		data = &collector.Sample{}
+	case EventStateChange:
+		data = &containers.StateChange{}
+	case EventMachineSample:
+		data = &collector.MachineSample{}
+	default:
+		return nil, fmt.Errorf("unsupported event type %q", raw.Type)
+	}
+
+	if err := json.Unmarshal(raw.Data, data); err != nil {
+		return nil, fmt.Errorf("error decoding %s data: %v", raw.Type, err)
+	}
+
+	return &Event{
+		MeterID:   raw.MeterID,
+		Type:      raw.Type,
+		Timestamp: raw.Timestamp,
+		Data:      data,
+	}, nil
+}
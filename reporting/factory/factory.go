@@ -2,8 +2,11 @@ package factory
 
 import (
 	"fmt"
+	"sort"
 
+	"github.com/MustWin/cmeter/configuration"
 	"github.com/MustWin/cmeter/reporting"
+	"github.com/MustWin/cmeter/reporting/retry"
 )
 
 var reportingFactories = make(map[string]ReportingDriverFactory)
@@ -26,12 +29,119 @@ func Register(name string, factory ReportingDriverFactory) {
 
 func Create(name string, parameters map[string]interface{}) (reporting.Driver, error) {
 	if factory, ok := reportingFactories[name]; ok {
-		return factory.Create(parameters)
+		parameters, err := decode(factory, parameters)
+		if err != nil {
+			return nil, err
+		}
+
+		driver, err := factory.Create(parameters)
+		if err != nil {
+			return nil, err
+		}
+
+		wrapped, err := retry.Wrap(driver, parameters)
+		if err != nil {
+			reporting.Close(driver)
+			return nil, err
+		}
+
+		return wrapped, nil
 	}
 
 	return nil, InvalidReportingDriverError{name}
 }
 
+// Describer is implemented by factories describing their drivers'
+// parameters. Their parameters are checked against the schema, completed
+// with its defaults and converted to the declared types before drivers are
+// created.
+type Describer interface {
+	Schema() configuration.Schema
+}
+
+// Names returns the names of the registered drivers.
+func Names() []string {
+	names := make([]string, 0, len(reportingFactories))
+	for name := range reportingFactories {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+// Schema returns the schema of the named driver's parameters, including the
+// retry parameters every driver accepts, and whether the driver describes
+// its parameters.
+func Schema(name string) (configuration.Schema, bool, error) {
+	factory, ok := reportingFactories[name]
+	if !ok {
+		return configuration.Schema{}, false, InvalidReportingDriverError{name}
+	}
+
+	describer, ok := factory.(Describer)
+	if !ok {
+		return configuration.Schema{}, false, nil
+	}
+
+	return withRetry(describer.Schema()), true, nil
+}
+
+func withRetry(schema configuration.Schema) configuration.Schema {
+	params := make([]configuration.Parameter, 0, len(schema.Parameters)+len(retry.Parameters))
+	schema.Parameters = append(append(params, schema.Parameters...), retry.Parameters...)
+	return schema
+}
+
+func decode(factory ReportingDriverFactory, parameters map[string]interface{}) (map[string]interface{}, error) {
+	describer, ok := factory.(Describer)
+	if !ok {
+		return parameters, nil
+	}
+
+	return withRetry(describer.Schema()).Decode(parameters)
+}
+
+// ParameterValidator is implemented by factories whose drivers can't be
+// created just to check their parameters, e.g. because they listen on a port.
+type ParameterValidator interface {
+	Validate(parameters map[string]interface{}) error
+}
+
+// Validate checks that the driver is registered and its parameters are
+// valid, against its schema for Describers. Unless its factory is a
+// ParameterValidator, the driver is created and closed.
+func Validate(name string, parameters map[string]interface{}) error {
+	factory, ok := reportingFactories[name]
+	if !ok {
+		return InvalidReportingDriverError{name}
+	}
+
+	parameters, err := decode(factory, parameters)
+	if err != nil {
+		return err
+	}
+
+	validator, ok := factory.(ParameterValidator)
+	if !ok {
+		driver, err := factory.Create(parameters)
+		if err != nil {
+			return err
+		}
+
+		defer reporting.Close(driver)
+		_, err = retry.Wrap(driver, parameters)
+		return err
+	}
+
+	if err := validator.Validate(parameters); err != nil {
+		return err
+	}
+
+	_, err = retry.Wrap(nil, parameters)
+	return err
+}
+
 type InvalidReportingDriverError struct {
 	Name string
 }
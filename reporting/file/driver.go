@@ -0,0 +1,337 @@
+package file
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/MustWin/cmeter/configuration"
+	"github.com/MustWin/cmeter/context"
+	"github.com/MustWin/cmeter/reporting"
+	"github.com/MustWin/cmeter/reporting/factory"
+)
+
+const (
+	FSYNC_ALWAYS   = "always"
+	FSYNC_INTERVAL = "interval"
+	FSYNC_NEVER    = "never"
+
+	DEFAULT_FSYNC_INTERVAL = time.Second
+
+	fileTimeFormat = "20060102T150405.000000000"
+)
+
+var (
+	ErrInvalidPath  = errors.New("invalid or missing file path")
+	ErrInvalidFsync = errors.New("invalid fsync policy, must be `always`, `interval` or `never`")
+)
+
+type driverFactory struct{}
+
+func (factory *driverFactory) Schema() configuration.Schema {
+	return configuration.Schema{
+		Description: "Writes every event as a JSON line to rotated files.",
+		Parameters: []configuration.Parameter{
+			{Name: "path", Type: configuration.TypeString, Required: true, Description: "path the files are named after, with the time they were opened"},
+			{Name: "max_size", Type: configuration.TypeInt, Description: "rotate files after this many bytes"},
+			{Name: "rotate_interval", Type: configuration.TypeDuration, Description: "rotate files after this long"},
+			{Name: "compress", Type: configuration.TypeBool, Default: "false", Description: "gzip rotated files"},
+			{Name: "fsync", Type: configuration.TypeString, Default: FSYNC_INTERVAL, Values: []string{FSYNC_ALWAYS, FSYNC_INTERVAL, FSYNC_NEVER}, Description: "when to fsync"},
+			{Name: "fsync_interval", Type: configuration.TypeDuration, Default: "1s", Description: "fsync interval of the `interval` policy"},
+		},
+	}
+}
+
+func (factory *driverFactory) Create(parameters map[string]interface{}) (reporting.Driver, error) {
+	params := configuration.Parameters(parameters)
+	path := params.String("path", "")
+	if path == "" {
+		return nil, ErrInvalidPath
+	}
+
+	maxSize, err := params.Int("max_size", 0)
+	if err != nil {
+		return nil, err
+	}
+
+	rotateInterval, err := params.Duration("rotate_interval", 0)
+	if err != nil {
+		return nil, err
+	}
+
+	compress, err := params.Bool("compress", false)
+	if err != nil {
+		return nil, err
+	}
+
+	fsync := strings.ToLower(params.String("fsync", FSYNC_INTERVAL))
+	switch fsync {
+	case FSYNC_ALWAYS, FSYNC_INTERVAL, FSYNC_NEVER:
+	default:
+		return nil, ErrInvalidFsync
+	}
+
+	fsyncInterval, err := params.Duration("fsync_interval", DEFAULT_FSYNC_INTERVAL)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("error creating directory: %v", err)
+	}
+
+	d := &Driver{
+		Path:           path,
+		MaxSize:        maxSize,
+		RotateInterval: rotateInterval,
+		Compress:       compress,
+		Fsync:          fsync,
+		FsyncInterval:  fsyncInterval,
+	}
+
+	if fsync == FSYNC_INTERVAL {
+		d.done = make(chan struct{})
+	}
+
+	return d, nil
+}
+
+func init() {
+	factory.Register("file", &driverFactory{})
+}
+
+// Driver appends events as JSON lines to files named after Path with the
+// time they were opened, e.g: `events-20161003T101500.000000000.ndjson`.
+// Receipts have the form `<file name>:<offset>`; the offset refers to the
+// uncompressed data when rotated files are compressed to `<file name>.gz`.
+// With the `always` fsync policy a failed sync fails the batch, so its events
+// are reported again; the `interval` policy logs sync failures.
+type Driver struct {
+	Path           string
+	MaxSize        int64
+	RotateInterval time.Duration
+	Compress       bool
+	Fsync          string
+	FsyncInterval  time.Duration
+
+	mutex  sync.Mutex
+	file   *os.File
+	name   string
+	size   int64
+	opened time.Time
+	// whether writes follow the last sync
+	dirty bool
+	// closed by Close to stop the interval syncs
+	done chan struct{}
+	// whether the interval syncs started
+	syncing bool
+}
+
+func (d *Driver) Report(ctx context.Context, e *reporting.Event) (reporting.Receipt, error) {
+	receipts, err := d.ReportBatch(ctx, []*reporting.Event{e})
+	if err != nil {
+		return reporting.EmptyReceipt, err
+	}
+
+	return receipts[0], nil
+}
+
+func (d *Driver) ReportBatch(ctx context.Context, events []*reporting.Event) ([]reporting.Receipt, error) {
+	lines := make([][]byte, len(events))
+	for i, e := range events {
+		blob, err := json.Marshal(e)
+		if err != nil {
+			return nil, fmt.Errorf("error encoding event: %v", err)
+		}
+
+		lines[i] = append(blob, '\n')
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	// started with the first report to log through its context
+	if d.done != nil && !d.syncing {
+		d.syncing = true
+		go d.syncEvery(ctx, d.done, d.FsyncInterval)
+	}
+
+	receipts := make([]reporting.Receipt, 0, len(events))
+	for _, line := range lines {
+		if d.shouldRotate(int64(len(line))) {
+			if err := d.rotate(ctx); err != nil {
+				return receipts, err
+			}
+		}
+
+		if _, err := d.file.Write(line); err != nil {
+			return receipts, fmt.Errorf("error writing event: %v", err)
+		}
+
+		receipts = append(receipts, reporting.Receipt(fmt.Sprintf("%s:%d", d.name, d.size)))
+		d.size += int64(len(line))
+		d.dirty = true
+	}
+
+	if d.Fsync == FSYNC_ALWAYS {
+		if err := d.sync(); err != nil {
+			return nil, fmt.Errorf("error syncing %s: %v", d.name, err)
+		}
+	}
+
+	return receipts, nil
+}
+
+// sync flushes the writes to the current file.
+func (d *Driver) sync() error {
+	if d.file == nil || !d.dirty {
+		return nil
+	}
+
+	if err := d.file.Sync(); err != nil {
+		return err
+	}
+
+	d.dirty = false
+	return nil
+}
+
+// syncEvery syncs the current file every interval until done is closed.
+func (d *Driver) syncEvery(ctx context.Context, done <-chan struct{}, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			d.mutex.Lock()
+			if err := d.sync(); err != nil {
+				context.GetLogger(ctx).Errorf("error syncing %s: %v", d.name, err)
+			}
+
+			d.mutex.Unlock()
+		}
+	}
+}
+
+// Close stops the interval syncs, then syncs and closes the current file.
+func (d *Driver) Close() error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if d.done != nil {
+		close(d.done)
+		d.done = nil
+	}
+
+	if d.file == nil {
+		return nil
+	}
+
+	syncErr := d.file.Sync()
+	err := d.file.Close()
+	d.file = nil
+	if syncErr != nil {
+		return syncErr
+	}
+
+	return err
+}
+
+func (d *Driver) shouldRotate(next int64) bool {
+	if d.file == nil {
+		return true
+	}
+
+	if d.MaxSize > 0 && d.size > 0 && d.size+next > d.MaxSize {
+		return true
+	}
+
+	return d.RotateInterval > 0 && time.Since(d.opened) >= d.RotateInterval
+}
+
+func (d *Driver) rotate(ctx context.Context) error {
+	if d.file != nil {
+		if err := d.file.Sync(); err != nil {
+			context.GetLogger(ctx).Errorf("error syncing %s: %v", d.name, err)
+		}
+
+		if err := d.file.Close(); err != nil {
+			context.GetLogger(ctx).Errorf("error closing %s: %v", d.name, err)
+		}
+
+		if d.Compress {
+			go compressFile(ctx, filepath.Join(filepath.Dir(d.Path), d.name))
+		}
+
+		d.file = nil
+	}
+
+	now := time.Now()
+	ext := filepath.Ext(d.Path)
+	name := fmt.Sprintf("%s-%s%s", strings.TrimSuffix(filepath.Base(d.Path), ext), now.UTC().Format(fileTimeFormat), ext)
+	fp, err := os.OpenFile(filepath.Join(filepath.Dir(d.Path), name), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("error opening file: %v", err)
+	}
+
+	info, err := fp.Stat()
+	if err != nil {
+		fp.Close()
+		return err
+	}
+
+	d.file = fp
+	d.name = name
+	d.size = info.Size()
+	d.opened = now
+	d.dirty = false
+	return nil
+}
+
+func compressFile(ctx context.Context, path string) {
+	if err := gzipFile(path); err != nil {
+		context.GetLogger(ctx).Errorf("error compressing %s: %v", path, err)
+		os.Remove(path + ".gz")
+		return
+	}
+
+	if err := os.Remove(path); err != nil {
+		context.GetLogger(ctx).Errorf("error removing %s: %v", path, err)
+	}
+}
+
+func gzipFile(path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+
+	defer in.Close()
+	out, err := os.OpenFile(path+".gz", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	defer out.Close()
+	zw := gzip.NewWriter(out)
+	zw.Name = filepath.Base(path)
+	if _, err := io.Copy(zw, in); err != nil {
+		return err
+	}
+
+	if err := zw.Close(); err != nil {
+		return err
+	}
+
+	return out.Sync()
+}
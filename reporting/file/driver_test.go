@@ -0,0 +1,180 @@
+package file
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/MustWin/cmeter/context"
+	"github.com/MustWin/cmeter/reporting"
+	"github.com/MustWin/cmeter/reporting/reportingtest"
+)
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "cmeter-file")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return dir
+}
+
+func testEvents(n int) []*reporting.Event {
+	events := make([]*reporting.Event, n)
+	for i := range events {
+		events[i] = reportingtest.ContainerSample("web", int64(i+1))
+	}
+
+	return events
+}
+
+// readEvents returns the timestamps of the events in the file, which is
+// decompressed when it's gzipped.
+func readEvents(t *testing.T, path string) []int64 {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer f.Close()
+
+	var r io.Reader = f
+	if strings.HasSuffix(path, ".gz") {
+		zr, err := gzip.NewReader(f)
+		if err != nil {
+			t.Fatalf("error reading %s: %v", path, err)
+		}
+
+		r = zr
+	}
+
+	var timestamps []int64
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		var e reporting.Event
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			t.Fatalf("invalid line in %s: %v", path, err)
+		}
+
+		timestamps = append(timestamps, e.Timestamp)
+	}
+
+	return timestamps
+}
+
+func TestReportBatch(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	d := reportingtest.NewDriver(t, &driverFactory{}, map[string]interface{}{
+		"path":  filepath.Join(dir, "events.ndjson"),
+		"fsync": FSYNC_ALWAYS,
+	}).(*Driver)
+
+	receipts, err := d.ReportBatch(context.Background(), testEvents(3))
+	if err != nil || len(receipts) != 3 {
+		t.Fatalf("expected 3 receipts, got %v and %v", receipts, err)
+	}
+
+	if err := d.Close(); err != nil {
+		t.Fatalf("error closing driver: %v", err)
+	}
+
+	paths, _ := filepath.Glob(filepath.Join(dir, "events-*.ndjson"))
+	if len(paths) != 1 {
+		t.Fatalf("expected a single file, got %v", paths)
+	}
+
+	data, err := ioutil.ReadFile(paths[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// receipts point at the start of their lines
+	offset := 0
+	for i, line := range strings.SplitAfter(string(data), "\n")[:3] {
+		if expected := fmt.Sprintf("%s:%d", filepath.Base(paths[0]), offset); string(receipts[i]) != expected {
+			t.Fatalf("expected receipt %s, got %s", expected, receipts[i])
+		}
+
+		offset += len(line)
+	}
+
+	if timestamps := readEvents(t, paths[0]); len(timestamps) != 3 || timestamps[2] != 3 {
+		t.Fatalf("expected the 3 events in order, got %v", timestamps)
+	}
+
+	if err := d.Close(); err != nil {
+		t.Fatalf("expected closing twice to succeed, got %v", err)
+	}
+}
+
+func TestRotation(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	line, _ := json.Marshal(testEvents(1)[0])
+	d := reportingtest.NewDriver(t, &driverFactory{}, map[string]interface{}{
+		"path":     filepath.Join(dir, "events.ndjson"),
+		"max_size": int64(2 * (len(line) + 1)),
+		"compress": true,
+		"fsync":    FSYNC_NEVER,
+	}).(*Driver)
+
+	for _, e := range testEvents(5) {
+		if _, err := d.Report(context.Background(), e); err != nil {
+			t.Fatalf("error reporting: %v", err)
+		}
+	}
+
+	d.Close()
+
+	// files hold 2 events each, the rotated ones are compressed in the
+	// background
+	var paths []string
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		paths, _ = filepath.Glob(filepath.Join(dir, "events-*"))
+		sort.Strings(paths)
+		if len(paths) == 3 && strings.HasSuffix(paths[0], ".gz") && strings.HasSuffix(paths[1], ".gz") {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("expected 2 compressed files and the current one, got %v", paths)
+		}
+	}
+
+	var timestamps []int64
+	for _, path := range paths {
+		timestamps = append(timestamps, readEvents(t, path)...)
+	}
+
+	if len(timestamps) != 5 {
+		t.Fatalf("expected the 5 events in order, got %v", timestamps)
+	}
+
+	for i, ts := range timestamps {
+		if ts != int64(i+1) {
+			t.Fatalf("expected the 5 events in order, got %v", timestamps)
+		}
+	}
+}
+
+func TestInvalidParameters(t *testing.T) {
+	if _, err := (&driverFactory{}).Create(map[string]interface{}{}); err != ErrInvalidPath {
+		t.Fatalf("expected %v, got %v", ErrInvalidPath, err)
+	}
+
+	if _, err := (&driverFactory{}).Create(map[string]interface{}{"path": "events.ndjson", "fsync": "sometimes"}); err != ErrInvalidFsync {
+		t.Fatalf("expected %v, got %v", ErrInvalidFsync, err)
+	}
+}
@@ -0,0 +1,97 @@
+package http
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/MustWin/cmeter/collector"
+	"github.com/MustWin/cmeter/containers"
+	"github.com/MustWin/cmeter/reporting"
+	"github.com/MustWin/cmeter/shared/uuid"
+)
+
+const (
+	CLOUDEVENTS_STRUCTURED = "structured"
+	CLOUDEVENTS_BINARY     = "binary"
+
+	CLOUDEVENTS_SPEC_VERSION = "1.0"
+
+	DEFAULT_CLOUDEVENTS_TYPE_PREFIX = "com.github.mustwin.cmeter."
+	DEFAULT_CLOUDEVENTS_SOURCE      = "cmeter"
+
+	contentTypeCloudEvent      = "application/cloudevents+json"
+	contentTypeCloudEventBatch = "application/cloudevents-batch+json"
+)
+
+var ErrInvalidCloudEventsMode = errors.New("invalid cloudevents mode, must be `structured` or `binary`")
+
+// cloudEvent is a CloudEvents 1.0 envelope of a reporting event. The id is
+// derived from the event's content so a retried event keeps its id.
+type cloudEvent struct {
+	SpecVersion     string      `json:"specversion"`
+	ID              string      `json:"id"`
+	Source          string      `json:"source"`
+	Type            string      `json:"type"`
+	Subject         string      `json:"subject,omitempty"`
+	Time            string      `json:"time"`
+	DataContentType string      `json:"datacontenttype"`
+	Data            interface{} `json:"data"`
+}
+
+func (d *Driver) cloudEvent(e *reporting.Event) (*cloudEvent, error) {
+	blob, err := json.Marshal(e)
+	if err != nil {
+		return nil, err
+	}
+
+	source := e.MeterID
+	if source == "" {
+		source = DEFAULT_CLOUDEVENTS_SOURCE
+	}
+
+	return &cloudEvent{
+		SpecVersion:     CLOUDEVENTS_SPEC_VERSION,
+		ID:              uuid.Derive(string(blob)),
+		Source:          source,
+		Type:            d.CloudEventsTypePrefix + e.Type,
+		Subject:         eventSubject(e),
+		Time:            time.Unix(e.Timestamp, 0).UTC().Format(time.RFC3339),
+		DataContentType: "application/json",
+		Data:            e.Data,
+	}, nil
+}
+
+// eventSubject is the container name, machine samples have no subject.
+func eventSubject(e *reporting.Event) string {
+	switch data := e.Data.(type) {
+	case *collector.Sample:
+		if data.Container != nil {
+			return data.Container.Name
+		}
+	case *containers.StateChange:
+		if data.Container != nil {
+			return data.Container.Name
+		}
+	}
+
+	return ""
+}
+
+// binaryHeader carries the event's attributes as `ce-` headers, the body is
+// the event's data.
+func (ce *cloudEvent) binaryHeader() http.Header {
+	h := http.Header{}
+	h.Set("Content-Type", ce.DataContentType)
+	h.Set("ce-specversion", ce.SpecVersion)
+	h.Set("ce-id", ce.ID)
+	h.Set("ce-source", ce.Source)
+	h.Set("ce-type", ce.Type)
+	h.Set("ce-time", ce.Time)
+	if ce.Subject != "" {
+		h.Set("ce-subject", ce.Subject)
+	}
+
+	return h
+}
@@ -5,14 +5,18 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"net/url"
 	"strconv"
 	"strings"
 
+	"github.com/MustWin/cmeter/configuration"
 	"github.com/MustWin/cmeter/context"
 	"github.com/MustWin/cmeter/reporting"
 	"github.com/MustWin/cmeter/reporting/factory"
+	"github.com/MustWin/cmeter/reporting/http/signature"
+	"github.com/MustWin/cmeter/reporting/transport"
 )
 
 const (
@@ -20,16 +24,49 @@ const (
 	CLIENT_VERSION_HEADER = "CMETER-VERSION"
 
 	DEFAULT_RECEIPT_HEADER = "CMETER-RECEIPT"
+
+	BATCH_FORMAT_JSON   = "json"
+	BATCH_FORMAT_NDJSON = "ndjson"
 )
 
 var (
 	ErrInvalidEndpoint = errors.New("invalid endpoint url")
 	ErrInvalidReceipt  = errors.New("received an invalid or empty receipt")
 	ErrInvalidHeaders  = errors.New("error reading additional header configuration")
+	ErrInvalidFormat   = errors.New("invalid batch format, must be `json` or `ndjson`")
+	ErrMissingSecret   = errors.New("signing requires a `secret_file`")
 )
 
 type driverFactory struct{}
 
+func (factory *driverFactory) Schema() configuration.Schema {
+	params := []configuration.Parameter{
+		{Name: "url", Type: configuration.TypeString, Required: true, Description: "endpoint the events are sent to"},
+		{Name: "method", Type: configuration.TypeString, Default: http.MethodPost, Description: "request method"},
+		{Name: "receipt_header", Type: configuration.TypeString, Default: DEFAULT_RECEIPT_HEADER, Description: "response header with the receipt"},
+		{Name: "headers", Type: configuration.TypeStringMap, Description: "additional request headers"},
+		{Name: "batch_format", Type: configuration.TypeString, Default: BATCH_FORMAT_JSON, Values: []string{BATCH_FORMAT_JSON, BATCH_FORMAT_NDJSON}, Description: "batches are sent as a `json` array or as `ndjson`"},
+		{Name: "encoding", Type: configuration.TypeString, Default: ENCODING_JSON, Values: []string{ENCODING_JSON, ENCODING_PROTOBUF, ENCODING_MSGPACK}, Description: "event encoding, protobuf events follow `reporting/http/event.proto`"},
+		{Name: "compression", Type: configuration.TypeString, Default: COMPRESSION_NONE, Values: []string{COMPRESSION_NONE, COMPRESSION_GZIP, COMPRESSION_ZSTD}, Description: "request body compression"},
+		{Name: "cloudevents", Type: configuration.TypeString, Values: []string{CLOUDEVENTS_STRUCTURED, CLOUDEVENTS_BINARY}, Description: "send CloudEvents 1.0 in this content mode, only with the `json` encoding"},
+		{Name: "cloudevents_type_prefix", Type: configuration.TypeString, Default: DEFAULT_CLOUDEVENTS_TYPE_PREFIX, Description: "prefix of the CloudEvents types, followed by the event type"},
+		{
+			Name:        "signing",
+			Type:        configuration.TypeSection,
+			Description: "sign request bodies with HMAC-SHA256",
+			Parameters: []configuration.Parameter{
+				{Name: "key_id", Type: configuration.TypeString, Description: "key id sent with the signatures"},
+				{Name: "secret_file", Type: configuration.TypeString, Required: true, Description: "file with the signing secret"},
+			},
+		},
+	}
+
+	return configuration.Schema{
+		Description: "Posts events to an HTTP endpoint.",
+		Parameters:  append(params, transport.ClientParameters...),
+	}
+}
+
 func (factory *driverFactory) Create(parameters map[string]interface{}) (reporting.Driver, error) {
 	endpointUrl, ok := parameters["url"].(string)
 	if !ok || endpointUrl == "" {
@@ -52,16 +89,106 @@ func (factory *driverFactory) Create(parameters map[string]interface{}) (reporti
 		receiptHeader = DEFAULT_RECEIPT_HEADER
 	}
 
-	headers, ok := parameters["headers"].(http.Header)
-	if !ok {
+	headerParams, err := configuration.Parameters(parameters).Sub("headers")
+	if err != nil {
 		return nil, ErrInvalidHeaders
 	}
 
+	headers := http.Header{}
+	for k := range headerParams {
+		headers.Set(k, headerParams.String(k, ""))
+	}
+
+	batchFormat, ok := parameters["batch_format"].(string)
+	if !ok || batchFormat == "" {
+		batchFormat = BATCH_FORMAT_JSON
+	}
+
+	batchFormat = strings.ToLower(batchFormat)
+	if batchFormat != BATCH_FORMAT_JSON && batchFormat != BATCH_FORMAT_NDJSON {
+		return nil, ErrInvalidFormat
+	}
+
+	cloudEvents, ok := parameters["cloudevents"].(string)
+	cloudEvents = strings.ToLower(cloudEvents)
+	if ok && cloudEvents != "" && cloudEvents != CLOUDEVENTS_STRUCTURED && cloudEvents != CLOUDEVENTS_BINARY {
+		return nil, ErrInvalidCloudEventsMode
+	}
+
+	cloudEventsTypePrefix, ok := parameters["cloudevents_type_prefix"].(string)
+	if !ok {
+		cloudEventsTypePrefix = DEFAULT_CLOUDEVENTS_TYPE_PREFIX
+	}
+
+	encoding, ok := parameters["encoding"].(string)
+	encoding = strings.ToLower(encoding)
+	if !ok || encoding == "" {
+		encoding = ENCODING_JSON
+	}
+
+	if encoding != ENCODING_JSON && encoding != ENCODING_PROTOBUF && encoding != ENCODING_MSGPACK {
+		return nil, ErrInvalidEncoding
+	}
+
+	if encoding != ENCODING_JSON && cloudEvents != "" {
+		return nil, ErrCloudEventsEncoding
+	}
+
+	compression, ok := parameters["compression"].(string)
+	compression = strings.ToLower(compression)
+	if !ok || compression == "" {
+		compression = COMPRESSION_NONE
+	}
+
+	if compression != COMPRESSION_NONE && compression != COMPRESSION_GZIP && compression != COMPRESSION_ZSTD {
+		return nil, ErrInvalidCompression
+	}
+
+	signer, err := newSigner(parameters)
+	if err != nil {
+		return nil, err
+	}
+
+	client, closer, err := transport.NewClient(parameters)
+	if err != nil {
+		return nil, err
+	}
+
 	return &Driver{
-		Endpoint:      endpointUrl,
-		Method:        httpMethod,
-		ReceiptHeader: receiptHeader,
-		ExtraHeaders:  headers,
+		Endpoint:              endpointUrl,
+		Method:                httpMethod,
+		ReceiptHeader:         receiptHeader,
+		ExtraHeaders:          headers,
+		BatchFormat:           batchFormat,
+		CloudEvents:           cloudEvents,
+		CloudEventsTypePrefix: cloudEventsTypePrefix,
+		Encoding:              encoding,
+		Compression:           compression,
+		Signer:                signer,
+		Client:                client,
+		closer:                closer,
+	}, nil
+}
+
+func newSigner(parameters map[string]interface{}) (*signature.Signer, error) {
+	params, err := configuration.Parameters(parameters).Sub("signing")
+	if err != nil || params == nil {
+		return nil, err
+	}
+
+	secretFile := params.String("secret_file", "")
+	if secretFile == "" {
+		return nil, ErrMissingSecret
+	}
+
+	secret, err := signature.LoadSecret(secretFile)
+	if err != nil {
+		return nil, err
+	}
+
+	return &signature.Signer{
+		KeyID:  params.String("key_id", ""),
+		Secret: secret,
 	}, nil
 }
 
@@ -74,21 +201,161 @@ type Driver struct {
 	Method        string
 	ReceiptHeader string
 	ExtraHeaders  http.Header
+	BatchFormat   string
+	// CloudEvents content mode, `structured` or `binary`, events are sent
+	// as they are when empty
+	CloudEvents           string
+	CloudEventsTypePrefix string
+	// `json`, `protobuf` or `msgpack`
+	Encoding string
+	// `none`, `gzip` or `zstd`, compressed bodies are sent with a matching
+	// `Content-Encoding`
+	Compression string
+	// signs request bodies when set
+	Signer *signature.Signer
+	Client *http.Client
+
+	closer io.Closer
 }
 
 func (d *Driver) Report(ctx context.Context, e *reporting.Event) (reporting.Receipt, error) {
-	blob, err := json.Marshal(e)
+	header := http.Header{}
+	if d.Encoding != ENCODING_JSON {
+		blob, contentType, err := d.encodeEvent(e)
+		if err != nil {
+			return reporting.EmptyReceipt, fmt.Errorf("error encoding event: %v", err)
+		}
+
+		header.Set("Content-Type", contentType)
+		return d.send(ctx, blob, header)
+	}
+
+	header.Set("Content-Type", "application/json")
+	var body interface{} = e
+	if d.CloudEvents != "" {
+		ce, err := d.cloudEvent(e)
+		if err != nil {
+			return reporting.EmptyReceipt, fmt.Errorf("error encoding event: %v", err)
+		}
+
+		body = ce
+		header.Set("Content-Type", contentTypeCloudEvent)
+		if d.CloudEvents == CLOUDEVENTS_BINARY {
+			body = ce.Data
+			header = ce.binaryHeader()
+		}
+	}
+
+	blob, err := json.Marshal(body)
 	if err != nil {
 		return reporting.EmptyReceipt, fmt.Errorf("error encoding event: %v", err)
 	}
 
+	return d.send(ctx, blob, header)
+}
+
+// ReportBatch sends all events in a single request, either as a JSON array
+// or as newline delimited JSON, or in the driver's binary encoding. The
+// batch shares the response's receipt.
+// Structured CloudEvents are sent as a JSON array batch; binary mode can't
+// batch, so each event is sent on its own.
+func (d *Driver) ReportBatch(ctx context.Context, events []*reporting.Event) ([]reporting.Receipt, error) {
+	if d.CloudEvents == CLOUDEVENTS_BINARY {
+		receipts := make([]reporting.Receipt, 0, len(events))
+		for _, e := range events {
+			receipt, err := d.Report(ctx, e)
+			if err != nil {
+				return receipts, err
+			}
+
+			receipts = append(receipts, receipt)
+		}
+
+		return receipts, nil
+	}
+
+	var blob []byte
+	var err error
+	header := http.Header{}
+	header.Set("Content-Type", "application/json")
+	if d.Encoding != ENCODING_JSON {
+		var contentType string
+		blob, contentType, err = d.encodeBatch(events)
+		header.Set("Content-Type", contentType)
+	} else if d.CloudEvents == CLOUDEVENTS_STRUCTURED {
+		header.Set("Content-Type", contentTypeCloudEventBatch)
+		batch := make([]*cloudEvent, len(events))
+		for i, e := range events {
+			if batch[i], err = d.cloudEvent(e); err != nil {
+				break
+			}
+		}
+
+		if err == nil {
+			blob, err = json.Marshal(batch)
+		}
+	} else if d.BatchFormat == BATCH_FORMAT_NDJSON {
+		header.Set("Content-Type", "application/x-ndjson")
+		buf := &bytes.Buffer{}
+		enc := json.NewEncoder(buf)
+		for _, e := range events {
+			if err = enc.Encode(e); err != nil {
+				break
+			}
+		}
+
+		blob = buf.Bytes()
+	} else {
+		blob, err = json.Marshal(events)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("error encoding events: %v", err)
+	}
+
+	receipt, err := d.send(ctx, blob, header)
+	if err != nil {
+		return nil, err
+	}
+
+	receipts := make([]reporting.Receipt, len(events))
+	for i := range receipts {
+		receipts[i] = receipt
+	}
+
+	return receipts, nil
+}
+
+// Close releases the connections and certificate watcher of the client.
+func (d *Driver) Close() error {
+	if d.closer == nil {
+		return nil
+	}
+
+	return d.closer.Close()
+}
+
+func (d *Driver) send(ctx context.Context, blob []byte, header http.Header) (reporting.Receipt, error) {
+	blob, err := d.compress(blob)
+	if err != nil {
+		return reporting.EmptyReceipt, fmt.Errorf("error compressing request: %v", err)
+	}
+
 	r, err := http.NewRequest(d.Method, d.Endpoint, bytes.NewReader(blob))
 	if err != nil {
 		return reporting.EmptyReceipt, fmt.Errorf("error creating request: %v", err)
 	}
 
 	r.Header.Add("Content-Length", strconv.FormatInt(int64(len(blob)), 10))
-	r.Header.Add("Content-Type", "application/json")
+	if d.Compression != COMPRESSION_NONE {
+		r.Header.Set("Content-Encoding", d.Compression)
+	}
+
+	for hn, hvs := range header {
+		for _, v := range hvs {
+			r.Header.Add(hn, v)
+		}
+	}
 
 	version := context.GetVersion(ctx)
 	r.Header.Add("User-Agent", fmt.Sprintf("%s/%s", CLIENT_USER_AGENT, version))
@@ -99,16 +366,21 @@ func (d *Driver) Report(ctx context.Context, e *reporting.Event) (reporting.Rece
 		}
 	}
 
-	client := http.DefaultClient
-	resp, err := client.Do(r)
+	if d.Signer != nil {
+		if err := d.Signer.SignRequest(r, blob); err != nil {
+			return reporting.EmptyReceipt, err
+		}
+	}
+
+	resp, err := d.Client.Do(r)
 	if err != nil {
-		return reporting.EmptyReceipt, fmt.Errorf("error sending request: %v", err)
+		return reporting.EmptyReceipt, fmt.Errorf("error sending request: %w", err)
 	}
 
 	defer resp.Body.Close()
 
 	if resp.StatusCode > 299 || resp.StatusCode < 200 {
-		return reporting.EmptyReceipt, fmt.Errorf("unexpected response: %q", resp.Status)
+		return reporting.EmptyReceipt, reporting.ResponseError(resp)
 	}
 
 	receiptStr := resp.Header.Get(d.ReceiptHeader)
@@ -0,0 +1,298 @@
+package http
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/MustWin/cmeter/collector"
+	"github.com/MustWin/cmeter/containers"
+	"github.com/MustWin/cmeter/context"
+	"github.com/MustWin/cmeter/reporting"
+	"github.com/MustWin/cmeter/reporting/http/signature"
+	"github.com/MustWin/cmeter/reporting/reportingtest"
+)
+
+type request struct {
+	header http.Header
+	body   []byte
+}
+
+// newServer records the requests it receives and answers them with a
+// receipt.
+func newServer(requests chan<- *request) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		requests <- &request{header: r.Header, body: body}
+		w.Header().Set(DEFAULT_RECEIPT_HEADER, "receipt")
+	}))
+}
+
+func newTestDriver(t *testing.T, parameters map[string]interface{}) *recordingDriver {
+	requests := make(chan *request, 1)
+	server := newServer(requests)
+	parameters["url"] = server.URL
+	d := reportingtest.NewDriver(t, &driverFactory{}, parameters)
+	return &recordingDriver{Driver: d, server: server, requests: requests}
+}
+
+// recordingDriver reports to its own server and returns the request of each
+// report.
+type recordingDriver struct {
+	reporting.Driver
+	server   *httptest.Server
+	requests chan *request
+}
+
+func (d *recordingDriver) report(t *testing.T, e *reporting.Event) *request {
+	receipt, err := d.Report(context.Background(), e)
+	if err != nil || receipt != "receipt" {
+		t.Fatalf("expected the server's receipt, got %q and %v", receipt, err)
+	}
+
+	return <-d.requests
+}
+
+func (d *recordingDriver) reportBatch(t *testing.T, events []*reporting.Event) *request {
+	receipts, err := d.Driver.(reporting.BatchDriver).ReportBatch(context.Background(), events)
+	if err != nil || len(receipts) != len(events) {
+		t.Fatalf("expected a receipt per event, got %v and %v", receipts, err)
+	}
+
+	return <-d.requests
+}
+
+func (d *recordingDriver) close() {
+	reporting.Close(d.Driver)
+	d.server.Close()
+}
+
+func testSample() *reporting.Event {
+	return &reporting.Event{
+		MeterID:   "meter",
+		Type:      reporting.EventSample,
+		Timestamp: 42,
+		Data: &collector.Sample{
+			Timestamp: 42,
+			Container: &containers.ContainerInfo{
+				Name:   "web",
+				Labels: map[string]string{"team": "core", "tenant": "acme"},
+			},
+			Usage: &containers.Usage{
+				Cpu:     &containers.CpuUsage{Total: 1000, PerCore: []int64{400, 600}},
+				Network: &containers.NetworkUsage{TotalRxBytes: 300},
+			},
+		},
+	}
+}
+
+// protoFields decodes the fields of a protobuf message, varints as their
+// value and length delimited fields as their bytes.
+func protoFields(t *testing.T, blob []byte) map[int][]interface{} {
+	fields := make(map[int][]interface{})
+	for len(blob) > 0 {
+		tag, n := binary.Uvarint(blob)
+		if n <= 0 {
+			t.Fatalf("invalid tag in %x", blob)
+		}
+
+		blob = blob[n:]
+		field := int(tag >> 3)
+		switch tag & 7 {
+		case 0:
+			v, n := binary.Uvarint(blob)
+			if n <= 0 {
+				t.Fatalf("invalid varint in %x", blob)
+			}
+
+			fields[field] = append(fields[field], v)
+			blob = blob[n:]
+		case 2:
+			length, n := binary.Uvarint(blob)
+			if n <= 0 || uint64(len(blob)-n) < length {
+				t.Fatalf("invalid length in %x", blob)
+			}
+
+			fields[field] = append(fields[field], blob[n:n+int(length)])
+			blob = blob[n+int(length):]
+		default:
+			t.Fatalf("unexpected wire type %d", tag&7)
+		}
+	}
+
+	return fields
+}
+
+func protoMessage(t *testing.T, fields map[int][]interface{}, field int) map[int][]interface{} {
+	if len(fields[field]) != 1 {
+		t.Fatalf("expected a single field %d, got %v", field, fields[field])
+	}
+
+	return protoFields(t, fields[field][0].([]byte))
+}
+
+func TestProtobufEncoding(t *testing.T) {
+	d := newTestDriver(t, map[string]interface{}{"encoding": ENCODING_PROTOBUF})
+	defer d.close()
+
+	r := d.report(t, testSample())
+	if ct := r.header.Get("Content-Type"); ct != contentTypeProtobufEvent {
+		t.Fatalf("expected content type %q, got %q", contentTypeProtobufEvent, ct)
+	}
+
+	event := protoFields(t, r.body)
+	if string(event[1][0].([]byte)) != "meter" || string(event[2][0].([]byte)) != reporting.EventSample || event[3][0].(uint64) != 42 {
+		t.Fatalf("expected the event's meter, type and timestamp, got %v", event)
+	}
+
+	sample := protoMessage(t, event, 4)
+	container := protoMessage(t, sample, 3)
+	if string(container[1][0].([]byte)) != "web" || len(container[2]) != 2 {
+		t.Fatalf("expected the container's name and 2 labels, got %v", container)
+	}
+
+	label := protoFields(t, container[2][0].([]byte))
+	if string(label[1][0].([]byte)) != "team" || string(label[2][0].([]byte)) != "core" {
+		t.Fatalf("expected the labels sorted by key, got %v", label)
+	}
+
+	cpu := protoMessage(t, protoMessage(t, sample, 4), 1)
+	if cpu[1][0].(uint64) != 1000 || !bytes.Equal(cpu[2][0].([]byte), []byte{0x90, 0x03, 0xd8, 0x04}) {
+		t.Fatalf("expected the cpu total and packed per core usage, got %v", cpu)
+	}
+
+	// batches are an EventBatch of events
+	r = d.reportBatch(t, []*reporting.Event{testSample(), testSample()})
+	if ct := r.header.Get("Content-Type"); ct != contentTypeProtobufBatch {
+		t.Fatalf("expected content type %q, got %q", contentTypeProtobufBatch, ct)
+	}
+
+	single, _ := marshalProto(testSample())
+	if batch := protoFields(t, r.body); len(batch[1]) != 2 || !bytes.Equal(batch[1][0].([]byte), single) {
+		t.Fatalf("expected 2 events in the batch, got %v", batch)
+	}
+}
+
+func TestMsgpackEncoding(t *testing.T) {
+	d := newTestDriver(t, map[string]interface{}{"encoding": ENCODING_MSGPACK})
+	defer d.close()
+
+	r := d.report(t, testSample())
+	if ct := r.header.Get("Content-Type"); ct != contentTypeMsgpack {
+		t.Fatalf("expected content type %q, got %q", contentTypeMsgpack, ct)
+	}
+
+	// a map of the event's 4 JSON keys, starting with `data`
+	if !bytes.HasPrefix(r.body, []byte{0x84, 0xa4, 'd', 'a', 't', 'a'}) {
+		t.Fatalf("expected the event as a map, got %x", r.body)
+	}
+
+	r = d.reportBatch(t, []*reporting.Event{testSample(), testSample(), testSample()})
+	if r.body[0] != 0x93 {
+		t.Fatalf("expected the batch as an array of 3 events, got %x", r.body)
+	}
+}
+
+func TestCompression(t *testing.T) {
+	expected, _ := json.Marshal(testSample())
+
+	d := newTestDriver(t, map[string]interface{}{"compression": COMPRESSION_GZIP})
+	defer d.close()
+
+	r := d.report(t, testSample())
+	if ce := r.header.Get("Content-Encoding"); ce != COMPRESSION_GZIP {
+		t.Fatalf("expected content encoding %q, got %q", COMPRESSION_GZIP, ce)
+	}
+
+	zr, err := gzip.NewReader(bytes.NewReader(r.body))
+	if err != nil {
+		t.Fatalf("error reading gzip body: %v", err)
+	}
+
+	if body, err := ioutil.ReadAll(zr); err != nil || !bytes.Equal(body, expected) {
+		t.Fatalf("expected the compressed event %s, got %s and %v", expected, body, err)
+	}
+
+	d = newTestDriver(t, map[string]interface{}{"compression": COMPRESSION_ZSTD})
+	defer d.close()
+
+	r = d.report(t, testSample())
+	if ce := r.header.Get("Content-Encoding"); ce != COMPRESSION_ZSTD {
+		t.Fatalf("expected content encoding %q, got %q", COMPRESSION_ZSTD, ce)
+	}
+
+	if !bytes.HasPrefix(r.body, []byte{0x28, 0xb5, 0x2f, 0xfd}) {
+		t.Fatalf("expected a zstd frame, got %x", r.body)
+	}
+}
+
+func TestInvalidEncodings(t *testing.T) {
+	cases := []struct {
+		parameters map[string]interface{}
+		err        error
+	}{
+		{map[string]interface{}{"encoding": "xml"}, ErrInvalidEncoding},
+		{map[string]interface{}{"compression": "brotli"}, ErrInvalidCompression},
+		{map[string]interface{}{"encoding": ENCODING_MSGPACK, "cloudevents": CLOUDEVENTS_STRUCTURED}, ErrCloudEventsEncoding},
+	}
+
+	for _, c := range cases {
+		c.parameters["url"] = "http://127.0.0.1"
+		if _, err := (&driverFactory{}).Create(c.parameters); err != c.err {
+			t.Errorf("expected %v for %v, got %v", c.err, c.parameters, err)
+		}
+	}
+}
+
+func TestSigning(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cmeter-http")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	secretFile := filepath.Join(dir, "secret")
+	if err := ioutil.WriteFile(secretFile, []byte("secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	d := newTestDriver(t, map[string]interface{}{
+		"compression": COMPRESSION_GZIP,
+		"signing":     map[string]interface{}{"key_id": "agent", "secret_file": secretFile},
+	})
+
+	defer d.close()
+
+	// the compressed body is signed
+	v := signature.NewVerifier(map[string][]byte{"agent": []byte("secret")})
+	r := d.report(t, testSample())
+	if err := v.Verify(r.header, r.body); err != nil {
+		t.Fatalf("expected the request to be signed, got %v", err)
+	}
+
+	r = d.reportBatch(t, []*reporting.Event{testSample(), testSample()})
+	if err := v.Verify(r.header, r.body); err != nil {
+		t.Fatalf("expected the batch to be signed, got %v", err)
+	}
+
+	if err := signature.NewVerifier(map[string][]byte{"agent": []byte("other")}).Verify(r.header, r.body); err != signature.ErrInvalidSignature {
+		t.Fatalf("expected the signature to depend on the secret, got %v", err)
+	}
+
+	_, err = (&driverFactory{}).Create(map[string]interface{}{
+		"url":     "http://127.0.0.1",
+		"signing": map[string]interface{}{"key_id": "agent"},
+	})
+
+	if err != ErrMissingSecret {
+		t.Fatalf("expected %v, got %v", ErrMissingSecret, err)
+	}
+}
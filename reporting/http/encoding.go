@@ -0,0 +1,78 @@
+package http
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+
+	"github.com/MustWin/cmeter/reporting"
+	"github.com/MustWin/cmeter/shared/msgpack"
+	"github.com/MustWin/cmeter/shared/zstd"
+)
+
+const (
+	ENCODING_JSON     = "json"
+	ENCODING_PROTOBUF = "protobuf"
+	ENCODING_MSGPACK  = "msgpack"
+
+	COMPRESSION_NONE = "none"
+	COMPRESSION_GZIP = "gzip"
+	COMPRESSION_ZSTD = "zstd"
+
+	contentTypeProtobufEvent = "application/x-protobuf; proto=cmeter.v1.Event"
+	contentTypeProtobufBatch = "application/x-protobuf; proto=cmeter.v1.EventBatch"
+	contentTypeMsgpack       = "application/msgpack"
+)
+
+var (
+	ErrInvalidEncoding     = errors.New("invalid encoding, must be `json`, `protobuf` or `msgpack`")
+	ErrInvalidCompression  = errors.New("invalid compression, must be `none`, `gzip` or `zstd`")
+	ErrCloudEventsEncoding = errors.New("cloudevents require the `json` encoding")
+)
+
+// encodeEvent encodes a single event in the driver's binary encoding, it
+// returns the body and its content type.
+func (d *Driver) encodeEvent(e *reporting.Event) ([]byte, string, error) {
+	if d.Encoding == ENCODING_PROTOBUF {
+		blob, err := marshalProto(e)
+		return blob, contentTypeProtobufEvent, err
+	}
+
+	blob, err := msgpack.Marshal(e)
+	return blob, contentTypeMsgpack, err
+}
+
+// encodeBatch encodes events in the driver's binary encoding, protobuf
+// batches are an EventBatch message and MessagePack batches an array.
+func (d *Driver) encodeBatch(events []*reporting.Event) ([]byte, string, error) {
+	if d.Encoding == ENCODING_PROTOBUF {
+		blob, err := marshalProtoBatch(events)
+		return blob, contentTypeProtobufBatch, err
+	}
+
+	blob, err := msgpack.Marshal(events)
+	return blob, contentTypeMsgpack, err
+}
+
+// compress returns the body compressed with the driver's compression, bodies
+// are sent as they are without one.
+func (d *Driver) compress(blob []byte) ([]byte, error) {
+	switch d.Compression {
+	case COMPRESSION_GZIP:
+		buf := &bytes.Buffer{}
+		w := gzip.NewWriter(buf)
+		if _, err := w.Write(blob); err != nil {
+			return nil, err
+		}
+
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+
+		return buf.Bytes(), nil
+	case COMPRESSION_ZSTD:
+		return zstd.Compress(blob), nil
+	}
+
+	return blob, nil
+}
@@ -0,0 +1,173 @@
+package http
+
+import (
+	"fmt"
+
+	"github.com/MustWin/cmeter/collector"
+	"github.com/MustWin/cmeter/containers"
+	"github.com/MustWin/cmeter/reporting"
+	"github.com/MustWin/cmeter/shared/protobuf"
+)
+
+// marshalProtoBatch encodes the events as an EventBatch of event.proto.
+func marshalProtoBatch(events []*reporting.Event) ([]byte, error) {
+	b := &protobuf.Buffer{}
+	for _, e := range events {
+		blob, err := marshalProto(e)
+		if err != nil {
+			return nil, err
+		}
+
+		b.BytesField(1, blob)
+	}
+
+	return b.Bytes(), nil
+}
+
+// marshalProto encodes the event as an Event of event.proto.
+func marshalProto(e *reporting.Event) ([]byte, error) {
+	b := &protobuf.Buffer{}
+	b.StringField(1, e.MeterID)
+	b.StringField(2, e.Type)
+	b.VarintField(3, uint64(e.Timestamp))
+	switch data := e.Data.(type) {
+	case *collector.Sample:
+		b.MessageField(4, func(sb *protobuf.Buffer) {
+			sb.VarintField(1, uint64(data.Timestamp))
+			sb.VarintField(2, uint64(data.FrameSize))
+			containerProto(sb, 3, data.Container)
+			if data.Usage != nil {
+				sb.MessageField(4, func(ub *protobuf.Buffer) {
+					cpuProto(ub, 1, data.Usage.Cpu)
+					memoryProto(ub, 2, data.Usage.Memory)
+					networkProto(ub, 3, data.Usage.Network)
+					diskProto(ub, 4, data.Usage.Disk)
+				})
+			}
+		})
+	case *containers.StateChange:
+		b.MessageField(5, func(sb *protobuf.Buffer) {
+			sb.StringField(1, string(data.State))
+			if data.Source != nil {
+				sb.MessageField(2, func(eb *protobuf.Buffer) {
+					eb.StringField(1, string(data.Source.Type))
+					containerProto(eb, 2, data.Source.Container)
+					eb.VarintField(3, uint64(data.Source.Timestamp))
+				})
+			}
+
+			containerProto(sb, 3, data.Container)
+		})
+	case *collector.MachineSample:
+		b.MessageField(6, func(sb *protobuf.Buffer) {
+			sb.VarintField(1, uint64(data.Timestamp))
+			sb.VarintField(2, uint64(data.FrameSize))
+			machineProto(sb, 3, data.Machine)
+			if data.Usage != nil {
+				sb.MessageField(4, func(ub *protobuf.Buffer) {
+					cpuProto(ub, 1, data.Usage.Cpu)
+					memoryProto(ub, 2, data.Usage.Memory)
+				})
+			}
+		})
+	case nil:
+	default:
+		return nil, fmt.Errorf("unsupported event data %T", e.Data)
+	}
+
+	return b.Bytes(), nil
+}
+
+func containerProto(b *protobuf.Buffer, field int, info *containers.ContainerInfo) {
+	if info == nil {
+		return
+	}
+
+	b.MessageField(field, func(cb *protobuf.Buffer) {
+		cb.StringField(1, info.Name)
+		cb.StringMapField(2, info.Labels)
+		cb.StringMapField(3, info.Envs)
+		cb.StringField(4, info.ImageName)
+		cb.StringField(5, info.ImageTag)
+		machineProto(cb, 6, info.Machine)
+		if info.Reserved != nil {
+			cb.MessageField(7, func(rb *protobuf.Buffer) {
+				rb.DoubleField(1, info.Reserved.Cpu)
+				rb.VarintField(2, info.Reserved.Memory)
+			})
+		}
+	})
+}
+
+func machineProto(b *protobuf.Buffer, field int, info *containers.MachineInfo) {
+	if info == nil {
+		return
+	}
+
+	b.MessageField(field, func(mb *protobuf.Buffer) {
+		mb.StringField(1, info.SystemUuid)
+		mb.VarintField(2, uint64(info.Cores))
+		mb.VarintField(3, info.MemoryBytes)
+		mb.VarintField(4, info.CpuFrequencyKhz)
+		mb.StringMapField(5, info.Labels)
+		mb.StringField(6, info.Name)
+	})
+}
+
+func cpuProto(b *protobuf.Buffer, field int, cpu *containers.CpuUsage) {
+	if cpu == nil {
+		return
+	}
+
+	b.MessageField(field, func(cb *protobuf.Buffer) {
+		cb.VarintField(1, uint64(cpu.Total))
+		perCore := make([]uint64, len(cpu.PerCore))
+		for i, v := range cpu.PerCore {
+			perCore[i] = uint64(v)
+		}
+
+		cb.PackedVarintField(2, perCore)
+	})
+}
+
+func memoryProto(b *protobuf.Buffer, field int, memory *containers.MemoryUsage) {
+	if memory == nil {
+		return
+	}
+
+	b.MessageField(field, func(mb *protobuf.Buffer) {
+		mb.VarintField(1, memory.Bytes)
+	})
+}
+
+func networkProto(b *protobuf.Buffer, field int, network *containers.NetworkUsage) {
+	if network == nil {
+		return
+	}
+
+	b.MessageField(field, func(nb *protobuf.Buffer) {
+		nb.VarintField(1, network.TotalRxBytes)
+		nb.VarintField(2, network.TotalTxBytes)
+		for _, iface := range network.Interfaces {
+			if iface == nil {
+				continue
+			}
+
+			nb.MessageField(3, func(ib *protobuf.Buffer) {
+				ib.StringField(1, iface.Name)
+				ib.VarintField(2, iface.RxBytes)
+				ib.VarintField(3, iface.TxBytes)
+			})
+		}
+	})
+}
+
+func diskProto(b *protobuf.Buffer, field int, disk *containers.DiskUsage) {
+	if disk == nil {
+		return
+	}
+
+	b.MessageField(field, func(db *protobuf.Buffer) {
+		db.PackedVarintField(1, disk.PerDiskIo)
+	})
+}
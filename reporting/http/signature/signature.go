@@ -0,0 +1,206 @@
+package signature
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Requests are signed with HMAC-SHA256 over `<timestamp>.<nonce>.<body>`,
+// the signature header has the form `v1=<hex digest>`.
+const (
+	KEY_ID_HEADER    = "CMETER-SIGNATURE-KEY-ID"
+	SIGNATURE_HEADER = "CMETER-SIGNATURE"
+	TIMESTAMP_HEADER = "CMETER-TIMESTAMP"
+	NONCE_HEADER     = "CMETER-NONCE"
+
+	SIGNATURE_VERSION = "v1"
+
+	DEFAULT_MAX_SKEW = 5 * time.Minute
+)
+
+var (
+	ErrMissingSignature = errors.New("missing signature headers")
+	ErrUnknownKey       = errors.New("unknown signature key id")
+	ErrInvalidSignature = errors.New("invalid signature")
+	ErrInvalidTimestamp = errors.New("timestamp outside of the allowed skew")
+	ErrReplayed         = errors.New("nonce was already used")
+	ErrEmptySecret      = errors.New("empty signing secret")
+)
+
+// Sign returns the signature header value for the request parts.
+func Sign(secret []byte, timestamp int64, nonce string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte("."))
+	mac.Write([]byte(nonce))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return SIGNATURE_VERSION + "=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// LoadSecret reads a secret from a file, surrounding whitespace is ignored.
+func LoadSecret(path string) ([]byte, error) {
+	blob, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading secret: %v", err)
+	}
+
+	secret := bytes.TrimSpace(blob)
+	if len(secret) == 0 {
+		return nil, ErrEmptySecret
+	}
+
+	return secret, nil
+}
+
+type Signer struct {
+	KeyID  string
+	Secret []byte
+}
+
+// SignRequest adds the signature headers for the body to the request.
+func (s *Signer) SignRequest(r *http.Request, body []byte) error {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return fmt.Errorf("error generating nonce: %v", err)
+	}
+
+	timestamp := time.Now().Unix()
+	nonceStr := hex.EncodeToString(nonce)
+	if s.KeyID != "" {
+		r.Header.Set(KEY_ID_HEADER, s.KeyID)
+	}
+
+	r.Header.Set(TIMESTAMP_HEADER, strconv.FormatInt(timestamp, 10))
+	r.Header.Set(NONCE_HEADER, nonceStr)
+	r.Header.Set(SIGNATURE_HEADER, Sign(s.Secret, timestamp, nonceStr, body))
+	return nil
+}
+
+// Verifier checks signed requests. Secrets are looked up by the request's
+// key id, an empty key id is used for requests without one. Nonces are
+// remembered for twice the allowed skew to reject replayed requests.
+type Verifier struct {
+	Secrets map[string][]byte
+	// defaults to DEFAULT_MAX_SKEW
+	MaxSkew time.Duration
+	// defaults to time.Now
+	Now func() time.Time
+
+	mutex  sync.Mutex
+	nonces map[string]time.Time
+}
+
+func NewVerifier(secrets map[string][]byte) *Verifier {
+	return &Verifier{
+		Secrets: secrets,
+		MaxSkew: DEFAULT_MAX_SKEW,
+	}
+}
+
+func (v *Verifier) maxSkew() time.Duration {
+	if v.MaxSkew > 0 {
+		return v.MaxSkew
+	}
+
+	return DEFAULT_MAX_SKEW
+}
+
+func (v *Verifier) now() time.Time {
+	if v.Now != nil {
+		return v.Now()
+	}
+
+	return time.Now()
+}
+
+// Verify checks the signature headers of a request against its body.
+func (v *Verifier) Verify(header http.Header, body []byte) error {
+	signature := header.Get(SIGNATURE_HEADER)
+	timestampStr := header.Get(TIMESTAMP_HEADER)
+	nonce := header.Get(NONCE_HEADER)
+	if signature == "" || timestampStr == "" || nonce == "" {
+		return ErrMissingSignature
+	}
+
+	secret, ok := v.Secrets[header.Get(KEY_ID_HEADER)]
+	if !ok {
+		return ErrUnknownKey
+	}
+
+	timestamp, err := strconv.ParseInt(timestampStr, 10, 64)
+	if err != nil {
+		return ErrInvalidTimestamp
+	}
+
+	now := v.now()
+	skew := now.Sub(time.Unix(timestamp, 0))
+	if skew < 0 {
+		skew = -skew
+	}
+
+	if skew > v.maxSkew() {
+		return ErrInvalidTimestamp
+	}
+
+	expected := Sign(secret, timestamp, nonce, body)
+	if !hmac.Equal([]byte(expected), []byte(strings.TrimSpace(signature))) {
+		return ErrInvalidSignature
+	}
+
+	return v.useNonce(header.Get(KEY_ID_HEADER)+":"+nonce, now)
+}
+
+func (v *Verifier) useNonce(nonce string, now time.Time) error {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	if v.nonces == nil {
+		v.nonces = make(map[string]time.Time)
+	}
+
+	for n, expires := range v.nonces {
+		if now.After(expires) {
+			delete(v.nonces, n)
+		}
+	}
+
+	if _, ok := v.nonces[nonce]; ok {
+		return ErrReplayed
+	}
+
+	v.nonces[nonce] = now.Add(2 * v.maxSkew())
+	return nil
+}
+
+// Handler only passes requests with a valid signature on to next, others
+// are answered with `401 Unauthorized`.
+func (v *Verifier) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		r.Body.Close()
+		if err != nil {
+			http.Error(w, "error reading body", http.StatusBadRequest)
+			return
+		}
+
+		if err := v.Verify(r.Header, body); err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		next.ServeHTTP(w, r)
+	})
+}
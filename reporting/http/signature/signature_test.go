@@ -0,0 +1,70 @@
+package signature
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+var body = []byte(`{"type":"usage_sample"}`)
+
+func signedHeader(t *testing.T, signer *Signer) http.Header {
+	r, err := http.NewRequest("POST", "http://example.org", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := signer.SignRequest(r, body); err != nil {
+		t.Fatalf("error signing request: %v", err)
+	}
+
+	return r.Header
+}
+
+func TestVerify(t *testing.T) {
+	signer := &Signer{KeyID: "k1", Secret: []byte("secret")}
+
+	// a struct literal uses the default skew
+	v := &Verifier{Secrets: map[string][]byte{"k1": []byte("secret")}}
+	header := signedHeader(t, signer)
+	if err := v.Verify(header, body); err != nil {
+		t.Fatalf("expected a valid signature, got %v", err)
+	}
+
+	if err := v.Verify(header, body); err != ErrReplayed {
+		t.Fatalf("expected the replayed request to be rejected, got %v", err)
+	}
+
+	if err := v.Verify(signedHeader(t, signer), []byte(`{"type":"machine_sample"}`)); err != ErrInvalidSignature {
+		t.Fatalf("expected the tampered body to be rejected, got %v", err)
+	}
+
+	header = signedHeader(t, signer)
+	header.Set(KEY_ID_HEADER, "k2")
+	if err := v.Verify(header, body); err != ErrUnknownKey {
+		t.Fatalf("expected the unknown key to be rejected, got %v", err)
+	}
+
+	header = signedHeader(t, signer)
+	header.Del(NONCE_HEADER)
+	if err := v.Verify(header, body); err != ErrMissingSignature {
+		t.Fatalf("expected the incomplete headers to be rejected, got %v", err)
+	}
+}
+
+func TestVerifyTimestamps(t *testing.T) {
+	signer := &Signer{Secret: []byte("secret")}
+	v := NewVerifier(map[string][]byte{"": []byte("secret")})
+	for _, offset := range []time.Duration{-time.Hour, time.Hour} {
+		// the request was signed an hour before or after the verifier's now
+		v.Now = func() time.Time { return time.Now().Add(-offset) }
+		if err := v.Verify(signedHeader(t, signer), body); err != ErrInvalidTimestamp {
+			t.Errorf("expected a timestamp %v away to be rejected, got %v", offset, err)
+		}
+	}
+
+	v.Now = func() time.Time { return time.Now().Add(time.Minute) }
+	if err := v.Verify(signedHeader(t, signer), body); err != nil {
+		t.Fatalf("expected a timestamp within the skew to pass, got %v", err)
+	}
+}
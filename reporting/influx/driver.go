@@ -0,0 +1,391 @@
+package influx
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/MustWin/cmeter/collector"
+	"github.com/MustWin/cmeter/configuration"
+	"github.com/MustWin/cmeter/containers"
+	"github.com/MustWin/cmeter/context"
+	"github.com/MustWin/cmeter/reporting"
+	"github.com/MustWin/cmeter/reporting/factory"
+)
+
+const (
+	API_V1 = "v1"
+	API_V2 = "v2"
+
+	DEFAULT_PRECISION  = "s"
+	DEFAULT_BATCH_SIZE = 5000
+)
+
+var (
+	ErrInvalidEndpoint  = errors.New("invalid endpoint url")
+	ErrInvalidAPI       = errors.New("invalid api version, must be `v1` or `v2`")
+	ErrInvalidPrecision = errors.New("invalid precision, must be `s`, `ms`, `us` or `ns`")
+	ErrMissingDatabase  = errors.New("the v1 api requires a `database`")
+	ErrMissingBucket    = errors.New("the v2 api requires an `org` and a `bucket`")
+)
+
+var precisions = map[string]int64{
+	"s":  1,
+	"ms": 1e3,
+	"us": 1e6,
+	"ns": 1e9,
+}
+
+type driverFactory struct{}
+
+func (factory *driverFactory) Schema() configuration.Schema {
+	return configuration.Schema{
+		Description: "Writes events in the InfluxDB line protocol.",
+		Parameters: []configuration.Parameter{
+			{Name: "url", Type: configuration.TypeString, Required: true, Description: "InfluxDB url"},
+			{Name: "api", Type: configuration.TypeString, Default: API_V1, Values: []string{API_V1, API_V2}, Description: "`v1` (`/write`) or `v2` (`/api/v2/write`)"},
+			{Name: "database", Type: configuration.TypeString, Description: "v1 database, required with the v1 api"},
+			{Name: "retention_policy", Type: configuration.TypeString, Description: "v1 retention policy"},
+			{Name: "username", Type: configuration.TypeString, Description: "v1 username"},
+			{Name: "password", Type: configuration.TypeString, Description: "v1 password"},
+			{Name: "org", Type: configuration.TypeString, Description: "v2 organization, required with the v2 api"},
+			{Name: "bucket", Type: configuration.TypeString, Description: "v2 bucket, required with the v2 api"},
+			{Name: "token", Type: configuration.TypeString, Description: "v2 token"},
+			{Name: "precision", Type: configuration.TypeString, Default: DEFAULT_PRECISION, Values: []string{"s", "ms", "us", "ns"}, Description: "timestamp precision"},
+			{Name: "tag_labels", Type: configuration.TypeStringList, Description: "container labels added as tags"},
+			{Name: "batch_size", Type: configuration.TypeInt, Default: "5000", Description: "maximum number of events per write request"},
+		},
+	}
+}
+
+func (factory *driverFactory) Create(parameters map[string]interface{}) (reporting.Driver, error) {
+	params := configuration.Parameters(parameters)
+	endpoint := params.String("url", "")
+	if endpoint == "" {
+		return nil, ErrInvalidEndpoint
+	}
+
+	base, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid endpoint url: %v", err)
+	}
+
+	precision := params.String("precision", DEFAULT_PRECISION)
+	if _, ok := precisions[precision]; !ok {
+		return nil, ErrInvalidPrecision
+	}
+
+	query := url.Values{}
+	headers := http.Header{}
+	api := strings.ToLower(params.String("api", API_V1))
+	switch api {
+	case API_V1:
+		database := params.String("database", "")
+		if database == "" {
+			return nil, ErrMissingDatabase
+		}
+
+		base.Path = strings.TrimSuffix(base.Path, "/") + "/write"
+		query.Set("db", database)
+		query.Set("precision", precision)
+		if rp := params.String("retention_policy", ""); rp != "" {
+			query.Set("rp", rp)
+		}
+
+		if username := params.String("username", ""); username != "" {
+			query.Set("u", username)
+			query.Set("p", params.String("password", ""))
+		}
+
+	case API_V2:
+		org := params.String("org", "")
+		bucket := params.String("bucket", "")
+		if org == "" || bucket == "" {
+			return nil, ErrMissingBucket
+		}
+
+		base.Path = strings.TrimSuffix(base.Path, "/") + "/api/v2/write"
+		query.Set("org", org)
+		query.Set("bucket", bucket)
+		query.Set("precision", precision)
+		if token := params.String("token", ""); token != "" {
+			headers.Set("Authorization", "Token "+token)
+		}
+
+	default:
+		return nil, ErrInvalidAPI
+	}
+
+	base.RawQuery = query.Encode()
+
+	tagLabels, err := params.StringList("tag_labels")
+	if err != nil {
+		return nil, err
+	}
+
+	batchSize, err := params.Int("batch_size", DEFAULT_BATCH_SIZE)
+	if err != nil {
+		return nil, err
+	}
+
+	if batchSize < 1 {
+		batchSize = DEFAULT_BATCH_SIZE
+	}
+
+	return &Driver{
+		WriteURL:  base.String(),
+		Headers:   headers,
+		Precision: precision,
+		TagLabels: tagLabels,
+		BatchSize: int(batchSize),
+	}, nil
+}
+
+func init() {
+	factory.Register("influx", &driverFactory{})
+}
+
+// Driver writes events in the InfluxDB line protocol to the v1 `/write` or
+// v2 `/api/v2/write` endpoint, as the `container_usage`, `machine_usage`
+// and `container_state` measurements.
+type Driver struct {
+	WriteURL  string
+	Headers   http.Header
+	Precision string
+	// container labels added as tags
+	TagLabels []string
+	// maximum number of events per write request
+	BatchSize int
+}
+
+func (d *Driver) Report(ctx context.Context, e *reporting.Event) (reporting.Receipt, error) {
+	if _, err := d.ReportBatch(ctx, []*reporting.Event{e}); err != nil {
+		return reporting.EmptyReceipt, err
+	}
+
+	return reporting.EmptyReceipt, nil
+}
+
+func (d *Driver) ReportBatch(ctx context.Context, events []*reporting.Event) ([]reporting.Receipt, error) {
+	receipts := make([]reporting.Receipt, 0, len(events))
+	for start := 0; start < len(events); start += d.BatchSize {
+		end := start + d.BatchSize
+		if end > len(events) {
+			end = len(events)
+		}
+
+		buf := &bytes.Buffer{}
+		for _, e := range events[start:end] {
+			if err := d.writeLine(buf, e); err != nil {
+				return receipts, err
+			}
+		}
+
+		if err := d.write(ctx, buf); err != nil {
+			return receipts, err
+		}
+
+		for i := start; i < end; i++ {
+			receipts = append(receipts, reporting.EmptyReceipt)
+		}
+	}
+
+	return receipts, nil
+}
+
+func (d *Driver) write(ctx context.Context, body *bytes.Buffer) error {
+	r, err := http.NewRequest(http.MethodPost, d.WriteURL, body)
+	if err != nil {
+		return fmt.Errorf("error creating request: %v", err)
+	}
+
+	r.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	r.Header.Set("User-Agent", "cmeter-influx-reporter/"+context.GetVersion(ctx))
+	for hn, hvs := range d.Headers {
+		for _, v := range hvs {
+			r.Header.Add(hn, v)
+		}
+	}
+
+	resp, err := http.DefaultClient.Do(r)
+	if err != nil {
+		return fmt.Errorf("error sending request: %w", err)
+	}
+
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode > 299 || resp.StatusCode < 200 {
+		return reporting.ResponseError(resp)
+	}
+
+	return nil
+}
+
+func (d *Driver) writeLine(buf *bytes.Buffer, e *reporting.Event) error {
+	ts := e.Timestamp * precisions[d.Precision]
+	switch data := e.Data.(type) {
+	case *collector.Sample:
+		if data.Container == nil || data.Usage == nil {
+			return nil
+		}
+
+		fields := []field{
+			{"frame_ms", int64(data.FrameSize.Nanoseconds() / 1e6)},
+		}
+
+		if data.Usage.Cpu != nil {
+			fields = append(fields, field{"cpu_ns", data.Usage.Cpu.Total})
+		}
+
+		if data.Usage.Memory != nil {
+			fields = append(fields, field{"memory_bytes", data.Usage.Memory.Bytes})
+		}
+
+		if data.Usage.Network != nil {
+			fields = append(fields,
+				field{"network_rx_bytes", data.Usage.Network.TotalRxBytes},
+				field{"network_tx_bytes", data.Usage.Network.TotalTxBytes})
+		}
+
+		if data.Usage.Disk != nil {
+			total := uint64(0)
+			for _, v := range data.Usage.Disk.PerDiskIo {
+				total += v
+			}
+
+			fields = append(fields, field{"disk_io_bytes", total})
+		}
+
+		if data.Container.Reserved != nil {
+			fields = append(fields,
+				field{"reserved_cpu", data.Container.Reserved.Cpu},
+				field{"reserved_memory_bytes", data.Container.Reserved.Memory})
+		}
+
+		writePoint(buf, "container_usage", d.containerTags(data.Container), fields, ts)
+
+	case *collector.MachineSample:
+		if data.Machine == nil || data.Usage == nil {
+			return nil
+		}
+
+		fields := []field{
+			{"cores", int64(data.Machine.Cores)},
+			{"memory_capacity_bytes", data.Machine.MemoryBytes},
+		}
+
+		if data.Usage.Cpu != nil {
+			fields = append(fields, field{"cpu_ns", data.Usage.Cpu.Total})
+		}
+
+		if data.Usage.Memory != nil {
+			fields = append(fields, field{"memory_bytes", data.Usage.Memory.Bytes})
+		}
+
+		tags := map[string]string{
+			"machine_uuid": data.Machine.SystemUuid,
+			"machine_name": data.Machine.Name,
+		}
+
+		writePoint(buf, "machine_usage", tags, fields, ts)
+
+	case *containers.StateChange:
+		if data.Container == nil {
+			return nil
+		}
+
+		tags := d.containerTags(data.Container)
+		tags["state"] = string(data.State)
+		fields := []field{{"running", data.State == containers.StateRunning}}
+		if data.Source != nil {
+			fields = append(fields, field{"source_event", string(data.Source.Type)})
+		}
+
+		writePoint(buf, "container_state", tags, fields, ts)
+
+	default:
+		return fmt.Errorf("unsupported event type %q", e.Type)
+	}
+
+	return nil
+}
+
+func (d *Driver) containerTags(info *containers.ContainerInfo) map[string]string {
+	tags := map[string]string{
+		"container_name": info.Name,
+		"image":          info.ImageName,
+		"image_tag":      info.ImageTag,
+	}
+
+	if info.Machine != nil {
+		tags["machine_uuid"] = info.Machine.SystemUuid
+	}
+
+	for _, label := range d.TagLabels {
+		if v, ok := info.Labels[label]; ok {
+			tags[label] = v
+		}
+	}
+
+	return tags
+}
+
+type field struct {
+	key   string
+	value interface{}
+}
+
+// line breaks end a line, they're escaped like the InfluxDB client does
+var (
+	measurementEscaper = strings.NewReplacer(",", `\,`, " ", `\ `, "\n", `\n`, "\r", `\r`, "\t", `\t`)
+	tagEscaper         = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `, "\n", `\n`, "\r", `\r`, "\t", `\t`)
+	stringEscaper      = strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+)
+
+func writePoint(buf *bytes.Buffer, measurement string, tags map[string]string, fields []field, ts int64) {
+	buf.WriteString(measurementEscaper.Replace(measurement))
+
+	keys := make([]string, 0, len(tags))
+	for k, v := range tags {
+		// empty tag values aren't allowed
+		if v != "" {
+			keys = append(keys, k)
+		}
+	}
+
+	sort.Strings(keys)
+	for _, k := range keys {
+		buf.WriteString("," + tagEscaper.Replace(k) + "=" + tagEscaper.Replace(tags[k]))
+	}
+
+	for i, f := range fields {
+		if i == 0 {
+			buf.WriteByte(' ')
+		} else {
+			buf.WriteByte(',')
+		}
+
+		buf.WriteString(tagEscaper.Replace(f.key) + "=")
+		switch v := f.value.(type) {
+		case string:
+			buf.WriteString(`"` + stringEscaper.Replace(v) + `"`)
+		case bool:
+			buf.WriteString(strconv.FormatBool(v))
+		case float64:
+			buf.WriteString(strconv.FormatFloat(v, 'f', -1, 64))
+		case uint64:
+			buf.WriteString(strconv.FormatUint(v, 10) + "i")
+		case int64:
+			buf.WriteString(strconv.FormatInt(v, 10) + "i")
+		}
+	}
+
+	buf.WriteString(" " + strconv.FormatInt(ts, 10) + "\n")
+}
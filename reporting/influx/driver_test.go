@@ -0,0 +1,156 @@
+package influx
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/MustWin/cmeter/collector"
+	"github.com/MustWin/cmeter/containers"
+	"github.com/MustWin/cmeter/context"
+	"github.com/MustWin/cmeter/reporting"
+	"github.com/MustWin/cmeter/reporting/reportingtest"
+)
+
+// write is a write request received by the test server.
+type write struct {
+	path          string
+	query         string
+	authorization string
+	lines         []string
+}
+
+func newServer(writes chan<- *write) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		writes <- &write{
+			path:          r.URL.Path,
+			query:         r.URL.RawQuery,
+			authorization: r.Header.Get("Authorization"),
+			lines:         strings.Split(strings.TrimSuffix(string(body), "\n"), "\n"),
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}))
+}
+
+func newTestDriver(t *testing.T, parameters map[string]interface{}) *Driver {
+	return reportingtest.NewDriver(t, &driverFactory{}, parameters).(*Driver)
+}
+
+func TestEscaping(t *testing.T) {
+	writes := make(chan *write, 1)
+	server := newServer(writes)
+	defer server.Close()
+
+	d := newTestDriver(t, map[string]interface{}{
+		"url":        server.URL,
+		"database":   "metering",
+		"tag_labels": []interface{}{"team name", "tenant=id"},
+	})
+
+	container := &containers.ContainerInfo{
+		Name:      "/web 1,blue",
+		ImageName: "nginx",
+		Labels: map[string]string{
+			"team name": "core, infra",
+			"tenant=id": "acme\nco",
+		},
+	}
+
+	events := []*reporting.Event{
+		{
+			MeterID:   "meter",
+			Type:      reporting.EventSample,
+			Timestamp: 1500000000,
+			Data: &collector.Sample{
+				Timestamp: 1500000000,
+				FrameSize: 15 * time.Second,
+				Container: container,
+				Usage: &containers.Usage{
+					Cpu:    &containers.CpuUsage{Total: 1000},
+					Memory: &containers.MemoryUsage{Bytes: 2048},
+				},
+			},
+		},
+		{
+			MeterID:   "meter",
+			Type:      reporting.EventStateChange,
+			Timestamp: 1500000001,
+			Data: &containers.StateChange{
+				State:     containers.StateRunning,
+				Source:    &containers.Event{Type: containers.EventType(`say "hi" \ bye`)},
+				Container: container,
+			},
+		},
+	}
+
+	if _, err := d.ReportBatch(context.Background(), events); err != nil {
+		t.Fatalf("error writing: %v", err)
+	}
+
+	w := <-writes
+	if w.path != "/write" || w.query != "db=metering&precision=s" {
+		t.Errorf("unexpected write url %s?%s", w.path, w.query)
+	}
+
+	// tags are sorted by key
+	expected := []string{
+		`container_usage,container_name=/web\ 1\,blue,image=nginx,team\ name=core\,\ infra,tenant\=id=acme\nco frame_ms=15000i,cpu_ns=1000i,memory_bytes=2048i 1500000000`,
+		`container_state,container_name=/web\ 1\,blue,image=nginx,state=running,team\ name=core\,\ infra,tenant\=id=acme\nco running=true,source_event="say \"hi\" \\ bye" 1500000001`,
+	}
+
+	if strings.Join(w.lines, "\n") != strings.Join(expected, "\n") {
+		t.Fatalf("expected lines:\n%s\ngot:\n%s", strings.Join(expected, "\n"), strings.Join(w.lines, "\n"))
+	}
+}
+
+func TestV2Write(t *testing.T) {
+	writes := make(chan *write, 2)
+	server := newServer(writes)
+	defer server.Close()
+
+	d := newTestDriver(t, map[string]interface{}{
+		"url":        server.URL + "/",
+		"api":        API_V2,
+		"org":        "acme",
+		"bucket":     "metering",
+		"token":      "secret",
+		"precision":  "ms",
+		"batch_size": 1,
+	})
+
+	events := make([]*reporting.Event, 2)
+	for i := range events {
+		events[i] = &reporting.Event{
+			MeterID:   "meter",
+			Type:      reporting.EventMachineSample,
+			Timestamp: int64(i + 1),
+			Data: &collector.MachineSample{
+				Timestamp: int64(i + 1),
+				Machine:   &containers.MachineInfo{SystemUuid: "machine", Cores: 2},
+				Usage:     &containers.MachineUsage{},
+			},
+		}
+	}
+
+	receipts, err := d.ReportBatch(context.Background(), events)
+	if err != nil || len(receipts) != 2 {
+		t.Fatalf("expected both events written, got %d receipts and %v", len(receipts), err)
+	}
+
+	for i := range events {
+		w := <-writes
+		if w.path != "/api/v2/write" || w.query != "bucket=metering&org=acme&precision=ms" || w.authorization != "Token secret" {
+			t.Errorf("unexpected write to %s?%s authorized by %q", w.path, w.query, w.authorization)
+		}
+
+		expected := "machine_usage,machine_uuid=machine cores=2i,memory_capacity_bytes=0i " + []string{"1000", "2000"}[i]
+		if len(w.lines) != 1 || w.lines[0] != expected {
+			t.Errorf("expected one line per request %q, got %q", expected, w.lines)
+		}
+	}
+}
@@ -0,0 +1,504 @@
+package kafka
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/MustWin/cmeter/collector"
+	"github.com/MustWin/cmeter/configuration"
+	"github.com/MustWin/cmeter/containers"
+	"github.com/MustWin/cmeter/context"
+	"github.com/MustWin/cmeter/reporting"
+	"github.com/MustWin/cmeter/reporting/factory"
+)
+
+const (
+	DEFAULT_CLIENT_ID = "cmeter"
+	DEFAULT_TIMEOUT   = 10 * time.Second
+
+	ACKS_NONE   = 0
+	ACKS_LEADER = 1
+	ACKS_ALL    = -1
+
+	COMPRESSION_NONE = "none"
+	COMPRESSION_GZIP = "gzip"
+)
+
+var (
+	ErrMissingBrokers     = errors.New("at least one broker address is required")
+	ErrMissingTopic       = errors.New("a topic is required")
+	ErrInvalidAcks        = errors.New("invalid acks, must be `all`, `1` or `0`")
+	ErrInvalidCompression = errors.New("invalid compression, must be `none` or `gzip`")
+	ErrIdempotenceAcks    = errors.New("idempotence requires acks to be `all`")
+)
+
+type driverFactory struct{}
+
+func (factory *driverFactory) Schema() configuration.Schema {
+	return configuration.Schema{
+		Description: "Produces events as JSON records to a Kafka topic, keyed by container.",
+		Parameters: []configuration.Parameter{
+			{Name: "brokers", Type: configuration.TypeStringList, Required: true, Description: "bootstrap broker addresses"},
+			{Name: "topic", Type: configuration.TypeString, Required: true, Description: "topic the events are produced to"},
+			{Name: "client_id", Type: configuration.TypeString, Default: DEFAULT_CLIENT_ID, Description: "client id sent to the brokers"},
+			{Name: "acks", Type: configuration.TypeString, Default: "all", Values: []string{"all", "-1", "1", "0"}, Description: "acknowledgements waited for, receipts carry no offset with `0`"},
+			{Name: "compression", Type: configuration.TypeString, Default: COMPRESSION_NONE, Values: []string{COMPRESSION_NONE, COMPRESSION_GZIP}, Description: "record batch compression"},
+			{Name: "idempotent", Type: configuration.TypeBool, Default: "false", Description: "deduplicate retried batches on the brokers, requires acks `all`"},
+			{Name: "timeout", Type: configuration.TypeDuration, Default: "10s", Description: "connect and request timeout"},
+		},
+	}
+}
+
+func (factory *driverFactory) Create(parameters map[string]interface{}) (reporting.Driver, error) {
+	params := configuration.Parameters(parameters)
+	brokers, err := params.StringList("brokers")
+	if err != nil {
+		return nil, err
+	}
+
+	if len(brokers) == 0 {
+		return nil, ErrMissingBrokers
+	}
+
+	topic := params.String("topic", "")
+	if topic == "" {
+		return nil, ErrMissingTopic
+	}
+
+	acks, err := parseAcks(parameters["acks"])
+	if err != nil {
+		return nil, err
+	}
+
+	compression := strings.ToLower(params.String("compression", COMPRESSION_NONE))
+	if compression != COMPRESSION_NONE && compression != COMPRESSION_GZIP {
+		return nil, ErrInvalidCompression
+	}
+
+	idempotent, err := params.Bool("idempotent", false)
+	if err != nil {
+		return nil, err
+	}
+
+	if idempotent && acks != ACKS_ALL {
+		return nil, ErrIdempotenceAcks
+	}
+
+	timeout, err := params.Duration("timeout", DEFAULT_TIMEOUT)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Driver{
+		Brokers:     brokers,
+		Topic:       topic,
+		ClientID:    params.String("client_id", DEFAULT_CLIENT_ID),
+		Acks:        acks,
+		Compression: compression,
+		Idempotent:  idempotent,
+		Timeout:     timeout,
+		conns:       make(map[int32]*conn),
+		sequences:   make(map[int32]int32),
+		producerID:  -1,
+	}, nil
+}
+
+func parseAcks(value interface{}) (int16, error) {
+	if value == nil {
+		return ACKS_ALL, nil
+	}
+
+	switch strings.ToLower(fmt.Sprint(value)) {
+	case "all", "-1":
+		return ACKS_ALL, nil
+	case "1":
+		return ACKS_LEADER, nil
+	case "0":
+		return ACKS_NONE, nil
+	}
+
+	return 0, ErrInvalidAcks
+}
+
+func init() {
+	factory.Register("kafka", &driverFactory{})
+}
+
+// Driver produces events as JSON records to a Kafka topic. Records are keyed
+// by container name, or machine UUID for machine samples, and partitioned
+// like the Java client does, so the events of a container stay ordered in
+// one partition. Receipts have the form `<topic>:<partition>:<offset>`, the
+// offset is missing when acks is 0.
+type Driver struct {
+	Brokers     []string
+	Topic       string
+	ClientID    string
+	Acks        int16
+	Compression string
+	Idempotent  bool
+	Timeout     time.Duration
+
+	mutex sync.Mutex
+	// broker addresses and connections by broker id
+	addrs map[int32]string
+	conns map[int32]*conn
+	// leader broker id by partition, nil when metadata needs a refresh
+	leaders       []int32
+	producerID    int64
+	producerEpoch int16
+	sequences     map[int32]int32
+	roundRobin    int32
+}
+
+func (d *Driver) Report(ctx context.Context, e *reporting.Event) (reporting.Receipt, error) {
+	receipts, err := d.ReportBatch(ctx, []*reporting.Event{e})
+	if err != nil {
+		return reporting.EmptyReceipt, err
+	}
+
+	return receipts[0], nil
+}
+
+func (d *Driver) ReportBatch(ctx context.Context, events []*reporting.Event) ([]reporting.Receipt, error) {
+	records := make([]*record, len(events))
+	for i, e := range events {
+		blob, err := json.Marshal(e)
+		if err != nil {
+			return nil, fmt.Errorf("error encoding event: %v", err)
+		}
+
+		records[i] = &record{
+			key:       eventKey(e),
+			value:     blob,
+			timestamp: e.Timestamp * 1000,
+			headers: [][2]string{
+				{"event_type", e.Type},
+				{"meter_id", e.MeterID},
+			},
+		}
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if d.leaders == nil {
+		if err := d.refreshMetadata(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	if d.Idempotent && d.producerID < 0 {
+		if err := d.initProducer(); err != nil {
+			return nil, err
+		}
+	}
+
+	// records of a partition keep the order of the events
+	sets := make(map[int32]*recordSet)
+	positions := make([]int, len(events))
+	partitions := make([]int32, len(events))
+	for i, r := range records {
+		p := d.partition(r.key)
+		set, ok := sets[p]
+		if !ok {
+			set = &recordSet{
+				partition:     p,
+				producerID:    -1,
+				producerEpoch: -1,
+				baseSequence:  -1,
+			}
+
+			if d.Idempotent {
+				set.producerID = d.producerID
+				set.producerEpoch = d.producerEpoch
+				set.baseSequence = d.sequences[p]
+			}
+
+			sets[p] = set
+		}
+
+		partitions[i] = p
+		positions[i] = len(set.records)
+		set.records = append(set.records, r)
+	}
+
+	byLeader := make(map[int32][]*recordSet)
+	leaderIDs := make([]int, 0)
+	for p, set := range sets {
+		leader := d.leaders[p]
+		if _, ok := byLeader[leader]; !ok {
+			leaderIDs = append(leaderIDs, int(leader))
+		}
+
+		byLeader[leader] = append(byLeader[leader], set)
+	}
+
+	sort.Ints(leaderIDs)
+	offsets := make(map[int32]int64)
+	failed := make(map[int32]error)
+	for _, id := range leaderIDs {
+		leader := int32(id)
+		results, err := d.produce(leader, byLeader[leader])
+		for _, set := range byLeader[leader] {
+			if err != nil {
+				failed[set.partition] = err
+				continue
+			}
+
+			result, ok := results[set.partition]
+			if !ok {
+				offsets[set.partition] = -1
+			} else if result.err != 0 {
+				failed[set.partition] = result.err
+				d.handleError(result.err)
+				continue
+			} else {
+				offsets[set.partition] = result.baseOffset
+			}
+
+			if d.Idempotent {
+				d.sequences[set.partition] = nextSequence(set.baseSequence, len(set.records))
+			}
+		}
+	}
+
+	// only the events up to the first undelivered one are acknowledged,
+	// the rest is sent again with the next attempt
+	receipts := make([]reporting.Receipt, 0, len(events))
+	for i := range events {
+		p := partitions[i]
+		if err, ok := failed[p]; ok {
+			return receipts, err
+		}
+
+		if offsets[p] < 0 {
+			receipts = append(receipts, reporting.Receipt(fmt.Sprintf("%s:%d", d.Topic, p)))
+		} else {
+			receipts = append(receipts, reporting.Receipt(fmt.Sprintf("%s:%d:%d", d.Topic, p, offsets[p]+int64(positions[i]))))
+		}
+	}
+
+	return receipts, nil
+}
+
+func (d *Driver) produce(leader int32, sets []*recordSet) (map[int32]partitionResult, error) {
+	if leader < 0 {
+		d.leaders = nil
+		return nil, Error(5)
+	}
+
+	c, err := d.conn(leader)
+	if err != nil {
+		d.leaders = nil
+		return nil, err
+	}
+
+	compression := compressionNone
+	if d.Compression == COMPRESSION_GZIP {
+		compression = compressionGzip
+	}
+
+	results, err := c.produce(d.Topic, d.Acks, compression, sets)
+	if err != nil {
+		d.closeConn(leader)
+		d.leaders = nil
+	}
+
+	return results, err
+}
+
+func (d *Driver) handleError(err Error) {
+	if err.staleMetadata() {
+		d.leaders = nil
+	}
+
+	if err.staleProducer() {
+		d.producerID = -1
+	}
+}
+
+func (d *Driver) refreshMetadata(ctx context.Context) error {
+	var lastErr error
+	for _, addr := range d.Brokers {
+		c, err := dial(addr, d.ClientID, d.Timeout)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		md, err := c.metadata(d.Topic)
+		c.Close()
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		if md.err != 0 {
+			return md.err
+		}
+
+		if len(md.partitions) == 0 {
+			return Error(3)
+		}
+
+		addrs := make(map[int32]string)
+		for _, b := range md.brokers {
+			addrs[b.id] = b.addr
+		}
+
+		for id, c := range d.conns {
+			if addrs[id] != c.addr {
+				d.closeConn(id)
+			}
+		}
+
+		leaders := make([]int32, len(md.partitions))
+		for _, p := range md.partitions {
+			if int(p.id) >= len(leaders) {
+				return fmt.Errorf("kafka: unexpected partition %d of %d", p.id, len(leaders))
+			}
+
+			leaders[p.id] = p.leader
+			if p.err != 0 && p.err != Error(5) {
+				context.GetLogger(ctx).Warnf("kafka partition %s:%d: %v", d.Topic, p.id, p.err)
+			}
+		}
+
+		d.addrs = addrs
+		d.leaders = leaders
+		return nil
+	}
+
+	return lastErr
+}
+
+func (d *Driver) initProducer() error {
+	c, err := d.conn(d.leaders[0])
+	if err != nil {
+		return err
+	}
+
+	id, epoch, err := c.initProducerID()
+	if err != nil {
+		return fmt.Errorf("error initializing idempotent producer: %w", err)
+	}
+
+	d.producerID = id
+	d.producerEpoch = epoch
+	d.sequences = make(map[int32]int32)
+	return nil
+}
+
+func (d *Driver) conn(id int32) (*conn, error) {
+	if c, ok := d.conns[id]; ok {
+		return c, nil
+	}
+
+	addr, ok := d.addrs[id]
+	if !ok {
+		return nil, fmt.Errorf("kafka: unknown broker %d", id)
+	}
+
+	c, err := dial(addr, d.ClientID, d.Timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	d.conns[id] = c
+	return c, nil
+}
+
+func (d *Driver) closeConn(id int32) {
+	if c, ok := d.conns[id]; ok {
+		c.Close()
+		delete(d.conns, id)
+	}
+}
+
+func (d *Driver) Close() error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	for id := range d.conns {
+		d.closeConn(id)
+	}
+
+	return nil
+}
+
+func (d *Driver) partition(key []byte) int32 {
+	n := int32(len(d.leaders))
+	if key == nil {
+		d.roundRobin = (d.roundRobin + 1) % n
+		return d.roundRobin
+	}
+
+	return (murmur2(key) & 0x7fffffff) % n
+}
+
+func nextSequence(base int32, count int) int32 {
+	// sequences wrap around to 0 after reaching the maximum int32
+	return int32((int64(base) + int64(count)) % (1 << 31))
+}
+
+func eventKey(e *reporting.Event) []byte {
+	switch data := e.Data.(type) {
+	case *collector.Sample:
+		if data.Container != nil {
+			return []byte(data.Container.Name)
+		}
+	case *containers.StateChange:
+		if data.Container != nil {
+			return []byte(data.Container.Name)
+		}
+	case *collector.MachineSample:
+		if data.Machine != nil {
+			return []byte(data.Machine.SystemUuid)
+		}
+	}
+
+	return nil
+}
+
+// murmur2 is the hash of the Java client's default partitioner.
+func murmur2(data []byte) int32 {
+	const (
+		seed = uint32(0x9747b28c)
+		m    = uint32(0x5bd1e995)
+		r    = 24
+	)
+
+	length := len(data)
+	h := seed ^ uint32(length)
+	for i := 0; i+4 <= length; i += 4 {
+		k := uint32(data[i]) | uint32(data[i+1])<<8 | uint32(data[i+2])<<16 | uint32(data[i+3])<<24
+		k *= m
+		k ^= k >> r
+		k *= m
+		h *= m
+		h ^= k
+	}
+
+	tail := length &^ 3
+	switch length % 4 {
+	case 3:
+		h ^= uint32(data[tail+2]) << 16
+		fallthrough
+	case 2:
+		h ^= uint32(data[tail+1]) << 8
+		fallthrough
+	case 1:
+		h ^= uint32(data[tail])
+		h *= m
+	}
+
+	h ^= h >> 13
+	h *= m
+	h ^= h >> 15
+	return int32(h)
+}
@@ -0,0 +1,468 @@
+package kafka
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/MustWin/cmeter/context"
+	"github.com/MustWin/cmeter/reporting"
+	"github.com/MustWin/cmeter/reporting/reportingtest"
+)
+
+// producedRecord is a record decoded by the test broker.
+type producedRecord struct {
+	partition int32
+	key       string
+	value     []byte
+	headers   map[string]string
+}
+
+// produceRequest is a produce request decoded by the test broker.
+type produceRequest struct {
+	acks    int16
+	records []producedRecord
+}
+
+// broker stands in for a single Kafka broker leading every partition of
+// its topic.
+type broker struct {
+	listener   net.Listener
+	topic      string
+	partitions int32
+
+	mutex    sync.Mutex
+	metadata int
+	offsets  map[int32]int64
+	// error codes answered once to the next produce request by partition
+	failures map[int32]Error
+	produced chan *produceRequest
+}
+
+func newBroker(t *testing.T, topic string, partitions int32) *broker {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b := &broker{
+		listener:   listener,
+		topic:      topic,
+		partitions: partitions,
+		offsets:    make(map[int32]int64),
+		failures:   make(map[int32]Error),
+		produced:   make(chan *produceRequest, 16),
+	}
+
+	go b.serve(t)
+	return b
+}
+
+func (b *broker) addr() string {
+	return b.listener.Addr().String()
+}
+
+func (b *broker) Close() error {
+	return b.listener.Close()
+}
+
+func (b *broker) serve(t *testing.T) {
+	for {
+		nc, err := b.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		go func() {
+			defer nc.Close()
+			for {
+				var size [4]byte
+				if _, err := io.ReadFull(nc, size[:]); err != nil {
+					return
+				}
+
+				body := make([]byte, binary.BigEndian.Uint32(size[:]))
+				if _, err := io.ReadFull(nc, body); err != nil {
+					return
+				}
+
+				d := &decoder{buf: body}
+				apiKey := d.int16()
+				d.int16() // version
+				correlationID := d.int32()
+				d.string() // client id
+
+				var resp *encoder
+				switch apiKey {
+				case apiMetadata:
+					resp = b.metadataResponse()
+				case apiProduce:
+					resp = b.produceResponse(t, d)
+				default:
+					t.Errorf("unexpected api key %d", apiKey)
+					return
+				}
+
+				if resp == nil {
+					continue
+				}
+
+				frame := &encoder{}
+				frame.int32(int32(4 + resp.Len()))
+				frame.int32(correlationID)
+				frame.Write(resp.Bytes())
+				if _, err := nc.Write(frame.Bytes()); err != nil {
+					return
+				}
+			}
+		}()
+	}
+}
+
+func (b *broker) metadataResponse() *encoder {
+	b.mutex.Lock()
+	b.metadata++
+	b.mutex.Unlock()
+
+	host, port, _ := net.SplitHostPort(b.addr())
+	portNumber, _ := strconv.Atoi(port)
+
+	resp := &encoder{}
+	resp.int32(1)
+	resp.int32(1) // broker id
+	resp.string(host)
+	resp.int32(int32(portNumber))
+	resp.nullString() // rack
+	resp.int32(1)     // controller id
+	resp.int32(1)
+	resp.int16(0)
+	resp.string(b.topic)
+	resp.int8(0) // is internal
+	resp.int32(b.partitions)
+	for p := int32(0); p < b.partitions; p++ {
+		resp.int16(0)
+		resp.int32(p)
+		resp.int32(1) // leader
+		resp.int32(1)
+		resp.int32(1) // replicas
+		resp.int32(1)
+		resp.int32(1) // isr
+	}
+
+	return resp
+}
+
+// varint reads the zig-zag encoded varints of record batches.
+func varint(t *testing.T, d *decoder) int64 {
+	v, n := binary.Varint(d.buf)
+	if n <= 0 {
+		t.Fatal("invalid varint")
+	}
+
+	d.buf = d.buf[n:]
+	return v
+}
+
+func varbytes(t *testing.T, d *decoder) []byte {
+	n := varint(t, d)
+	if n < 0 {
+		return nil
+	}
+
+	return d.next(int(n))
+}
+
+func decodeBatch(t *testing.T, partition int32, batch []byte) []producedRecord {
+	d := &decoder{buf: batch}
+	d.int64() // base offset
+	if length := d.int32(); int(length) != len(d.buf) {
+		t.Errorf("batch length %d, expected %d", length, len(d.buf))
+	}
+
+	d.int32() // partition leader epoch
+	if magic := d.int8(); magic != recordBatchMagic {
+		t.Errorf("batch magic %d, expected %d", magic, recordBatchMagic)
+	}
+
+	crc := uint32(d.int32())
+	if sum := crc32.Checksum(d.buf, castagnoli); sum != crc {
+		t.Errorf("batch crc %x, expected %x", crc, sum)
+	}
+
+	if compression := d.int16(); compression != compressionNone {
+		t.Errorf("unexpected batch compression %d", compression)
+	}
+
+	lastOffsetDelta := d.int32()
+	d.int64() // first timestamp
+	d.int64() // max timestamp
+	d.int64() // producer id
+	d.int16() // producer epoch
+	d.int32() // base sequence
+	count := d.int32()
+	if lastOffsetDelta != count-1 {
+		t.Errorf("last offset delta %d of %d records", lastOffsetDelta, count)
+	}
+
+	records := make([]producedRecord, 0, count)
+	for i := int32(0); i < count; i++ {
+		rd := &decoder{buf: d.next(int(varint(t, d)))}
+		rd.int8() // attributes
+		varint(t, rd)
+		if delta := varint(t, rd); delta != int64(i) {
+			t.Errorf("record offset delta %d, expected %d", delta, i)
+		}
+
+		r := producedRecord{
+			partition: partition,
+			key:       string(varbytes(t, rd)),
+			value:     varbytes(t, rd),
+			headers:   make(map[string]string),
+		}
+
+		for h := varint(t, rd); h > 0; h-- {
+			r.headers[string(varbytes(t, rd))] = string(varbytes(t, rd))
+		}
+
+		records = append(records, r)
+	}
+
+	if d.err != nil {
+		t.Errorf("error decoding record batch: %v", d.err)
+	}
+
+	return records
+}
+
+func (b *broker) produceResponse(t *testing.T, d *decoder) *encoder {
+	d.string() // transactional id
+	req := &produceRequest{acks: d.int16()}
+	d.int32() // timeout
+
+	type result struct {
+		partition int32
+		err       Error
+		offset    int64
+	}
+
+	var results []result
+	for i, n := int32(0), d.int32(); i < n; i++ {
+		if topic := d.string(); topic != b.topic {
+			t.Errorf("produced to %q, expected %q", topic, b.topic)
+		}
+
+		for j, m := int32(0), d.int32(); j < m; j++ {
+			partition := d.int32()
+			records := decodeBatch(t, partition, d.next(int(d.int32())))
+
+			b.mutex.Lock()
+			r := result{partition: partition, err: b.failures[partition], offset: -1}
+			delete(b.failures, partition)
+			if r.err == 0 {
+				r.offset = b.offsets[partition]
+				b.offsets[partition] += int64(len(records))
+				req.records = append(req.records, records...)
+			}
+
+			b.mutex.Unlock()
+			results = append(results, r)
+		}
+	}
+
+	if d.err != nil {
+		t.Errorf("error decoding produce request: %v", d.err)
+	}
+
+	b.produced <- req
+	if req.acks == ACKS_NONE {
+		return nil
+	}
+
+	resp := &encoder{}
+	resp.int32(1)
+	resp.string(b.topic)
+	resp.int32(int32(len(results)))
+	for _, r := range results {
+		resp.int32(r.partition)
+		resp.int16(int16(r.err))
+		resp.int64(r.offset)
+		resp.int64(-1) // log append time
+	}
+
+	resp.int32(0) // throttle time
+	return resp
+}
+
+func (b *broker) nextRequest(t *testing.T) *produceRequest {
+	select {
+	case req := <-b.produced:
+		return req
+	case <-time.After(5 * time.Second):
+		t.Fatal("no produce request received")
+		return nil
+	}
+}
+
+func newTestDriver(t *testing.T, b *broker, acks string) *Driver {
+	return reportingtest.NewDriver(t, &driverFactory{}, map[string]interface{}{
+		"brokers": []interface{}{b.addr()},
+		"topic":   b.topic,
+		"acks":    acks,
+		"timeout": "5s",
+	}).(*Driver)
+}
+
+// javaPartition is the partition the Java client picks for a key hashed to
+// hash by murmur2.
+func javaPartition(hash int32, partitions int32) int32 {
+	return (hash & 0x7fffffff) % partitions
+}
+
+func TestProduce(t *testing.T) {
+	b := newBroker(t, "events", 4)
+	defer b.Close()
+
+	d := newTestDriver(t, b, "all")
+	defer reporting.Close(d)
+
+	// the hashes of the keys computed by the Java client
+	partitions := map[string]int32{
+		"foobar": javaPartition(-790332482, 4),
+		"21":     javaPartition(-973932308, 4),
+	}
+
+	events := []*reporting.Event{
+		reportingtest.ContainerSample("foobar", 1),
+		reportingtest.ContainerSample("21", 2),
+		reportingtest.ContainerSample("foobar", 3),
+	}
+
+	receipts, err := d.ReportBatch(context.Background(), events)
+	if err != nil {
+		t.Fatalf("error producing: %v", err)
+	}
+
+	req := b.nextRequest(t)
+	if req.acks != ACKS_ALL {
+		t.Errorf("produced with acks %d, expected %d", req.acks, ACKS_ALL)
+	}
+
+	if len(req.records) != len(events) {
+		t.Fatalf("expected %d records, got %d", len(events), len(req.records))
+	}
+
+	var timestamps []int64
+	for _, r := range req.records {
+		if r.partition != partitions[r.key] {
+			t.Errorf("record keyed %q produced to partition %d, expected %d", r.key, r.partition, partitions[r.key])
+		}
+
+		if r.headers["event_type"] != reporting.EventSample || r.headers["meter_id"] != "meter" {
+			t.Errorf("unexpected record headers %v", r.headers)
+		}
+
+		var e reporting.Event
+		if err := json.Unmarshal(r.value, &e); err != nil {
+			t.Fatalf("error decoding record value: %v", err)
+		}
+
+		if r.key == "foobar" {
+			timestamps = append(timestamps, e.Timestamp)
+		}
+	}
+
+	if len(timestamps) != 2 || timestamps[0] != 1 || timestamps[1] != 3 {
+		t.Errorf("expected the records of a key in event order, got timestamps %v", timestamps)
+	}
+
+	expected := []reporting.Receipt{
+		reporting.Receipt(fmt.Sprintf("events:%d:0", partitions["foobar"])),
+		reporting.Receipt(fmt.Sprintf("events:%d:0", partitions["21"])),
+		reporting.Receipt(fmt.Sprintf("events:%d:1", partitions["foobar"])),
+	}
+
+	for i, receipt := range expected {
+		if i >= len(receipts) || receipts[i] != receipt {
+			t.Fatalf("expected receipts %v, got %v", expected, receipts)
+		}
+	}
+}
+
+func TestProduceWithoutAcks(t *testing.T) {
+	b := newBroker(t, "events", 1)
+	defer b.Close()
+
+	d := newTestDriver(t, b, "0")
+	defer reporting.Close(d)
+
+	receipts, err := d.ReportBatch(context.Background(), []*reporting.Event{reportingtest.ContainerSample("web", 1)})
+	if err != nil {
+		t.Fatalf("error producing: %v", err)
+	}
+
+	if req := b.nextRequest(t); req.acks != ACKS_NONE || len(req.records) != 1 {
+		t.Fatalf("expected one record produced with acks 0, got %d with acks %d", len(req.records), req.acks)
+	}
+
+	if len(receipts) != 1 || receipts[0] != "events:0" {
+		t.Fatalf("expected a receipt without offset, got %v", receipts)
+	}
+}
+
+func TestProduceLeaderError(t *testing.T) {
+	b := newBroker(t, "events", 1)
+	defer b.Close()
+
+	d := newTestDriver(t, b, "1")
+	defer reporting.Close(d)
+
+	b.mutex.Lock()
+	b.failures[0] = Error(6)
+	b.mutex.Unlock()
+
+	events := []*reporting.Event{reportingtest.ContainerSample("web", 1)}
+	_, err := d.ReportBatch(context.Background(), events)
+	if kerr, ok := err.(Error); !ok || kerr != Error(6) || !kerr.Temporary() {
+		t.Fatalf("expected a temporary not leader error, got %v", err)
+	}
+
+	if req := b.nextRequest(t); req.acks != ACKS_LEADER {
+		t.Errorf("produced with acks %d, expected %d", req.acks, ACKS_LEADER)
+	}
+
+	receipts, err := d.ReportBatch(context.Background(), events)
+	if err != nil || len(receipts) != 1 || receipts[0] != "events:0:0" {
+		t.Fatalf("expected the retry to be delivered, got %v and %v", receipts, err)
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.metadata != 2 {
+		t.Fatalf("expected the partition leaders to be looked up again, got %d metadata requests", b.metadata)
+	}
+}
+
+func TestMurmur2(t *testing.T) {
+	// values of org.apache.kafka.common.utils.Utils.murmur2
+	hashes := map[string]int32{
+		"21":                         -973932308,
+		"foobar":                     -790332482,
+		"a-little-bit-long-string":   -985981536,
+		"a-little-bit-longer-string": -1486304829,
+		"lkjh234lh9fiuh90y23oiuhsafujhadof229phr9h19h89h8": -58897971,
+		"abc": 479470107,
+	}
+
+	for key, hash := range hashes {
+		if h := murmur2([]byte(key)); h != hash {
+			t.Errorf("murmur2(%q) = %d, expected %d", key, h, hash)
+		}
+	}
+}
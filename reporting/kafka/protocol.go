@@ -0,0 +1,510 @@
+package kafka
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"time"
+)
+
+// The driver speaks the few Kafka protocol requests a producer needs,
+// see https://kafka.apache.org/protocol for their layout.
+
+const (
+	apiProduce        = 0
+	apiMetadata       = 3
+	apiInitProducerID = 22
+
+	produceVersion        = 3
+	metadataVersion       = 1
+	initProducerIDVersion = 0
+
+	compressionNone = 0
+	compressionGzip = 1
+
+	recordBatchMagic = 2
+)
+
+var (
+	errShortResponse = errors.New("kafka: short response")
+
+	castagnoli = crc32.MakeTable(crc32.Castagnoli)
+)
+
+// Error is an error code returned by a Kafka broker.
+type Error int16
+
+var errorMessages = map[Error]string{
+	-1: "unknown server error",
+	1:  "offset out of range",
+	2:  "corrupt message",
+	3:  "unknown topic or partition",
+	5:  "leader not available",
+	6:  "not leader for partition",
+	7:  "request timed out",
+	10: "message too large",
+	14: "coordinator load in progress",
+	19: "not enough replicas",
+	20: "not enough replicas after append",
+	29: "topic authorization failed",
+	31: "cluster authorization failed",
+	45: "out of order sequence number",
+	46: "duplicate sequence number",
+	47: "invalid producer epoch",
+	59: "unknown producer id",
+}
+
+func (err Error) Error() string {
+	if msg, ok := errorMessages[err]; ok {
+		return fmt.Sprintf("kafka: %s (%d)", msg, int16(err))
+	}
+
+	return fmt.Sprintf("kafka: error code %d", int16(err))
+}
+
+// Temporary tells whether a later attempt may succeed, once the partition
+// leaders or the producer id are renewed or the brokers caught up.
+func (err Error) Temporary() bool {
+	switch err {
+	case 7, 14, 19, 20:
+		return true
+	}
+
+	return err.staleMetadata() || err.staleProducer()
+}
+
+// staleMetadata tells whether the partition leaders have to be looked up
+// again before retrying.
+func (err Error) staleMetadata() bool {
+	switch err {
+	case 3, 5, 6:
+		return true
+	}
+
+	return false
+}
+
+// staleProducer tells whether the producer id has to be renewed.
+func (err Error) staleProducer() bool {
+	switch err {
+	case 45, 47, 59:
+		return true
+	}
+
+	return false
+}
+
+type encoder struct {
+	bytes.Buffer
+}
+
+func (e *encoder) int8(v int8) {
+	e.WriteByte(byte(v))
+}
+
+func (e *encoder) int16(v int16) {
+	var buf [2]byte
+	binary.BigEndian.PutUint16(buf[:], uint16(v))
+	e.Write(buf[:])
+}
+
+func (e *encoder) int32(v int32) {
+	var buf [4]byte
+	binary.BigEndian.PutUint32(buf[:], uint32(v))
+	e.Write(buf[:])
+}
+
+func (e *encoder) int64(v int64) {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], uint64(v))
+	e.Write(buf[:])
+}
+
+func (e *encoder) string(s string) {
+	e.int16(int16(len(s)))
+	e.WriteString(s)
+}
+
+func (e *encoder) nullString() {
+	e.int16(-1)
+}
+
+func (e *encoder) bytes(b []byte) {
+	e.int32(int32(len(b)))
+	e.Write(b)
+}
+
+// varint writes the zig-zag encoded varints used inside record batches.
+func (e *encoder) varint(v int64) {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutVarint(buf[:], v)
+	e.Write(buf[:n])
+}
+
+func (e *encoder) varbytes(b []byte) {
+	if b == nil {
+		e.varint(-1)
+		return
+	}
+
+	e.varint(int64(len(b)))
+	e.Write(b)
+}
+
+type decoder struct {
+	buf []byte
+	err error
+}
+
+func (d *decoder) next(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+
+	if n < 0 || len(d.buf) < n {
+		d.err = errShortResponse
+		return nil
+	}
+
+	b := d.buf[:n]
+	d.buf = d.buf[n:]
+	return b
+}
+
+func (d *decoder) int8() int8 {
+	if b := d.next(1); b != nil {
+		return int8(b[0])
+	}
+
+	return 0
+}
+
+func (d *decoder) int16() int16 {
+	if b := d.next(2); b != nil {
+		return int16(binary.BigEndian.Uint16(b))
+	}
+
+	return 0
+}
+
+func (d *decoder) int32() int32 {
+	if b := d.next(4); b != nil {
+		return int32(binary.BigEndian.Uint32(b))
+	}
+
+	return 0
+}
+
+func (d *decoder) int64() int64 {
+	if b := d.next(8); b != nil {
+		return int64(binary.BigEndian.Uint64(b))
+	}
+
+	return 0
+}
+
+func (d *decoder) string() string {
+	n := d.int16()
+	if n < 0 {
+		return ""
+	}
+
+	return string(d.next(int(n)))
+}
+
+func (d *decoder) int32Array() []int32 {
+	n := d.int32()
+	values := make([]int32, 0)
+	for i := int32(0); i < n && d.err == nil; i++ {
+		values = append(values, d.int32())
+	}
+
+	return values
+}
+
+// conn is a connection to a single broker. Requests are sent one at a time.
+type conn struct {
+	addr          string
+	clientID      string
+	timeout       time.Duration
+	nc            net.Conn
+	correlationID int32
+}
+
+func dial(addr string, clientID string, timeout time.Duration) (*conn, error) {
+	nc, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to kafka broker %s: %w", addr, err)
+	}
+
+	return &conn{
+		addr:     addr,
+		clientID: clientID,
+		timeout:  timeout,
+		nc:       nc,
+	}, nil
+}
+
+func (c *conn) Close() error {
+	return c.nc.Close()
+}
+
+// roundTrip sends a request and reads its response body, unless the
+// request doesn't expect one.
+func (c *conn) roundTrip(apiKey int16, version int16, body []byte, expectResponse bool) (*decoder, error) {
+	c.correlationID++
+	req := &encoder{}
+	req.int32(0)
+	req.int16(apiKey)
+	req.int16(version)
+	req.int32(c.correlationID)
+	req.string(c.clientID)
+	req.Write(body)
+
+	blob := req.Bytes()
+	binary.BigEndian.PutUint32(blob, uint32(len(blob)-4))
+
+	c.nc.SetDeadline(time.Now().Add(c.timeout))
+	if _, err := c.nc.Write(blob); err != nil {
+		return nil, fmt.Errorf("error sending request to kafka broker %s: %w", c.addr, err)
+	}
+
+	if !expectResponse {
+		return nil, nil
+	}
+
+	var header [8]byte
+	if _, err := io.ReadFull(c.nc, header[:]); err != nil {
+		return nil, fmt.Errorf("error reading response from kafka broker %s: %w", c.addr, err)
+	}
+
+	size := int32(binary.BigEndian.Uint32(header[:4]))
+	if size < 4 {
+		return nil, errShortResponse
+	}
+
+	if id := int32(binary.BigEndian.Uint32(header[4:])); id != c.correlationID {
+		return nil, fmt.Errorf("kafka broker %s answered request %d, expected %d", c.addr, id, c.correlationID)
+	}
+
+	resp := make([]byte, size-4)
+	if _, err := io.ReadFull(c.nc, resp); err != nil {
+		return nil, fmt.Errorf("error reading response from kafka broker %s: %w", c.addr, err)
+	}
+
+	return &decoder{buf: resp}, nil
+}
+
+type brokerMetadata struct {
+	id   int32
+	addr string
+}
+
+type partitionMetadata struct {
+	id     int32
+	leader int32
+	err    Error
+}
+
+type topicMetadata struct {
+	brokers    []brokerMetadata
+	err        Error
+	partitions []partitionMetadata
+}
+
+func (c *conn) metadata(topic string) (*topicMetadata, error) {
+	req := &encoder{}
+	req.int32(1)
+	req.string(topic)
+
+	d, err := c.roundTrip(apiMetadata, metadataVersion, req.Bytes(), true)
+	if err != nil {
+		return nil, err
+	}
+
+	md := &topicMetadata{}
+	for i, n := int32(0), d.int32(); i < n && d.err == nil; i++ {
+		b := brokerMetadata{id: d.int32()}
+		host := d.string()
+		port := d.int32()
+		d.string() // rack
+		b.addr = net.JoinHostPort(host, fmt.Sprint(port))
+		md.brokers = append(md.brokers, b)
+	}
+
+	d.int32() // controller id
+	for i, n := int32(0), d.int32(); i < n && d.err == nil; i++ {
+		topicErr := Error(d.int16())
+		name := d.string()
+		d.int8() // is internal
+		partitions := make([]partitionMetadata, 0)
+		for j, m := int32(0), d.int32(); j < m && d.err == nil; j++ {
+			p := partitionMetadata{err: Error(d.int16())}
+			p.id = d.int32()
+			p.leader = d.int32()
+			d.int32Array() // replicas
+			d.int32Array() // isr
+			partitions = append(partitions, p)
+		}
+
+		if name == topic {
+			md.err = topicErr
+			md.partitions = partitions
+		}
+	}
+
+	return md, d.err
+}
+
+func (c *conn) initProducerID() (int64, int16, error) {
+	req := &encoder{}
+	req.nullString()
+	req.int32(int32(c.timeout / time.Millisecond))
+
+	d, err := c.roundTrip(apiInitProducerID, initProducerIDVersion, req.Bytes(), true)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	d.int32() // throttle time
+	code := Error(d.int16())
+	id := d.int64()
+	epoch := d.int16()
+	if d.err != nil {
+		return 0, 0, d.err
+	}
+
+	if code != 0 {
+		return 0, 0, code
+	}
+
+	return id, epoch, nil
+}
+
+type record struct {
+	key       []byte
+	value     []byte
+	timestamp int64
+	headers   [][2]string
+}
+
+// recordSet is a record batch of one partition in a produce request.
+type recordSet struct {
+	partition     int32
+	records       []*record
+	producerID    int64
+	producerEpoch int16
+	baseSequence  int32
+}
+
+type partitionResult struct {
+	err        Error
+	baseOffset int64
+}
+
+func (rs *recordSet) encode(compression int) ([]byte, error) {
+	first := rs.records[0].timestamp
+	max := first
+	records := &encoder{}
+	for i, r := range rs.records {
+		if r.timestamp > max {
+			max = r.timestamp
+		}
+
+		rec := &encoder{}
+		rec.int8(0) // attributes
+		rec.varint(r.timestamp - first)
+		rec.varint(int64(i))
+		rec.varbytes(r.key)
+		rec.varbytes(r.value)
+		rec.varint(int64(len(r.headers)))
+		for _, h := range r.headers {
+			rec.varbytes([]byte(h[0]))
+			rec.varbytes([]byte(h[1]))
+		}
+
+		records.varint(int64(rec.Len()))
+		records.Write(rec.Bytes())
+	}
+
+	payload := records.Bytes()
+	if compression == compressionGzip {
+		buf := &bytes.Buffer{}
+		w := gzip.NewWriter(buf)
+		if _, err := w.Write(payload); err != nil {
+			return nil, err
+		}
+
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+
+		payload = buf.Bytes()
+	}
+
+	// everything after the crc field, which covers it
+	tail := &encoder{}
+	tail.int16(int16(compression))
+	tail.int32(int32(len(rs.records) - 1))
+	tail.int64(first)
+	tail.int64(max)
+	tail.int64(rs.producerID)
+	tail.int16(rs.producerEpoch)
+	tail.int32(rs.baseSequence)
+	tail.int32(int32(len(rs.records)))
+	tail.Write(payload)
+
+	batch := &encoder{}
+	batch.int64(0) // base offset
+	batch.int32(int32(4 + 1 + 4 + tail.Len()))
+	batch.int32(-1) // partition leader epoch
+	batch.int8(recordBatchMagic)
+	batch.int32(int32(crc32.Checksum(tail.Bytes(), castagnoli)))
+	batch.Write(tail.Bytes())
+	return batch.Bytes(), nil
+}
+
+// produce sends the record sets of a topic, the results are keyed by
+// partition and empty when acks is 0.
+func (c *conn) produce(topic string, acks int16, compression int, sets []*recordSet) (map[int32]partitionResult, error) {
+	req := &encoder{}
+	req.nullString() // transactional id
+	req.int16(acks)
+	req.int32(int32(c.timeout / time.Millisecond))
+	req.int32(1)
+	req.string(topic)
+	req.int32(int32(len(sets)))
+	for _, rs := range sets {
+		batch, err := rs.encode(compression)
+		if err != nil {
+			return nil, fmt.Errorf("error encoding record batch: %v", err)
+		}
+
+		req.int32(rs.partition)
+		req.bytes(batch)
+	}
+
+	d, err := c.roundTrip(apiProduce, produceVersion, req.Bytes(), acks != 0)
+	if err != nil || d == nil {
+		return nil, err
+	}
+
+	results := make(map[int32]partitionResult)
+	for i, n := int32(0), d.int32(); i < n && d.err == nil; i++ {
+		d.string() // topic
+		for j, m := int32(0), d.int32(); j < m && d.err == nil; j++ {
+			partition := d.int32()
+			result := partitionResult{err: Error(d.int16())}
+			result.baseOffset = d.int64()
+			d.int64() // log append time
+			results[partition] = result
+		}
+	}
+
+	return results, d.err
+}
@@ -3,6 +3,7 @@ package mock
 import (
 	"fmt"
 
+	"github.com/MustWin/cmeter/configuration"
 	"github.com/MustWin/cmeter/context"
 	"github.com/MustWin/cmeter/reporting"
 	"github.com/MustWin/cmeter/reporting/factory"
@@ -10,6 +11,12 @@ import (
 
 type driverFactory struct{}
 
+func (factory *driverFactory) Schema() configuration.Schema {
+	return configuration.Schema{
+		Description: "Counts and logs events, for testing.",
+	}
+}
+
 func (factory *driverFactory) Create(_ map[string]interface{}) (reporting.Driver, error) {
 	return &Driver{}, nil
 }
@@ -28,3 +35,14 @@ func (d *Driver) Report(ctx context.Context, e *reporting.Event) (reporting.Rece
 	context.GetLogger(ctx).Infof("report#%d: %+#v", d.Counter, e)
 	return reporting.Receipt(receipt), nil
 }
+
+func (d *Driver) ReportBatch(ctx context.Context, events []*reporting.Event) ([]reporting.Receipt, error) {
+	receipts := make([]reporting.Receipt, len(events))
+	for i, e := range events {
+		d.Counter++
+		receipts[i] = reporting.Receipt(fmt.Sprintf("event#%d", d.Counter))
+		context.GetLogger(ctx).Infof("report#%d (batch of %d): %+#v", d.Counter, len(events), e)
+	}
+
+	return receipts, nil
+}
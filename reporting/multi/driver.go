@@ -0,0 +1,494 @@
+package multi
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/MustWin/cmeter/collector"
+	"github.com/MustWin/cmeter/configuration"
+	"github.com/MustWin/cmeter/containers"
+	"github.com/MustWin/cmeter/context"
+	"github.com/MustWin/cmeter/reporting"
+	"github.com/MustWin/cmeter/reporting/factory"
+)
+
+const (
+	ANY_VALUE = "*"
+
+	// events remembered as delivered to some destinations only
+	MAX_PARTIAL_DELIVERIES = 10000
+)
+
+var ErrNoDestinations = errors.New("no reporting destinations configured")
+
+type driverFactory struct{}
+
+func (factory *driverFactory) Schema() configuration.Schema {
+	return configuration.Schema{
+		Description: "Fans out events to several reporting drivers.",
+		Parameters: []configuration.Parameter{
+			{
+				Name:        "destinations",
+				Type:        configuration.TypeMap,
+				Required:    true,
+				Description: "destinations by name",
+				Parameters: []configuration.Parameter{
+					{Name: "driver", Type: configuration.TypeString, Required: true, Description: "reporting driver of the destination"},
+					{Name: "parameters", Type: configuration.TypeMap, Description: "parameters of the driver"},
+					{Name: "events", Type: configuration.TypeStringList, Values: []string{reporting.EventSample, reporting.EventStateChange, reporting.EventMachineSample}, Description: "event types routed to the destination, all when omitted"},
+					{Name: "labels", Type: configuration.TypeStringMap, Description: "container labels required for an event to be routed to the destination, `*` matches any value"},
+					{Name: "required", Type: configuration.TypeBool, Default: "true", Description: "failures cause the event to be retried, otherwise they are only logged"},
+				},
+			},
+		},
+	}
+}
+
+// createFunc creates, or only validates, the driver of a destination.
+type createFunc func(name string, parameters map[string]interface{}) (reporting.Driver, error)
+
+func newDestinations(parameters map[string]interface{}, create createFunc) ([]*Destination, error) {
+	destinations, err := configuration.Parameters(parameters).Sub("destinations")
+	if err != nil {
+		return nil, err
+	}
+
+	if len(destinations) == 0 {
+		return nil, ErrNoDestinations
+	}
+
+	names := make([]string, 0, len(destinations))
+	for name := range destinations {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	dests := make([]*Destination, 0, len(names))
+	for _, name := range names {
+		dest, err := newDestination(name, destinations[name], create)
+		if err != nil {
+			(&Driver{Destinations: dests}).Close()
+			return nil, fmt.Errorf("invalid destination %q: %v", name, err)
+		}
+
+		dests = append(dests, dest)
+	}
+
+	return dests, nil
+}
+
+func (factory *driverFactory) Create(parameters map[string]interface{}) (reporting.Driver, error) {
+	dests, err := newDestinations(parameters, createDriver)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Driver{Destinations: dests}, nil
+}
+
+// Validate validates the destinations' drivers instead of creating them.
+func (factory *driverFactory) Validate(parameters map[string]interface{}) error {
+	_, err := newDestinations(parameters, validateDriver)
+	return err
+}
+
+func createDriver(name string, parameters map[string]interface{}) (reporting.Driver, error) {
+	return factory.Create(name, parameters)
+}
+
+func validateDriver(name string, parameters map[string]interface{}) (reporting.Driver, error) {
+	return nil, factory.Validate(name, parameters)
+}
+
+func init() {
+	factory.Register("multi", &driverFactory{})
+}
+
+type Destination struct {
+	Name   string
+	Driver reporting.Driver
+	// event types routed to the destination, all when empty
+	Events []string
+	// container labels an event's container must carry, a value of "*"
+	// matches any value
+	Labels map[string]string
+	// failures of required destinations fail the whole report
+	Required bool
+}
+
+func newDestination(name string, raw interface{}, create createFunc) (*Destination, error) {
+	params, ok := configuration.ToParameters(raw)
+	if !ok {
+		return nil, fmt.Errorf("destination must be a map")
+	}
+
+	driverType := params.String("driver", "")
+	if driverType == "" {
+		return nil, fmt.Errorf("driver not specified")
+	}
+
+	driverParams, err := params.Sub("parameters")
+	if err != nil {
+		return nil, err
+	}
+
+	if driverParams == nil {
+		driverParams = make(configuration.Parameters)
+	}
+
+	events, err := params.StringList("events")
+	if err != nil {
+		return nil, err
+	}
+
+	labelParams, err := params.Sub("labels")
+	if err != nil {
+		return nil, err
+	}
+
+	labels := make(map[string]string, len(labelParams))
+	for k := range labelParams {
+		labels[k] = labelParams.String(k, ANY_VALUE)
+	}
+
+	required, err := params.Bool("required", true)
+	if err != nil {
+		return nil, err
+	}
+
+	driver, err := create(driverType, driverParams)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Destination{
+		Name:     name,
+		Driver:   driver,
+		Events:   events,
+		Labels:   labels,
+		Required: required,
+	}, nil
+}
+
+func eventLabels(e *reporting.Event) (map[string]string, bool) {
+	switch data := e.Data.(type) {
+	case *collector.Sample:
+		if data.Container != nil {
+			return data.Container.Labels, true
+		}
+	case *containers.StateChange:
+		if data.Container != nil {
+			return data.Container.Labels, true
+		}
+	}
+
+	return nil, false
+}
+
+// Matches reports whether the event is routed to the destination. Events
+// without a container, like machine samples, only match destinations
+// without label selectors.
+func (dest *Destination) Matches(e *reporting.Event) bool {
+	if len(dest.Events) > 0 {
+		found := false
+		for _, t := range dest.Events {
+			if t == e.Type {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return false
+		}
+	}
+
+	if len(dest.Labels) == 0 {
+		return true
+	}
+
+	labels, ok := eventLabels(e)
+	if !ok {
+		return false
+	}
+
+	for k, expected := range dest.Labels {
+		v, ok := labels[k]
+		if !ok || (expected != ANY_VALUE && v != expected) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Driver fans events out to several destinations in parallel. Receipts
+// combine the destinations' receipts as `name:receipt` pairs. When a
+// required destination fails, the destinations that received an event
+// are remembered, so retries and spool replays of the event only resend
+// it to the destinations that didn't. Those deliveries are kept in
+// memory: after a restart or reload every destination receives the event
+// again.
+type Driver struct {
+	Destinations []*Destination
+
+	partials partialDeliveries
+}
+
+func (d *Driver) Report(ctx context.Context, e *reporting.Event) (reporting.Receipt, error) {
+	receipts, err := d.ReportBatch(ctx, []*reporting.Event{e})
+	if len(receipts) > 0 {
+		return receipts[0], err
+	}
+
+	return reporting.EmptyReceipt, err
+}
+
+// Close closes the destinations' drivers.
+func (d *Driver) Close() error {
+	var errs []string
+	for _, dest := range d.Destinations {
+		if err := reporting.Close(dest.Driver); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", dest.Name, err))
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("error closing destinations: %s", strings.Join(errs, "; "))
+	}
+
+	return nil
+}
+
+type destinationResult struct {
+	dest *Destination
+	// indices of the events sent to the destination
+	indices  []int
+	receipts []reporting.Receipt
+	err      error
+}
+
+func (d *Driver) ReportBatch(ctx context.Context, events []*reporting.Event) ([]reporting.Receipt, error) {
+	keys := make([]string, len(events))
+	for i, e := range events {
+		keys[i] = eventKey(e)
+	}
+
+	// receipts of the destinations by event, including earlier deliveries
+	destReceipts := make([]map[string]reporting.Receipt, len(events))
+	for i := range events {
+		destReceipts[i] = d.partials.receipts(keys[i])
+	}
+
+	results := make([]*destinationResult, 0, len(d.Destinations))
+	for _, dest := range d.Destinations {
+		res := &destinationResult{dest: dest}
+		for i, e := range events {
+			if _, delivered := destReceipts[i][dest.Name]; !delivered && dest.Matches(e) {
+				res.indices = append(res.indices, i)
+			}
+		}
+
+		if len(res.indices) > 0 {
+			results = append(results, res)
+		}
+	}
+
+	var wg sync.WaitGroup
+	for _, res := range results {
+		wg.Add(1)
+		go func(res *destinationResult) {
+			defer wg.Done()
+			routed := make([]*reporting.Event, len(res.indices))
+			for i, index := range res.indices {
+				routed[i] = events[index]
+			}
+
+			dctx := context.WithLogger(ctx, context.GetLoggerWithField(ctx, "reporting.destination", res.dest.Name))
+			if len(routed) == 1 {
+				receipt, err := res.dest.Driver.Report(dctx, routed[0])
+				if err == nil {
+					res.receipts = []reporting.Receipt{receipt}
+				}
+
+				res.err = err
+			} else {
+				res.receipts, res.err = reporting.ReportBatch(dctx, res.dest.Driver, routed)
+			}
+		}(res)
+	}
+
+	wg.Wait()
+
+	delivered := len(events)
+	errs := make([]string, 0)
+	// events a required destination holds back, by index
+	held := make(map[int]bool)
+	var heldReasons []string
+	for _, res := range results {
+		for i, receipt := range res.receipts {
+			if i < len(res.indices) {
+				destReceipts[res.indices[i]][res.dest.Name] = receipt
+			}
+		}
+
+		if res.err == nil {
+			continue
+		}
+
+		if !res.dest.Required {
+			context.GetLogger(ctx).Errorf("error reporting to optional destination %q: %v", res.dest.Name, res.err)
+			continue
+		}
+
+		var heldErr reporting.HeldError
+		if errors.As(res.err, &heldErr) && len(heldErr.Held) > 0 && len(res.receipts) >= len(res.indices) {
+			for _, i := range heldErr.Held {
+				if i < len(res.indices) {
+					held[res.indices[i]] = true
+					delete(destReceipts[res.indices[i]], res.dest.Name)
+				}
+			}
+
+			heldReasons = append(heldReasons, fmt.Sprintf("%s: %s", res.dest.Name, heldErr.Reason))
+			continue
+		}
+
+		if len(res.receipts) >= len(res.indices) {
+			context.GetLogger(ctx).Errorf("error reporting to destination %q after delivering every event: %v", res.dest.Name, res.err)
+			continue
+		}
+
+		errs = append(errs, fmt.Sprintf("%s: %v", res.dest.Name, res.err))
+		if failed := res.indices[len(res.receipts)]; failed < delivered {
+			delivered = failed
+		}
+	}
+
+	// held events only skip the receipts of the others, unless another
+	// destination failed
+	if len(errs) > 0 {
+		for i := range held {
+			if i < delivered {
+				delivered = i
+			}
+		}
+	}
+
+	var heldIndices []int
+	receipts := make([]reporting.Receipt, delivered)
+	for i := range events {
+		if i < delivered && held[i] {
+			heldIndices = append(heldIndices, i)
+		}
+
+		if i >= delivered || held[i] {
+			d.partials.remember(keys[i], destReceipts[i])
+			continue
+		}
+
+		d.partials.forget(keys[i])
+		parts := make([]string, 0, len(destReceipts[i]))
+		for _, dest := range d.Destinations {
+			if receipt, ok := destReceipts[i][dest.Name]; ok {
+				parts = append(parts, fmt.Sprintf("%s:%s", dest.Name, receipt))
+			}
+		}
+
+		receipts[i] = reporting.Receipt(strings.Join(parts, ","))
+	}
+
+	if len(errs) > 0 {
+		return receipts, fmt.Errorf("error reporting to destinations: %s", strings.Join(errs, "; "))
+	}
+
+	if len(heldIndices) > 0 {
+		return receipts, reporting.HeldError{Reason: strings.Join(heldReasons, "; "), Held: heldIndices}
+	}
+
+	return receipts, nil
+}
+
+// eventKey identifies an event across retries and spool replays, which
+// decode it again from the spool.
+func eventKey(e *reporting.Event) string {
+	blob, err := json.Marshal(e)
+	if err != nil {
+		return ""
+	}
+
+	sum := sha256.Sum256(blob)
+	return hex.EncodeToString(sum[:])
+}
+
+// partialDeliveries holds the receipts of the destinations that received
+// events other required destinations failed, by event key. The oldest
+// events are forgotten beyond MAX_PARTIAL_DELIVERIES.
+type partialDeliveries struct {
+	mutex  sync.Mutex
+	events map[string]*list.Element
+	order  *list.List
+}
+
+type partialDelivery struct {
+	key      string
+	receipts map[string]reporting.Receipt
+}
+
+// receipts returns a copy of the event's receipts by destination.
+func (p *partialDeliveries) receipts(key string) map[string]reporting.Receipt {
+	receipts := make(map[string]reporting.Receipt)
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if elem, ok := p.events[key]; ok && key != "" {
+		for name, receipt := range elem.Value.(*partialDelivery).receipts {
+			receipts[name] = receipt
+		}
+	}
+
+	return receipts
+}
+
+func (p *partialDeliveries) remember(key string, receipts map[string]reporting.Receipt) {
+	if key == "" || len(receipts) == 0 {
+		return
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.events == nil {
+		p.events = make(map[string]*list.Element)
+		p.order = list.New()
+	}
+
+	if elem, ok := p.events[key]; ok {
+		elem.Value.(*partialDelivery).receipts = receipts
+		return
+	}
+
+	p.events[key] = p.order.PushBack(&partialDelivery{key: key, receipts: receipts})
+	for p.order.Len() > MAX_PARTIAL_DELIVERIES {
+		oldest := p.order.Front()
+		p.order.Remove(oldest)
+		delete(p.events, oldest.Value.(*partialDelivery).key)
+	}
+}
+
+func (p *partialDeliveries) forget(key string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if elem, ok := p.events[key]; ok {
+		p.order.Remove(elem)
+		delete(p.events, key)
+	}
+}
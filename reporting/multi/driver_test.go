@@ -0,0 +1,132 @@
+package multi
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/MustWin/cmeter/context"
+	"github.com/MustWin/cmeter/reporting"
+)
+
+// countingDriver counts the events it receives and fails while failures
+// are left.
+type countingDriver struct {
+	received int
+	failures int
+	// receipts returned along with the failures
+	failedReceipts int
+}
+
+func (d *countingDriver) Report(ctx context.Context, e *reporting.Event) (reporting.Receipt, error) {
+	receipts, err := d.ReportBatch(ctx, []*reporting.Event{e})
+	if len(receipts) > 0 {
+		return receipts[0], err
+	}
+
+	return reporting.EmptyReceipt, err
+}
+
+func (d *countingDriver) ReportBatch(ctx context.Context, events []*reporting.Event) ([]reporting.Receipt, error) {
+	d.received += len(events)
+	if d.failures > 0 {
+		d.failures--
+		return make([]reporting.Receipt, d.failedReceipts), errors.New("unavailable")
+	}
+
+	return make([]reporting.Receipt, len(events)), nil
+}
+
+func testEvents() []*reporting.Event {
+	return []*reporting.Event{
+		{MeterID: "meter", Type: reporting.EventSample, Timestamp: 1},
+		{MeterID: "meter", Type: reporting.EventSample, Timestamp: 2},
+	}
+}
+
+func TestRetryOnlyResendsToFailedDestinations(t *testing.T) {
+	healthy := &countingDriver{}
+	failing := &countingDriver{failures: 1}
+	d := &Driver{Destinations: []*Destination{
+		{Name: "healthy", Driver: healthy, Required: true},
+		{Name: "failing", Driver: failing, Required: true},
+	}}
+
+	ctx := context.Background()
+	if receipts, err := d.ReportBatch(ctx, testEvents()); err == nil || len(receipts) != 0 {
+		t.Fatalf("expected the batch to fail without receipts, got %d receipts and %v", len(receipts), err)
+	}
+
+	// a spool replay decodes new events
+	receipts, err := d.ReportBatch(ctx, testEvents())
+	if err != nil || len(receipts) != 2 {
+		t.Fatalf("expected the batch to be delivered, got %d receipts and %v", len(receipts), err)
+	}
+
+	if receipts[0] != "healthy:,failing:" {
+		t.Fatalf("expected the receipts of both destinations, got %q", receipts[0])
+	}
+
+	if healthy.received != 2 {
+		t.Fatalf("expected the healthy destination to receive the events once, got %d events", healthy.received)
+	}
+
+	if failing.received != 4 {
+		t.Fatalf("expected the failing destination to receive the events twice, got %d events", failing.received)
+	}
+
+	// delivered events are forgotten
+	if _, err := d.ReportBatch(ctx, testEvents()); err != nil || healthy.received != 4 {
+		t.Fatalf("expected delivered events to be sent again, got %d events and %v", healthy.received, err)
+	}
+}
+
+func TestFailureWithEveryReceipt(t *testing.T) {
+	d := &Driver{Destinations: []*Destination{
+		{Name: "odd", Driver: &countingDriver{failures: 1, failedReceipts: 2}, Required: true},
+	}}
+
+	receipts, err := d.ReportBatch(context.Background(), testEvents())
+	if err != nil || len(receipts) != 2 {
+		t.Fatalf("expected the receipted events to be delivered, got %d receipts and %v", len(receipts), err)
+	}
+}
+
+// holdingDriver holds back the first event of every batch.
+type holdingDriver struct {
+	received int
+}
+
+func (d *holdingDriver) Report(ctx context.Context, e *reporting.Event) (reporting.Receipt, error) {
+	d.received++
+	return reporting.EmptyReceipt, reporting.HeldError{Reason: "no key"}
+}
+
+func (d *holdingDriver) ReportBatch(ctx context.Context, events []*reporting.Event) ([]reporting.Receipt, error) {
+	d.received += len(events)
+	return make([]reporting.Receipt, len(events)), reporting.HeldError{Reason: "no key", Held: []int{0}}
+}
+
+func TestHeldEventsSkipped(t *testing.T) {
+	healthy := &countingDriver{}
+	holding := &holdingDriver{}
+	d := &Driver{Destinations: []*Destination{
+		{Name: "healthy", Driver: healthy, Required: true},
+		{Name: "holding", Driver: holding, Required: true},
+	}}
+
+	ctx := context.Background()
+	receipts, err := d.ReportBatch(ctx, testEvents())
+	held, ok := err.(reporting.HeldError)
+	if !ok || len(held.Held) != 1 || held.Held[0] != 0 || len(receipts) != 2 {
+		t.Fatalf("expected the first event held and receipts for both, got %d receipts and %v", len(receipts), err)
+	}
+
+	if receipts[1] != "healthy:,holding:" {
+		t.Fatalf("expected the receipts of both destinations for the second event, got %q", receipts[1])
+	}
+
+	// the replay of the held event only goes to the destination holding it
+	if _, err := d.Report(ctx, testEvents()[0]); err == nil || healthy.received != 2 || holding.received != 3 {
+		t.Fatalf("expected the held event resent to the holding destination only, got %d and %d events and %v", healthy.received, holding.received, err)
+	}
+}
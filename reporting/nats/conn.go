@@ -0,0 +1,288 @@
+package nats
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The driver speaks the NATS client protocol directly, see
+// https://docs.nats.io/reference/reference-protocols/nats-protocol
+
+const (
+	DEFAULT_PORT = "4222"
+
+	statusNoResponders = "503"
+)
+
+var ErrNoResponders = errors.New("nats: no responders, is a JetStream stream bound to the subject?")
+
+type serverInfo struct {
+	ServerID    string `json:"server_id"`
+	Headers     bool   `json:"headers"`
+	MaxPayload  int64  `json:"max_payload"`
+	TLSRequired bool   `json:"tls_required"`
+}
+
+type connectOptions struct {
+	Verbose      bool   `json:"verbose"`
+	Pedantic     bool   `json:"pedantic"`
+	Name         string `json:"name"`
+	Lang         string `json:"lang"`
+	Version      string `json:"version"`
+	Protocol     int    `json:"protocol"`
+	Headers      bool   `json:"headers"`
+	NoResponders bool   `json:"no_responders"`
+	User         string `json:"user,omitempty"`
+	Pass         string `json:"pass,omitempty"`
+	AuthToken    string `json:"auth_token,omitempty"`
+}
+
+// message is a MSG or HMSG received on a subscription.
+type message struct {
+	subject string
+	status  string
+	payload []byte
+}
+
+type conn struct {
+	nc      net.Conn
+	r       *bufio.Reader
+	w       *bufio.Writer
+	timeout time.Duration
+	info    serverInfo
+	inbox   string
+	// messages received while waiting for a PONG
+	received []*message
+}
+
+func dial(u *url.URL, opts connectOptions, timeout time.Duration) (*conn, error) {
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), DEFAULT_PORT)
+	}
+
+	nc, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to nats server %s: %w", addr, err)
+	}
+
+	c := &conn{
+		nc:      nc,
+		r:       bufio.NewReader(nc),
+		w:       bufio.NewWriter(nc),
+		timeout: timeout,
+	}
+
+	if err := c.handshake(opts); err != nil {
+		nc.Close()
+		return nil, err
+	}
+
+	return c, nil
+}
+
+func (c *conn) handshake(opts connectOptions) error {
+	c.nc.SetDeadline(time.Now().Add(c.timeout))
+	line, err := c.readLine()
+	if err != nil {
+		return err
+	}
+
+	if !strings.HasPrefix(line, "INFO ") {
+		return fmt.Errorf("nats: expected INFO, got %q", line)
+	}
+
+	if err := json.Unmarshal([]byte(line[5:]), &c.info); err != nil {
+		return fmt.Errorf("nats: invalid INFO: %v", err)
+	}
+
+	if c.info.TLSRequired {
+		return fmt.Errorf("nats: server requires TLS, which isn't supported")
+	}
+
+	opts.Headers = c.info.Headers
+	opts.NoResponders = c.info.Headers
+	blob, err := json.Marshal(opts)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(c.w, "CONNECT %s\r\n", blob)
+	return c.flush()
+}
+
+// subscribe subscribes to a new inbox, replies to `<inbox>.>` are received
+// through it.
+func (c *conn) subscribe() error {
+	token := make([]byte, 12)
+	if _, err := rand.Read(token); err != nil {
+		return err
+	}
+
+	c.inbox = "_INBOX." + hex.EncodeToString(token)
+	fmt.Fprintf(c.w, "SUB %s.> 1\r\n", c.inbox)
+	return c.flush()
+}
+
+func (c *conn) publish(subject string, reply string, payload []byte) error {
+	if c.info.MaxPayload > 0 && int64(len(payload)) > c.info.MaxPayload {
+		return fmt.Errorf("nats: payload of %d bytes exceeds the server maximum of %d", len(payload), c.info.MaxPayload)
+	}
+
+	if reply != "" {
+		fmt.Fprintf(c.w, "PUB %s %s %d\r\n", subject, reply, len(payload))
+	} else {
+		fmt.Fprintf(c.w, "PUB %s %d\r\n", subject, len(payload))
+	}
+
+	c.w.Write(payload)
+	_, err := c.w.WriteString("\r\n")
+	return err
+}
+
+// flush sends the buffered operations followed by a PING and waits for the
+// PONG, at which point the server has processed all of them.
+func (c *conn) flush() error {
+	c.w.WriteString("PING\r\n")
+	if err := c.w.Flush(); err != nil {
+		return fmt.Errorf("error sending to nats server: %w", err)
+	}
+
+	c.nc.SetDeadline(time.Now().Add(c.timeout))
+	for {
+		msg, err := c.read()
+		if err != nil {
+			return err
+		}
+
+		if msg == nil {
+			return nil
+		}
+
+		c.received = append(c.received, msg)
+	}
+}
+
+// next waits for the next message received on the subscription.
+func (c *conn) next() (*message, error) {
+	if len(c.received) > 0 {
+		msg := c.received[0]
+		c.received = c.received[1:]
+		return msg, nil
+	}
+
+	for {
+		msg, err := c.read()
+		if err != nil {
+			return nil, err
+		}
+
+		if msg != nil {
+			return msg, nil
+		}
+	}
+}
+
+// read handles one server operation and returns the received message, or
+// nil after a PONG.
+func (c *conn) read() (*message, error) {
+	for {
+		line, err := c.readLine()
+		if err != nil {
+			return nil, err
+		}
+
+		op := line
+		args := ""
+		if i := strings.IndexByte(line, ' '); i > 0 {
+			op = line[:i]
+			args = line[i+1:]
+		}
+
+		switch strings.ToUpper(op) {
+		case "PING":
+			c.w.WriteString("PONG\r\n")
+			if err := c.w.Flush(); err != nil {
+				return nil, err
+			}
+		case "PONG":
+			return nil, nil
+		case "+OK", "INFO":
+		case "-ERR":
+			return nil, fmt.Errorf("nats: %s", strings.Trim(args, "'"))
+		case "MSG", "HMSG":
+			return c.readMessage(strings.ToUpper(op) == "HMSG", strings.Fields(args))
+		default:
+			return nil, fmt.Errorf("nats: unexpected operation %q", op)
+		}
+	}
+}
+
+func (c *conn) readMessage(hasHeaders bool, args []string) (*message, error) {
+	// MSG <subject> <sid> [reply-to] <#bytes>
+	// HMSG <subject> <sid> [reply-to] <#header bytes> <#total bytes>
+	min := 3
+	if hasHeaders {
+		min = 4
+	}
+
+	if len(args) < min {
+		return nil, fmt.Errorf("nats: invalid message arguments %q", args)
+	}
+
+	total, err := strconv.Atoi(args[len(args)-1])
+	if err != nil {
+		return nil, fmt.Errorf("nats: invalid message size: %v", err)
+	}
+
+	headerSize := 0
+	if hasHeaders {
+		if headerSize, err = strconv.Atoi(args[len(args)-2]); err != nil || headerSize > total {
+			return nil, fmt.Errorf("nats: invalid message header size")
+		}
+	}
+
+	data := make([]byte, total+2)
+	if _, err := io.ReadFull(c.r, data); err != nil {
+		return nil, fmt.Errorf("error reading from nats server: %w", err)
+	}
+
+	msg := &message{
+		subject: args[0],
+		payload: data[headerSize:total],
+	}
+
+	if hasHeaders {
+		// the first header line is the version with an optional status:
+		// `NATS/1.0 503`
+		status := strings.SplitN(string(data[:headerSize]), "\r\n", 2)[0]
+		if fields := strings.Fields(status); len(fields) > 1 {
+			msg.status = fields[1]
+		}
+	}
+
+	return msg, nil
+}
+
+func (c *conn) readLine() (string, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return "", fmt.Errorf("error reading from nats server: %w", err)
+	}
+
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+func (c *conn) Close() error {
+	return c.nc.Close()
+}
@@ -0,0 +1,283 @@
+package nats
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/MustWin/cmeter/configuration"
+	"github.com/MustWin/cmeter/context"
+	"github.com/MustWin/cmeter/reporting"
+	"github.com/MustWin/cmeter/reporting/bus"
+	"github.com/MustWin/cmeter/reporting/factory"
+)
+
+const (
+	DEFAULT_URL     = "nats://127.0.0.1:4222"
+	DEFAULT_SUBJECT = "cmeter.{event_type}"
+	DEFAULT_NAME    = "cmeter"
+	DEFAULT_TIMEOUT = 5 * time.Second
+)
+
+var ErrInvalidURL = errors.New("invalid nats url, must be `nats://host:port`")
+
+type driverFactory struct{}
+
+func (factory *driverFactory) Schema() configuration.Schema {
+	return configuration.Schema{
+		Description: "Publishes events as JSON to NATS subjects.",
+		Parameters: []configuration.Parameter{
+			{Name: "url", Type: configuration.TypeString, Default: DEFAULT_URL, Description: "server url, may include credentials"},
+			{Name: "subject", Type: configuration.TypeString, Default: DEFAULT_SUBJECT, Description: "subject template, with `{event_type}`, `{meter_id}`, `{container}`, `{image}`, `{machine}`, `{state}` and `{label:<name>}` placeholders"},
+			{Name: "missing_value", Type: configuration.TypeString, Default: bus.DEFAULT_MISSING_VALUE, Description: "used for placeholders without a value"},
+			{Name: "jetstream", Type: configuration.TypeBool, Default: "false", Description: "wait for JetStream acknowledgements, receipts are `<stream>:<sequence>`"},
+			{Name: "timeout", Type: configuration.TypeDuration, Default: "5s", Description: "connect and acknowledgement timeout"},
+			{Name: "name", Type: configuration.TypeString, Default: DEFAULT_NAME, Description: "connection name"},
+			{Name: "user", Type: configuration.TypeString, Description: "user, instead of the url's"},
+			{Name: "password", Type: configuration.TypeString, Description: "password, instead of the url's"},
+			{Name: "token", Type: configuration.TypeString, Description: "authentication token"},
+		},
+	}
+}
+
+func (factory *driverFactory) Create(parameters map[string]interface{}) (reporting.Driver, error) {
+	params := configuration.Parameters(parameters)
+	u, err := url.Parse(params.String("url", DEFAULT_URL))
+	if err != nil || u.Scheme != "nats" || u.Host == "" {
+		return nil, ErrInvalidURL
+	}
+
+	subject, err := bus.ParseTemplate(params.String("subject", DEFAULT_SUBJECT))
+	if err != nil {
+		return nil, fmt.Errorf("invalid subject: %v", err)
+	}
+
+	subject.Missing = params.String("missing_value", subject.Missing)
+	jetStream, err := params.Bool("jetstream", false)
+	if err != nil {
+		return nil, err
+	}
+
+	timeout, err := params.Duration("timeout", DEFAULT_TIMEOUT)
+	if err != nil {
+		return nil, err
+	}
+
+	opts := connectOptions{
+		Name:      params.String("name", DEFAULT_NAME),
+		Lang:      "go",
+		Protocol:  1,
+		User:      params.String("user", ""),
+		Pass:      params.String("password", ""),
+		AuthToken: params.String("token", ""),
+	}
+
+	if u.User != nil {
+		opts.User = u.User.Username()
+		opts.Pass, _ = u.User.Password()
+	}
+
+	session := make([]byte, 8)
+	if _, err := rand.Read(session); err != nil {
+		return nil, fmt.Errorf("error creating session id: %v", err)
+	}
+
+	return &Driver{
+		URL:       u,
+		Subject:   subject,
+		JetStream: jetStream,
+		Timeout:   timeout,
+		options:   opts,
+		session:   hex.EncodeToString(session),
+	}, nil
+}
+
+func init() {
+	factory.Register("nats", &driverFactory{})
+}
+
+type pubAck struct {
+	Stream    string `json:"stream"`
+	Sequence  uint64 `json:"seq"`
+	Duplicate bool   `json:"duplicate"`
+	Error     *struct {
+		Code        int    `json:"code"`
+		Description string `json:"description"`
+	} `json:"error"`
+}
+
+// Driver publishes events as JSON to NATS subjects built from the Subject
+// template. A batch is confirmed once the server processed it and its
+// events get `<server id>:<session>:<batch>:<index>` receipts, the session
+// is random so receipts aren't repeated by other drivers, after reloads or
+// restarts; with JetStream enabled
+// every event waits for the stream's acknowledgement and gets a
+// `<stream>:<sequence>` receipt instead.
+type Driver struct {
+	URL       *url.URL
+	Subject   *bus.Template
+	JetStream bool
+	Timeout   time.Duration
+
+	options connectOptions
+	mutex   sync.Mutex
+	conn    *conn
+	session string
+	batch   uint64
+}
+
+func (d *Driver) Report(ctx context.Context, e *reporting.Event) (reporting.Receipt, error) {
+	receipts, err := d.ReportBatch(ctx, []*reporting.Event{e})
+	if err != nil {
+		return reporting.EmptyReceipt, err
+	}
+
+	return receipts[0], nil
+}
+
+func (d *Driver) ReportBatch(ctx context.Context, events []*reporting.Event) ([]reporting.Receipt, error) {
+	payloads := make([][]byte, len(events))
+	for i, e := range events {
+		blob, err := json.Marshal(e)
+		if err != nil {
+			return nil, fmt.Errorf("error encoding event: %v", err)
+		}
+
+		payloads[i] = blob
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if d.conn == nil {
+		if err := d.connect(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	receipts, err := d.publish(events, payloads)
+	if err != nil {
+		if _, ok := err.(ackError); !ok {
+			d.conn.Close()
+			d.conn = nil
+		}
+	}
+
+	return receipts, err
+}
+
+func (d *Driver) Close() error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if d.conn == nil {
+		return nil
+	}
+
+	err := d.conn.Close()
+	d.conn = nil
+	return err
+}
+
+func (d *Driver) connect(ctx context.Context) error {
+	opts := d.options
+	opts.Version = context.GetVersion(ctx)
+	c, err := dial(d.URL, opts, d.Timeout)
+	if err != nil {
+		return err
+	}
+
+	if d.JetStream {
+		if err := c.subscribe(); err != nil {
+			c.Close()
+			return err
+		}
+	}
+
+	d.conn = c
+	return nil
+}
+
+// ackError is a negative acknowledgement, the connection stays usable.
+type ackError struct {
+	error
+}
+
+func (d *Driver) publish(events []*reporting.Event, payloads [][]byte) ([]reporting.Receipt, error) {
+	d.batch++
+	prefix := fmt.Sprintf("%s.%d.", d.conn.inbox, d.batch)
+	for i, e := range events {
+		reply := ""
+		if d.JetStream {
+			reply = prefix + strconv.Itoa(i)
+		}
+
+		if err := d.conn.publish(d.Subject.Execute(e), reply, payloads[i]); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := d.conn.flush(); err != nil {
+		return nil, err
+	}
+
+	receipts := make([]reporting.Receipt, len(events))
+	if !d.JetStream {
+		// the PONG confirmed the batch, core NATS doesn't acknowledge messages
+		for i := range receipts {
+			receipts[i] = reporting.Receipt(fmt.Sprintf("%s:%s:%d:%d", d.conn.info.ServerID, d.session, d.batch, i))
+		}
+
+		return receipts, nil
+	}
+
+	errs := make([]error, len(events))
+	pending := len(events)
+	for pending > 0 {
+		msg, err := d.conn.next()
+		if err != nil {
+			return nil, err
+		}
+
+		if !strings.HasPrefix(msg.subject, prefix) {
+			// late reply to an earlier batch
+			continue
+		}
+
+		i, err := strconv.Atoi(strings.TrimPrefix(msg.subject, prefix))
+		if err != nil || i < 0 || i >= len(events) {
+			continue
+		}
+
+		pending--
+		if msg.status == statusNoResponders {
+			errs[i] = ErrNoResponders
+			continue
+		}
+
+		ack := pubAck{}
+		if err := json.Unmarshal(msg.payload, &ack); err != nil {
+			errs[i] = fmt.Errorf("nats: invalid acknowledgement: %v", err)
+		} else if ack.Error != nil {
+			errs[i] = fmt.Errorf("nats: %s (%d)", ack.Error.Description, ack.Error.Code)
+		} else {
+			receipts[i] = reporting.Receipt(fmt.Sprintf("%s:%d", ack.Stream, ack.Sequence))
+		}
+	}
+
+	// only the events up to the first failure count as delivered
+	for i, err := range errs {
+		if err != nil {
+			return receipts[:i], ackError{err}
+		}
+	}
+
+	return receipts, nil
+}
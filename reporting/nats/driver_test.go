@@ -0,0 +1,270 @@
+package nats
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/MustWin/cmeter/context"
+	"github.com/MustWin/cmeter/reporting"
+	"github.com/MustWin/cmeter/reporting/reportingtest"
+)
+
+type published struct {
+	subject string
+	payload []byte
+}
+
+// server is a NATS server speaking just enough of the protocol for the
+// driver. With jetStream set publications with a reply subject are
+// acknowledged by a stream, unless nack or noResponders return an error
+// for the payload.
+type server struct {
+	l         net.Listener
+	jetStream bool
+
+	mutex        sync.Mutex
+	maxPayload   int
+	connects     []connectOptions
+	published    []published
+	nack         func(payload []byte) bool
+	noResponders func(payload []byte) bool
+}
+
+func newServer(t *testing.T, jetStream bool) *server {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &server{l: l, jetStream: jetStream}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			go s.serve(c)
+		}
+	}()
+
+	return s
+}
+
+func (s *server) url() string {
+	return "nats://agent:secret@" + s.l.Addr().String()
+}
+
+func (s *server) Close() {
+	s.l.Close()
+}
+
+func (s *server) serve(c net.Conn) {
+	defer c.Close()
+
+	s.mutex.Lock()
+	info, _ := json.Marshal(serverInfo{ServerID: "server", Headers: true, MaxPayload: int64(s.maxPayload)})
+	s.mutex.Unlock()
+
+	fmt.Fprintf(c, "INFO %s\r\n", info)
+	r := bufio.NewReader(c)
+	sequence := 0
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		switch fields[0] {
+		case "CONNECT":
+			opts := connectOptions{}
+			json.Unmarshal([]byte(strings.TrimPrefix(strings.TrimSpace(line), "CONNECT ")), &opts)
+			s.mutex.Lock()
+			s.connects = append(s.connects, opts)
+			s.mutex.Unlock()
+		case "PING":
+			io.WriteString(c, "PONG\r\n")
+		case "PUB":
+			size, _ := strconv.Atoi(fields[len(fields)-1])
+			payload := make([]byte, size+2)
+			if _, err := io.ReadFull(r, payload); err != nil {
+				return
+			}
+
+			payload = payload[:size]
+			s.mutex.Lock()
+			s.published = append(s.published, published{fields[1], payload})
+			nack := s.nack != nil && s.nack(payload)
+			noResponders := s.noResponders != nil && s.noResponders(payload)
+			s.mutex.Unlock()
+
+			if !s.jetStream || len(fields) != 4 {
+				continue
+			}
+
+			reply := fields[2]
+			if noResponders {
+				header := "NATS/1.0 503\r\n\r\n"
+				fmt.Fprintf(c, "HMSG %s 1 %d %d\r\n%s\r\n", reply, len(header), len(header), header)
+				continue
+			}
+
+			ack := `{"error":{"code":10060,"description":"expected stream does not match"}}`
+			if !nack {
+				sequence++
+				ack = fmt.Sprintf(`{"stream":"USAGE","seq":%d}`, sequence)
+			}
+
+			fmt.Fprintf(c, "MSG %s 1 %d\r\n%s\r\n", reply, len(ack), ack)
+		}
+	}
+}
+
+func (s *server) connections() []connectOptions {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]connectOptions(nil), s.connects...)
+}
+
+func (s *server) subjects() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	subjects := make([]string, len(s.published))
+	for i, p := range s.published {
+		subjects[i] = p.subject
+	}
+
+	return subjects
+}
+
+func events(names ...string) []*reporting.Event {
+	events := make([]*reporting.Event, len(names))
+	for i, name := range names {
+		events[i] = reportingtest.ContainerSample(name, int64(i+1))
+	}
+
+	return events
+}
+
+func TestPublish(t *testing.T) {
+	s := newServer(t, false)
+	defer s.Close()
+
+	d := reportingtest.NewDriver(t, &driverFactory{}, map[string]interface{}{
+		"url":     s.url(),
+		"subject": "usage.{event_type}.{container}",
+	}).(*Driver)
+
+	defer d.Close()
+
+	receipts, err := d.ReportBatch(context.Background(), events("/web.1", "db"))
+	if err != nil {
+		t.Fatalf("error reporting: %v", err)
+	}
+
+	for i, receipt := range receipts {
+		if expected := fmt.Sprintf("server:%s:1:%d", d.session, i); string(receipt) != expected {
+			t.Fatalf("expected receipt %s, got %s", expected, receipt)
+		}
+	}
+
+	// placeholders can't add tokens
+	subjects := s.subjects()
+	if len(subjects) != 2 || subjects[0] != "usage.usage_sample.web_1" || subjects[1] != "usage.usage_sample.db" {
+		t.Fatalf("expected the subjects from the template, got %v", subjects)
+	}
+
+	if receipt, err := d.Report(context.Background(), events("web")[0]); err != nil || receipt != reporting.Receipt(fmt.Sprintf("server:%s:2:0", d.session)) {
+		t.Fatalf("expected a receipt of the second batch, got %q and %v", receipt, err)
+	}
+
+	connects := s.connections()
+	if len(connects) != 1 || connects[0].User != "agent" || connects[0].Pass != "secret" || connects[0].Name != DEFAULT_NAME {
+		t.Fatalf("expected a single connection with the url's credentials, got %+v", connects)
+	}
+
+	// sessions keep the receipts of other drivers apart
+	other := reportingtest.NewDriver(t, &driverFactory{}, map[string]interface{}{"url": s.url()}).(*Driver)
+	defer other.Close()
+	if other.session == d.session {
+		t.Fatal("expected every driver to get its own session")
+	}
+}
+
+func TestJetStream(t *testing.T) {
+	s := newServer(t, true)
+	defer s.Close()
+
+	d := reportingtest.NewDriver(t, &driverFactory{}, map[string]interface{}{
+		"url":       s.url(),
+		"jetstream": true,
+	})
+
+	defer reporting.Close(d)
+
+	batch := d.(reporting.BatchDriver)
+	receipts, err := batch.ReportBatch(context.Background(), events("web", "db"))
+	if err != nil || len(receipts) != 2 || receipts[0] != "USAGE:1" || receipts[1] != "USAGE:2" {
+		t.Fatalf("expected the stream's sequences as receipts, got %v and %v", receipts, err)
+	}
+
+	// events up to the first negative acknowledgement are delivered
+	s.mutex.Lock()
+	s.nack = func(payload []byte) bool { return strings.Contains(string(payload), `"name":"db"`) }
+	s.mutex.Unlock()
+
+	receipts, err = batch.ReportBatch(context.Background(), events("web", "db", "cache"))
+	if err == nil || !strings.Contains(err.Error(), "expected stream does not match") || len(receipts) != 1 || receipts[0] != "USAGE:3" {
+		t.Fatalf("expected the first event delivered and the stream's error, got %v and %v", receipts, err)
+	}
+
+	s.mutex.Lock()
+	s.noResponders = func(payload []byte) bool { return true }
+	s.mutex.Unlock()
+
+	if _, err := batch.ReportBatch(context.Background(), events("web")); err == nil || err.Error() != ErrNoResponders.Error() {
+		t.Fatalf("expected %v, got %v", ErrNoResponders, err)
+	}
+
+	// negative acknowledgements keep the connection
+	if connects := s.connections(); len(connects) != 1 {
+		t.Fatalf("expected a single connection, got %d", len(connects))
+	}
+}
+
+func TestMaxPayload(t *testing.T) {
+	s := newServer(t, false)
+	defer s.Close()
+
+	s.mutex.Lock()
+	s.maxPayload = 10
+	s.mutex.Unlock()
+
+	d := reportingtest.NewDriver(t, &driverFactory{}, map[string]interface{}{"url": s.url()})
+	defer reporting.Close(d)
+
+	if _, err := d.Report(context.Background(), events("web")[0]); err == nil || !strings.Contains(err.Error(), "exceeds the server maximum") {
+		t.Fatalf("expected the payload to be rejected, got %v", err)
+	}
+}
+
+func TestInvalidURL(t *testing.T) {
+	for _, u := range []string{"http://127.0.0.1:4222", "nats://", "://"} {
+		if _, err := (&driverFactory{}).Create(map[string]interface{}{"url": u}); err != ErrInvalidURL {
+			t.Errorf("expected %v for %s, got %v", ErrInvalidURL, u, err)
+		}
+	}
+}
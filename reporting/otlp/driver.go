@@ -0,0 +1,318 @@
+package otlp
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/MustWin/cmeter/collector"
+	"github.com/MustWin/cmeter/configuration"
+	"github.com/MustWin/cmeter/containers"
+	"github.com/MustWin/cmeter/context"
+	"github.com/MustWin/cmeter/reporting"
+	"github.com/MustWin/cmeter/reporting/factory"
+)
+
+const (
+	DEFAULT_ENDPOINT = "http://localhost:4318/v1/metrics"
+
+	ENCODING_PROTOBUF = "protobuf"
+	ENCODING_JSON     = "json"
+
+	SCOPE_NAME = "github.com/MustWin/cmeter"
+)
+
+var (
+	ErrInvalidEndpoint = errors.New("invalid endpoint url")
+	ErrInvalidEncoding = errors.New("invalid encoding, must be `protobuf` or `json`")
+)
+
+type driverFactory struct{}
+
+func (factory *driverFactory) Schema() configuration.Schema {
+	return configuration.Schema{
+		Description: "Exports OpenTelemetry metrics to an OTLP/HTTP collector.",
+		Parameters: []configuration.Parameter{
+			{Name: "endpoint", Type: configuration.TypeString, Default: DEFAULT_ENDPOINT, Description: "collector metrics endpoint"},
+			{Name: "encoding", Type: configuration.TypeString, Default: ENCODING_PROTOBUF, Values: []string{ENCODING_PROTOBUF, ENCODING_JSON}, Description: "request encoding"},
+			{Name: "headers", Type: configuration.TypeStringMap, Description: "additional request headers"},
+		},
+	}
+}
+
+func (factory *driverFactory) Create(parameters map[string]interface{}) (reporting.Driver, error) {
+	params := configuration.Parameters(parameters)
+	endpoint := params.String("endpoint", DEFAULT_ENDPOINT)
+	if endpoint == "" {
+		return nil, ErrInvalidEndpoint
+	}
+
+	if _, err := url.Parse(endpoint); err != nil {
+		return nil, fmt.Errorf("invalid endpoint url: %v", err)
+	}
+
+	encoding := strings.ToLower(params.String("encoding", ENCODING_PROTOBUF))
+	if encoding != ENCODING_PROTOBUF && encoding != ENCODING_JSON {
+		return nil, ErrInvalidEncoding
+	}
+
+	headerParams, err := params.Sub("headers")
+	if err != nil {
+		return nil, err
+	}
+
+	headers := http.Header{}
+	for k := range headerParams {
+		headers.Set(k, headerParams.String(k, ""))
+	}
+
+	return &Driver{
+		Endpoint: endpoint,
+		Encoding: encoding,
+		Headers:  headers,
+		started:  make(map[string]*cumulative),
+	}, nil
+}
+
+func init() {
+	factory.Register("otlp", &driverFactory{})
+}
+
+type cumulative struct {
+	start      uint64
+	cpuSeconds float64
+}
+
+// Driver exports usage as OTLP metrics over HTTP. Container and machine
+// info become resource attributes; CPU time is accumulated into a
+// cumulative sum, network and disk figures are cumulative already.
+type Driver struct {
+	Endpoint string
+	Encoding string
+	Headers  http.Header
+
+	mutex   sync.Mutex
+	started map[string]*cumulative
+}
+
+func (d *Driver) Report(ctx context.Context, e *reporting.Event) (reporting.Receipt, error) {
+	if _, err := d.ReportBatch(ctx, []*reporting.Event{e}); err != nil {
+		return reporting.EmptyReceipt, err
+	}
+
+	return reporting.EmptyReceipt, nil
+}
+
+func (d *Driver) ReportBatch(ctx context.Context, events []*reporting.Event) ([]reporting.Receipt, error) {
+	req := &exportRequest{ResourceMetrics: make([]*resourceMetrics, 0, len(events))}
+
+	d.mutex.Lock()
+	for _, e := range events {
+		rm, err := d.convert(ctx, e)
+		if err != nil {
+			d.mutex.Unlock()
+			return nil, err
+		}
+
+		if rm != nil {
+			req.ResourceMetrics = append(req.ResourceMetrics, rm)
+		}
+	}
+
+	d.mutex.Unlock()
+
+	if len(req.ResourceMetrics) > 0 {
+		if err := d.export(ctx, req); err != nil {
+			return nil, err
+		}
+	}
+
+	return make([]reporting.Receipt, len(events)), nil
+}
+
+func (d *Driver) export(ctx context.Context, req *exportRequest) error {
+	var body []byte
+	contentType := "application/x-protobuf"
+	if d.Encoding == ENCODING_JSON {
+		var err error
+		if body, err = json.Marshal(req); err != nil {
+			return fmt.Errorf("error encoding metrics: %v", err)
+		}
+
+		contentType = "application/json"
+	} else {
+		body = req.marshalProto()
+	}
+
+	r, err := http.NewRequest(http.MethodPost, d.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("error creating request: %v", err)
+	}
+
+	r.Header.Set("Content-Type", contentType)
+	r.Header.Set("User-Agent", "cmeter-otlp-exporter/"+context.GetVersion(ctx))
+	for hn, hvs := range d.Headers {
+		for _, v := range hvs {
+			r.Header.Add(hn, v)
+		}
+	}
+
+	resp, err := http.DefaultClient.Do(r)
+	if err != nil {
+		return fmt.Errorf("error sending request: %w", err)
+	}
+
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode > 299 || resp.StatusCode < 200 {
+		return reporting.ResponseError(resp)
+	}
+
+	return nil
+}
+
+func (d *Driver) convert(ctx context.Context, e *reporting.Event) (*resourceMetrics, error) {
+	switch data := e.Data.(type) {
+	case *collector.Sample:
+		if data.Container == nil || data.Usage == nil {
+			return nil, nil
+		}
+
+		return d.convertSample(ctx, data), nil
+	case *collector.MachineSample:
+		if data.Machine == nil || data.Usage == nil {
+			return nil, nil
+		}
+
+		return d.convertMachineSample(ctx, data), nil
+	case *containers.StateChange:
+		if data.State == containers.StateStopped && data.Container != nil {
+			delete(d.started, "container:"+data.Container.Name)
+		}
+
+		return nil, nil
+	}
+
+	return nil, fmt.Errorf("unsupported event type %q", e.Type)
+}
+
+func (d *Driver) accumulate(key string, ts uint64, cpu *containers.CpuUsage) *cumulative {
+	c, ok := d.started[key]
+	if !ok {
+		c = &cumulative{start: ts}
+		d.started[key] = c
+	}
+
+	if cpu != nil {
+		c.cpuSeconds += float64(cpu.Total) / 1e9
+	}
+
+	return c
+}
+
+func machineAttributes(m *containers.MachineInfo) []keyValue {
+	if m == nil {
+		return nil
+	}
+
+	return []keyValue{
+		attr("host.id", m.SystemUuid),
+		attr("host.name", m.Name),
+	}
+}
+
+func containerAttributes(c *containers.ContainerInfo) []keyValue {
+	attributes := []keyValue{
+		attr("container.name", c.Name),
+		attr("container.image.name", c.ImageName),
+		attr("container.image.tag", c.ImageTag),
+	}
+
+	labels := make([]string, 0, len(c.Labels))
+	for k := range c.Labels {
+		labels = append(labels, k)
+	}
+
+	sort.Strings(labels)
+	for _, k := range labels {
+		attributes = append(attributes, attr("container.label."+k, c.Labels[k]))
+	}
+
+	return append(attributes, machineAttributes(c.Machine)...)
+}
+
+func timestamp(ts int64) uint64 {
+	return uint64(time.Unix(ts, 0).UnixNano())
+}
+
+func newResourceMetrics(ctx context.Context, attributes []keyValue, metrics []*metric) *resourceMetrics {
+	attributes = append([]keyValue{attr("service.name", "cmeter"), attr("service.instance.id", context.GetInstanceID(ctx))}, attributes...)
+	return &resourceMetrics{
+		Resource: resource{Attributes: attributes},
+		ScopeMetrics: []*scopeMetrics{
+			{
+				Scope:   scope{Name: SCOPE_NAME, Version: context.GetVersion(ctx)},
+				Metrics: metrics,
+			},
+		},
+	}
+}
+
+func (d *Driver) convertSample(ctx context.Context, s *collector.Sample) *resourceMetrics {
+	ts := timestamp(s.Timestamp)
+	acc := d.accumulate("container:"+s.Container.Name, ts, s.Usage.Cpu)
+
+	metrics := []*metric{
+		cumulativeSum("container.cpu.time", "s", "Total CPU time consumed by the container.", doublePoint(acc.start, ts, acc.cpuSeconds)),
+	}
+
+	if s.Usage.Memory != nil {
+		metrics = append(metrics, gaugeOf("container.memory.usage", "By", "Memory usage of the container.",
+			intPoint(0, ts, int64(s.Usage.Memory.Bytes))))
+	}
+
+	if s.Usage.Network != nil {
+		metrics = append(metrics, cumulativeSum("container.network.io", "By", "Bytes received and sent by the container.",
+			intPoint(acc.start, ts, int64(s.Usage.Network.TotalRxBytes), attr("network.io.direction", "receive")),
+			intPoint(acc.start, ts, int64(s.Usage.Network.TotalTxBytes), attr("network.io.direction", "transmit"))))
+	}
+
+	if s.Usage.Disk != nil {
+		total := uint64(0)
+		for _, v := range s.Usage.Disk.PerDiskIo {
+			total += v
+		}
+
+		metrics = append(metrics, cumulativeSum("container.disk.io", "By", "Disk IO of the container.",
+			intPoint(acc.start, ts, int64(total))))
+	}
+
+	return newResourceMetrics(ctx, containerAttributes(s.Container), metrics)
+}
+
+func (d *Driver) convertMachineSample(ctx context.Context, s *collector.MachineSample) *resourceMetrics {
+	ts := timestamp(s.Timestamp)
+	acc := d.accumulate("machine:"+s.Machine.SystemUuid, ts, s.Usage.Cpu)
+
+	metrics := []*metric{
+		cumulativeSum("system.cpu.time", "s", "Total CPU time consumed on the machine.", doublePoint(acc.start, ts, acc.cpuSeconds)),
+		gaugeOf("system.cpu.logical.count", "{cpu}", "Number of CPU cores of the machine.", intPoint(0, ts, int64(s.Machine.Cores))),
+		gaugeOf("system.memory.limit", "By", "Memory capacity of the machine.", intPoint(0, ts, int64(s.Machine.MemoryBytes))),
+	}
+
+	if s.Usage.Memory != nil {
+		metrics = append(metrics, gaugeOf("system.memory.usage", "By", "Memory usage of the machine.",
+			intPoint(0, ts, int64(s.Usage.Memory.Bytes))))
+	}
+
+	return newResourceMetrics(ctx, machineAttributes(s.Machine), metrics)
+}
@@ -0,0 +1,359 @@
+package otlp
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/MustWin/cmeter/collector"
+	"github.com/MustWin/cmeter/containers"
+	"github.com/MustWin/cmeter/context"
+	"github.com/MustWin/cmeter/reporting"
+	"github.com/MustWin/cmeter/reporting/reportingtest"
+)
+
+// export is what a receiver reads from a request, whatever its encoding.
+type export struct {
+	attributes map[string]string
+	// `sum` or `gauge` by metric name
+	kinds map[string]string
+	// cumulative monotonic sums by metric name
+	cumulative map[string]bool
+	// value of the first data point by metric name
+	values map[string]float64
+}
+
+func newExport() *export {
+	return &export{
+		attributes: make(map[string]string),
+		kinds:      make(map[string]string),
+		cumulative: make(map[string]bool),
+		values:     make(map[string]float64),
+	}
+}
+
+// receive exports the sample to a test receiver and decodes the request.
+func receive(t *testing.T, encoding string, s *collector.Sample) *export {
+	var contentType string
+	var body []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		contentType = r.Header.Get("Content-Type")
+		body, _ = ioutil.ReadAll(r.Body)
+	}))
+
+	defer server.Close()
+
+	d := reportingtest.NewDriver(t, &driverFactory{}, map[string]interface{}{
+		"endpoint": server.URL + "/v1/metrics",
+		"encoding": encoding,
+	})
+
+	e := &reporting.Event{MeterID: "meter", Type: reporting.EventSample, Timestamp: s.Timestamp, Data: s}
+	if _, err := d.Report(context.Background(), e); err != nil {
+		t.Fatalf("error reporting: %v", err)
+	}
+
+	switch encoding {
+	case ENCODING_JSON:
+		if contentType != "application/json" {
+			t.Fatalf("expected a json request, got %q", contentType)
+		}
+
+		return decodeJSON(t, body)
+	default:
+		if contentType != "application/x-protobuf" {
+			t.Fatalf("expected a protobuf request, got %q", contentType)
+		}
+
+		return decodeProto(t, body)
+	}
+}
+
+func decodeJSON(t *testing.T, body []byte) *export {
+	type point struct {
+		AsInt    string   `json:"asInt"`
+		AsDouble *float64 `json:"asDouble"`
+	}
+
+	type points struct {
+		DataPoints             []point `json:"dataPoints"`
+		AggregationTemporality int     `json:"aggregationTemporality"`
+		IsMonotonic            bool    `json:"isMonotonic"`
+	}
+
+	var req struct {
+		ResourceMetrics []struct {
+			Resource struct {
+				Attributes []keyValue `json:"attributes"`
+			} `json:"resource"`
+			ScopeMetrics []struct {
+				Metrics []struct {
+					Name  string  `json:"name"`
+					Gauge *points `json:"gauge"`
+					Sum   *points `json:"sum"`
+				} `json:"metrics"`
+			} `json:"scopeMetrics"`
+		} `json:"resourceMetrics"`
+	}
+
+	if err := json.Unmarshal(body, &req); err != nil {
+		t.Fatalf("error decoding json export: %v", err)
+	}
+
+	if len(req.ResourceMetrics) != 1 {
+		t.Fatalf("expected one resource, got %d", len(req.ResourceMetrics))
+	}
+
+	x := newExport()
+	rm := req.ResourceMetrics[0]
+	for _, kv := range rm.Resource.Attributes {
+		x.attributes[kv.Key] = kv.Value.StringValue
+	}
+
+	for _, sm := range rm.ScopeMetrics {
+		for _, m := range sm.Metrics {
+			p := m.Gauge
+			x.kinds[m.Name] = "gauge"
+			if m.Sum != nil {
+				p = m.Sum
+				x.kinds[m.Name] = "sum"
+				x.cumulative[m.Name] = m.Sum.AggregationTemporality == temporalityCumulative && m.Sum.IsMonotonic
+			}
+
+			if p == nil || len(p.DataPoints) == 0 {
+				t.Fatalf("expected data points for %q", m.Name)
+			}
+
+			if v := p.DataPoints[0].AsDouble; v != nil {
+				x.values[m.Name] = *v
+			} else {
+				i, err := strconv.ParseInt(p.DataPoints[0].AsInt, 10, 64)
+				if err != nil {
+					t.Fatalf("invalid int value for %q: %v", m.Name, err)
+				}
+
+				x.values[m.Name] = float64(i)
+			}
+		}
+	}
+
+	return x
+}
+
+// field is a decoded protobuf field, bytes holds the payload of length
+// delimited fields, value the others.
+type field struct {
+	number int
+	value  uint64
+	bytes  []byte
+}
+
+func decodeFields(t *testing.T, b []byte) []field {
+	var fields []field
+	for len(b) > 0 {
+		tag, n := binary.Uvarint(b)
+		if n <= 0 {
+			t.Fatal("invalid protobuf tag")
+		}
+
+		b = b[n:]
+		f := field{number: int(tag >> 3)}
+		switch tag & 7 {
+		case 0:
+			f.value, n = binary.Uvarint(b)
+			if n <= 0 {
+				t.Fatal("invalid protobuf varint")
+			}
+
+			b = b[n:]
+		case 1:
+			if len(b) < 8 {
+				t.Fatal("invalid protobuf fixed64")
+			}
+
+			f.value = binary.LittleEndian.Uint64(b)
+			b = b[8:]
+		case 2:
+			size, n := binary.Uvarint(b)
+			if n <= 0 || uint64(len(b)-n) < size {
+				t.Fatal("invalid protobuf length")
+			}
+
+			f.bytes = b[n : n+int(size)]
+			b = b[n+int(size):]
+		default:
+			t.Fatalf("unexpected protobuf wire type %d", tag&7)
+		}
+
+		fields = append(fields, f)
+	}
+
+	return fields
+}
+
+// messages returns the payloads of the fields numbered number.
+func messages(t *testing.T, b []byte, number int) [][]byte {
+	var payloads [][]byte
+	for _, f := range decodeFields(t, b) {
+		if f.number == number {
+			payloads = append(payloads, f.bytes)
+		}
+	}
+
+	return payloads
+}
+
+func decodeProto(t *testing.T, body []byte) *export {
+	resources := messages(t, body, 1)
+	if len(resources) != 1 {
+		t.Fatalf("expected one resource, got %d", len(resources))
+	}
+
+	x := newExport()
+	for _, r := range messages(t, resources[0], 1) {
+		for _, kv := range messages(t, r, 1) {
+			key := string(messages(t, kv, 1)[0])
+			value := string(messages(t, messages(t, kv, 2)[0], 1)[0])
+			x.attributes[key] = value
+		}
+	}
+
+	for _, sm := range messages(t, resources[0], 2) {
+		for _, m := range messages(t, sm, 2) {
+			name := string(messages(t, m, 1)[0])
+			var points []byte
+			if gauges := messages(t, m, 5); len(gauges) > 0 {
+				x.kinds[name] = "gauge"
+				points = gauges[0]
+			}
+
+			if sums := messages(t, m, 7); len(sums) > 0 {
+				x.kinds[name] = "sum"
+				points = sums[0]
+				var temporality, monotonic uint64
+				for _, f := range decodeFields(t, sums[0]) {
+					switch f.number {
+					case 2:
+						temporality = f.value
+					case 3:
+						monotonic = f.value
+					}
+				}
+
+				x.cumulative[name] = temporality == temporalityCumulative && monotonic == 1
+			}
+
+			dataPoints := messages(t, points, 1)
+			if len(dataPoints) == 0 {
+				t.Fatalf("expected data points for %q", name)
+			}
+
+			for _, f := range decodeFields(t, dataPoints[0]) {
+				switch f.number {
+				case 4:
+					x.values[name] = math.Float64frombits(f.value)
+				case 6:
+					x.values[name] = float64(int64(f.value))
+				}
+			}
+		}
+	}
+
+	return x
+}
+
+func testSample() *collector.Sample {
+	return &collector.Sample{
+		Timestamp: 1500000000,
+		Container: &containers.ContainerInfo{
+			Name:      "web",
+			ImageName: "nginx",
+			ImageTag:  "1.13",
+			Labels:    map[string]string{"tenant": "acme"},
+			Machine:   &containers.MachineInfo{SystemUuid: "machine", Name: "node-1", Cores: 2},
+		},
+		Usage: &containers.Usage{
+			Cpu:     &containers.CpuUsage{Total: 1500000000},
+			Memory:  &containers.MemoryUsage{Bytes: 1024},
+			Network: &containers.NetworkUsage{TotalRxBytes: 10, TotalTxBytes: 20},
+			Disk:    &containers.DiskUsage{PerDiskIo: []uint64{30, 12}},
+		},
+	}
+}
+
+func TestExport(t *testing.T) {
+	for _, encoding := range []string{ENCODING_PROTOBUF, ENCODING_JSON} {
+		x := receive(t, encoding, testSample())
+
+		attributes := map[string]string{
+			"service.name":           "cmeter",
+			"container.name":         "web",
+			"container.image.name":   "nginx",
+			"container.image.tag":    "1.13",
+			"container.label.tenant": "acme",
+			"host.id":                "machine",
+			"host.name":              "node-1",
+		}
+
+		for k, v := range attributes {
+			if x.attributes[k] != v {
+				t.Errorf("%s: expected resource attribute %s=%q, got %q", encoding, k, v, x.attributes[k])
+			}
+		}
+
+		kinds := map[string]string{
+			"container.cpu.time":     "sum",
+			"container.memory.usage": "gauge",
+			"container.network.io":   "sum",
+			"container.disk.io":      "sum",
+		}
+
+		if len(x.kinds) != len(kinds) {
+			t.Errorf("%s: expected %d metrics, got %v", encoding, len(kinds), x.kinds)
+		}
+
+		for name, kind := range kinds {
+			if x.kinds[name] != kind {
+				t.Errorf("%s: expected %s to be a %s, got %q", encoding, name, kind, x.kinds[name])
+			}
+
+			if kind == "sum" && !x.cumulative[name] {
+				t.Errorf("%s: expected %s to be a cumulative monotonic sum", encoding, name)
+			}
+		}
+
+		values := map[string]float64{
+			"container.cpu.time":     1.5,
+			"container.memory.usage": 1024,
+			"container.network.io":   10,
+			"container.disk.io":      42,
+		}
+
+		for name, v := range values {
+			if x.values[name] != v {
+				t.Errorf("%s: expected %s to be %v, got %v", encoding, name, v, x.values[name])
+			}
+		}
+	}
+}
+
+func TestCumulativeCpuTime(t *testing.T) {
+	d := &Driver{Encoding: ENCODING_JSON, started: make(map[string]*cumulative)}
+	ctx := context.Background()
+	first := d.convertSample(ctx, testSample())
+
+	s := testSample()
+	s.Timestamp++
+	second := d.convertSample(ctx, s)
+
+	start := first.ScopeMetrics[0].Metrics[0].Sum.DataPoints[0].StartTimeUnixNano
+	p := second.ScopeMetrics[0].Metrics[0].Sum.DataPoints[0]
+	if p.StartTimeUnixNano != start || p.AsDouble != 3 {
+		t.Fatalf("expected the cpu time accumulated since the first sample, got %v since %d", p.AsDouble, p.StartTimeUnixNano)
+	}
+}
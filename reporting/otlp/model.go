@@ -0,0 +1,141 @@
+package otlp
+
+import (
+	"encoding/json"
+	"strconv"
+)
+
+// The types below mirror the OTLP metrics messages used by the driver,
+// `opentelemetry/proto/collector/metrics/v1/metrics_service.proto`. They
+// marshal to the OTLP/JSON mapping and, with marshalProto, to protobuf.
+
+const (
+	temporalityCumulative = 2
+)
+
+type exportRequest struct {
+	ResourceMetrics []*resourceMetrics `json:"resourceMetrics"`
+}
+
+type resourceMetrics struct {
+	Resource     resource        `json:"resource"`
+	ScopeMetrics []*scopeMetrics `json:"scopeMetrics"`
+}
+
+type resource struct {
+	Attributes []keyValue `json:"attributes"`
+}
+
+type scopeMetrics struct {
+	Scope   scope     `json:"scope"`
+	Metrics []*metric `json:"metrics"`
+}
+
+type scope struct {
+	Name    string `json:"name"`
+	Version string `json:"version,omitempty"`
+}
+
+type metric struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	Unit        string `json:"unit,omitempty"`
+	Gauge       *gauge `json:"gauge,omitempty"`
+	Sum         *sum   `json:"sum,omitempty"`
+}
+
+type gauge struct {
+	DataPoints []*dataPoint `json:"dataPoints"`
+}
+
+type sum struct {
+	DataPoints             []*dataPoint `json:"dataPoints"`
+	AggregationTemporality int          `json:"aggregationTemporality"`
+	IsMonotonic            bool         `json:"isMonotonic"`
+}
+
+type keyValue struct {
+	Key   string   `json:"key"`
+	Value anyValue `json:"value"`
+}
+
+type anyValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+type dataPoint struct {
+	Attributes        []keyValue
+	StartTimeUnixNano uint64
+	TimeUnixNano      uint64
+	IsDouble          bool
+	AsInt             int64
+	AsDouble          float64
+}
+
+// MarshalJSON follows the OTLP/JSON encoding of 64 bit integers as strings.
+func (p *dataPoint) MarshalJSON() ([]byte, error) {
+	m := map[string]interface{}{
+		"timeUnixNano": strconv.FormatUint(p.TimeUnixNano, 10),
+	}
+
+	if len(p.Attributes) > 0 {
+		m["attributes"] = p.Attributes
+	}
+
+	if p.StartTimeUnixNano > 0 {
+		m["startTimeUnixNano"] = strconv.FormatUint(p.StartTimeUnixNano, 10)
+	}
+
+	if p.IsDouble {
+		m["asDouble"] = p.AsDouble
+	} else {
+		m["asInt"] = strconv.FormatInt(p.AsInt, 10)
+	}
+
+	return json.Marshal(m)
+}
+
+func attr(key string, value string) keyValue {
+	return keyValue{Key: key, Value: anyValue{StringValue: value}}
+}
+
+func intPoint(start uint64, ts uint64, value int64, attributes ...keyValue) *dataPoint {
+	return &dataPoint{
+		Attributes:        attributes,
+		StartTimeUnixNano: start,
+		TimeUnixNano:      ts,
+		AsInt:             value,
+	}
+}
+
+func doublePoint(start uint64, ts uint64, value float64, attributes ...keyValue) *dataPoint {
+	return &dataPoint{
+		Attributes:        attributes,
+		StartTimeUnixNano: start,
+		TimeUnixNano:      ts,
+		IsDouble:          true,
+		AsDouble:          value,
+	}
+}
+
+func cumulativeSum(name string, unit string, description string, points ...*dataPoint) *metric {
+	return &metric{
+		Name:        name,
+		Unit:        unit,
+		Description: description,
+		Sum: &sum{
+			DataPoints:             points,
+			AggregationTemporality: temporalityCumulative,
+			IsMonotonic:            true,
+		},
+	}
+}
+
+func gaugeOf(name string, unit string, description string, points ...*dataPoint) *metric {
+	return &metric{
+		Name:        name,
+		Unit:        unit,
+		Description: description,
+		Gauge:       &gauge{DataPoints: points},
+	}
+}
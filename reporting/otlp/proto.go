@@ -0,0 +1,92 @@
+package otlp
+
+import (
+	"math"
+
+	"github.com/MustWin/cmeter/shared/protobuf"
+)
+
+// marshalProto writes the request in the protobuf wire format, using the
+// field numbers of the OTLP proto definitions.
+func (r *exportRequest) marshalProto() []byte {
+	b := &protobuf.Buffer{}
+	for _, rm := range r.ResourceMetrics {
+		b.MessageField(1, rm.marshalProto)
+	}
+
+	return b.Bytes()
+}
+
+func (rm *resourceMetrics) marshalProto(b *protobuf.Buffer) {
+	b.MessageField(1, func(rb *protobuf.Buffer) {
+		for _, kv := range rm.Resource.Attributes {
+			rb.MessageField(1, kv.marshalProto)
+		}
+	})
+
+	for _, sm := range rm.ScopeMetrics {
+		b.MessageField(2, sm.marshalProto)
+	}
+}
+
+func (sm *scopeMetrics) marshalProto(b *protobuf.Buffer) {
+	b.MessageField(1, func(sb *protobuf.Buffer) {
+		sb.StringField(1, sm.Scope.Name)
+		sb.StringField(2, sm.Scope.Version)
+	})
+
+	for _, m := range sm.Metrics {
+		b.MessageField(2, m.marshalProto)
+	}
+}
+
+func (m *metric) marshalProto(b *protobuf.Buffer) {
+	b.StringField(1, m.Name)
+	b.StringField(2, m.Description)
+	b.StringField(3, m.Unit)
+	if m.Gauge != nil {
+		b.MessageField(5, func(gb *protobuf.Buffer) {
+			for _, p := range m.Gauge.DataPoints {
+				gb.MessageField(1, p.marshalProto)
+			}
+		})
+	}
+
+	if m.Sum != nil {
+		b.MessageField(7, func(sb *protobuf.Buffer) {
+			for _, p := range m.Sum.DataPoints {
+				sb.MessageField(1, p.marshalProto)
+			}
+
+			sb.VarintField(2, uint64(m.Sum.AggregationTemporality))
+			if m.Sum.IsMonotonic {
+				sb.VarintField(3, 1)
+			}
+		})
+	}
+}
+
+func (p *dataPoint) marshalProto(b *protobuf.Buffer) {
+	if p.StartTimeUnixNano > 0 {
+		b.Fixed64Field(2, p.StartTimeUnixNano)
+	}
+
+	b.Fixed64Field(3, p.TimeUnixNano)
+	if p.IsDouble {
+		b.Fixed64Field(4, math.Float64bits(p.AsDouble))
+	} else {
+		b.Fixed64Field(6, uint64(p.AsInt))
+	}
+
+	for _, kv := range p.Attributes {
+		b.MessageField(7, kv.marshalProto)
+	}
+}
+
+func (kv keyValue) marshalProto(b *protobuf.Buffer) {
+	b.StringField(1, kv.Key)
+	b.MessageField(2, func(vb *protobuf.Buffer) {
+		// written even when empty so the value stays a string
+		vb.BytesField(1, []byte(kv.Value.StringValue))
+	})
+}
@@ -0,0 +1,469 @@
+package prometheus
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/MustWin/cmeter/collector"
+	"github.com/MustWin/cmeter/configuration"
+	"github.com/MustWin/cmeter/containers"
+	"github.com/MustWin/cmeter/context"
+	"github.com/MustWin/cmeter/reporting"
+	"github.com/MustWin/cmeter/reporting/factory"
+)
+
+const (
+	DEFAULT_ADDRESS = ":9190"
+	DEFAULT_PATH    = "/metrics"
+
+	CONTENT_TYPE = "text/plain; version=0.0.4; charset=utf-8"
+)
+
+var invalidLabelChars = regexp.MustCompile("[^a-zA-Z0-9_]")
+
+type driverFactory struct{}
+
+func (factory *driverFactory) Schema() configuration.Schema {
+	return configuration.Schema{
+		Description: "Serves the latest usage for Prometheus to scrape.",
+		Parameters: []configuration.Parameter{
+			{Name: "address", Type: configuration.TypeString, Default: DEFAULT_ADDRESS, Description: "address the metrics are served on"},
+			{Name: "path", Type: configuration.TypeString, Default: DEFAULT_PATH, Description: "path the metrics are served on"},
+			{Name: "labels", Type: configuration.TypeStringList, Description: "container labels exposed as `label_<name>` metric labels"},
+		},
+	}
+}
+
+// Validate checks the parameters without opening the metrics listener, which
+// may be in use by a running agent.
+func (factory *driverFactory) Validate(parameters map[string]interface{}) error {
+	params := configuration.Parameters(parameters)
+	if _, err := params.StringList("labels"); err != nil {
+		return err
+	}
+
+	if _, _, err := net.SplitHostPort(params.String("address", DEFAULT_ADDRESS)); err != nil {
+		return fmt.Errorf("invalid metrics address: %v", err)
+	}
+
+	if !strings.HasPrefix(params.String("path", DEFAULT_PATH), "/") {
+		return fmt.Errorf("invalid metrics path, must start with `/`")
+	}
+
+	return nil
+}
+
+func (factory *driverFactory) Create(parameters map[string]interface{}) (reporting.Driver, error) {
+	params := configuration.Parameters(parameters)
+	allowed, err := params.StringList("labels")
+	if err != nil {
+		return nil, err
+	}
+
+	d := &Driver{
+		Labels:     allowed,
+		containers: make(map[string]*containerSeries),
+		machines:   make(map[string]*machineSeries),
+	}
+
+	var renamed []string
+	d.metricLabels, renamed = metricLabels(allowed)
+	for _, warning := range renamed {
+		log.Warn(warning)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(params.String("path", DEFAULT_PATH), d)
+	d.handler = mux
+	if d.listener, err = listen(params.String("address", DEFAULT_ADDRESS), mux); err != nil {
+		return nil, fmt.Errorf("error opening metrics listener: %v", err)
+	}
+
+	return d, nil
+}
+
+var (
+	listenersMutex sync.Mutex
+	listeners      = make(map[string]*listener)
+)
+
+// listener serves the metrics of the latest driver created for its address,
+// so a driver replacing another one, e.g. on a configuration reload, takes
+// over its address instead of failing to listen on it. It is closed with
+// the last driver using it.
+type listener struct {
+	server  *http.Server
+	address string
+
+	mutex sync.RWMutex
+	// handlers of the drivers using the listener, the last one serves
+	handlers []http.Handler
+}
+
+func listen(address string, handler http.Handler) (*listener, error) {
+	listenersMutex.Lock()
+	defer listenersMutex.Unlock()
+
+	l, ok := listeners[address]
+	if !ok {
+		nl, err := net.Listen("tcp", address)
+		if err != nil {
+			return nil, err
+		}
+
+		l = &listener{address: address}
+		l.server = &http.Server{Handler: l}
+		listeners[address] = l
+		go l.server.Serve(nl)
+	}
+
+	l.mutex.Lock()
+	l.handlers = append(l.handlers, handler)
+	l.mutex.Unlock()
+	return l, nil
+}
+
+func (l *listener) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var handler http.Handler = http.NotFoundHandler()
+	l.mutex.RLock()
+	if len(l.handlers) > 0 {
+		handler = l.handlers[len(l.handlers)-1]
+	}
+
+	l.mutex.RUnlock()
+	handler.ServeHTTP(w, r)
+}
+
+// release stops serving the handler, closing the listener when no handlers
+// are left.
+func (l *listener) release(handler http.Handler) error {
+	listenersMutex.Lock()
+	defer listenersMutex.Unlock()
+
+	l.mutex.Lock()
+	for i, h := range l.handlers {
+		if h == handler {
+			l.handlers = append(l.handlers[:i], l.handlers[i+1:]...)
+			break
+		}
+	}
+
+	remaining := len(l.handlers)
+	l.mutex.Unlock()
+	if remaining > 0 {
+		return nil
+	}
+
+	delete(listeners, l.address)
+	return l.server.Close()
+}
+
+func init() {
+	factory.Register("prometheus", &driverFactory{})
+}
+
+// MetricLabel maps a container label name to a valid metric label name.
+func MetricLabel(name string) string {
+	return "label_" + invalidLabelChars.ReplaceAllString(name, "_")
+}
+
+// metricLabels maps the container labels to distinct metric label names. A
+// label whose name sanitizes to the name of an earlier one gets a numeric
+// suffix, a repeated label is exposed once; the returned warnings describe
+// both.
+func metricLabels(names []string) (map[string]string, []string) {
+	labels := make(map[string]string, len(names))
+	taken := make(map[string]string, len(names))
+	var warnings []string
+	for _, name := range names {
+		if _, ok := labels[name]; ok {
+			warnings = append(warnings, fmt.Sprintf("container label %q is listed more than once, exposing it once", name))
+			continue
+		}
+
+		metric := MetricLabel(name)
+		if other, ok := taken[metric]; ok {
+			base := metric
+			for i := 2; ok; i++ {
+				metric = fmt.Sprintf("%s_%d", base, i)
+				_, ok = taken[metric]
+			}
+
+			warnings = append(warnings, fmt.Sprintf("container labels %q and %q both map to metric label %s, exposing %q as %s", other, name, base, name, metric))
+		}
+
+		labels[name] = metric
+		taken[metric] = name
+	}
+
+	return labels, warnings
+}
+
+type containerSeries struct {
+	info       *containers.ContainerInfo
+	cpuSeconds float64
+	usage      *containers.Usage
+	timestamp  int64
+}
+
+type machineSeries struct {
+	info       *containers.MachineInfo
+	cpuSeconds float64
+	usage      *containers.MachineUsage
+	timestamp  int64
+}
+
+// Driver keeps the latest usage of every container and machine and serves
+// it in the Prometheus text exposition format. CPU usage is accumulated
+// from the sampled deltas; network and disk figures are the cumulative
+// values reported by the containers driver.
+type Driver struct {
+	// container labels exposed as `label_<name>` metric labels
+	Labels []string
+
+	mutex      sync.Mutex
+	containers map[string]*containerSeries
+	machines   map[string]*machineSeries
+	listener   *listener
+	handler    http.Handler
+
+	// metric label names of Labels
+	metricLabels map[string]string
+}
+
+func (d *Driver) Report(ctx context.Context, e *reporting.Event) (reporting.Receipt, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	switch data := e.Data.(type) {
+	case *collector.Sample:
+		d.recordSample(data)
+	case *collector.MachineSample:
+		d.recordMachineSample(data)
+	case *containers.StateChange:
+		if data.State == containers.StateStopped && data.Container != nil {
+			delete(d.containers, data.Container.Name)
+		}
+	default:
+		return reporting.EmptyReceipt, fmt.Errorf("unsupported event type %q", e.Type)
+	}
+
+	return reporting.EmptyReceipt, nil
+}
+
+// Close stops serving the driver's metrics.
+func (d *Driver) Close() error {
+	d.mutex.Lock()
+	l := d.listener
+	d.listener = nil
+	d.mutex.Unlock()
+
+	if l == nil {
+		return nil
+	}
+
+	return l.release(d.handler)
+}
+
+func (d *Driver) recordSample(s *collector.Sample) {
+	if s.Container == nil || s.Usage == nil {
+		return
+	}
+
+	series, ok := d.containers[s.Container.Name]
+	if !ok {
+		series = &containerSeries{}
+		d.containers[s.Container.Name] = series
+	}
+
+	series.info = s.Container
+	series.usage = s.Usage
+	series.timestamp = s.Timestamp
+	if s.Usage.Cpu != nil {
+		series.cpuSeconds += float64(s.Usage.Cpu.Total) / 1e9
+	}
+}
+
+func (d *Driver) recordMachineSample(s *collector.MachineSample) {
+	if s.Machine == nil || s.Usage == nil {
+		return
+	}
+
+	series, ok := d.machines[s.Machine.SystemUuid]
+	if !ok {
+		series = &machineSeries{}
+		d.machines[s.Machine.SystemUuid] = series
+	}
+
+	series.info = s.Machine
+	series.usage = s.Usage
+	series.timestamp = s.Timestamp
+	if s.Usage.Cpu != nil {
+		series.cpuSeconds += float64(s.Usage.Cpu.Total) / 1e9
+	}
+}
+
+func (d *Driver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	buf := &bytes.Buffer{}
+	d.write(buf)
+	w.Header().Set("Content-Type", CONTENT_TYPE)
+	w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+	w.Write(buf.Bytes())
+}
+
+type sample struct {
+	labels string
+	value  float64
+}
+
+type family struct {
+	name    string
+	help    string
+	kind    string
+	samples []sample
+}
+
+func (f *family) add(labels string, value float64) {
+	f.samples = append(f.samples, sample{labels, value})
+}
+
+func (d *Driver) containerLabels(info *containers.ContainerInfo) string {
+	pairs := [][2]string{
+		{"container_name", info.Name},
+		{"image", info.ImageName},
+		{"image_tag", info.ImageTag},
+	}
+
+	if info.Machine != nil {
+		pairs = append(pairs, [2]string{"machine", info.Machine.SystemUuid})
+	}
+
+	if d.metricLabels == nil {
+		d.metricLabels, _ = metricLabels(d.Labels)
+	}
+
+	exposed := make(map[string]bool, len(d.Labels))
+	for _, name := range d.Labels {
+		if v, ok := info.Labels[name]; ok && !exposed[name] {
+			exposed[name] = true
+			pairs = append(pairs, [2]string{d.metricLabels[name], v})
+		}
+	}
+
+	return formatLabels(pairs)
+}
+
+func machineLabels(info *containers.MachineInfo) string {
+	return formatLabels([][2]string{
+		{"machine", info.SystemUuid},
+		{"machine_name", info.Name},
+	})
+}
+
+func (d *Driver) write(buf *bytes.Buffer) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	cpu := &family{name: "cmeter_container_cpu_usage_seconds_total", help: "Cumulative CPU time consumed by the container.", kind: "counter"}
+	memory := &family{name: "cmeter_container_memory_usage_bytes", help: "Current memory usage of the container.", kind: "gauge"}
+	rx := &family{name: "cmeter_container_network_receive_bytes_total", help: "Cumulative bytes received by the container.", kind: "counter"}
+	tx := &family{name: "cmeter_container_network_transmit_bytes_total", help: "Cumulative bytes sent by the container.", kind: "counter"}
+	disk := &family{name: "cmeter_container_disk_io_bytes_total", help: "Cumulative disk IO of the container.", kind: "counter"}
+	reservedCpu := &family{name: "cmeter_container_cpu_reserved_cores", help: "CPU cores reserved for the container.", kind: "gauge"}
+	reservedMemory := &family{name: "cmeter_container_memory_reserved_bytes", help: "Memory reserved for the container.", kind: "gauge"}
+	lastSample := &family{name: "cmeter_container_last_sample_timestamp_seconds", help: "Time of the container's latest sample.", kind: "gauge"}
+
+	names := make([]string, 0, len(d.containers))
+	for name := range d.containers {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	for _, name := range names {
+		series := d.containers[name]
+		labels := d.containerLabels(series.info)
+		cpu.add(labels, series.cpuSeconds)
+		lastSample.add(labels, float64(series.timestamp))
+		if series.usage.Memory != nil {
+			memory.add(labels, float64(series.usage.Memory.Bytes))
+		}
+
+		if series.usage.Network != nil {
+			rx.add(labels, float64(series.usage.Network.TotalRxBytes))
+			tx.add(labels, float64(series.usage.Network.TotalTxBytes))
+		}
+
+		if series.usage.Disk != nil {
+			total := uint64(0)
+			for _, v := range series.usage.Disk.PerDiskIo {
+				total += v
+			}
+
+			disk.add(labels, float64(total))
+		}
+
+		if series.info.Reserved != nil {
+			reservedCpu.add(labels, series.info.Reserved.Cpu)
+			reservedMemory.add(labels, float64(series.info.Reserved.Memory))
+		}
+	}
+
+	machineCpu := &family{name: "cmeter_machine_cpu_usage_seconds_total", help: "Cumulative CPU time consumed on the machine.", kind: "counter"}
+	machineMemory := &family{name: "cmeter_machine_memory_usage_bytes", help: "Current memory usage of the machine.", kind: "gauge"}
+	machineCores := &family{name: "cmeter_machine_cores", help: "Number of CPU cores of the machine.", kind: "gauge"}
+	machineMemoryTotal := &family{name: "cmeter_machine_memory_bytes", help: "Memory capacity of the machine.", kind: "gauge"}
+
+	ids := make([]string, 0, len(d.machines))
+	for id := range d.machines {
+		ids = append(ids, id)
+	}
+
+	sort.Strings(ids)
+	for _, id := range ids {
+		series := d.machines[id]
+		labels := machineLabels(series.info)
+		machineCpu.add(labels, series.cpuSeconds)
+		machineCores.add(labels, float64(series.info.Cores))
+		machineMemoryTotal.add(labels, float64(series.info.MemoryBytes))
+		if series.usage.Memory != nil {
+			machineMemory.add(labels, float64(series.usage.Memory.Bytes))
+		}
+	}
+
+	families := []*family{
+		cpu, memory, rx, tx, disk, reservedCpu, reservedMemory, lastSample,
+		machineCpu, machineMemory, machineCores, machineMemoryTotal,
+	}
+
+	for _, f := range families {
+		if len(f.samples) == 0 {
+			continue
+		}
+
+		fmt.Fprintf(buf, "# HELP %s %s\n", f.name, f.help)
+		fmt.Fprintf(buf, "# TYPE %s %s\n", f.name, f.kind)
+		for _, s := range f.samples {
+			fmt.Fprintf(buf, "%s%s %s\n", f.name, s.labels, strconv.FormatFloat(s.value, 'g', -1, 64))
+		}
+	}
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatLabels(pairs [][2]string) string {
+	parts := make([]string, len(pairs))
+	for i, pair := range pairs {
+		parts[i] = fmt.Sprintf(`%s="%s"`, pair[0], labelValueEscaper.Replace(pair[1]))
+	}
+
+	return "{" + strings.Join(parts, ",") + "}"
+}
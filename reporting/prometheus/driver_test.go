@@ -0,0 +1,55 @@
+package prometheus
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/MustWin/cmeter/collector"
+	"github.com/MustWin/cmeter/containers"
+)
+
+func TestMetricLabels(t *testing.T) {
+	labels, warnings := metricLabels([]string{"a.b", "a_b", "a-b", "team", "team"})
+	expected := map[string]string{
+		"a.b":  "label_a_b",
+		"a_b":  "label_a_b_2",
+		"a-b":  "label_a_b_3",
+		"team": "label_team",
+	}
+
+	if len(labels) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, labels)
+	}
+
+	for name, metric := range expected {
+		if labels[name] != metric {
+			t.Errorf("expected %s to become %s, got %q", name, metric, labels[name])
+		}
+	}
+
+	if len(warnings) != 3 {
+		t.Fatalf("expected a warning per collision and repeat, got %v", warnings)
+	}
+}
+
+func TestCollidingLabelsExposedOnce(t *testing.T) {
+	d := &Driver{
+		Labels:     []string{"a.b", "a_b", "a.b"},
+		containers: make(map[string]*containerSeries),
+		machines:   make(map[string]*machineSeries),
+	}
+
+	d.recordSample(&collector.Sample{
+		Container: &containers.ContainerInfo{Name: "web", Labels: map[string]string{"a.b": "dot", "a_b": "underscore"}},
+		Usage:     &containers.Usage{},
+		Timestamp: 1,
+	})
+
+	buf := &bytes.Buffer{}
+	d.write(buf)
+	expected := `cmeter_container_last_sample_timestamp_seconds{container_name="web",image="",image_tag="",label_a_b="dot",label_a_b_2="underscore"} 1`
+	if !strings.Contains(buf.String(), expected) {
+		t.Fatalf("expected %s in:\n%s", expected, buf.String())
+	}
+}
@@ -0,0 +1,257 @@
+package redact
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/MustWin/cmeter/collector"
+	"github.com/MustWin/cmeter/configuration"
+	"github.com/MustWin/cmeter/containers"
+	"github.com/MustWin/cmeter/reporting"
+)
+
+const (
+	MODE_MASK = "mask"
+	MODE_HASH = "hash"
+
+	// replaces masked values
+	MASK = "[REDACTED]"
+
+	// prefixes hashed values
+	HASH_PREFIX = "sha256:"
+)
+
+var ErrMissingHashKey = errors.New("the `hash` redaction mode requires a `hash_key`")
+
+// filter applies the allow, deny and redaction rules of a metadata kind.
+type filter struct {
+	allow  []*regexp.Regexp
+	deny   []*regexp.Regexp
+	redact []*regexp.Regexp
+	values []*regexp.Regexp
+}
+
+// Redactor removes and redacts container and machine labels and container
+// environment variables from events, so secrets aren't reported.
+type Redactor struct {
+	labels  *filter
+	envs    *filter
+	mode    string
+	hashKey []byte
+}
+
+// compile compiles patterns matching whole names, or substrings of values
+// when partial.
+func compile(kind string, patterns []string, partial bool) ([]*regexp.Regexp, error) {
+	compiled := make([]*regexp.Regexp, 0, len(patterns))
+	for _, p := range patterns {
+		if !partial {
+			p = "^(?:" + p + ")$"
+		}
+
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid redaction %s pattern: %v", kind, err)
+		}
+
+		compiled = append(compiled, re)
+	}
+
+	return compiled, nil
+}
+
+func newFilter(config configuration.MetadataFilter) (*filter, error) {
+	f := &filter{}
+	var err error
+	if f.allow, err = compile("allow", config.Allow, false); err != nil {
+		return nil, err
+	}
+
+	if f.deny, err = compile("deny", config.Deny, false); err != nil {
+		return nil, err
+	}
+
+	if f.redact, err = compile("redact", config.Redact, false); err != nil {
+		return nil, err
+	}
+
+	if f.values, err = compile("redact_values", config.RedactValues, true); err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+func (f *filter) empty() bool {
+	return len(f.allow) == 0 && len(f.deny) == 0 && len(f.redact) == 0 && len(f.values) == 0
+}
+
+func matchAny(patterns []*regexp.Regexp, s string) bool {
+	for _, re := range patterns {
+		if re.MatchString(s) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// New creates a redactor for the configuration, it returns nil when there
+// is nothing to redact.
+func New(config configuration.RedactionConfig) (*Redactor, error) {
+	mode := strings.ToLower(config.Mode)
+	if mode == "" {
+		mode = MODE_MASK
+	}
+
+	if mode != MODE_MASK && mode != MODE_HASH {
+		return nil, fmt.Errorf("invalid redaction mode %q, must be `mask` or `hash`", config.Mode)
+	}
+
+	// plain hashes of short values such as emails are easily reversed
+	if mode == MODE_HASH && config.HashKey == "" {
+		return nil, ErrMissingHashKey
+	}
+
+	labels, err := newFilter(config.Labels)
+	if err != nil {
+		return nil, err
+	}
+
+	envs, err := newFilter(config.Envs)
+	if err != nil {
+		return nil, err
+	}
+
+	if labels.empty() && envs.empty() {
+		return nil, nil
+	}
+
+	return &Redactor{
+		labels:  labels,
+		envs:    envs,
+		mode:    mode,
+		hashKey: []byte(config.HashKey),
+	}, nil
+}
+
+// conceal replaces a redacted value with the mask or its hash. Hashes are
+// keyed with the hash key, so equal values stay joinable without being
+// guessable from their hash.
+func (r *Redactor) conceal(value string) string {
+	if r.mode == MODE_MASK {
+		return MASK
+	}
+
+	mac := hmac.New(sha256.New, r.hashKey)
+	mac.Write([]byte(value))
+	return HASH_PREFIX + hex.EncodeToString(mac.Sum(nil))
+}
+
+// keeps tells whether a name is neither removed nor redacted as a whole.
+func (f *filter) keeps(name string) bool {
+	if len(f.allow) > 0 && !matchAny(f.allow, name) {
+		return false
+	}
+
+	return !matchAny(f.deny, name) && !matchAny(f.redact, name)
+}
+
+// KeepsLabel tells whether a label is reported, with its value unchanged
+// unless it matches `redact_values`.
+func (r *Redactor) KeepsLabel(name string) bool {
+	return r == nil || r.labels.keeps(name)
+}
+
+// KeepsEnv tells whether an environment variable is reported, with its
+// value unchanged unless it matches `redact_values`.
+func (r *Redactor) KeepsEnv(name string) bool {
+	return r == nil || r.envs.keeps(name)
+}
+
+// apply returns a filtered copy of the metadata: names not allowed or denied
+// are removed, values of names matching `redact` are concealed as a whole
+// and substrings matching `redact_values` are concealed in the others.
+func (r *Redactor) apply(f *filter, metadata map[string]string) map[string]string {
+	if metadata == nil || f.empty() {
+		return metadata
+	}
+
+	filtered := make(map[string]string, len(metadata))
+	for name, value := range metadata {
+		if len(f.allow) > 0 && !matchAny(f.allow, name) {
+			continue
+		}
+
+		if matchAny(f.deny, name) {
+			continue
+		}
+
+		if matchAny(f.redact, name) {
+			value = r.conceal(value)
+		} else {
+			for _, re := range f.values {
+				value = re.ReplaceAllStringFunc(value, r.conceal)
+			}
+		}
+
+		filtered[name] = value
+	}
+
+	return filtered
+}
+
+func (r *Redactor) machine(m *containers.MachineInfo) *containers.MachineInfo {
+	if m == nil {
+		return nil
+	}
+
+	redacted := *m
+	redacted.Labels = r.apply(r.labels, m.Labels)
+	return &redacted
+}
+
+func (r *Redactor) container(c *containers.ContainerInfo) *containers.ContainerInfo {
+	if c == nil {
+		return nil
+	}
+
+	redacted := *c
+	redacted.Labels = r.apply(r.labels, c.Labels)
+	redacted.Envs = r.apply(r.envs, c.Envs)
+	redacted.Machine = r.machine(c.Machine)
+	return &redacted
+}
+
+// Event returns a copy of the event with redacted metadata, the original
+// event and the container info it shares with the registry are untouched.
+func (r *Redactor) Event(e *reporting.Event) *reporting.Event {
+	redacted := *e
+	switch data := e.Data.(type) {
+	case *collector.Sample:
+		s := *data
+		s.Container = r.container(data.Container)
+		redacted.Data = &s
+	case *collector.MachineSample:
+		s := *data
+		s.Machine = r.machine(data.Machine)
+		redacted.Data = &s
+	case *containers.StateChange:
+		ch := *data
+		ch.Container = r.container(data.Container)
+		if data.Source != nil {
+			source := *data.Source
+			source.Container = r.container(data.Source.Container)
+			ch.Source = &source
+		}
+
+		redacted.Data = &ch
+	}
+
+	return &redacted
+}
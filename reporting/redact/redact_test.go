@@ -0,0 +1,177 @@
+package redact
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/MustWin/cmeter/collector"
+	"github.com/MustWin/cmeter/configuration"
+	"github.com/MustWin/cmeter/containers"
+	"github.com/MustWin/cmeter/reporting"
+)
+
+func testContainer() *containers.ContainerInfo {
+	return &containers.ContainerInfo{
+		Name: "web",
+		Labels: map[string]string{
+			"team":        "core",
+			"owner.email": "ops@example.com",
+			"debug":       "true",
+			"notes":       "contact ops@example.com or dev@example.com",
+		},
+		Envs: map[string]string{
+			"PATH":        "/usr/bin",
+			"DB_PASSWORD": "hunter2",
+			"API_TOKEN":   "abc",
+		},
+		Machine: &containers.MachineInfo{
+			Labels: map[string]string{"zone": "a", "owner.email": "infra@example.com"},
+		},
+	}
+}
+
+func testConfig() configuration.RedactionConfig {
+	return configuration.RedactionConfig{
+		Labels: configuration.MetadataFilter{
+			Deny:         []string{"debug"},
+			Redact:       []string{"owner\\..*"},
+			RedactValues: []string{"[a-z]+@example\\.com"},
+		},
+		Envs: configuration.MetadataFilter{
+			Allow:  []string{"PATH", ".*_PASSWORD"},
+			Redact: []string{".*PASSWORD"},
+		},
+	}
+}
+
+func newRedactor(t *testing.T, config configuration.RedactionConfig) *Redactor {
+	r, err := New(config)
+	if err != nil || r == nil {
+		t.Fatalf("expected a redactor, got %v and %v", r, err)
+	}
+
+	return r
+}
+
+func TestSample(t *testing.T) {
+	r := newRedactor(t, testConfig())
+	c := testContainer()
+	e := &reporting.Event{Type: reporting.EventSample, Data: &collector.Sample{Container: c}}
+
+	redacted := r.Event(e).Data.(*collector.Sample).Container
+	labels := map[string]string{
+		"team":        "core",
+		"owner.email": MASK,
+		"notes":       "contact " + MASK + " or " + MASK,
+	}
+
+	if !reflect.DeepEqual(redacted.Labels, labels) {
+		t.Fatalf("expected labels %v, got %v", labels, redacted.Labels)
+	}
+
+	envs := map[string]string{"PATH": "/usr/bin", "DB_PASSWORD": MASK}
+	if !reflect.DeepEqual(redacted.Envs, envs) {
+		t.Fatalf("expected envs %v, got %v", envs, redacted.Envs)
+	}
+
+	if machine := redacted.Machine.Labels; machine["owner.email"] != MASK || machine["zone"] != "a" {
+		t.Fatalf("expected the machine labels to be redacted, got %v", machine)
+	}
+
+	// the registry's container info is shared, it must not change
+	if !reflect.DeepEqual(c, testContainer()) || e.Data.(*collector.Sample).Container != c {
+		t.Fatal("expected the original event to be untouched")
+	}
+}
+
+func TestStateChange(t *testing.T) {
+	r := newRedactor(t, testConfig())
+	e := &reporting.Event{Type: reporting.EventStateChange, Data: &containers.StateChange{
+		Container: testContainer(),
+		Source:    &containers.Event{Container: testContainer()},
+	}}
+
+	ch := r.Event(e).Data.(*containers.StateChange)
+	if ch.Container.Envs["DB_PASSWORD"] != MASK || ch.Source.Container.Envs["DB_PASSWORD"] != MASK {
+		t.Fatalf("expected the container and its source to be redacted, got %v and %v", ch.Container.Envs, ch.Source.Container.Envs)
+	}
+
+	if e.Data.(*containers.StateChange).Source.Container.Envs["DB_PASSWORD"] != "hunter2" {
+		t.Fatal("expected the original source event to be untouched")
+	}
+
+	machine := r.Event(&reporting.Event{Data: &collector.MachineSample{Machine: testContainer().Machine}})
+	if labels := machine.Data.(*collector.MachineSample).Machine.Labels; labels["owner.email"] != MASK {
+		t.Fatalf("expected the machine sample to be redacted, got %v", labels)
+	}
+}
+
+func TestHashMode(t *testing.T) {
+	config := testConfig()
+	config.Mode = "HASH"
+	config.HashKey = "key"
+	r := newRedactor(t, config)
+
+	mac := hmac.New(sha256.New, []byte("key"))
+	mac.Write([]byte("hunter2"))
+	expected := HASH_PREFIX + hex.EncodeToString(mac.Sum(nil))
+
+	// equal values keep equal hashes
+	envs := r.Event(&reporting.Event{Data: &collector.Sample{Container: testContainer()}}).Data.(*collector.Sample).Container.Envs
+	if envs["DB_PASSWORD"] != expected {
+		t.Fatalf("expected %s, got %s", expected, envs["DB_PASSWORD"])
+	}
+
+	config.HashKey = ""
+	if _, err := New(config); err != ErrMissingHashKey {
+		t.Fatalf("expected %v, got %v", ErrMissingHashKey, err)
+	}
+}
+
+func TestKeeps(t *testing.T) {
+	r := newRedactor(t, testConfig())
+	cases := []struct {
+		keeps    func(string) bool
+		name     string
+		expected bool
+	}{
+		{r.KeepsLabel, "team", true},
+		{r.KeepsLabel, "notes", true},
+		{r.KeepsLabel, "debug", false},
+		{r.KeepsLabel, "owner.email", false},
+		{r.KeepsEnv, "PATH", true},
+		{r.KeepsEnv, "API_TOKEN", false},
+		{r.KeepsEnv, "DB_PASSWORD", false},
+	}
+
+	for _, c := range cases {
+		if c.keeps(c.name) != c.expected {
+			t.Errorf("expected %s kept: %v", c.name, c.expected)
+		}
+	}
+
+	// without a redactor everything is kept
+	var none *Redactor
+	if !none.KeepsLabel("debug") || !none.KeepsEnv("DB_PASSWORD") {
+		t.Fatal("expected a nil redactor to keep everything")
+	}
+}
+
+func TestNew(t *testing.T) {
+	if r, err := New(configuration.RedactionConfig{}); r != nil || err != nil {
+		t.Fatalf("expected no redactor without rules, got %v and %v", r, err)
+	}
+
+	if _, err := New(configuration.RedactionConfig{Mode: "drop"}); err == nil || !strings.Contains(err.Error(), "invalid redaction mode") {
+		t.Fatalf("expected the mode to be rejected, got %v", err)
+	}
+
+	config := configuration.RedactionConfig{Envs: configuration.MetadataFilter{Deny: []string{"("}}}
+	if _, err := New(config); err == nil || !strings.Contains(err.Error(), "invalid redaction deny pattern") {
+		t.Fatalf("expected the pattern to be rejected, got %v", err)
+	}
+}
@@ -1,6 +1,10 @@
 package reporting
 
 import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
 	"time"
 
 	"github.com/MustWin/cmeter/context"
@@ -23,10 +27,102 @@ var (
 	EventMachineSample = "machine_usage_sample"
 )
 
+// StatusError is returned by drivers when the backend rejected an event
+// with a status code, so callers can decide whether to retry it.
+type StatusError struct {
+	StatusCode int
+	Status     string
+	RetryAfter time.Duration
+}
+
+func (err StatusError) Error() string {
+	return fmt.Sprintf("unexpected response: %q", err.Status)
+}
+
+// ResponseError creates a StatusError for the response, including the
+// delay requested by its `Retry-After` header.
+func ResponseError(resp *http.Response) StatusError {
+	return StatusError{
+		StatusCode: resp.StatusCode,
+		Status:     resp.Status,
+		RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After")),
+	}
+}
+
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+
+	if at, err := http.ParseTime(value); err == nil {
+		if d := at.Sub(time.Now()); d > 0 {
+			return d
+		}
+	}
+
+	return 0
+}
+
+// HeldError is returned for events a driver holds back, e.g. until it can
+// resolve their api key. They are neither retried nor acknowledged, so the
+// spool keeps them until a later replay delivers them.
+type HeldError struct {
+	Reason string
+	// indices of the held events of a batch whose other events were
+	// reported, the receipts then cover the whole batch
+	Held []int
+}
+
+func (err HeldError) Error() string {
+	return "event held: " + err.Reason
+}
+
 type Driver interface {
 	Report(ctx context.Context, e *Event) (Receipt, error)
 }
 
+// BatchDriver is implemented by drivers able to send several events at
+// once. On failure the returned receipts cover the events delivered before
+// the error, in order, except for the events listed by a HeldError.
+type BatchDriver interface {
+	Driver
+	ReportBatch(ctx context.Context, events []*Event) ([]Receipt, error)
+}
+
+// ReportBatch sends the events with the driver's batch support, falling back
+// to a Report call per event for drivers that don't implement BatchDriver.
+func ReportBatch(ctx context.Context, d Driver, events []*Event) ([]Receipt, error) {
+	if bd, ok := d.(BatchDriver); ok {
+		return bd.ReportBatch(ctx, events)
+	}
+
+	receipts := make([]Receipt, 0, len(events))
+	for _, e := range events {
+		receipt, err := d.Report(ctx, e)
+		if err != nil {
+			return receipts, err
+		}
+
+		receipts = append(receipts, receipt)
+	}
+
+	return receipts, nil
+}
+
+// Close releases the driver's connections, listeners and goroutines when it
+// implements io.Closer. The driver is not used afterwards.
+func Close(d Driver) error {
+	if c, ok := d.(io.Closer); ok {
+		return c.Close()
+	}
+
+	return nil
+}
+
 func Generate(ctx context.Context, eventType string, data interface{}) *Event {
 	return &Event{
 		Timestamp: time.Now().Unix(),
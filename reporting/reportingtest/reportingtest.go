@@ -0,0 +1,38 @@
+// Package reportingtest provides helpers shared by the tests of the
+// reporting drivers.
+package reportingtest
+
+import (
+	"testing"
+
+	"github.com/MustWin/cmeter/collector"
+	"github.com/MustWin/cmeter/containers"
+	"github.com/MustWin/cmeter/reporting"
+	"github.com/MustWin/cmeter/reporting/factory"
+)
+
+// NewDriver creates a driver with the factory, failing the test when the
+// parameters are rejected.
+func NewDriver(t testing.TB, f factory.ReportingDriverFactory, parameters map[string]interface{}) reporting.Driver {
+	d, err := f.Create(parameters)
+	if err != nil {
+		t.Fatalf("error creating driver: %v", err)
+	}
+
+	return d
+}
+
+// ContainerSample creates a sample event of the named container using
+// timestamp nanoseconds of CPU.
+func ContainerSample(name string, timestamp int64) *reporting.Event {
+	return &reporting.Event{
+		MeterID:   "meter",
+		Type:      reporting.EventSample,
+		Timestamp: timestamp,
+		Data: &collector.Sample{
+			Timestamp: timestamp,
+			Container: &containers.ContainerInfo{Name: name},
+			Usage:     &containers.Usage{Cpu: &containers.CpuUsage{Total: timestamp}},
+		},
+	}
+}
@@ -0,0 +1,136 @@
+package retry
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/MustWin/cmeter/configuration"
+	"github.com/MustWin/cmeter/context"
+	"github.com/MustWin/cmeter/reporting"
+)
+
+const (
+	DEFAULT_BREAKER_FAILURES = 5
+	DEFAULT_BREAKER_COOLDOWN = time.Minute
+)
+
+var ErrCircuitOpen = errors.New("circuit breaker open, reporting paused")
+
+// Breaker stops calling the wrapped driver after a number of consecutive
+// failures. Once the cooldown passed a single probe report is let through;
+// its success closes the circuit again. Only the failures a retry could
+// overcome are counted, permanent failures, e.g. rejected events, show that
+// the backend is reachable.
+type Breaker struct {
+	reporting.Driver
+	Failures int
+	Cooldown time.Duration
+	// status codes counted as failures, those retried by the retry policy
+	StatusCodes []int
+
+	mutex    sync.Mutex
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+func newBreaker(driver reporting.Driver, parameters configuration.Parameters, statusCodes []int) (*Breaker, error) {
+	failures, err := parameters.Int("failures", DEFAULT_BREAKER_FAILURES)
+	if err != nil {
+		return nil, err
+	}
+
+	if failures < 1 {
+		return nil, fmt.Errorf("failures must be at least 1")
+	}
+
+	cooldown, err := parameters.Duration("cooldown", DEFAULT_BREAKER_COOLDOWN)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Breaker{
+		Driver:      driver,
+		Failures:    int(failures),
+		Cooldown:    cooldown,
+		StatusCodes: statusCodes,
+	}, nil
+}
+
+func (b *Breaker) Open() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.failures >= b.Failures
+}
+
+func (b *Breaker) allow() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.failures < b.Failures {
+		return true
+	}
+
+	if b.probing || time.Since(b.openedAt) < b.Cooldown {
+		return false
+	}
+
+	b.probing = true
+	return true
+}
+
+func (b *Breaker) record(ctx context.Context, err error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.probing = false
+	var held reporting.HeldError
+	if errors.As(err, &held) {
+		// not a failure of the backend
+		return
+	}
+
+	if err == nil || !(Policy{StatusCodes: b.StatusCodes}).retryable(err) {
+		if b.failures >= b.Failures {
+			context.GetLogger(ctx).Info("circuit breaker closed, reporting resumed")
+		}
+
+		b.failures = 0
+		return
+	}
+
+	b.failures++
+	if b.failures >= b.Failures {
+		if b.failures == b.Failures {
+			context.GetLogger(ctx).Warnf("circuit breaker opened after %d failures, pausing reporting for %v", b.failures, b.Cooldown)
+		}
+
+		b.openedAt = time.Now()
+	}
+}
+
+func (b *Breaker) Report(ctx context.Context, e *reporting.Event) (reporting.Receipt, error) {
+	if !b.allow() {
+		return reporting.EmptyReceipt, ErrCircuitOpen
+	}
+
+	receipt, err := b.Driver.Report(ctx, e)
+	b.record(ctx, err)
+	return receipt, err
+}
+
+func (b *Breaker) ReportBatch(ctx context.Context, events []*reporting.Event) ([]reporting.Receipt, error) {
+	if !b.allow() {
+		return nil, ErrCircuitOpen
+	}
+
+	receipts, err := reporting.ReportBatch(ctx, b.Driver, events)
+	b.record(ctx, err)
+	return receipts, err
+}
+
+func (b *Breaker) Close() error {
+	return reporting.Close(b.Driver)
+}
@@ -0,0 +1,254 @@
+package retry
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/MustWin/cmeter/configuration"
+	"github.com/MustWin/cmeter/context"
+	"github.com/MustWin/cmeter/reporting"
+)
+
+const (
+	DEFAULT_MAX_ATTEMPTS = 3
+	DEFAULT_BASE_BACKOFF = 500 * time.Millisecond
+	DEFAULT_MAX_BACKOFF  = 30 * time.Second
+	DEFAULT_JITTER       = 0.2
+)
+
+var DefaultStatusCodes = []int{408, 429, 500, 502, 503, 504}
+
+type Policy struct {
+	MaxAttempts int
+	BaseBackoff time.Duration
+	MaxBackoff  time.Duration
+	// fraction of each backoff that is randomized, between 0 and 1
+	Jitter float64
+	// status codes that may succeed on a later attempt, other
+	// reporting.StatusError failures are returned immediately, like every
+	// error that isn't a transport failure
+	StatusCodes []int
+}
+
+// retryable tells whether a failed report may succeed on a later attempt:
+// transport failures, errors declaring themselves temporary and the status
+// codes of the policy. Other errors are permanent, e.g. encoding errors or
+// invalid receipts of events the backend already accepted, which would be
+// sent twice.
+func (p Policy) retryable(err error) bool {
+	var statusErr reporting.StatusError
+	if errors.As(err, &statusErr) {
+		for _, code := range p.StatusCodes {
+			if code == statusErr.StatusCode {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	return transient(err)
+}
+
+func transient(err error) bool {
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+
+	for _, target := range []error{io.EOF, io.ErrUnexpectedEOF, syscall.ECONNRESET, syscall.ECONNREFUSED, syscall.EPIPE} {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+
+	var temporary interface {
+		Temporary() bool
+	}
+
+	return errors.As(err, &temporary) && temporary.Temporary()
+}
+
+// Backoff returns the delay before the given retry attempt, starting at 1.
+func (p Policy) Backoff(attempt int) time.Duration {
+	d := p.BaseBackoff
+	for i := 1; i < attempt && d < p.MaxBackoff; i++ {
+		d *= 2
+	}
+
+	if d > p.MaxBackoff {
+		d = p.MaxBackoff
+	}
+
+	if p.Jitter > 0 {
+		d -= time.Duration(p.Jitter * rand.Float64() * float64(d))
+	}
+
+	return d
+}
+
+// Driver retries failed reports of the wrapped driver according to its policy.
+type Driver struct {
+	reporting.Driver
+	Policy Policy
+}
+
+func (d *Driver) Report(ctx context.Context, e *reporting.Event) (reporting.Receipt, error) {
+	receipt := reporting.EmptyReceipt
+	err := d.do(ctx, func() error {
+		var err error
+		receipt, err = d.Driver.Report(ctx, e)
+		return err
+	})
+
+	return receipt, err
+}
+
+// ReportBatch only retries the events that weren't delivered yet, so a
+// partially delivered batch isn't sent twice.
+func (d *Driver) ReportBatch(ctx context.Context, events []*reporting.Event) ([]reporting.Receipt, error) {
+	receipts := make([]reporting.Receipt, 0, len(events))
+	offset := 0
+	err := d.do(ctx, func() error {
+		offset = len(receipts)
+		delivered, err := reporting.ReportBatch(ctx, d.Driver, events[offset:])
+		receipts = append(receipts, delivered...)
+		return err
+	})
+
+	// the held events are numbered within the last attempt
+	var held reporting.HeldError
+	if offset > 0 && errors.As(err, &held) && len(held.Held) > 0 {
+		indices := make([]int, len(held.Held))
+		for i, index := range held.Held {
+			indices[i] = offset + index
+		}
+
+		err = reporting.HeldError{Reason: held.Reason, Held: indices}
+	}
+
+	return receipts, err
+}
+
+func (d *Driver) Close() error {
+	return reporting.Close(d.Driver)
+}
+
+func (d *Driver) do(ctx context.Context, send func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := send()
+		if err == nil || attempt >= d.Policy.MaxAttempts || !d.Policy.retryable(err) {
+			return err
+		}
+
+		wait := d.Policy.Backoff(attempt)
+		var statusErr reporting.StatusError
+		if errors.As(err, &statusErr) && statusErr.RetryAfter > 0 {
+			if statusErr.RetryAfter > d.Policy.MaxBackoff {
+				return err
+			}
+
+			wait = statusErr.RetryAfter
+		}
+
+		context.GetLogger(ctx).Debugf("report attempt %d failed, retrying in %v: %v", attempt, wait, err)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(wait):
+		}
+	}
+}
+
+func parsePolicy(parameters configuration.Parameters) (Policy, error) {
+	var err error
+	p := Policy{}
+
+	maxAttempts, err := parameters.Int("max_attempts", DEFAULT_MAX_ATTEMPTS)
+	if err != nil {
+		return p, err
+	}
+
+	p.MaxAttempts = int(maxAttempts)
+	if p.BaseBackoff, err = parameters.Duration("base_backoff", DEFAULT_BASE_BACKOFF); err != nil {
+		return p, err
+	}
+
+	if p.MaxBackoff, err = parameters.Duration("max_backoff", DEFAULT_MAX_BACKOFF); err != nil {
+		return p, err
+	}
+
+	if p.Jitter, err = parameters.Float("jitter", DEFAULT_JITTER); err != nil {
+		return p, err
+	}
+
+	if p.StatusCodes, err = parameters.IntList("status_codes"); err != nil {
+		return p, err
+	}
+
+	if p.StatusCodes == nil {
+		p.StatusCodes = DefaultStatusCodes
+	}
+
+	if p.MaxAttempts < 1 {
+		return p, fmt.Errorf("max_attempts must be at least 1")
+	}
+
+	if p.Jitter < 0 || p.Jitter > 1 {
+		return p, fmt.Errorf("jitter must be between 0 and 1")
+	}
+
+	if p.MaxBackoff < p.BaseBackoff {
+		p.MaxBackoff = p.BaseBackoff
+	}
+
+	return p, nil
+}
+
+// Wrap applies the `retry` and `circuit_breaker` sections of a reporting
+// driver's parameters to the driver. Drivers without either section are
+// returned as-is.
+func Wrap(driver reporting.Driver, parameters map[string]interface{}) (reporting.Driver, error) {
+	params := configuration.Parameters(parameters)
+
+	retryParams, err := params.Sub("retry")
+	if err != nil {
+		return nil, err
+	}
+
+	statusCodes := DefaultStatusCodes
+	if retryParams != nil {
+		policy, err := parsePolicy(retryParams)
+		if err != nil {
+			return nil, fmt.Errorf("invalid retry parameters: %v", err)
+		}
+
+		statusCodes = policy.StatusCodes
+
+		driver = &Driver{
+			Driver: driver,
+			Policy: policy,
+		}
+	}
+
+	breakerParams, err := params.Sub("circuit_breaker")
+	if err != nil {
+		return nil, err
+	}
+
+	if breakerParams != nil {
+		breaker, err := newBreaker(driver, breakerParams, statusCodes)
+		if err != nil {
+			return nil, fmt.Errorf("invalid circuit_breaker parameters: %v", err)
+		}
+
+		driver = breaker
+	}
+
+	return driver, nil
+}
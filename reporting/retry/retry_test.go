@@ -0,0 +1,150 @@
+package retry
+
+import (
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/MustWin/cmeter/context"
+	"github.com/MustWin/cmeter/reporting"
+)
+
+// failingDriver returns the errors in order, then succeeds.
+type failingDriver struct {
+	errs  []error
+	calls int
+}
+
+func (d *failingDriver) Report(ctx context.Context, e *reporting.Event) (reporting.Receipt, error) {
+	d.calls++
+	if len(d.errs) == 0 {
+		return reporting.Receipt("ok"), nil
+	}
+
+	err := d.errs[0]
+	d.errs = d.errs[1:]
+	return reporting.EmptyReceipt, err
+}
+
+func testEvent() *reporting.Event {
+	return &reporting.Event{MeterID: "meter", Type: reporting.EventSample, Timestamp: 1}
+}
+
+func TestBackoff(t *testing.T) {
+	p := Policy{BaseBackoff: 100 * time.Millisecond, MaxBackoff: time.Second}
+	expected := []time.Duration{100, 200, 400, 800, 1000, 1000}
+	for i, d := range expected {
+		if backoff := p.Backoff(i + 1); backoff != d*time.Millisecond {
+			t.Errorf("expected a backoff of %v for attempt %d, got %v", d*time.Millisecond, i+1, backoff)
+		}
+	}
+
+	// jitter shortens the backoff by up to its fraction
+	p.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		if backoff := p.Backoff(2); backoff > 200*time.Millisecond || backoff < 100*time.Millisecond {
+			t.Fatalf("expected a backoff between 100ms and 200ms, got %v", backoff)
+		}
+	}
+}
+
+func TestRetryable(t *testing.T) {
+	p := Policy{StatusCodes: DefaultStatusCodes}
+	cases := []struct {
+		err       error
+		retryable bool
+	}{
+		{reporting.StatusError{StatusCode: 503}, true},
+		{reporting.StatusError{StatusCode: 400}, false},
+		{io.ErrUnexpectedEOF, true},
+		{errors.New("error encoding event"), false},
+		{reporting.HeldError{Reason: "no key"}, false},
+	}
+
+	for _, c := range cases {
+		if p.retryable(c.err) != c.retryable {
+			t.Errorf("expected %v to be retryable: %v", c.err, c.retryable)
+		}
+	}
+}
+
+func TestRetry(t *testing.T) {
+	driver := &failingDriver{errs: []error{io.EOF, reporting.StatusError{StatusCode: 502}}}
+	d := &Driver{Driver: driver, Policy: Policy{MaxAttempts: 3, BaseBackoff: time.Millisecond, MaxBackoff: time.Millisecond, StatusCodes: DefaultStatusCodes}}
+	if receipt, err := d.Report(context.Background(), testEvent()); err != nil || receipt != "ok" {
+		t.Fatalf("expected the third attempt to succeed, got %q and %v", receipt, err)
+	}
+
+	// permanent failures aren't retried
+	driver = &failingDriver{errs: []error{reporting.StatusError{StatusCode: 400}}}
+	d.Driver = driver
+	if _, err := d.Report(context.Background(), testEvent()); err == nil || driver.calls != 1 {
+		t.Fatalf("expected a single failed attempt, got %d attempts and %v", driver.calls, err)
+	}
+}
+
+func TestBreakerTransitions(t *testing.T) {
+	unavailable := reporting.StatusError{StatusCode: 503}
+	driver := &failingDriver{errs: []error{unavailable, unavailable, unavailable}}
+	b := &Breaker{Driver: driver, Failures: 2, Cooldown: 20 * time.Millisecond, StatusCodes: DefaultStatusCodes}
+	ctx := context.Background()
+
+	// closed until the consecutive failures reach the limit
+	for i := 0; i < 2; i++ {
+		if _, err := b.Report(ctx, testEvent()); err != unavailable {
+			t.Fatalf("expected the driver's error, got %v", err)
+		}
+	}
+
+	if !b.Open() {
+		t.Fatal("expected the circuit to open")
+	}
+
+	if _, err := b.Report(ctx, testEvent()); err != ErrCircuitOpen || driver.calls != 2 {
+		t.Fatalf("expected reports to be refused, got %v after %d calls", err, driver.calls)
+	}
+
+	// half-open after the cooldown: a failing probe opens the circuit again
+	time.Sleep(30 * time.Millisecond)
+	if _, err := b.Report(ctx, testEvent()); err != unavailable {
+		t.Fatalf("expected the probe to reach the driver, got %v", err)
+	}
+
+	if _, err := b.Report(ctx, testEvent()); err != ErrCircuitOpen {
+		t.Fatalf("expected the failed probe to open the circuit again, got %v", err)
+	}
+
+	// a successful probe closes it
+	time.Sleep(30 * time.Millisecond)
+	if _, err := b.Report(ctx, testEvent()); err != nil || b.Open() {
+		t.Fatalf("expected the probe to close the circuit, got %v", err)
+	}
+}
+
+func TestBreakerSingleProbe(t *testing.T) {
+	b := &Breaker{Driver: &failingDriver{}, Failures: 1, Cooldown: time.Millisecond}
+	b.record(context.Background(), io.EOF)
+	time.Sleep(5 * time.Millisecond)
+
+	if !b.allow() {
+		t.Fatal("expected a probe to be let through after the cooldown")
+	}
+
+	if b.allow() {
+		t.Fatal("expected a single probe at a time")
+	}
+}
+
+func TestBreakerIgnoresPermanentFailures(t *testing.T) {
+	rejected := reporting.StatusError{StatusCode: 400}
+	driver := &failingDriver{errs: []error{rejected, rejected, reporting.HeldError{Reason: "no key"}, rejected}}
+	b := &Breaker{Driver: driver, Failures: 2, Cooldown: time.Minute, StatusCodes: DefaultStatusCodes}
+	for i := 0; i < 4; i++ {
+		b.Report(context.Background(), testEvent())
+	}
+
+	if b.Open() {
+		t.Fatal("expected rejected and held events not to open the circuit")
+	}
+}
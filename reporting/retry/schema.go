@@ -0,0 +1,29 @@
+package retry
+
+import "github.com/MustWin/cmeter/configuration"
+
+// Parameters are the `retry` and `circuit_breaker` sections every reporting
+// driver accepts.
+var Parameters = []configuration.Parameter{
+	{
+		Name:        "retry",
+		Type:        configuration.TypeSection,
+		Description: "retry failed reports",
+		Parameters: []configuration.Parameter{
+			{Name: "max_attempts", Type: configuration.TypeInt, Default: "3", Description: "attempts per report, including the first one"},
+			{Name: "base_backoff", Type: configuration.TypeDuration, Default: "500ms", Description: "backoff after the first failure, doubled after each further failure"},
+			{Name: "max_backoff", Type: configuration.TypeDuration, Default: "30s", Description: "maximum backoff"},
+			{Name: "jitter", Type: configuration.TypeFloat, Default: "0.2", Description: "fraction of each backoff that is randomized, between 0 and 1"},
+			{Name: "status_codes", Type: configuration.TypeIntList, Default: "408,429,500,502,503,504", Description: "response status codes worth retrying, `Retry-After` is honored"},
+		},
+	},
+	{
+		Name:        "circuit_breaker",
+		Type:        configuration.TypeSection,
+		Description: "pause reporting after consecutive failures, events keep being spooled in the meantime",
+		Parameters: []configuration.Parameter{
+			{Name: "failures", Type: configuration.TypeInt, Default: "5", Description: "consecutive retryable failures opening the circuit"},
+			{Name: "cooldown", Type: configuration.TypeDuration, Default: "1m", Description: "pause before a probe report is let through"},
+		},
+	},
+}
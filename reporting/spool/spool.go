@@ -0,0 +1,527 @@
+package spool
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/MustWin/cmeter/configuration"
+	"github.com/MustWin/cmeter/reporting"
+)
+
+const (
+	DEFAULT_SEGMENT_SIZE    = 8 * 1024 * 1024
+	DEFAULT_REPLAY_INTERVAL = 30 * time.Second
+
+	segmentExt = ".seg"
+	ackExt     = ".ack"
+
+	// magic(4) + payload length(4) + crc(4) + record id(8)
+	headerSize = 20
+
+	// "cmtr"
+	recordMagic uint32 = 0x636d7472
+)
+
+var ErrClosed = errors.New("spool is closed")
+
+// Spool is a write-ahead store for reporting events. Events are appended to
+// segment files before they are sent and acknowledged once a receipt was
+// obtained; segments are removed when all of their events are acknowledged.
+type Spool struct {
+	mutex       sync.Mutex
+	directory   string
+	maxSize     int64
+	maxAge      time.Duration
+	segmentSize int64
+	segments    []*segment
+	index       map[uint64]*segment
+	inflight    map[uint64]bool
+	nextID      uint64
+	closed      bool
+}
+
+type segment struct {
+	seq      uint64
+	path     string
+	size     int64
+	modified time.Time
+	pending  map[uint64]int64
+	file     *os.File
+}
+
+func (s *segment) ackPath() string {
+	return strings.TrimSuffix(s.path, segmentExt) + ackExt
+}
+
+func (s *segment) remove() {
+	if s.file != nil {
+		s.file.Close()
+		s.file = nil
+	}
+
+	os.Remove(s.path)
+	os.Remove(s.ackPath())
+}
+
+func New(config configuration.SpoolConfig) (*Spool, error) {
+	if config.Directory == "" {
+		return nil, fmt.Errorf("spool directory not specified")
+	}
+
+	if err := os.MkdirAll(config.Directory, 0700); err != nil {
+		return nil, fmt.Errorf("error creating spool directory: %v", err)
+	}
+
+	segmentSize := config.SegmentSize
+	if segmentSize <= 0 {
+		segmentSize = DEFAULT_SEGMENT_SIZE
+	}
+
+	s := &Spool{
+		directory:   config.Directory,
+		maxSize:     config.MaxSize,
+		maxAge:      config.MaxAge,
+		segmentSize: segmentSize,
+		index:       make(map[uint64]*segment),
+		inflight:    make(map[uint64]bool),
+		nextID:      1,
+	}
+
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+
+	s.enforceLimits()
+	return s, nil
+}
+
+// Len returns the number of unacknowledged events in the spool.
+func (s *Spool) Len() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return len(s.index)
+}
+
+// Append persists the event and returns the record id used to acknowledge
+// or release it. The record is considered in flight until then.
+func (s *Spool) Append(e *reporting.Event) (uint64, error) {
+	payload, err := json.Marshal(e)
+	if err != nil {
+		return 0, fmt.Errorf("error encoding event: %v", err)
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.closed {
+		return 0, ErrClosed
+	}
+
+	active := s.active()
+	if active == nil || active.size >= s.segmentSize {
+		if active, err = s.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	id := s.nextID
+	record := encodeRecord(id, payload)
+	if _, err := active.file.Write(record); err != nil {
+		return 0, fmt.Errorf("error writing spool record: %v", err)
+	}
+
+	if err := active.file.Sync(); err != nil {
+		return 0, fmt.Errorf("error syncing spool segment: %v", err)
+	}
+
+	s.nextID++
+	active.pending[id] = active.size
+	active.size += int64(len(record))
+	active.modified = time.Now()
+	s.index[id] = active
+	s.inflight[id] = true
+	s.enforceLimits()
+	return id, nil
+}
+
+// Ack marks the record as delivered. Records dropped by the size or age
+// limits in the meantime are ignored.
+func (s *Spool) Ack(id uint64) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	delete(s.inflight, id)
+	seg, ok := s.index[id]
+	if !ok {
+		return nil
+	}
+
+	delete(s.index, id)
+	delete(seg.pending, id)
+	if len(seg.pending) == 0 && seg != s.active() {
+		s.drop(seg)
+		return nil
+	}
+
+	fp, err := os.OpenFile(seg.ackPath(), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("error opening spool ack file: %v", err)
+	}
+
+	defer fp.Close()
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, id)
+	if _, err := fp.Write(buf); err != nil {
+		return fmt.Errorf("error writing spool ack: %v", err)
+	}
+
+	return nil
+}
+
+// Release returns an unacknowledged record to the spool so it is picked up
+// by the next replay.
+func (s *Spool) Release(id uint64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.inflight, id)
+}
+
+// Replay calls fn for every unacknowledged record that isn't in flight,
+// oldest first. fn is expected to Ack or Release each record.
+func (s *Spool) Replay(fn func(id uint64, e *reporting.Event)) error {
+	type entry struct {
+		id     uint64
+		path   string
+		offset int64
+	}
+
+	s.mutex.Lock()
+	if s.closed {
+		s.mutex.Unlock()
+		return ErrClosed
+	}
+
+	s.enforceLimits()
+	entries := make([]entry, 0)
+	for _, seg := range s.segments {
+		ids := make([]uint64, 0, len(seg.pending))
+		for id := range seg.pending {
+			if !s.inflight[id] {
+				ids = append(ids, id)
+			}
+		}
+
+		sort.Sort(idList(ids))
+		for _, id := range ids {
+			s.inflight[id] = true
+			entries = append(entries, entry{id, seg.path, seg.pending[id]})
+		}
+	}
+
+	s.mutex.Unlock()
+
+	for _, en := range entries {
+		e, err := readRecord(en.path, en.offset, en.id)
+		if err != nil {
+			log.Warnf("dropping unreadable spool record %d: %v", en.id, err)
+			s.Ack(en.id)
+			continue
+		}
+
+		fn(en.id, e)
+	}
+
+	return nil
+}
+
+func (s *Spool) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.closed {
+		return nil
+	}
+
+	s.closed = true
+	if active := s.active(); active != nil && active.file != nil {
+		err := active.file.Close()
+		active.file = nil
+		return err
+	}
+
+	return nil
+}
+
+func (s *Spool) active() *segment {
+	if len(s.segments) == 0 {
+		return nil
+	}
+
+	active := s.segments[len(s.segments)-1]
+	if active.file == nil {
+		return nil
+	}
+
+	return active
+}
+
+func (s *Spool) rotate() (*segment, error) {
+	if prev := s.active(); prev != nil {
+		prev.file.Close()
+		prev.file = nil
+		if len(prev.pending) == 0 {
+			s.drop(prev)
+		}
+	}
+
+	seq := uint64(1)
+	if len(s.segments) > 0 {
+		seq = s.segments[len(s.segments)-1].seq + 1
+	}
+
+	path := filepath.Join(s.directory, fmt.Sprintf("%020d%s", seq, segmentExt))
+	fp, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("error creating spool segment: %v", err)
+	}
+
+	seg := &segment{
+		seq:      seq,
+		path:     path,
+		modified: time.Now(),
+		pending:  make(map[uint64]int64),
+		file:     fp,
+	}
+
+	s.segments = append(s.segments, seg)
+	return seg, nil
+}
+
+func (s *Spool) drop(seg *segment) {
+	for id := range seg.pending {
+		delete(s.index, id)
+		delete(s.inflight, id)
+	}
+
+	for i, other := range s.segments {
+		if other == seg {
+			s.segments = append(s.segments[:i], s.segments[i+1:]...)
+			break
+		}
+	}
+
+	seg.remove()
+}
+
+func (s *Spool) enforceLimits() {
+	if s.maxAge > 0 {
+		cutoff := time.Now().Add(-s.maxAge)
+		for _, seg := range append([]*segment{}, s.segments...) {
+			if seg.file == nil && seg.modified.Before(cutoff) {
+				log.Warnf("dropping expired spool segment %s with %d unreported events", seg.path, len(seg.pending))
+				s.drop(seg)
+			}
+		}
+	}
+
+	if s.maxSize > 0 {
+		for len(s.segments) > 1 && s.size() > s.maxSize {
+			seg := s.segments[0]
+			log.Warnf("spool size limit reached, dropping segment %s with %d unreported events", seg.path, len(seg.pending))
+			s.drop(seg)
+		}
+	}
+}
+
+func (s *Spool) size() int64 {
+	total := int64(0)
+	for _, seg := range s.segments {
+		total += seg.size
+	}
+
+	return total
+}
+
+func (s *Spool) load() error {
+	paths, err := filepath.Glob(filepath.Join(s.directory, "*"+segmentExt))
+	if err != nil {
+		return err
+	}
+
+	sort.Strings(paths)
+	for _, path := range paths {
+		seq, err := strconv.ParseUint(strings.TrimSuffix(filepath.Base(path), segmentExt), 10, 64)
+		if err != nil {
+			log.Warnf("ignoring unrecognized spool file %s", path)
+			continue
+		}
+
+		seg, maxID, err := loadSegment(seq, path)
+		if err != nil {
+			return err
+		}
+
+		if maxID >= s.nextID {
+			s.nextID = maxID + 1
+		}
+
+		if len(seg.pending) == 0 {
+			seg.remove()
+			continue
+		}
+
+		for id := range seg.pending {
+			s.index[id] = seg
+		}
+
+		s.segments = append(s.segments, seg)
+	}
+
+	return nil
+}
+
+func loadSegment(seq uint64, path string) (*segment, uint64, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, 0, fmt.Errorf("error reading spool segment: %v", err)
+	}
+
+	seg := &segment{
+		seq:      seq,
+		path:     path,
+		size:     info.Size(),
+		modified: info.ModTime(),
+		pending:  make(map[uint64]int64),
+	}
+
+	maxID := uint64(0)
+	corrupted := 0
+	for offset := 0; offset+headerSize <= len(data); {
+		id, length, ok := decodeHeader(data[offset:])
+		if !ok {
+			corrupted++
+			offset = nextMagic(data, offset+1)
+			continue
+		}
+
+		seg.pending[id] = int64(offset)
+		if id > maxID {
+			maxID = id
+		}
+
+		offset += headerSize + length
+	}
+
+	if corrupted > 0 {
+		log.Warnf("skipped %d corrupted regions in spool segment %s", corrupted, path)
+	}
+
+	acks, err := ioutil.ReadFile(seg.ackPath())
+	if err != nil && !os.IsNotExist(err) {
+		return nil, 0, fmt.Errorf("error reading spool acks: %v", err)
+	}
+
+	for i := 0; i+8 <= len(acks); i += 8 {
+		delete(seg.pending, binary.BigEndian.Uint64(acks[i:]))
+	}
+
+	return seg, maxID, nil
+}
+
+func encodeRecord(id uint64, payload []byte) []byte {
+	record := make([]byte, headerSize+len(payload))
+	binary.BigEndian.PutUint32(record[0:], recordMagic)
+	binary.BigEndian.PutUint32(record[4:], uint32(len(payload)))
+	binary.BigEndian.PutUint64(record[12:], id)
+	copy(record[headerSize:], payload)
+	binary.BigEndian.PutUint32(record[8:], crc32.ChecksumIEEE(record[12:]))
+	return record
+}
+
+// decodeHeader validates the record starting at data[0] and returns its id
+// and payload length.
+func decodeHeader(data []byte) (uint64, int, bool) {
+	if binary.BigEndian.Uint32(data[0:]) != recordMagic {
+		return 0, 0, false
+	}
+
+	length := int(binary.BigEndian.Uint32(data[4:]))
+	if length < 0 || headerSize+length > len(data) {
+		return 0, 0, false
+	}
+
+	if crc32.ChecksumIEEE(data[12:headerSize+length]) != binary.BigEndian.Uint32(data[8:]) {
+		return 0, 0, false
+	}
+
+	return binary.BigEndian.Uint64(data[12:]), length, true
+}
+
+func nextMagic(data []byte, from int) int {
+	for i := from; i+4 <= len(data); i++ {
+		if binary.BigEndian.Uint32(data[i:]) == recordMagic {
+			return i
+		}
+	}
+
+	return len(data)
+}
+
+func readRecord(path string, offset int64, id uint64) (*reporting.Event, error) {
+	fp, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	defer fp.Close()
+	header := make([]byte, headerSize)
+	if _, err := fp.ReadAt(header, offset); err != nil {
+		return nil, err
+	}
+
+	length := int64(binary.BigEndian.Uint32(header[4:]))
+	record := make([]byte, headerSize+length)
+	if _, err := fp.ReadAt(record, offset); err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	recordID, _, ok := decodeHeader(record)
+	if !ok || recordID != id {
+		return nil, fmt.Errorf("corrupted record")
+	}
+
+	return reporting.Decode(record[headerSize:])
+}
+
+type idList []uint64
+
+func (a idList) Len() int {
+	return len(a)
+}
+
+func (a idList) Swap(i int, j int) {
+	a[i], a[j] = a[j], a[i]
+}
+
+func (a idList) Less(i int, j int) bool {
+	return a[i] < a[j]
+}
@@ -0,0 +1,222 @@
+package spool
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/MustWin/cmeter/configuration"
+	"github.com/MustWin/cmeter/reporting"
+)
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "cmeter-spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return dir
+}
+
+func open(t *testing.T, config configuration.SpoolConfig) *Spool {
+	s, err := New(config)
+	if err != nil {
+		t.Fatalf("error opening spool: %v", err)
+	}
+
+	return s
+}
+
+func testEvent(timestamp int64) *reporting.Event {
+	return &reporting.Event{MeterID: "meter", Type: reporting.EventSample, Timestamp: timestamp}
+}
+
+func appendEvents(t *testing.T, s *Spool, n int) []uint64 {
+	ids := make([]uint64, n)
+	for i := range ids {
+		id, err := s.Append(testEvent(int64(i + 1)))
+		if err != nil {
+			t.Fatalf("error appending event: %v", err)
+		}
+
+		ids[i] = id
+	}
+
+	return ids
+}
+
+// replayed returns the timestamps of the replayed events, releasing them.
+func replayed(t *testing.T, s *Spool) []int64 {
+	var timestamps []int64
+	err := s.Replay(func(id uint64, e *reporting.Event) {
+		timestamps = append(timestamps, e.Timestamp)
+		s.Release(id)
+	})
+
+	if err != nil {
+		t.Fatalf("error replaying spool: %v", err)
+	}
+
+	return timestamps
+}
+
+func expectTimestamps(t *testing.T, got []int64, expected ...int64) {
+	if len(got) != len(expected) {
+		t.Fatalf("expected events %v, got %v", expected, got)
+	}
+
+	for i := range expected {
+		if got[i] != expected[i] {
+			t.Fatalf("expected events %v, got %v", expected, got)
+		}
+	}
+}
+
+func TestAppendReplay(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	s := open(t, configuration.SpoolConfig{Directory: dir})
+	defer s.Close()
+
+	ids := appendEvents(t, s, 3)
+
+	// appended events are in flight until released
+	expectTimestamps(t, replayed(t, s))
+	for _, id := range ids {
+		s.Release(id)
+	}
+
+	expectTimestamps(t, replayed(t, s), 1, 2, 3)
+	if err := s.Ack(ids[1]); err != nil {
+		t.Fatalf("error acknowledging event: %v", err)
+	}
+
+	expectTimestamps(t, replayed(t, s), 1, 3)
+	if s.Len() != 2 {
+		t.Fatalf("expected 2 pending events, got %d", s.Len())
+	}
+}
+
+func TestAcksSurviveReopen(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	s := open(t, configuration.SpoolConfig{Directory: dir})
+	ids := appendEvents(t, s, 3)
+	if err := s.Ack(ids[0]); err != nil {
+		t.Fatalf("error acknowledging event: %v", err)
+	}
+
+	s.Close()
+
+	s = open(t, configuration.SpoolConfig{Directory: dir})
+	defer s.Close()
+	expectTimestamps(t, replayed(t, s), 2, 3)
+
+	// ids keep increasing across runs
+	id, err := s.Append(testEvent(4))
+	if err != nil || id <= ids[2] {
+		t.Fatalf("expected an id above %d, got %d and %v", ids[2], id, err)
+	}
+}
+
+func TestCorruptedRecordSkipped(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	s := open(t, configuration.SpoolConfig{Directory: dir})
+	appendEvents(t, s, 3)
+	s.Close()
+
+	paths, _ := filepath.Glob(filepath.Join(dir, "*"+segmentExt))
+	if len(paths) != 1 {
+		t.Fatalf("expected one segment, got %v", paths)
+	}
+
+	data, err := ioutil.ReadFile(paths[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// flips a payload byte of the second record, whose crc no longer
+	// matches, the third record is found again by its magic
+	second := nextMagic(data, 1)
+	data[second+headerSize+1] ^= 0xff
+	if err := ioutil.WriteFile(paths[0], data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	s = open(t, configuration.SpoolConfig{Directory: dir})
+	expectTimestamps(t, replayed(t, s), 1, 3)
+	s.Close()
+
+	// a record cut short by a crash is dropped
+	if err := ioutil.WriteFile(paths[0], data[:len(data)-5], 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	s = open(t, configuration.SpoolConfig{Directory: dir})
+	defer s.Close()
+	expectTimestamps(t, replayed(t, s), 1)
+}
+
+func TestMaxSize(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	payload, err := json.Marshal(testEvent(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	record := int64(len(encodeRecord(1, payload)))
+	s := open(t, configuration.SpoolConfig{
+		Directory:   dir,
+		SegmentSize: 2 * record,
+		MaxSize:     4 * record,
+	})
+
+	defer s.Close()
+
+	ids := appendEvents(t, s, 6)
+	for _, id := range ids {
+		s.Release(id)
+	}
+
+	// the oldest segment is dropped to stay within the limit
+	expectTimestamps(t, replayed(t, s), 3, 4, 5, 6)
+	if size := s.size(); size > 4*record {
+		t.Fatalf("expected at most %d bytes, got %d", 4*record, size)
+	}
+
+	// acknowledging dropped events is ignored
+	if err := s.Ack(ids[0]); err != nil {
+		t.Fatalf("error acknowledging a dropped event: %v", err)
+	}
+}
+
+func TestClosed(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	s := open(t, configuration.SpoolConfig{Directory: dir})
+	appendEvents(t, s, 1)
+	if err := s.Close(); err != nil {
+		t.Fatalf("error closing spool: %v", err)
+	}
+
+	if _, err := s.Append(testEvent(2)); err != ErrClosed {
+		t.Fatalf("expected appends to fail with %v, got %v", ErrClosed, err)
+	}
+
+	if err := s.Replay(func(uint64, *reporting.Event) {}); err != ErrClosed {
+		t.Fatalf("expected replays to fail with %v, got %v", ErrClosed, err)
+	}
+
+	if err := s.Close(); err != nil {
+		t.Fatalf("expected closing twice to succeed, got %v", err)
+	}
+}
@@ -0,0 +1,341 @@
+package statsd
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/MustWin/cmeter/collector"
+	"github.com/MustWin/cmeter/configuration"
+	"github.com/MustWin/cmeter/containers"
+	"github.com/MustWin/cmeter/context"
+	"github.com/MustWin/cmeter/reporting"
+	"github.com/MustWin/cmeter/reporting/factory"
+)
+
+const (
+	DEFAULT_ADDRESS = "127.0.0.1:8125"
+	DEFAULT_NETWORK = "udp"
+	DEFAULT_PREFIX  = "cmeter."
+	DEFAULT_MTU     = 1432
+)
+
+var (
+	ErrInvalidNetwork = errors.New("invalid network, must be `udp` or `unixgram`")
+
+	invalidNameChars = regexp.MustCompile("[^a-zA-Z0-9_.-]")
+	invalidTagChars  = regexp.MustCompile("[|,#\n]")
+)
+
+type driverFactory struct{}
+
+func (factory *driverFactory) Schema() configuration.Schema {
+	return configuration.Schema{
+		Description: "Emits StatsD metrics.",
+		Parameters: []configuration.Parameter{
+			{Name: "network", Type: configuration.TypeString, Default: DEFAULT_NETWORK, Values: []string{"udp", "unixgram"}, Description: "network of the address"},
+			{Name: "address", Type: configuration.TypeString, Default: DEFAULT_ADDRESS, Description: "StatsD server address"},
+			{Name: "prefix", Type: configuration.TypeString, Default: DEFAULT_PREFIX, Description: "prefix of the metric names"},
+			{Name: "mtu", Type: configuration.TypeInt, Default: "1432", Description: "maximum packet size"},
+			{Name: "tags", Type: configuration.TypeBool, Default: "false", Description: "use DogStatsD tags to identify containers instead of metric names"},
+			{Name: "tag_labels", Type: configuration.TypeStringList, Description: "container labels added as tags"},
+		},
+	}
+}
+
+func (factory *driverFactory) Create(parameters map[string]interface{}) (reporting.Driver, error) {
+	params := configuration.Parameters(parameters)
+
+	network := strings.ToLower(params.String("network", DEFAULT_NETWORK))
+	switch network {
+	case "udp", "udp4", "udp6", "unixgram":
+	default:
+		return nil, ErrInvalidNetwork
+	}
+
+	mtu, err := params.Int("mtu", DEFAULT_MTU)
+	if err != nil {
+		return nil, err
+	}
+
+	tags, err := params.Bool("tags", false)
+	if err != nil {
+		return nil, err
+	}
+
+	tagLabels, err := params.StringList("tag_labels")
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := net.Dial(network, params.String("address", DEFAULT_ADDRESS))
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to statsd: %v", err)
+	}
+
+	return &Driver{
+		Prefix:    params.String("prefix", DEFAULT_PREFIX),
+		MTU:       int(mtu),
+		Tags:      tags,
+		TagLabels: tagLabels,
+		conn:      conn,
+		last:      make(map[string]*counters),
+	}, nil
+}
+
+func init() {
+	factory.Register("statsd", &driverFactory{})
+}
+
+type counters struct {
+	rx   uint64
+	tx   uint64
+	disk uint64
+}
+
+// Driver emits usage as StatsD gauges and counters. With Tags enabled,
+// DogStatsD tags identify the container; otherwise the container name is
+// part of the metric name.
+type Driver struct {
+	Prefix string
+	MTU    int
+	Tags   bool
+	// container labels added as DogStatsD tags
+	TagLabels []string
+
+	conn  net.Conn
+	mutex sync.Mutex
+	// the containers driver reports cumulative network and disk figures,
+	// counters are sent as the difference to the last sample
+	last map[string]*counters
+}
+
+func (d *Driver) Report(ctx context.Context, e *reporting.Event) (reporting.Receipt, error) {
+	if _, err := d.ReportBatch(ctx, []*reporting.Event{e}); err != nil {
+		return reporting.EmptyReceipt, err
+	}
+
+	return reporting.EmptyReceipt, nil
+}
+
+func (d *Driver) ReportBatch(ctx context.Context, events []*reporting.Event) ([]reporting.Receipt, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	lines := make([]string, 0)
+	for _, e := range events {
+		eventLines, err := d.lines(e)
+		if err != nil {
+			return nil, err
+		}
+
+		lines = append(lines, eventLines...)
+	}
+
+	if err := d.send(lines); err != nil {
+		return nil, err
+	}
+
+	return make([]reporting.Receipt, len(events)), nil
+}
+
+func (d *Driver) Close() error {
+	return d.conn.Close()
+}
+
+// send packs the lines into as few packets as the MTU allows.
+func (d *Driver) send(lines []string) error {
+	packet := &bytes.Buffer{}
+	for _, line := range lines {
+		if packet.Len() > 0 && packet.Len()+1+len(line) > d.MTU {
+			if _, err := d.conn.Write(packet.Bytes()); err != nil {
+				return fmt.Errorf("error sending metrics: %w", err)
+			}
+
+			packet.Reset()
+		}
+
+		if packet.Len() > 0 {
+			packet.WriteByte('\n')
+		}
+
+		packet.WriteString(line)
+	}
+
+	if packet.Len() > 0 {
+		if _, err := d.conn.Write(packet.Bytes()); err != nil {
+			return fmt.Errorf("error sending metrics: %w", err)
+		}
+	}
+
+	return nil
+}
+
+func (d *Driver) lines(e *reporting.Event) ([]string, error) {
+	switch data := e.Data.(type) {
+	case *collector.Sample:
+		return d.sampleLines(data), nil
+	case *collector.MachineSample:
+		return d.machineLines(data), nil
+	case *containers.StateChange:
+		return d.stateChangeLines(data), nil
+	}
+
+	return nil, fmt.Errorf("unsupported event type %q", e.Type)
+}
+
+func (d *Driver) sampleLines(s *collector.Sample) []string {
+	if s.Container == nil || s.Usage == nil {
+		return nil
+	}
+
+	name, tags := d.containerScope(s.Container)
+	lines := make([]string, 0)
+	if s.Usage.Cpu != nil {
+		lines = append(lines, d.metric(name+"cpu.nanoseconds", s.Usage.Cpu.Total, "c", tags))
+	}
+
+	if s.Usage.Memory != nil {
+		lines = append(lines, d.metric(name+"memory.bytes", s.Usage.Memory.Bytes, "g", tags))
+	}
+
+	if s.Container.Reserved != nil {
+		lines = append(lines, d.metric(name+"cpu.reserved_cores", s.Container.Reserved.Cpu, "g", tags))
+		lines = append(lines, d.metric(name+"memory.reserved_bytes", s.Container.Reserved.Memory, "g", tags))
+	}
+
+	current := &counters{}
+	if s.Usage.Network != nil {
+		current.rx = s.Usage.Network.TotalRxBytes
+		current.tx = s.Usage.Network.TotalTxBytes
+	}
+
+	if s.Usage.Disk != nil {
+		for _, v := range s.Usage.Disk.PerDiskIo {
+			current.disk += v
+		}
+	}
+
+	if last, ok := d.last[s.Container.Name]; ok {
+		lines = append(lines,
+			d.metric(name+"network.rx_bytes", delta(last.rx, current.rx), "c", tags),
+			d.metric(name+"network.tx_bytes", delta(last.tx, current.tx), "c", tags),
+			d.metric(name+"disk.io_bytes", delta(last.disk, current.disk), "c", tags))
+	}
+
+	d.last[s.Container.Name] = current
+	return lines
+}
+
+func (d *Driver) machineLines(s *collector.MachineSample) []string {
+	if s.Machine == nil || s.Usage == nil {
+		return nil
+	}
+
+	name := "machine."
+	tags := ""
+	if d.Tags {
+		tags = formatTags([][2]string{{"machine", s.Machine.SystemUuid}, {"machine_name", s.Machine.Name}})
+	} else {
+		name = fmt.Sprintf("machine.%s.", sanitizeName(s.Machine.SystemUuid))
+	}
+
+	lines := []string{
+		d.metric(name+"cores", s.Machine.Cores, "g", tags),
+		d.metric(name+"memory.capacity_bytes", s.Machine.MemoryBytes, "g", tags),
+	}
+
+	if s.Usage.Cpu != nil {
+		lines = append(lines, d.metric(name+"cpu.nanoseconds", s.Usage.Cpu.Total, "c", tags))
+	}
+
+	if s.Usage.Memory != nil {
+		lines = append(lines, d.metric(name+"memory.bytes", s.Usage.Memory.Bytes, "g", tags))
+	}
+
+	return lines
+}
+
+func (d *Driver) stateChangeLines(ch *containers.StateChange) []string {
+	if ch.Container == nil {
+		return nil
+	}
+
+	name, tags := d.containerScope(ch.Container)
+	switch ch.State {
+	case containers.StateRunning:
+		return []string{d.metric(name+"started", 1, "c", tags)}
+	case containers.StateStopped:
+		delete(d.last, ch.Container.Name)
+		return []string{d.metric(name+"stopped", 1, "c", tags)}
+	}
+
+	return nil
+}
+
+func (d *Driver) containerScope(info *containers.ContainerInfo) (string, string) {
+	if !d.Tags {
+		return fmt.Sprintf("container.%s.", sanitizeName(info.Name)), ""
+	}
+
+	pairs := [][2]string{
+		{"container_name", info.Name},
+		{"image", info.ImageName},
+		{"image_tag", info.ImageTag},
+	}
+
+	for _, label := range d.TagLabels {
+		if v, ok := info.Labels[label]; ok {
+			pairs = append(pairs, [2]string{label, v})
+		}
+	}
+
+	return "container.", formatTags(pairs)
+}
+
+func (d *Driver) metric(name string, value interface{}, kind string, tags string) string {
+	var v string
+	switch n := value.(type) {
+	case float64:
+		v = strconv.FormatFloat(n, 'f', -1, 64)
+	default:
+		v = fmt.Sprint(n)
+	}
+
+	return fmt.Sprintf("%s%s:%s|%s%s", d.Prefix, name, v, kind, tags)
+}
+
+func delta(last, current uint64) uint64 {
+	if current < last {
+		// counter was reset
+		return current
+	}
+
+	return current - last
+}
+
+func sanitizeName(name string) string {
+	return invalidNameChars.ReplaceAllString(strings.Trim(name, "/"), "_")
+}
+
+func formatTags(pairs [][2]string) string {
+	tags := make([]string, 0, len(pairs))
+	for _, pair := range pairs {
+		if pair[1] == "" {
+			continue
+		}
+
+		tags = append(tags, invalidTagChars.ReplaceAllString(pair[0], "_")+":"+invalidTagChars.ReplaceAllString(pair[1], "_"))
+	}
+
+	if len(tags) == 0 {
+		return ""
+	}
+
+	return "|#" + strings.Join(tags, ",")
+}
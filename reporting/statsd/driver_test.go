@@ -0,0 +1,182 @@
+package statsd
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/MustWin/cmeter/collector"
+	"github.com/MustWin/cmeter/containers"
+	"github.com/MustWin/cmeter/context"
+	"github.com/MustWin/cmeter/reporting"
+	"github.com/MustWin/cmeter/reporting/reportingtest"
+)
+
+// listen returns a statsd server standing in for the one the driver sends
+// to.
+func listen(t *testing.T) *net.UDPConn {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return conn
+}
+
+// packets reads the packets sent until none arrives for a while.
+func packets(t *testing.T, conn *net.UDPConn) []string {
+	var received []string
+	buf := make([]byte, 65536)
+	for {
+		conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		n, err := conn.Read(buf)
+		if err != nil {
+			if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+				return received
+			}
+
+			t.Fatalf("error reading packet: %v", err)
+		}
+
+		received = append(received, string(buf[:n]))
+	}
+}
+
+func newTestDriver(t *testing.T, conn *net.UDPConn, parameters map[string]interface{}) reporting.Driver {
+	parameters["address"] = conn.LocalAddr().String()
+	return reportingtest.NewDriver(t, &driverFactory{}, parameters)
+}
+
+func sampleEvent(rx uint64) *reporting.Event {
+	return &reporting.Event{
+		MeterID:   "meter",
+		Type:      reporting.EventSample,
+		Timestamp: 1,
+		Data: &collector.Sample{
+			Timestamp: 1,
+			Container: &containers.ContainerInfo{
+				Name:      "/web.1 blue",
+				ImageName: "nginx",
+				ImageTag:  "1.13",
+				Labels:    map[string]string{"tenant": "acme,inc|#1", "team": "core"},
+				Reserved:  &containers.ReservedResources{Cpu: 0.5, Memory: 512},
+			},
+			Usage: &containers.Usage{
+				Cpu:     &containers.CpuUsage{Total: 1000},
+				Memory:  &containers.MemoryUsage{Bytes: 2048},
+				Network: &containers.NetworkUsage{TotalRxBytes: rx, TotalTxBytes: 10},
+				Disk:    &containers.DiskUsage{},
+			},
+		},
+	}
+}
+
+func expectLines(t *testing.T, received []string, expected []string) {
+	lines := strings.Split(strings.Join(received, "\n"), "\n")
+	if strings.Join(lines, "\n") != strings.Join(expected, "\n") {
+		t.Fatalf("expected lines:\n%s\ngot:\n%s", strings.Join(expected, "\n"), strings.Join(lines, "\n"))
+	}
+}
+
+func TestTaggedLines(t *testing.T) {
+	conn := listen(t)
+	defer conn.Close()
+
+	d := newTestDriver(t, conn, map[string]interface{}{
+		"tags":       true,
+		"tag_labels": []interface{}{"tenant", "missing"},
+	})
+
+	defer reporting.Close(d)
+
+	ctx := context.Background()
+	if _, err := d.Report(ctx, sampleEvent(100)); err != nil {
+		t.Fatalf("error reporting: %v", err)
+	}
+
+	tags := "|#container_name:/web.1 blue,image:nginx,image_tag:1.13,tenant:acme_inc__1"
+	expectLines(t, packets(t, conn), []string{
+		"cmeter.container.cpu.nanoseconds:1000|c" + tags,
+		"cmeter.container.memory.bytes:2048|g" + tags,
+		"cmeter.container.cpu.reserved_cores:0.5|g" + tags,
+		"cmeter.container.memory.reserved_bytes:512|g" + tags,
+	})
+
+	// network and disk counters are sent as the difference to the last sample
+	if _, err := d.Report(ctx, sampleEvent(150)); err != nil {
+		t.Fatalf("error reporting: %v", err)
+	}
+
+	expectLines(t, packets(t, conn), []string{
+		"cmeter.container.cpu.nanoseconds:1000|c" + tags,
+		"cmeter.container.memory.bytes:2048|g" + tags,
+		"cmeter.container.cpu.reserved_cores:0.5|g" + tags,
+		"cmeter.container.memory.reserved_bytes:512|g" + tags,
+		"cmeter.container.network.rx_bytes:50|c" + tags,
+		"cmeter.container.network.tx_bytes:0|c" + tags,
+		"cmeter.container.disk.io_bytes:0|c" + tags,
+	})
+}
+
+func TestNamedLines(t *testing.T) {
+	conn := listen(t)
+	defer conn.Close()
+
+	d := newTestDriver(t, conn, map[string]interface{}{"prefix": "app."})
+	defer reporting.Close(d)
+
+	e := &reporting.Event{
+		MeterID:   "meter",
+		Type:      reporting.EventStateChange,
+		Timestamp: 1,
+		Data: &containers.StateChange{
+			State:     containers.StateRunning,
+			Container: &containers.ContainerInfo{Name: "/web.1 blue"},
+		},
+	}
+
+	if _, err := d.Report(context.Background(), e); err != nil {
+		t.Fatalf("error reporting: %v", err)
+	}
+
+	expectLines(t, packets(t, conn), []string{"app.container.web.1_blue.started:1|c"})
+}
+
+func TestPacketsFitMTU(t *testing.T) {
+	conn := listen(t)
+	defer conn.Close()
+
+	mtu := 200
+	d := newTestDriver(t, conn, map[string]interface{}{"tags": true, "mtu": mtu})
+	defer reporting.Close(d)
+
+	events := []*reporting.Event{sampleEvent(100), sampleEvent(200), sampleEvent(300)}
+	if _, err := d.(*Driver).ReportBatch(context.Background(), events); err != nil {
+		t.Fatalf("error reporting: %v", err)
+	}
+
+	received := packets(t, conn)
+	if len(received) < 2 {
+		t.Fatalf("expected the lines split into several packets, got %d", len(received))
+	}
+
+	lines := 0
+	for _, packet := range received {
+		if len(packet) > mtu {
+			t.Errorf("packet of %d bytes exceeds the mtu", len(packet))
+		}
+
+		for _, line := range strings.Split(packet, "\n") {
+			if !strings.HasPrefix(line, "cmeter.container.") || !strings.Contains(line, "|#container_name:") {
+				t.Errorf("unexpected line %q", line)
+			}
+
+			lines++
+		}
+	}
+
+	if lines != 4+7+7 {
+		t.Fatalf("expected %d lines, got %d", 4+7+7, lines)
+	}
+}
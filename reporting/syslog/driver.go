@@ -0,0 +1,296 @@
+package syslog
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/MustWin/cmeter/configuration"
+	"github.com/MustWin/cmeter/context"
+	"github.com/MustWin/cmeter/reporting"
+	"github.com/MustWin/cmeter/reporting/factory"
+	"github.com/MustWin/cmeter/reporting/transport"
+)
+
+const (
+	DEFAULT_SYSLOG_SOCKET  = "/dev/log"
+	DEFAULT_JOURNAL_SOCKET = "/run/systemd/journal/socket"
+	DEFAULT_APP_NAME       = "cmeter"
+	DEFAULT_FACILITY       = "local0"
+	DEFAULT_SEVERITY       = "info"
+	DEFAULT_TIMEOUT        = 5 * time.Second
+
+	FRAMING_OCTET_COUNTING  = "octet_counting"
+	FRAMING_NON_TRANSPARENT = "non_transparent"
+)
+
+var (
+	ErrInvalidNetwork  = errors.New("invalid network, must be `unixgram`, `unix`, `udp`, `tcp` or `tls`")
+	ErrInvalidFormat   = errors.New("invalid format, must be `rfc5424` or `journald`")
+	ErrInvalidFraming  = errors.New("invalid framing, must be `octet_counting` or `non_transparent`")
+	ErrInvalidFacility = errors.New("invalid facility")
+	ErrInvalidSeverity = errors.New("invalid severity")
+	ErrJournaldNetwork = errors.New("the journald format requires the `unixgram` network")
+)
+
+var facilities = []string{
+	"kern", "user", "mail", "daemon", "auth", "syslog", "lpr", "news",
+	"uucp", "cron", "authpriv", "ftp", "ntp", "audit", "alert", "clock",
+	"local0", "local1", "local2", "local3", "local4", "local5", "local6", "local7",
+}
+
+var severities = []string{
+	"emerg", "alert", "crit", "err", "warning", "notice", "info", "debug",
+}
+
+func parseCode(value string, names []string) (int, bool) {
+	for i, name := range names {
+		if strings.EqualFold(name, value) {
+			return i, true
+		}
+	}
+
+	code, err := strconv.Atoi(value)
+	return code, err == nil && code >= 0 && code < len(names)
+}
+
+type driverFactory struct{}
+
+func (factory *driverFactory) Schema() configuration.Schema {
+	params := []configuration.Parameter{
+		{Name: "format", Type: configuration.TypeString, Default: FORMAT_RFC5424, Values: []string{FORMAT_RFC5424, FORMAT_JOURNALD}, Description: "RFC 5424 messages or the journald native protocol"},
+		{Name: "network", Type: configuration.TypeString, Default: "unixgram", Values: []string{"unixgram", "unix", "udp", "udp4", "udp6", "tcp", "tcp4", "tcp6", "tls"}, Description: "network of the address"},
+		{Name: "address", Type: configuration.TypeString, Description: "syslog address, defaults to `/dev/log`, or `/run/systemd/journal/socket` with the `journald` format"},
+		{Name: "framing", Type: configuration.TypeString, Values: []string{FRAMING_OCTET_COUNTING, FRAMING_NON_TRANSPARENT}, Description: "stream framing, defaults to `non_transparent` on `unix` and `octet_counting` otherwise"},
+		{Name: "facility", Type: configuration.TypeString, Default: DEFAULT_FACILITY, Description: "facility name or code"},
+		{Name: "severity", Type: configuration.TypeString, Default: DEFAULT_SEVERITY, Description: "severity name or code"},
+		{Name: "enterprise_id", Type: configuration.TypeInt, Default: strconv.Itoa(DEFAULT_ENTERPRISE_ID), Description: "private enterprise number used in the structured data ids"},
+		{Name: "timeout", Type: configuration.TypeDuration, Default: "5s", Description: "connect and write timeout"},
+		{Name: "hostname", Type: configuration.TypeString, Description: "hostname of the messages, defaults to the machine's"},
+		{Name: "app_name", Type: configuration.TypeString, Default: DEFAULT_APP_NAME, Description: "application name of the messages"},
+	}
+
+	return configuration.Schema{
+		Description: "Writes events as syslog or journald log messages.",
+		Parameters:  append(params, transport.TLSParameters...),
+	}
+}
+
+func (factory *driverFactory) Create(parameters map[string]interface{}) (reporting.Driver, error) {
+	params := configuration.Parameters(parameters)
+	format := strings.ToLower(params.String("format", FORMAT_RFC5424))
+	address := DEFAULT_SYSLOG_SOCKET
+	switch format {
+	case FORMAT_RFC5424:
+	case FORMAT_JOURNALD:
+		address = DEFAULT_JOURNAL_SOCKET
+	default:
+		return nil, ErrInvalidFormat
+	}
+
+	network := strings.ToLower(params.String("network", "unixgram"))
+	framing := FRAMING_OCTET_COUNTING
+	switch network {
+	case "unixgram", "udp", "udp4", "udp6":
+	case "unix":
+		framing = FRAMING_NON_TRANSPARENT
+	case "tcp", "tcp4", "tcp6", "tls":
+	default:
+		return nil, ErrInvalidNetwork
+	}
+
+	if format == FORMAT_JOURNALD && network != "unixgram" {
+		return nil, ErrJournaldNetwork
+	}
+
+	framing = strings.ToLower(params.String("framing", framing))
+	if framing != FRAMING_OCTET_COUNTING && framing != FRAMING_NON_TRANSPARENT {
+		return nil, ErrInvalidFraming
+	}
+
+	facility, ok := parseCode(params.String("facility", DEFAULT_FACILITY), facilities)
+	if !ok {
+		return nil, ErrInvalidFacility
+	}
+
+	severity, ok := parseCode(params.String("severity", DEFAULT_SEVERITY), severities)
+	if !ok {
+		return nil, ErrInvalidSeverity
+	}
+
+	enterpriseID, err := params.Int("enterprise_id", DEFAULT_ENTERPRISE_ID)
+	if err != nil {
+		return nil, err
+	}
+
+	timeout, err := params.Duration("timeout", DEFAULT_TIMEOUT)
+	if err != nil {
+		return nil, err
+	}
+
+	hostname, _ := os.Hostname()
+	d := &Driver{
+		Network:      network,
+		Address:      params.String("address", address),
+		Format:       format,
+		Framing:      framing,
+		Facility:     facility,
+		Severity:     severity,
+		Hostname:     params.String("hostname", hostname),
+		AppName:      params.String("app_name", DEFAULT_APP_NAME),
+		EnterpriseID: int(enterpriseID),
+		Timeout:      timeout,
+		pid:          os.Getpid(),
+	}
+
+	if network == "tls" {
+		if d.TLSConfig, d.certs, err = transport.TLSConfig(params); err != nil {
+			return nil, err
+		}
+	}
+
+	return d, nil
+}
+
+func init() {
+	factory.Register("syslog", &driverFactory{})
+}
+
+// Driver writes every event as a log message, either in the RFC 5424
+// format with the event's fields as structured data or in the journald
+// native protocol. The event JSON is the message text, so usage can be
+// recovered from log pipelines.
+type Driver struct {
+	Network string
+	Address string
+	Format  string
+	// framing of messages on stream connections, RFC 6587
+	Framing      string
+	Facility     int
+	Severity     int
+	Hostname     string
+	AppName      string
+	EnterpriseID int
+	Timeout      time.Duration
+	TLSConfig    *tls.Config
+
+	pid   int
+	certs io.Closer
+	mutex sync.Mutex
+	conn  net.Conn
+}
+
+func (d *Driver) Report(ctx context.Context, e *reporting.Event) (reporting.Receipt, error) {
+	if _, err := d.ReportBatch(ctx, []*reporting.Event{e}); err != nil {
+		return reporting.EmptyReceipt, err
+	}
+
+	return reporting.EmptyReceipt, nil
+}
+
+func (d *Driver) ReportBatch(ctx context.Context, events []*reporting.Event) ([]reporting.Receipt, error) {
+	messages := make([][]byte, len(events))
+	for i, e := range events {
+		blob, err := json.Marshal(e)
+		if err != nil {
+			return nil, fmt.Errorf("error encoding event: %v", err)
+		}
+
+		if d.Format == FORMAT_JOURNALD {
+			messages[i] = d.formatJournald(e, blob)
+		} else {
+			messages[i] = d.frame(d.formatRFC5424(e, blob))
+		}
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	receipts := make([]reporting.Receipt, 0, len(events))
+	for _, msg := range messages {
+		if err := d.write(msg); err != nil {
+			return receipts, err
+		}
+
+		receipts = append(receipts, reporting.EmptyReceipt)
+	}
+
+	return receipts, nil
+}
+
+func (d *Driver) Close() error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	var err error
+	if d.conn != nil {
+		err = d.conn.Close()
+		d.conn = nil
+	}
+
+	if d.certs != nil {
+		if certsErr := d.certs.Close(); err == nil {
+			err = certsErr
+		}
+	}
+
+	return err
+}
+
+func (d *Driver) stream() bool {
+	switch d.Network {
+	case "unixgram", "udp", "udp4", "udp6":
+		return false
+	}
+
+	return true
+}
+
+func (d *Driver) frame(msg []byte) []byte {
+	if !d.stream() {
+		return msg
+	}
+
+	if d.Framing == FRAMING_NON_TRANSPARENT {
+		return append(msg, '\n')
+	}
+
+	return append([]byte(strconv.Itoa(len(msg))+" "), msg...)
+}
+
+func (d *Driver) write(msg []byte) error {
+	if d.conn == nil {
+		conn, err := d.dial()
+		if err != nil {
+			return fmt.Errorf("error connecting to %s %s: %w", d.Network, d.Address, err)
+		}
+
+		d.conn = conn
+	}
+
+	d.conn.SetWriteDeadline(time.Now().Add(d.Timeout))
+	if _, err := d.conn.Write(msg); err != nil {
+		d.conn.Close()
+		d.conn = nil
+		return fmt.Errorf("error writing to %s %s: %w", d.Network, d.Address, err)
+	}
+
+	return nil
+}
+
+func (d *Driver) dial() (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: d.Timeout}
+	if d.Network == "tls" {
+		return tls.DialWithDialer(dialer, "tcp", d.Address, d.TLSConfig)
+	}
+
+	return dialer.Dial(d.Network, d.Address)
+}
@@ -0,0 +1,252 @@
+package syslog
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/MustWin/cmeter/collector"
+	"github.com/MustWin/cmeter/containers"
+	"github.com/MustWin/cmeter/context"
+	"github.com/MustWin/cmeter/reporting"
+	"github.com/MustWin/cmeter/reporting/reportingtest"
+)
+
+func testEvent() *reporting.Event {
+	return &reporting.Event{
+		MeterID:   "meter",
+		Type:      reporting.EventSample,
+		Timestamp: 42,
+		Data: &collector.Sample{
+			Timestamp: 42,
+			Container: &containers.ContainerInfo{
+				Name:      "web",
+				ImageName: "nginx",
+				Labels:    map[string]string{"team name": `core "infra"]`, "notes": "a\nb"},
+			},
+			Usage: &containers.Usage{Cpu: &containers.CpuUsage{Total: 1000}},
+		},
+	}
+}
+
+func newTestDriver(t *testing.T, parameters map[string]interface{}) *Driver {
+	parameters["hostname"] = "host"
+	return reportingtest.NewDriver(t, &driverFactory{}, parameters).(*Driver)
+}
+
+func TestRFC5424(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer conn.Close()
+
+	d := newTestDriver(t, map[string]interface{}{
+		"network": "udp",
+		"address": conn.LocalAddr().String(),
+	})
+
+	defer d.Close()
+	if _, err := d.Report(context.Background(), testEvent()); err != nil {
+		t.Fatalf("error reporting: %v", err)
+	}
+
+	buf := make([]byte, 4096)
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// local0.info, with the label name and value made valid
+	msg := string(buf[:n])
+	expected := fmt.Sprintf(`<134>1 1970-01-01T00:00:42Z host cmeter %d usage_sample `+
+		`[event@32473 type="usage_sample" meter_id="meter" timestamp="42"]`+
+		`[container@32473 name="web" image="nginx" image_tag=""]`+
+		`[usage@32473 frame_ms="0" cpu_ns="1000"]`+
+		`[labels@32473 notes="a`+"\n"+`b" team_name="core \"infra\"\]"] {`, os.Getpid())
+
+	if !strings.HasPrefix(msg, expected) {
+		t.Fatalf("expected the message to start with:\n%s\ngot:\n%s", expected, msg)
+	}
+
+	blob, _ := json.Marshal(testEvent())
+	if !strings.HasSuffix(msg, "] "+string(blob)) {
+		t.Fatalf("expected the event JSON as the message, got %s", msg)
+	}
+}
+
+func TestStreamFraming(t *testing.T) {
+	for _, framing := range []string{FRAMING_OCTET_COUNTING, FRAMING_NON_TRANSPARENT} {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		d := newTestDriver(t, map[string]interface{}{
+			"network": "tcp",
+			"address": l.Addr().String(),
+			"framing": framing,
+		})
+
+		event := testEvent()
+		event.Data.(*collector.Sample).Container.Labels = nil
+		if _, err := d.ReportBatch(context.Background(), []*reporting.Event{event, event}); err != nil {
+			t.Fatalf("%s: error reporting: %v", framing, err)
+		}
+
+		d.Close()
+		conn, err := l.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		r := bufio.NewReader(conn)
+		for i := 0; i < 2; i++ {
+			var msg string
+			if framing == FRAMING_OCTET_COUNTING {
+				prefix, err := r.ReadString(' ')
+				if err != nil {
+					t.Fatalf("%s: error reading frame: %v", framing, err)
+				}
+
+				size, _ := strconv.Atoi(strings.TrimSpace(prefix))
+				frame := make([]byte, size)
+				if _, err := io.ReadFull(r, frame); err != nil {
+					t.Fatalf("%s: error reading frame: %v", framing, err)
+				}
+
+				msg = string(frame)
+			} else if msg, err = r.ReadString('\n'); err != nil {
+				t.Fatalf("%s: error reading frame: %v", framing, err)
+			}
+
+			if !strings.HasPrefix(msg, "<134>1 ") || !strings.HasSuffix(strings.TrimSuffix(msg, "\n"), "}") {
+				t.Fatalf("%s: expected message %d in its own frame, got %q", framing, i, msg)
+			}
+		}
+
+		conn.Close()
+		l.Close()
+	}
+}
+
+// journalFields parses a journald native protocol datagram.
+func journalFields(t *testing.T, datagram []byte) map[string]string {
+	fields := make(map[string]string)
+	for len(datagram) > 0 {
+		end := bytes.IndexByte(datagram, '\n')
+		if end < 0 {
+			t.Fatalf("unterminated field in %q", datagram)
+		}
+
+		line := string(datagram[:end])
+		datagram = datagram[end+1:]
+		if i := strings.IndexByte(line, '='); i >= 0 {
+			fields[line[:i]] = line[i+1:]
+			continue
+		}
+
+		size := int(binary.LittleEndian.Uint64(datagram))
+		fields[line] = string(datagram[8 : 8+size])
+		datagram = datagram[8+size+1:]
+	}
+
+	return fields
+}
+
+func TestJournald(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cmeter-syslog")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	socket := filepath.Join(dir, "journal.sock")
+	conn, err := net.ListenPacket("unixgram", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer conn.Close()
+
+	d := newTestDriver(t, map[string]interface{}{
+		"format":   FORMAT_JOURNALD,
+		"address":  socket,
+		"severity": "warning",
+	})
+
+	defer d.Close()
+	if _, err := d.Report(context.Background(), testEvent()); err != nil {
+		t.Fatalf("error reporting: %v", err)
+	}
+
+	buf := make([]byte, 8192)
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fields := journalFields(t, buf[:n])
+	expected := map[string]string{
+		"PRIORITY":                "4",
+		"SYSLOG_FACILITY":         "16",
+		"SYSLOG_IDENTIFIER":       "cmeter",
+		"CMETER_CONTAINER_NAME":   "web",
+		"CMETER_USAGE_CPU_NS":     "1000",
+		"CMETER_LABELS_TEAM_NAME": `core "infra"]`,
+		"CMETER_LABELS_NOTES":     "a\nb",
+		"CMETER_EVENT_TYPE":       reporting.EventSample,
+		"CMETER_EVENT_METER_ID":   "meter",
+		"CMETER_EVENT_TIMESTAMP":  "42",
+		"CMETER_CONTAINER_IMAGE":  "nginx",
+		"CMETER_USAGE_FRAME_MS":   "0",
+	}
+
+	for name, value := range expected {
+		if fields[name] != value {
+			t.Errorf("expected %s=%q, got %q", name, value, fields[name])
+		}
+	}
+
+	if !strings.HasPrefix(fields["MESSAGE"], "{") {
+		t.Fatalf("expected the event JSON as the message, got %q", fields["MESSAGE"])
+	}
+}
+
+func TestInvalidParameters(t *testing.T) {
+	cases := []struct {
+		parameters map[string]interface{}
+		err        error
+	}{
+		{map[string]interface{}{"format": "cef"}, ErrInvalidFormat},
+		{map[string]interface{}{"network": "sctp"}, ErrInvalidNetwork},
+		{map[string]interface{}{"format": FORMAT_JOURNALD, "network": "udp"}, ErrJournaldNetwork},
+		{map[string]interface{}{"framing": "lines"}, ErrInvalidFraming},
+		{map[string]interface{}{"facility": "local8"}, ErrInvalidFacility},
+		{map[string]interface{}{"severity": "8"}, ErrInvalidSeverity},
+	}
+
+	for _, c := range cases {
+		if _, err := (&driverFactory{}).Create(c.parameters); err != c.err {
+			t.Errorf("expected %v for %v, got %v", c.err, c.parameters, err)
+		}
+	}
+
+	// facilities and severities are names or codes
+	d := newTestDriver(t, map[string]interface{}{"facility": "AUTH", "severity": "3"})
+	if d.Facility != 4 || d.Severity != 3 {
+		t.Fatalf("expected facility 4 and severity 3, got %d and %d", d.Facility, d.Severity)
+	}
+}
@@ -0,0 +1,244 @@
+package syslog
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/MustWin/cmeter/collector"
+	"github.com/MustWin/cmeter/containers"
+	"github.com/MustWin/cmeter/reporting"
+)
+
+const (
+	FORMAT_RFC5424  = "rfc5424"
+	FORMAT_JOURNALD = "journald"
+
+	// the enterprise number reserved for documentation, RFC 5612
+	DEFAULT_ENTERPRISE_ID = 32473
+
+	nilValue = "-"
+)
+
+var (
+	invalidSDNameChars  = regexp.MustCompile(`[^!#-<>-\\^-~]`)
+	invalidJournalChars = regexp.MustCompile(`[^A-Z0-9_]`)
+	sdValueEscaper      = strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`)
+	invalidHeaderChars  = regexp.MustCompile(`[^!-~]`)
+)
+
+// section is a group of event fields, an SD element in RFC 5424 messages.
+type section struct {
+	id     string
+	params [][2]string
+}
+
+func (s *section) add(name string, value interface{}) {
+	s.params = append(s.params, [2]string{name, fmt.Sprint(value)})
+}
+
+func containerSection(info *containers.ContainerInfo) *section {
+	s := &section{id: "container"}
+	s.add("name", info.Name)
+	s.add("image", info.ImageName)
+	s.add("image_tag", info.ImageTag)
+	if info.Machine != nil {
+		s.add("machine_uuid", info.Machine.SystemUuid)
+	}
+
+	return s
+}
+
+func labelSection(labels map[string]string) *section {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+	s := &section{id: "labels"}
+	for _, k := range keys {
+		s.add(k, labels[k])
+	}
+
+	return s
+}
+
+// sections breaks the event down into the fields usage can be recovered
+// from, the full event is part of the message as well.
+func sections(e *reporting.Event) []*section {
+	event := &section{id: "event"}
+	event.add("type", e.Type)
+	event.add("meter_id", e.MeterID)
+	event.add("timestamp", e.Timestamp)
+	result := []*section{event}
+
+	switch data := e.Data.(type) {
+	case *collector.Sample:
+		if data.Container == nil || data.Usage == nil {
+			break
+		}
+
+		usage := &section{id: "usage"}
+		usage.add("frame_ms", int64(data.FrameSize/time.Millisecond))
+		if data.Usage.Cpu != nil {
+			usage.add("cpu_ns", data.Usage.Cpu.Total)
+		}
+
+		if data.Usage.Memory != nil {
+			usage.add("memory_bytes", data.Usage.Memory.Bytes)
+		}
+
+		if data.Usage.Network != nil {
+			usage.add("network_rx_bytes", data.Usage.Network.TotalRxBytes)
+			usage.add("network_tx_bytes", data.Usage.Network.TotalTxBytes)
+		}
+
+		if data.Usage.Disk != nil {
+			total := uint64(0)
+			for _, v := range data.Usage.Disk.PerDiskIo {
+				total += v
+			}
+
+			usage.add("disk_io_bytes", total)
+		}
+
+		result = append(result, containerSection(data.Container), usage, labelSection(data.Container.Labels))
+
+	case *containers.StateChange:
+		if data.Container == nil {
+			break
+		}
+
+		state := &section{id: "state"}
+		state.add("state", data.State)
+		if data.Source != nil {
+			state.add("source_event", data.Source.Type)
+		}
+
+		result = append(result, containerSection(data.Container), state, labelSection(data.Container.Labels))
+
+	case *collector.MachineSample:
+		if data.Machine == nil || data.Usage == nil {
+			break
+		}
+
+		machine := &section{id: "machine"}
+		machine.add("uuid", data.Machine.SystemUuid)
+		machine.add("name", data.Machine.Name)
+		machine.add("cores", data.Machine.Cores)
+		machine.add("memory_capacity_bytes", data.Machine.MemoryBytes)
+		if data.Usage.Cpu != nil {
+			machine.add("cpu_ns", data.Usage.Cpu.Total)
+		}
+
+		if data.Usage.Memory != nil {
+			machine.add("memory_bytes", data.Usage.Memory.Bytes)
+		}
+
+		result = append(result, machine)
+	}
+
+	return result
+}
+
+// header fields are limited to printable ASCII without spaces.
+func headerField(value string, max int) string {
+	value = invalidHeaderChars.ReplaceAllString(value, "_")
+	if value == "" {
+		return nilValue
+	}
+
+	if len(value) > max {
+		value = value[:max]
+	}
+
+	return value
+}
+
+// sdName restricts a name to the characters RFC 5424 allows for SD-IDs and
+// PARAM-NAMEs: printable ASCII except `=`, ` `, `]` and `"`.
+func sdName(name string) string {
+	name = invalidSDNameChars.ReplaceAllString(name, "_")
+	if len(name) > 32 {
+		name = name[:32]
+	}
+
+	return name
+}
+
+// formatRFC5424 formats the event as `<PRI>1 TIMESTAMP HOSTNAME APP-NAME
+// PROCID MSGID [SD-ELEMENT]... MSG` with the event JSON as MSG.
+func (d *Driver) formatRFC5424(e *reporting.Event, blob []byte) []byte {
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "<%d>1 %s %s %s %d %s ",
+		d.Facility*8+d.Severity,
+		time.Unix(e.Timestamp, 0).UTC().Format(time.RFC3339),
+		headerField(d.Hostname, 255),
+		headerField(d.AppName, 48),
+		d.pid,
+		headerField(e.Type, 32))
+
+	suffix := "@" + strconv.Itoa(d.EnterpriseID)
+	for _, s := range sections(e) {
+		if len(s.params) == 0 {
+			continue
+		}
+
+		buf.WriteString("[" + sdName(s.id+suffix))
+		for _, p := range s.params {
+			buf.WriteString(" " + sdName(p[0]) + `="` + sdValueEscaper.Replace(p[1]) + `"`)
+		}
+
+		buf.WriteString("]")
+	}
+
+	buf.WriteString(" ")
+	buf.Write(blob)
+	return buf.Bytes()
+}
+
+func journalName(name string) string {
+	name = invalidJournalChars.ReplaceAllString(strings.ToUpper(name), "_")
+	if len(name) > 64 {
+		name = name[:64]
+	}
+
+	return name
+}
+
+// formatJournald formats the event in the journald native protocol, fields
+// are named `CMETER_<SECTION>_<NAME>` and MESSAGE holds the event JSON.
+func (d *Driver) formatJournald(e *reporting.Event, blob []byte) []byte {
+	buf := &bytes.Buffer{}
+	writeJournalField(buf, "MESSAGE", string(blob))
+	writeJournalField(buf, "PRIORITY", strconv.Itoa(d.Severity))
+	writeJournalField(buf, "SYSLOG_FACILITY", strconv.Itoa(d.Facility))
+	writeJournalField(buf, "SYSLOG_IDENTIFIER", d.AppName)
+	for _, s := range sections(e) {
+		for _, p := range s.params {
+			writeJournalField(buf, journalName("CMETER_"+s.id+"_"+p[0]), p[1])
+		}
+	}
+
+	return buf.Bytes()
+}
+
+func writeJournalField(buf *bytes.Buffer, name string, value string) {
+	if !strings.ContainsRune(value, '\n') {
+		buf.WriteString(name + "=" + value + "\n")
+		return
+	}
+
+	// values with newlines are length prefixed
+	var size [8]byte
+	binary.LittleEndian.PutUint64(size[:], uint64(len(value)))
+	buf.WriteString(name + "\n")
+	buf.Write(size[:])
+	buf.WriteString(value + "\n")
+}
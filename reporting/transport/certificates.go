@@ -0,0 +1,162 @@
+package transport
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/fsnotify/fsnotify"
+)
+
+const reloadDelay = 500 * time.Millisecond
+
+var errNoPeerCertificates = errors.New("server presented no certificates")
+
+// certStore holds the current client certificate and CA pool loaded from
+// their files.
+type certStore struct {
+	caFile   string
+	certFile string
+	keyFile  string
+
+	mutex sync.RWMutex
+	cert  *tls.Certificate
+	roots *x509.CertPool
+
+	watcher *fsnotify.Watcher
+}
+
+func (s *certStore) load() error {
+	var cert *tls.Certificate
+	if s.certFile != "" {
+		c, err := tls.LoadX509KeyPair(s.certFile, s.keyFile)
+		if err != nil {
+			return fmt.Errorf("error loading client certificate: %v", err)
+		}
+
+		cert = &c
+	}
+
+	var roots *x509.CertPool
+	if s.caFile != "" {
+		pem, err := ioutil.ReadFile(s.caFile)
+		if err != nil {
+			return fmt.Errorf("error reading ca_file: %v", err)
+		}
+
+		roots = x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates found in ca_file %q", s.caFile)
+		}
+	}
+
+	s.mutex.Lock()
+	s.cert = cert
+	s.roots = roots
+	s.mutex.Unlock()
+	return nil
+}
+
+// watch reloads the files when anything in their directories changes, which
+// also covers files replaced by renames or symlink swaps. Failed reloads
+// keep the previous certificates.
+func (s *certStore) watch() error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+
+	dirs := make(map[string]bool)
+	for _, f := range []string{s.caFile, s.certFile, s.keyFile} {
+		if f != "" {
+			dirs[filepath.Dir(f)] = true
+		}
+	}
+
+	for dir := range dirs {
+		if err := watcher.Add(dir); err != nil {
+			watcher.Close()
+			return err
+		}
+	}
+
+	s.watcher = watcher
+	go func() {
+		// a certificate and its key are usually replaced one after the
+		// other, so reloads wait for the changes to settle
+		reload := time.NewTimer(reloadDelay)
+		reload.Stop()
+		for {
+			select {
+			case _, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+
+				reload.Reset(reloadDelay)
+
+			case <-reload.C:
+				if err := s.load(); err != nil {
+					log.Warnf("keeping the previous certificates, reload failed: %v", err)
+				} else {
+					log.Debugf("reloaded certificates")
+				}
+
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+
+				log.Warnf("certificate watcher error: %v", err)
+			}
+		}
+	}()
+
+	return nil
+}
+
+// Close stops watching the files.
+func (s *certStore) Close() error {
+	if s.watcher == nil {
+		return nil
+	}
+
+	return s.watcher.Close()
+}
+
+func (s *certStore) clientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.cert, nil
+}
+
+// verifyConnection verifies the server's certificate chain and name against
+// the current CA pool.
+func (s *certStore) verifyConnection(cs tls.ConnectionState) error {
+	if len(cs.PeerCertificates) == 0 {
+		return errNoPeerCertificates
+	}
+
+	s.mutex.RLock()
+	roots := s.roots
+	s.mutex.RUnlock()
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range cs.PeerCertificates[1:] {
+		intermediates.AddCert(cert)
+	}
+
+	_, err := cs.PeerCertificates[0].Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		DNSName:       cs.ServerName,
+	})
+
+	return err
+}
@@ -0,0 +1,277 @@
+package transport
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/MustWin/cmeter/configuration"
+)
+
+const (
+	OAUTH2_AUTH_HEADER = "header"
+	OAUTH2_AUTH_PARAMS = "params"
+
+	DEFAULT_OAUTH2_REFRESH_BEFORE = time.Minute
+)
+
+var (
+	ErrMissingTokenURL    = errors.New("oauth2 requires a `token_url`")
+	ErrMissingClientID    = errors.New("oauth2 requires a `client_id` or `client_id_file`")
+	ErrMissingSecretFile  = errors.New("oauth2 requires a `client_secret_file`")
+	ErrInvalidOAuth2Style = errors.New("invalid oauth2 auth_style, must be `header` or `params`")
+)
+
+// tokenSource fetches access tokens with the OAuth2 client credentials grant
+// (RFC 6749 section 4.4) and caches them until shortly before they expire.
+// Credential files are read for every token request, so rotated secrets
+// are picked up.
+type tokenSource struct {
+	TokenURL      string
+	ClientID      string
+	ClientIDFile  string
+	SecretFile    string
+	Scopes        []string
+	AuthStyle     string
+	RefreshBefore time.Duration
+	Client        *http.Client
+
+	mutex     sync.Mutex
+	token     string
+	refreshAt time.Time
+}
+
+func newTokenSource(parameters configuration.Parameters, client *http.Client) (*tokenSource, error) {
+	s := &tokenSource{
+		TokenURL:     parameters.String("token_url", ""),
+		ClientID:     parameters.String("client_id", ""),
+		ClientIDFile: parameters.String("client_id_file", ""),
+		SecretFile:   parameters.String("client_secret_file", ""),
+		AuthStyle:    strings.ToLower(parameters.String("auth_style", OAUTH2_AUTH_HEADER)),
+		Client:       client,
+	}
+
+	if s.TokenURL == "" {
+		return nil, ErrMissingTokenURL
+	}
+
+	if _, err := url.Parse(s.TokenURL); err != nil {
+		return nil, fmt.Errorf("invalid oauth2 token_url: %v", err)
+	}
+
+	if s.ClientID == "" && s.ClientIDFile == "" {
+		return nil, ErrMissingClientID
+	}
+
+	if s.SecretFile == "" {
+		return nil, ErrMissingSecretFile
+	}
+
+	if s.AuthStyle != OAUTH2_AUTH_HEADER && s.AuthStyle != OAUTH2_AUTH_PARAMS {
+		return nil, ErrInvalidOAuth2Style
+	}
+
+	var err error
+	if s.Scopes, err = parameters.StringList("scopes"); err != nil {
+		return nil, err
+	}
+
+	if s.RefreshBefore, err = parameters.Duration("refresh_before", DEFAULT_OAUTH2_REFRESH_BEFORE); err != nil {
+		return nil, err
+	}
+
+	// fail early on unreadable credentials
+	if _, _, err := s.credentials(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func readCredential(path string) (string, error) {
+	blob, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("error reading oauth2 credentials: %v", err)
+	}
+
+	value := strings.TrimSpace(string(blob))
+	if value == "" {
+		return "", fmt.Errorf("empty oauth2 credentials in %q", path)
+	}
+
+	return value, nil
+}
+
+func (s *tokenSource) credentials() (string, string, error) {
+	clientID := s.ClientID
+	if s.ClientIDFile != "" {
+		var err error
+		if clientID, err = readCredential(s.ClientIDFile); err != nil {
+			return "", "", err
+		}
+	}
+
+	secret, err := readCredential(s.SecretFile)
+	return clientID, secret, err
+}
+
+// Token returns the cached token or fetches a new one when there is none or
+// it expires within RefreshBefore, at most half of its lifetime.
+func (s *tokenSource) Token() (string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.token != "" && (s.refreshAt.IsZero() || time.Now().Before(s.refreshAt)) {
+		return s.token, nil
+	}
+
+	token, expiresIn, err := s.fetch()
+	if err != nil {
+		return "", err
+	}
+
+	s.token = token
+	s.refreshAt = time.Time{}
+	if expiresIn > 0 {
+		margin := s.RefreshBefore
+		if margin > expiresIn/2 {
+			margin = expiresIn / 2
+		}
+
+		s.refreshAt = time.Now().Add(expiresIn - margin)
+	}
+
+	return token, nil
+}
+
+// invalidate drops the token if it's still the cached one, so the next call
+// to Token fetches a new one.
+func (s *tokenSource) invalidate(token string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.token == token {
+		s.token = ""
+	}
+}
+
+func (s *tokenSource) fetch() (string, time.Duration, error) {
+	clientID, secret, err := s.credentials()
+	if err != nil {
+		return "", 0, err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "client_credentials")
+	if len(s.Scopes) > 0 {
+		form.Set("scope", strings.Join(s.Scopes, " "))
+	}
+
+	if s.AuthStyle == OAUTH2_AUTH_PARAMS {
+		form.Set("client_id", clientID)
+		form.Set("client_secret", secret)
+	}
+
+	r, err := http.NewRequest(http.MethodPost, s.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", 0, fmt.Errorf("error creating token request: %v", err)
+	}
+
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.Header.Set("Accept", "application/json")
+	if s.AuthStyle == OAUTH2_AUTH_HEADER {
+		r.SetBasicAuth(url.QueryEscape(clientID), url.QueryEscape(secret))
+	}
+
+	resp, err := s.Client.Do(r)
+	if err != nil {
+		return "", 0, fmt.Errorf("error requesting token: %w", err)
+	}
+
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return "", 0, fmt.Errorf("error reading token response: %w", err)
+	}
+
+	if resp.StatusCode > 299 || resp.StatusCode < 200 {
+		return "", 0, fmt.Errorf("token request failed: %s: %s", resp.Status, bytes.TrimSpace(body))
+	}
+
+	var token struct {
+		AccessToken string `json:"access_token"`
+		TokenType   string `json:"token_type"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+
+	if err := json.Unmarshal(body, &token); err != nil {
+		return "", 0, fmt.Errorf("error decoding token response: %v", err)
+	}
+
+	if token.AccessToken == "" {
+		return "", 0, errors.New("token response without an access_token")
+	}
+
+	if token.TokenType != "" && !strings.EqualFold(token.TokenType, "bearer") {
+		return "", 0, fmt.Errorf("unsupported token type %q", token.TokenType)
+	}
+
+	return token.AccessToken, time.Duration(token.ExpiresIn) * time.Second, nil
+}
+
+// bearerTransport authorizes requests with the source's tokens. A 401
+// response invalidates the token and the request is retried once with a
+// new one.
+type bearerTransport struct {
+	source *tokenSource
+	base   http.RoundTripper
+}
+
+func (t *bearerTransport) authorized(r *http.Request, token string) *http.Request {
+	r = r.Clone(r.Context())
+	r.Header.Set("Authorization", "Bearer "+token)
+	return r
+}
+
+func (t *bearerTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	token, err := t.source.Token()
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := t.base.RoundTrip(t.authorized(r, token))
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+
+	t.source.invalidate(token)
+
+	// the body was consumed, the request can only be repeated if it can
+	// be recreated
+	if r.Body != nil && r.GetBody == nil {
+		return resp, nil
+	}
+
+	if token, err = t.source.Token(); err != nil {
+		return resp, nil
+	}
+
+	retry := t.authorized(r, token)
+	if r.GetBody != nil {
+		if retry.Body, err = r.GetBody(); err != nil {
+			return resp, nil
+		}
+	}
+
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	return t.base.RoundTrip(retry)
+}
@@ -0,0 +1,226 @@
+package transport
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/MustWin/cmeter/configuration"
+)
+
+// tokenServer issues numbered tokens to the client `agent` with the secret
+// `secret`, and accepts events authorized with the latest one.
+type tokenServer struct {
+	*httptest.Server
+	expiresIn int
+
+	mutex  sync.Mutex
+	issued int
+	forms  []string
+	bodies []string
+}
+
+func newTokenServer(expiresIn int) *tokenServer {
+	s := &tokenServer{expiresIn: expiresIn}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/token", s.token)
+	mux.HandleFunc("/events", s.events)
+	s.Server = httptest.NewServer(mux)
+	return s
+}
+
+func (s *tokenServer) token(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	id, secret, ok := r.BasicAuth()
+	if !ok {
+		id, secret = r.PostForm.Get("client_id"), r.PostForm.Get("client_secret")
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.forms = append(s.forms, r.PostForm.Encode())
+	if id != "agent" || secret != "secret" || r.PostForm.Get("grant_type") != "client_credentials" {
+		http.Error(w, `{"error":"invalid_client"}`, http.StatusUnauthorized)
+		return
+	}
+
+	s.issued++
+	fmt.Fprintf(w, `{"access_token":"token-%d","token_type":"Bearer","expires_in":%d}`, s.issued, s.expiresIn)
+}
+
+func (s *tokenServer) events(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if r.Header.Get("Authorization") != fmt.Sprintf("Bearer token-%d", s.issued) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	s.bodies = append(s.bodies, string(body))
+}
+
+// revoke makes the server expect a new token.
+func (s *tokenServer) revoke() {
+	s.mutex.Lock()
+	s.issued++
+	s.mutex.Unlock()
+}
+
+func (s *tokenServer) tokens() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return len(s.forms)
+}
+
+func oauth2Client(t *testing.T, dir string, oauth2 map[string]interface{}) *http.Client {
+	secretFile := filepath.Join(dir, "secret")
+	if err := ioutil.WriteFile(secretFile, []byte("secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	oauth2["client_secret_file"] = secretFile
+	client, _, err := NewClient(configuration.Parameters{"oauth2": oauth2})
+	if err != nil {
+		t.Fatalf("error creating client: %v", err)
+	}
+
+	return client
+}
+
+func post(t *testing.T, client *http.Client, url string, body string) int {
+	resp, err := client.Post(url, "text/plain", strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("error posting: %v", err)
+	}
+
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestClientCredentials(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	for _, style := range []string{OAUTH2_AUTH_HEADER, OAUTH2_AUTH_PARAMS} {
+		server := newTokenServer(3600)
+		client := oauth2Client(t, dir, map[string]interface{}{
+			"token_url":  server.URL + "/token",
+			"client_id":  "agent",
+			"scopes":     []interface{}{"metering.write", "metering.read"},
+			"auth_style": style,
+		})
+
+		for i := 0; i < 3; i++ {
+			if status := post(t, client, server.URL+"/events", "event"); status != http.StatusOK {
+				t.Fatalf("%s: expected the request to be authorized, got %d", style, status)
+			}
+		}
+
+		if server.tokens() != 1 {
+			t.Fatalf("%s: expected the token to be cached, got %d token requests", style, server.tokens())
+		}
+
+		if !strings.Contains(server.forms[0], "scope=metering.write+metering.read") {
+			t.Fatalf("%s: expected the scopes to be requested, got %s", style, server.forms[0])
+		}
+
+		server.Close()
+	}
+}
+
+func TestRefreshBeforeExpiry(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	server := newTokenServer(60)
+	defer server.Close()
+
+	// with a minute left, tokens are refreshed after at most half of it
+	client := oauth2Client(t, dir, map[string]interface{}{
+		"token_url":      server.URL + "/token",
+		"client_id":      "agent",
+		"refresh_before": "59s",
+	})
+
+	source := client.Transport.(*bearerTransport).source
+	token, err := source.Token()
+	if err != nil || token != "token-1" {
+		t.Fatalf("expected the first token, got %q and %v", token, err)
+	}
+
+	// as if the refresh time passed
+	source.refreshAt = source.refreshAt.Add(-31 * time.Second)
+	if token, err := source.Token(); err != nil || token != "token-2" {
+		t.Fatalf("expected a new token before the old one expires, got %q and %v", token, err)
+	}
+}
+
+func TestRetryOnUnauthorized(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	server := newTokenServer(3600)
+	defer server.Close()
+
+	client := oauth2Client(t, dir, map[string]interface{}{
+		"token_url": server.URL + "/token",
+		"client_id": "agent",
+	})
+
+	if status := post(t, client, server.URL+"/events", "first"); status != http.StatusOK {
+		t.Fatalf("expected the request to be authorized, got %d", status)
+	}
+
+	// the cached token is rejected, the request is repeated with a new one
+	server.revoke()
+	if status := post(t, client, server.URL+"/events", "second"); status != http.StatusOK {
+		t.Fatalf("expected the request to be retried with a new token, got %d", status)
+	}
+
+	if server.tokens() != 2 || len(server.bodies) != 2 || server.bodies[1] != "second" {
+		t.Fatalf("expected the body to be sent again after 2 token requests, got %d and %v", server.tokens(), server.bodies)
+	}
+}
+
+func TestInvalidOAuth2(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	secretFile := filepath.Join(dir, "secret")
+	if err := ioutil.WriteFile(secretFile, []byte("secret"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		oauth2 map[string]interface{}
+		err    error
+	}{
+		{map[string]interface{}{"client_id": "agent", "client_secret_file": secretFile}, ErrMissingTokenURL},
+		{map[string]interface{}{"token_url": "http://auth", "client_secret_file": secretFile}, ErrMissingClientID},
+		{map[string]interface{}{"token_url": "http://auth", "client_id": "agent"}, ErrMissingSecretFile},
+		{map[string]interface{}{"token_url": "http://auth", "client_id": "agent", "client_secret_file": secretFile, "auth_style": "cookie"}, ErrInvalidOAuth2Style},
+	}
+
+	for _, c := range cases {
+		if _, _, err := NewClient(configuration.Parameters{"oauth2": c.oauth2}); err != c.err {
+			t.Errorf("expected %v for %v, got %v", c.err, c.oauth2, err)
+		}
+	}
+
+	// unreadable credentials fail early
+	oauth2 := map[string]interface{}{"token_url": "http://auth", "client_id": "agent", "client_secret_file": filepath.Join(dir, "missing")}
+	if _, _, err := NewClient(configuration.Parameters{"oauth2": oauth2}); err == nil {
+		t.Fatal("expected a missing secret file to be rejected")
+	}
+}
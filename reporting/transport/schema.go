@@ -0,0 +1,36 @@
+package transport
+
+import "github.com/MustWin/cmeter/configuration"
+
+// TLSParameters are the parameters read by TLSConfig.
+var TLSParameters = []configuration.Parameter{
+	{Name: "ca_file", Type: configuration.TypeString, Description: "CA certificates verifying the server, instead of the system's"},
+	{Name: "cert_file", Type: configuration.TypeString, Description: "client certificate"},
+	{Name: "key_file", Type: configuration.TypeString, Description: "client certificate key"},
+	{Name: "server_name", Type: configuration.TypeString, Description: "server name verified against the server certificate"},
+	{Name: "min_tls_version", Type: configuration.TypeString, Values: []string{"1.0", "1.1", "1.2", "1.3"}, Description: "minimum TLS version"},
+	{Name: "insecure_skip_verify", Type: configuration.TypeBool, Default: "false", Description: "don't verify the server certificate"},
+	{Name: "reload_certificates", Type: configuration.TypeBool, Default: "true", Description: "reload the certificate files when they change"},
+}
+
+// OAuth2Parameters are the parameters of the `oauth2` section.
+var OAuth2Parameters = []configuration.Parameter{
+	{Name: "token_url", Type: configuration.TypeString, Required: true, Description: "token endpoint"},
+	{Name: "client_id", Type: configuration.TypeString, Description: "client id, or `client_id_file`"},
+	{Name: "client_id_file", Type: configuration.TypeString, Description: "file with the client id"},
+	{Name: "client_secret_file", Type: configuration.TypeString, Required: true, Description: "file with the client secret"},
+	{Name: "scopes", Type: configuration.TypeStringList, Description: "requested scopes"},
+	{Name: "auth_style", Type: configuration.TypeString, Default: OAUTH2_AUTH_HEADER, Values: []string{OAUTH2_AUTH_HEADER, OAUTH2_AUTH_PARAMS}, Description: "send the credentials as basic auth `header` or as form `params`"},
+	{Name: "refresh_before", Type: configuration.TypeDuration, Default: "1m", Description: "refresh tokens this long before they expire"},
+}
+
+// ClientParameters are the parameters read by NewClient.
+var ClientParameters = append(append([]configuration.Parameter{}, TLSParameters...),
+	configuration.Parameter{Name: "connect_timeout", Type: configuration.TypeDuration, Default: "30s", Description: "connection timeout"},
+	configuration.Parameter{Name: "request_timeout", Type: configuration.TypeDuration, Default: "1m", Description: "request timeout, including reading the response"},
+	configuration.Parameter{Name: "idle_conn_timeout", Type: configuration.TypeDuration, Default: "90s", Description: "time idle connections are kept open"},
+	configuration.Parameter{Name: "max_idle_conns", Type: configuration.TypeInt, Default: "100", Description: "maximum number of idle connections"},
+	configuration.Parameter{Name: "max_idle_conns_per_host", Type: configuration.TypeInt, Default: "2", Description: "maximum number of idle connections per host"},
+	configuration.Parameter{Name: "proxy", Type: configuration.TypeString, Description: "proxy url, defaults to the `HTTP_PROXY`, `HTTPS_PROXY` and `NO_PROXY` environment variables, `none` disables proxies"},
+	configuration.Parameter{Name: "oauth2", Type: configuration.TypeSection, Parameters: OAuth2Parameters, Description: "authorize requests with bearer tokens from the OAuth2 client credentials grant"},
+)
@@ -0,0 +1,223 @@
+package transport
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/MustWin/cmeter/configuration"
+)
+
+const (
+	DEFAULT_CONNECT_TIMEOUT         = 30 * time.Second
+	DEFAULT_REQUEST_TIMEOUT         = 60 * time.Second
+	DEFAULT_TLS_HANDSHAKE_TIMEOUT   = 10 * time.Second
+	DEFAULT_IDLE_CONN_TIMEOUT       = 90 * time.Second
+	DEFAULT_MAX_IDLE_CONNS          = 100
+	DEFAULT_MAX_IDLE_CONNS_PER_HOST = 2
+
+	// disables proxies, including the ones from the environment
+	PROXY_NONE = "none"
+)
+
+var ErrInvalidTLSVersion = errors.New("invalid min_tls_version, must be `1.0`, `1.1`, `1.2` or `1.3`")
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// TLSConfig creates the TLS configuration of a reporting driver from its
+// `ca_file`, `cert_file`, `key_file`, `server_name`, `min_tls_version`,
+// `insecure_skip_verify` and `reload_certificates` parameters. Certificate
+// files are reloaded when they change unless `reload_certificates` is false,
+// until the returned closer is closed.
+func TLSConfig(parameters configuration.Parameters) (*tls.Config, io.Closer, error) {
+	insecure, err := parameters.Bool("insecure_skip_verify", false)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	config := &tls.Config{
+		ServerName:         parameters.String("server_name", ""),
+		InsecureSkipVerify: insecure,
+	}
+
+	if version := parameters.String("min_tls_version", ""); version != "" {
+		v, ok := tlsVersions[version]
+		if !ok {
+			return nil, nil, ErrInvalidTLSVersion
+		}
+
+		config.MinVersion = v
+	}
+
+	store := &certStore{
+		caFile:   parameters.String("ca_file", ""),
+		certFile: parameters.String("cert_file", ""),
+		keyFile:  parameters.String("key_file", ""),
+	}
+
+	if store.caFile == "" && store.certFile == "" && store.keyFile == "" {
+		return config, store, nil
+	}
+
+	if (store.certFile == "") != (store.keyFile == "") {
+		return nil, nil, fmt.Errorf("cert_file and key_file must be set together")
+	}
+
+	if err := store.load(); err != nil {
+		return nil, nil, err
+	}
+
+	reload, err := parameters.Bool("reload_certificates", true)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if reload {
+		if err := store.watch(); err != nil {
+			return nil, nil, fmt.Errorf("error watching certificate files: %v", err)
+		}
+	}
+
+	if store.certFile != "" {
+		config.GetClientCertificate = store.clientCertificate
+	}
+
+	if store.caFile != "" && !insecure {
+		// the roots may change, so the server certificate is verified
+		// against the current ones instead of a fixed RootCAs pool
+		config.InsecureSkipVerify = true
+		config.VerifyConnection = store.verifyConnection
+	}
+
+	return config, store, nil
+}
+
+// NewClient creates the http client of a reporting driver from its
+// parameters: the TLSConfig parameters plus `connect_timeout`,
+// `request_timeout`, `max_idle_conns`, `max_idle_conns_per_host`,
+// `idle_conn_timeout` and `proxy`. Without a `proxy` the environment's
+// proxy settings apply, `none` disables them. With an `oauth2` section
+// requests carry bearer tokens from the client credentials grant. The
+// returned closer releases the client's connections and certificate watcher.
+func NewClient(parameters configuration.Parameters) (*http.Client, io.Closer, error) {
+	tlsConfig, certs, err := TLSConfig(parameters)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	client, transport, err := newClient(parameters, tlsConfig)
+	if err != nil {
+		certs.Close()
+		return nil, nil, err
+	}
+
+	return client, &clientCloser{certs: certs, transport: transport}, nil
+}
+
+// clientCloser closes the idle connections of a client and its certificate
+// watcher.
+type clientCloser struct {
+	certs     io.Closer
+	transport *http.Transport
+}
+
+func (c *clientCloser) Close() error {
+	c.transport.CloseIdleConnections()
+	return c.certs.Close()
+}
+
+func newClient(parameters configuration.Parameters, tlsConfig *tls.Config) (*http.Client, *http.Transport, error) {
+	connectTimeout, err := parameters.Duration("connect_timeout", DEFAULT_CONNECT_TIMEOUT)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	requestTimeout, err := parameters.Duration("request_timeout", DEFAULT_REQUEST_TIMEOUT)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	idleConnTimeout, err := parameters.Duration("idle_conn_timeout", DEFAULT_IDLE_CONN_TIMEOUT)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	maxIdleConns, err := parameters.Int("max_idle_conns", DEFAULT_MAX_IDLE_CONNS)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	maxIdleConnsPerHost, err := parameters.Int("max_idle_conns_per_host", DEFAULT_MAX_IDLE_CONNS_PER_HOST)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	proxy := http.ProxyFromEnvironment
+	switch proxyURL := parameters.String("proxy", ""); proxyURL {
+	case "":
+	case PROXY_NONE:
+		proxy = nil
+	default:
+		u, err := url.Parse(proxyURL)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid proxy url: %v", err)
+		}
+
+		proxy = http.ProxyURL(u)
+	}
+
+	dialer := &net.Dialer{
+		Timeout:   connectTimeout,
+		KeepAlive: 30 * time.Second,
+	}
+
+	transport := &http.Transport{
+		Proxy:                 proxy,
+		DialContext:           dialer.DialContext,
+		TLSClientConfig:       tlsConfig,
+		TLSHandshakeTimeout:   DEFAULT_TLS_HANDSHAKE_TIMEOUT,
+		MaxIdleConns:          int(maxIdleConns),
+		MaxIdleConnsPerHost:   int(maxIdleConnsPerHost),
+		IdleConnTimeout:       idleConnTimeout,
+		ExpectContinueTimeout: time.Second,
+	}
+
+	client := &http.Client{
+		Timeout:   requestTimeout,
+		Transport: transport,
+	}
+
+	oauth2, err := parameters.Sub("oauth2")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if oauth2 != nil {
+		// tokens are requested with the same connection settings
+		source, err := newTokenSource(oauth2, &http.Client{
+			Timeout:   requestTimeout,
+			Transport: transport,
+		})
+
+		if err != nil {
+			return nil, nil, err
+		}
+
+		client.Transport = &bearerTransport{
+			source: source,
+			base:   transport,
+		}
+	}
+
+	return client, transport, nil
+}
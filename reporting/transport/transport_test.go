@@ -0,0 +1,247 @@
+package transport
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/MustWin/cmeter/configuration"
+)
+
+const serverName = "ingest.cmeter.test"
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	der  []byte
+}
+
+// newCert creates a certificate signed by the parent, or a self-signed CA
+// without one.
+func newCert(t *testing.T, name string, parent *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		DNSNames:     []string{name},
+	}
+
+	signer := &testCert{cert: template, key: key}
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage = x509.KeyUsageCertSign
+	} else {
+		signer = parent
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, signer.cert, &key.PublicKey, signer.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &testCert{cert: cert, key: key, der: der}
+}
+
+func (c *testCert) tlsCertificate() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.der}, PrivateKey: c.key}
+}
+
+// write writes the certificate, and its key when keyPath is set, as PEM.
+func (c *testCert) write(t *testing.T, certPath string, keyPath string) {
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.der})
+	if err := ioutil.WriteFile(certPath, certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if keyPath == "" {
+		return
+	}
+
+	der, err := x509.MarshalECPrivateKey(c.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+	if err := ioutil.WriteFile(keyPath, keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// newTLSServer serves with the certificate, requiring client certificates
+// signed by clientCA.
+func newTLSServer(cert *testCert, clientCA *testCert) *httptest.Server {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.TLS.PeerCertificates[0].Subject.CommonName))
+	}))
+
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(clientCA.cert)
+	server.TLS = &tls.Config{
+		Certificates: []tls.Certificate{cert.tlsCertificate()},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientCAs,
+	}
+
+	// rejected handshakes are expected
+	server.Config.ErrorLog = log.New(ioutil.Discard, "", 0)
+	server.StartTLS()
+	return server
+}
+
+func get(client *http.Client, url string) (string, error) {
+	resp, err := client.Get(url)
+	if err != nil {
+		return "", err
+	}
+
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	return string(body), err
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "cmeter-transport")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return dir
+}
+
+func TestTLSConfigValidation(t *testing.T) {
+	if _, _, err := TLSConfig(configuration.Parameters{"min_tls_version": "1.4"}); err != ErrInvalidTLSVersion {
+		t.Fatalf("expected %v, got %v", ErrInvalidTLSVersion, err)
+	}
+
+	if _, _, err := TLSConfig(configuration.Parameters{"cert_file": "client.pem"}); err == nil {
+		t.Fatal("expected a certificate without a key to be rejected")
+	}
+
+	config, certs, err := TLSConfig(configuration.Parameters{"min_tls_version": "1.2", "server_name": serverName})
+	if err != nil {
+		t.Fatalf("error creating tls config: %v", err)
+	}
+
+	defer certs.Close()
+	if config.MinVersion != tls.VersionTLS12 || config.ServerName != serverName {
+		t.Fatalf("expected tls 1.2 with server name %s, got %x and %q", serverName, config.MinVersion, config.ServerName)
+	}
+}
+
+func TestMutualTLS(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	ca := newCert(t, "cmeter test ca", nil)
+	server := newTLSServer(newCert(t, serverName, ca), ca)
+	defer server.Close()
+
+	params := configuration.Parameters{
+		"ca_file":             filepath.Join(dir, "ca.pem"),
+		"cert_file":           filepath.Join(dir, "client.pem"),
+		"key_file":            filepath.Join(dir, "client-key.pem"),
+		"server_name":         serverName,
+		"reload_certificates": false,
+	}
+
+	ca.write(t, params.String("ca_file", ""), "")
+	newCert(t, "agent", ca).write(t, params.String("cert_file", ""), params.String("key_file", ""))
+
+	client, closer, err := NewClient(params)
+	if err != nil {
+		t.Fatalf("error creating client: %v", err)
+	}
+
+	defer closer.Close()
+	if name, err := get(client, server.URL); err != nil || name != "agent" {
+		t.Fatalf("expected the server to see the agent's certificate, got %q and %v", name, err)
+	}
+
+	// the server's name must match server_name
+	params["server_name"] = "other.cmeter.test"
+	client, closer, err = NewClient(params)
+	if err != nil {
+		t.Fatalf("error creating client: %v", err)
+	}
+
+	defer closer.Close()
+	if _, err := get(client, server.URL); err == nil {
+		t.Fatal("expected a server certificate for another name to be rejected")
+	}
+}
+
+func TestCertificateReload(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	oldCA := newCert(t, "old ca", nil)
+	newCA := newCert(t, "new ca", nil)
+
+	// the server moved to the new CA, the client still trusts the old one
+	server := newTLSServer(newCert(t, serverName, newCA), newCA)
+	defer server.Close()
+
+	params := configuration.Parameters{
+		"ca_file":     filepath.Join(dir, "ca.pem"),
+		"cert_file":   filepath.Join(dir, "client.pem"),
+		"key_file":    filepath.Join(dir, "client-key.pem"),
+		"server_name": serverName,
+	}
+
+	oldCA.write(t, params.String("ca_file", ""), "")
+	newCert(t, "old agent", oldCA).write(t, params.String("cert_file", ""), params.String("key_file", ""))
+
+	client, closer, err := NewClient(params)
+	if err != nil {
+		t.Fatalf("error creating client: %v", err)
+	}
+
+	defer closer.Close()
+	if _, err := get(client, server.URL); err == nil {
+		t.Fatal("expected the server's certificate to be rejected before the reload")
+	}
+
+	newCA.write(t, params.String("ca_file", ""), "")
+	newCert(t, "new agent", newCA).write(t, params.String("cert_file", ""), params.String("key_file", ""))
+
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		name, err := get(client, server.URL)
+		if err == nil && name == "new agent" {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the new certificates to be used after the reload, got %q and %v", name, err)
+		}
+
+		time.Sleep(100 * time.Millisecond)
+	}
+}
@@ -0,0 +1,169 @@
+package msgpack
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+)
+
+// Marshal encodes v as MessagePack. Values are encoded from their JSON form,
+// so the result has the same structure and keys as json.Marshal would
+// produce; integers stay integers, map keys are sorted.
+func Marshal(v interface{}) ([]byte, error) {
+	blob, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(blob))
+	dec.UseNumber()
+	var value interface{}
+	if err := dec.Decode(&value); err != nil {
+		return nil, err
+	}
+
+	buf := &bytes.Buffer{}
+	if err := encode(buf, value); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func encode(buf *bytes.Buffer, v interface{}) error {
+	switch v := v.(type) {
+	case nil:
+		buf.WriteByte(0xc0)
+	case bool:
+		if v {
+			buf.WriteByte(0xc3)
+		} else {
+			buf.WriteByte(0xc2)
+		}
+	case json.Number:
+		return encodeNumber(buf, v)
+	case string:
+		encodeString(buf, v)
+	case []interface{}:
+		encodeLength(buf, len(v), 0x90, 15, 0xdc)
+		for _, item := range v {
+			if err := encode(buf, item); err != nil {
+				return err
+			}
+		}
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+
+		sort.Strings(keys)
+		encodeLength(buf, len(keys), 0x80, 15, 0xde)
+		for _, k := range keys {
+			encodeString(buf, k)
+			if err := encode(buf, v[k]); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("unsupported value type %T", v)
+	}
+
+	return nil
+}
+
+// encodeLength writes the header of a string, array or map: the fix format
+// for lengths up to fixMax, the 16 bit format (bigCode) or the 32 bit format
+// (bigCode+1) otherwise.
+func encodeLength(buf *bytes.Buffer, n int, fixCode byte, fixMax int, bigCode byte) {
+	switch {
+	case n <= fixMax:
+		buf.WriteByte(fixCode | byte(n))
+	case n <= math.MaxUint16:
+		buf.WriteByte(bigCode)
+		binary.Write(buf, binary.BigEndian, uint16(n))
+	default:
+		buf.WriteByte(bigCode + 1)
+		binary.Write(buf, binary.BigEndian, uint32(n))
+	}
+}
+
+func encodeString(buf *bytes.Buffer, s string) {
+	if len(s) > 31 && len(s) <= math.MaxUint8 {
+		buf.WriteByte(0xd9)
+		buf.WriteByte(byte(len(s)))
+	} else {
+		encodeLength(buf, len(s), 0xa0, 31, 0xda)
+	}
+
+	buf.WriteString(s)
+}
+
+func encodeNumber(buf *bytes.Buffer, n json.Number) error {
+	if i, err := strconv.ParseInt(string(n), 10, 64); err == nil {
+		if i >= 0 {
+			encodeUint(buf, uint64(i))
+		} else {
+			encodeInt(buf, i)
+		}
+
+		return nil
+	}
+
+	if u, err := strconv.ParseUint(string(n), 10, 64); err == nil {
+		encodeUint(buf, u)
+		return nil
+	}
+
+	f, err := strconv.ParseFloat(string(n), 64)
+	if err != nil {
+		return err
+	}
+
+	buf.WriteByte(0xcb)
+	binary.Write(buf, binary.BigEndian, f)
+	return nil
+}
+
+// encodeUint and encodeInt use the smallest format that fits the value.
+func encodeUint(buf *bytes.Buffer, u uint64) {
+	switch {
+	case u <= 127:
+		buf.WriteByte(byte(u))
+	case u <= math.MaxUint8:
+		buf.WriteByte(0xcc)
+		buf.WriteByte(byte(u))
+	case u <= math.MaxUint16:
+		buf.WriteByte(0xcd)
+		binary.Write(buf, binary.BigEndian, uint16(u))
+	case u <= math.MaxUint32:
+		buf.WriteByte(0xce)
+		binary.Write(buf, binary.BigEndian, uint32(u))
+	default:
+		buf.WriteByte(0xcf)
+		binary.Write(buf, binary.BigEndian, u)
+	}
+}
+
+func encodeInt(buf *bytes.Buffer, i int64) {
+	switch {
+	case i >= -32:
+		buf.WriteByte(byte(int8(i)))
+	case i >= math.MinInt8:
+		buf.WriteByte(0xd0)
+		buf.WriteByte(byte(int8(i)))
+	case i >= math.MinInt16:
+		buf.WriteByte(0xd1)
+		binary.Write(buf, binary.BigEndian, int16(i))
+	case i >= math.MinInt32:
+		buf.WriteByte(0xd2)
+		binary.Write(buf, binary.BigEndian, int32(i))
+	default:
+		buf.WriteByte(0xd3)
+		binary.Write(buf, binary.BigEndian, i)
+	}
+}
@@ -0,0 +1,67 @@
+package msgpack
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestMarshal(t *testing.T) {
+	long := strings.Repeat("x", 40)
+	cases := []struct {
+		value    interface{}
+		expected []byte
+	}{
+		{nil, []byte{0xc0}},
+		{true, []byte{0xc3}},
+		{false, []byte{0xc2}},
+		{0, []byte{0x00}},
+		{127, []byte{0x7f}},
+		{128, []byte{0xcc, 0x80}},
+		{256, []byte{0xcd, 0x01, 0x00}},
+		{65536, []byte{0xce, 0x00, 0x01, 0x00, 0x00}},
+		{uint64(1) << 63, []byte{0xcf, 0x80, 0, 0, 0, 0, 0, 0, 0}},
+		{-1, []byte{0xff}},
+		{-32, []byte{0xe0}},
+		{-33, []byte{0xd0, 0xdf}},
+		{-129, []byte{0xd1, 0xff, 0x7f}},
+		{1.5, []byte{0xcb, 0x3f, 0xf8, 0, 0, 0, 0, 0, 0}},
+		{"", []byte{0xa0}},
+		{"abc", []byte{0xa3, 'a', 'b', 'c'}},
+		{long, append([]byte{0xd9, 40}, long...)},
+		{[]int{1, 2}, []byte{0x92, 0x01, 0x02}},
+		{make([]int, 16), append([]byte{0xdc, 0x00, 0x10}, make([]byte, 16)...)},
+		// keys are sorted
+		{map[string]int{"b": 2, "a": 1}, []byte{0x82, 0xa1, 'a', 0x01, 0xa1, 'b', 0x02}},
+	}
+
+	for _, c := range cases {
+		blob, err := Marshal(c.value)
+		if err != nil {
+			t.Errorf("error encoding %v: %v", c.value, err)
+			continue
+		}
+
+		if !bytes.Equal(blob, c.expected) {
+			t.Errorf("expected %v to encode as %x, got %x", c.value, c.expected, blob)
+		}
+	}
+}
+
+func TestMarshalStruct(t *testing.T) {
+	// structs are encoded with their JSON keys
+	blob, err := Marshal(struct {
+		Name  string `json:"name"`
+		Total int64  `json:"total"`
+		Empty string `json:"empty,omitempty"`
+	}{Name: "web", Total: 300})
+
+	if err != nil {
+		t.Fatalf("error encoding struct: %v", err)
+	}
+
+	expected := []byte{0x82, 0xa4, 'n', 'a', 'm', 'e', 0xa3, 'w', 'e', 'b', 0xa5, 't', 'o', 't', 'a', 'l', 0xcd, 0x01, 0x2c}
+	if !bytes.Equal(blob, expected) {
+		t.Fatalf("expected %x, got %x", expected, blob)
+	}
+}
@@ -0,0 +1,113 @@
+package protobuf
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"sort"
+)
+
+const (
+	WireVarint  = 0
+	WireFixed64 = 1
+	WireBytes   = 2
+)
+
+// Buffer writes the protobuf wire format. Scalar fields with zero values are
+// skipped, as proto3 does.
+type Buffer struct {
+	bytes.Buffer
+}
+
+func (b *Buffer) Varint(v uint64) {
+	buf := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutUvarint(buf, v)
+	b.Write(buf[:n])
+}
+
+func (b *Buffer) Tag(field int, wireType int) {
+	b.Varint(uint64(field<<3 | wireType))
+}
+
+// BytesField writes a length delimited field even when it's empty.
+func (b *Buffer) BytesField(field int, v []byte) {
+	b.Tag(field, WireBytes)
+	b.Varint(uint64(len(v)))
+	b.Write(v)
+}
+
+func (b *Buffer) StringField(field int, s string) {
+	if s == "" {
+		return
+	}
+
+	b.BytesField(field, []byte(s))
+}
+
+func (b *Buffer) VarintField(field int, v uint64) {
+	if v == 0 {
+		return
+	}
+
+	b.Tag(field, WireVarint)
+	b.Varint(v)
+}
+
+func (b *Buffer) BoolField(field int, v bool) {
+	if v {
+		b.VarintField(field, 1)
+	}
+}
+
+// Fixed64Field writes the field even when it's zero.
+func (b *Buffer) Fixed64Field(field int, v uint64) {
+	b.Tag(field, WireFixed64)
+	buf := make([]byte, 8)
+	binary.LittleEndian.PutUint64(buf, v)
+	b.Write(buf)
+}
+
+func (b *Buffer) DoubleField(field int, v float64) {
+	if v == 0 {
+		return
+	}
+
+	b.Fixed64Field(field, math.Float64bits(v))
+}
+
+// PackedVarintField writes repeated varints in the packed encoding.
+func (b *Buffer) PackedVarintField(field int, values []uint64) {
+	if len(values) == 0 {
+		return
+	}
+
+	packed := &Buffer{}
+	for _, v := range values {
+		packed.Varint(v)
+	}
+
+	b.BytesField(field, packed.Bytes())
+}
+
+func (b *Buffer) MessageField(field int, encode func(*Buffer)) {
+	inner := &Buffer{}
+	encode(inner)
+	b.BytesField(field, inner.Bytes())
+}
+
+// StringMapField writes a `map<string, string>` field, entries are sorted by
+// key so equal maps encode equally.
+func (b *Buffer) StringMapField(field int, m map[string]string) {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+	for _, k := range keys {
+		b.MessageField(field, func(eb *Buffer) {
+			eb.StringField(1, k)
+			eb.StringField(2, m[k])
+		})
+	}
+}
@@ -0,0 +1,41 @@
+package protobuf
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestFields(t *testing.T) {
+	cases := []struct {
+		name     string
+		write    func(b *Buffer)
+		expected []byte
+	}{
+		{"varint", func(b *Buffer) { b.VarintField(1, 300) }, []byte{0x08, 0xac, 0x02}},
+		{"zero varint", func(b *Buffer) { b.VarintField(1, 0) }, nil},
+		{"string", func(b *Buffer) { b.StringField(2, "web") }, []byte{0x12, 0x03, 'w', 'e', 'b'}},
+		{"empty string", func(b *Buffer) { b.StringField(2, "") }, nil},
+		{"empty bytes", func(b *Buffer) { b.BytesField(2, nil) }, []byte{0x12, 0x00}},
+		{"bool", func(b *Buffer) { b.BoolField(3, true) }, []byte{0x18, 0x01}},
+		{"double", func(b *Buffer) { b.DoubleField(1, 1.5) }, []byte{0x09, 0, 0, 0, 0, 0, 0, 0xf8, 0x3f}},
+		{"zero double", func(b *Buffer) { b.DoubleField(1, 0) }, nil},
+		{"packed", func(b *Buffer) { b.PackedVarintField(4, []uint64{3, 270}) }, []byte{0x22, 0x03, 0x03, 0x8e, 0x02}},
+		{"empty packed", func(b *Buffer) { b.PackedVarintField(4, nil) }, nil},
+		{"message", func(b *Buffer) {
+			b.MessageField(5, func(mb *Buffer) { mb.VarintField(1, 1) })
+		}, []byte{0x2a, 0x02, 0x08, 0x01}},
+		// map entries are sorted by key
+		{"map", func(b *Buffer) {
+			b.StringMapField(1, map[string]string{"b": "2", "a": "1"})
+		}, []byte{0x0a, 0x06, 0x0a, 0x01, 'a', 0x12, 0x01, '1', 0x0a, 0x06, 0x0a, 0x01, 'b', 0x12, 0x01, '2'}},
+		{"large field", func(b *Buffer) { b.VarintField(16, 1) }, []byte{0x80, 0x01, 0x01}},
+	}
+
+	for _, c := range cases {
+		b := &Buffer{}
+		c.write(b)
+		if !bytes.Equal(b.Bytes(), c.expected) {
+			t.Errorf("%s: expected %x, got %x", c.name, c.expected, b.Bytes())
+		}
+	}
+}
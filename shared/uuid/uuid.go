@@ -7,3 +7,9 @@ import (
 func Generate() string {
 	return uuid.NewV4().String()
 }
+
+// Derive returns a name based uuid, the same name always yields the same
+// uuid.
+func Derive(name string) string {
+	return uuid.NewV5(uuid.NamespaceOID, name).String()
+}
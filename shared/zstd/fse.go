@@ -0,0 +1,268 @@
+package zstd
+
+// bitWriter writes bits from the least significant end; readers start at the
+// last byte, after the final marker bit, and read backwards.
+type bitWriter struct {
+	out   []byte
+	bits  uint64
+	nbits uint
+}
+
+func (w *bitWriter) add(value uint64, n uint) {
+	if n == 0 {
+		return
+	}
+
+	w.bits |= (value & (1<<n - 1)) << w.nbits
+	w.nbits += n
+	for w.nbits >= 8 {
+		w.out = append(w.out, byte(w.bits))
+		w.bits >>= 8
+		w.nbits -= 8
+	}
+}
+
+func (w *bitWriter) close() []byte {
+	w.add(1, 1)
+	if w.nbits > 0 {
+		w.out = append(w.out, byte(w.bits))
+	}
+
+	return w.out
+}
+
+func highBit(v uint32) uint {
+	n := uint(0)
+	for v > 1 {
+		v >>= 1
+		n++
+	}
+
+	return n
+}
+
+// The predefined distributions and code tables of RFC 8878 section 3.1.1.3.2,
+// -1 stands for a "less than 1" probability.
+var (
+	llNorm = []int16{
+		4, 3, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 1, 1, 1,
+		2, 2, 2, 2, 2, 2, 2, 2, 2, 3, 2, 1, 1, 1, 1, 1,
+		-1, -1, -1, -1,
+	}
+	mlNorm = []int16{
+		1, 4, 3, 2, 2, 2, 2, 2, 2, 1, 1, 1, 1, 1, 1, 1,
+		1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1,
+		1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, -1, -1,
+		-1, -1, -1, -1, -1,
+	}
+	ofNorm = []int16{
+		1, 1, 1, 1, 1, 1, 2, 2, 2, 1, 1, 1, 1, 1, 1, 1,
+		1, 1, 1, 1, 1, 1, 1, 1, -1, -1, -1, -1, -1,
+	}
+
+	llBaselines = []uint32{
+		0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15,
+		16, 18, 20, 22, 24, 28, 32, 40, 48, 64, 128, 256, 512, 1024, 2048, 4096,
+		8192, 16384, 32768, 65536,
+	}
+	llBits = []uint{
+		0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+		1, 1, 1, 1, 2, 2, 3, 3, 4, 6, 7, 8, 9, 10, 11, 12,
+		13, 14, 15, 16,
+	}
+	mlBaselines = []uint32{
+		3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18,
+		19, 20, 21, 22, 23, 24, 25, 26, 27, 28, 29, 30, 31, 32, 33, 34,
+		35, 37, 39, 41, 43, 47, 51, 59, 67, 83, 99, 131, 259, 515, 1027, 2051,
+		4099, 8195, 16387, 32771, 65539,
+	}
+	mlBits = []uint{
+		0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+		0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+		1, 1, 1, 1, 2, 2, 3, 3, 4, 4, 5, 7, 8, 9, 10, 11,
+		12, 13, 14, 15, 16,
+	}
+
+	llTable = newFSETable(llNorm, 6)
+	mlTable = newFSETable(mlNorm, 6)
+	ofTable = newFSETable(ofNorm, 5)
+)
+
+func lengthCode(baselines []uint32, v uint32) int {
+	for code := len(baselines) - 1; code > 0; code-- {
+		if baselines[code] <= v {
+			return code
+		}
+	}
+
+	return 0
+}
+
+type symbolTransform struct {
+	deltaNbBits    uint32
+	deltaFindState int32
+}
+
+// fseTable is the encoding side of an FSE table, built the way decoders
+// spread the symbols over their states.
+type fseTable struct {
+	log        uint
+	stateTable []uint16
+	symbols    []symbolTransform
+}
+
+func newFSETable(norm []int16, log uint) *fseTable {
+	size := 1 << log
+	symbols := make([]int, size)
+	cumul := make([]int, len(norm)+1)
+	high := size - 1
+	for s, n := range norm {
+		if n == -1 {
+			cumul[s+1] = cumul[s] + 1
+			symbols[high] = s
+			high--
+		} else {
+			cumul[s+1] = cumul[s] + int(n)
+		}
+	}
+
+	step := size>>1 + size>>3 + 3
+	position := 0
+	for s, n := range norm {
+		for i := 0; i < int(n); i++ {
+			symbols[position] = s
+			position = (position + step) & (size - 1)
+			for position > high {
+				position = (position + step) & (size - 1)
+			}
+		}
+	}
+
+	t := &fseTable{
+		log:        log,
+		stateTable: make([]uint16, size),
+		symbols:    make([]symbolTransform, len(norm)),
+	}
+
+	for u := 0; u < size; u++ {
+		s := symbols[u]
+		t.stateTable[cumul[s]] = uint16(size + u)
+		cumul[s]++
+	}
+
+	total := int32(0)
+	for s, n := range norm {
+		switch n {
+		case -1, 1:
+			t.symbols[s] = symbolTransform{
+				deltaNbBits:    uint32(log<<16) - uint32(size),
+				deltaFindState: total - 1,
+			}
+			total++
+		default:
+			maxBitsOut := log - highBit(uint32(n-1))
+			minStatePlus := uint32(n) << maxBitsOut
+			t.symbols[s] = symbolTransform{
+				deltaNbBits:    uint32(maxBitsOut<<16) - minStatePlus,
+				deltaFindState: total - int32(n),
+			}
+			total += int32(n)
+		}
+	}
+
+	return t
+}
+
+type fseState struct {
+	table *fseTable
+	value uint32
+}
+
+func (s *fseState) init(symbol int) {
+	tt := s.table.symbols[symbol]
+	nbBitsOut := (tt.deltaNbBits + 1<<15) >> 16
+	value := nbBitsOut<<16 - tt.deltaNbBits
+	s.value = uint32(s.table.stateTable[int32(value>>nbBitsOut)+tt.deltaFindState])
+}
+
+func (s *fseState) encode(w *bitWriter, symbol int) {
+	tt := s.table.symbols[symbol]
+	nbBitsOut := (s.value + tt.deltaNbBits) >> 16
+	w.add(uint64(s.value), uint(nbBitsOut))
+	s.value = uint32(s.table.stateTable[int32(s.value>>nbBitsOut)+tt.deltaFindState])
+}
+
+func (s *fseState) flush(w *bitWriter) {
+	w.add(uint64(s.value), s.table.log)
+}
+
+type sequenceCodes struct {
+	ll, ml, of                int
+	llExtra, mlExtra, ofExtra uint64
+}
+
+func codesOf(seq sequence) sequenceCodes {
+	ll := lengthCode(llBaselines, seq.litLen)
+	ml := lengthCode(mlBaselines, seq.matchLen)
+	// offsets are sent as offset+3, the smaller values refer to repeated
+	// offsets which aren't used
+	offBase := seq.offset + 3
+	of := int(highBit(offBase))
+	return sequenceCodes{
+		ll:      ll,
+		ml:      ml,
+		of:      of,
+		llExtra: uint64(seq.litLen - llBaselines[ll]),
+		mlExtra: uint64(seq.matchLen - mlBaselines[ml]),
+		ofExtra: uint64(offBase - 1<<uint(of)),
+	}
+}
+
+// appendSequences writes the sequences section with the predefined tables.
+// Sequences are encoded last to first so decoders read them in order.
+func appendSequences(out []byte, seqs []sequence) []byte {
+	n := len(seqs)
+	switch {
+	case n < 128:
+		out = append(out, byte(n))
+	case n < 0x7F00:
+		out = append(out, byte(n>>8)+128, byte(n))
+	default:
+		out = append(out, 255, byte(n-0x7F00), byte((n-0x7F00)>>8))
+	}
+
+	if n == 0 {
+		return out
+	}
+
+	// predefined mode for all three tables
+	out = append(out, 0)
+
+	w := &bitWriter{}
+	ll := &fseState{table: llTable}
+	ml := &fseState{table: mlTable}
+	of := &fseState{table: ofTable}
+
+	c := codesOf(seqs[n-1])
+	ml.init(c.ml)
+	of.init(c.of)
+	ll.init(c.ll)
+	w.add(c.llExtra, llBits[c.ll])
+	w.add(c.mlExtra, mlBits[c.ml])
+	w.add(c.ofExtra, uint(c.of))
+
+	for i := n - 2; i >= 0; i-- {
+		c := codesOf(seqs[i])
+		of.encode(w, c.of)
+		ml.encode(w, c.ml)
+		ll.encode(w, c.ll)
+		w.add(c.llExtra, llBits[c.ll])
+		w.add(c.mlExtra, mlBits[c.ml])
+		w.add(c.ofExtra, uint(c.of))
+	}
+
+	ml.flush(w)
+	of.flush(w)
+	ll.flush(w)
+	return append(out, w.close()...)
+}
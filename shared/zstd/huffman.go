@@ -0,0 +1,247 @@
+package zstd
+
+import (
+	"encoding/binary"
+)
+
+const (
+	literalsTypeRaw        = 0
+	literalsTypeCompressed = 2
+
+	maxHuffmanBits = 11
+
+	// weights can only be described directly for up to 128 symbols, the
+	// last symbol's weight is implied
+	maxDirectSymbol = 128
+
+	// single stream Huffman literals are limited by the 10 bit sizes
+	maxSingleStream = 1023
+)
+
+// appendLiterals writes the literals section, Huffman coded if that is
+// smaller than the raw literals.
+func appendLiterals(out []byte, literals []byte) []byte {
+	if compressed := appendHuffmanLiterals(nil, literals); compressed != nil && len(compressed) < len(literals) {
+		return append(out, compressed...)
+	}
+
+	n := len(literals)
+	switch {
+	case n < 32:
+		out = append(out, byte(literalsTypeRaw|n<<3))
+	case n < 4096:
+		h := literalsTypeRaw | 1<<2 | n<<4
+		out = append(out, byte(h), byte(h>>8))
+	default:
+		h := literalsTypeRaw | 3<<2 | n<<4
+		out = append(out, byte(h), byte(h>>8), byte(h>>16))
+	}
+
+	return append(out, literals...)
+}
+
+type huffmanCode struct {
+	code uint16
+	bits uint
+}
+
+// huffmanLengths returns the code lengths of a Huffman code for the counts,
+// counts are halved until no code is longer than maxHuffmanBits.
+func huffmanLengths(counts []int) []uint {
+	for {
+		lengths := buildLengths(counts)
+		longest := uint(0)
+		for _, l := range lengths {
+			if l > longest {
+				longest = l
+			}
+		}
+
+		if longest <= maxHuffmanBits {
+			return lengths
+		}
+
+		for s, c := range counts {
+			if c > 0 {
+				counts[s] = (c + 1) / 2
+			}
+		}
+	}
+}
+
+func buildLengths(counts []int) []uint {
+	type node struct {
+		count  int
+		parent int
+	}
+
+	var nodes []node
+	var active []int
+	leaves := make([]int, len(counts))
+	for s, c := range counts {
+		leaves[s] = -1
+		if c > 0 {
+			leaves[s] = len(nodes)
+			active = append(active, len(nodes))
+			nodes = append(nodes, node{count: c, parent: -1})
+		}
+	}
+
+	// smallest returns and removes the active node with the lowest count
+	smallest := func() int {
+		min := 0
+		for i := range active {
+			if nodes[active[i]].count < nodes[active[min]].count {
+				min = i
+			}
+		}
+
+		n := active[min]
+		active = append(active[:min], active[min+1:]...)
+		return n
+	}
+
+	for len(active) > 1 {
+		a, b := smallest(), smallest()
+		parent := len(nodes)
+		nodes = append(nodes, node{count: nodes[a].count + nodes[b].count, parent: -1})
+		nodes[a].parent = parent
+		nodes[b].parent = parent
+		active = append(active, parent)
+	}
+
+	lengths := make([]uint, len(counts))
+	for s, leaf := range leaves {
+		if leaf < 0 {
+			continue
+		}
+
+		for n := leaf; nodes[n].parent >= 0; n = nodes[n].parent {
+			lengths[s]++
+		}
+	}
+
+	return lengths
+}
+
+// appendHuffmanLiterals writes Huffman coded literals with a directly
+// described tree, nil is returned when the literals can't be coded that way.
+func appendHuffmanLiterals(out []byte, literals []byte) []byte {
+	counts := make([]int, 256)
+	maxSymbol := 0
+	distinct := 0
+	for _, b := range literals {
+		if counts[b] == 0 {
+			distinct++
+		}
+
+		counts[b]++
+		if int(b) > maxSymbol {
+			maxSymbol = int(b)
+		}
+	}
+
+	if distinct < 2 || maxSymbol > maxDirectSymbol {
+		return nil
+	}
+
+	lengths := huffmanLengths(counts[:maxSymbol+1])
+	maxBits := uint(0)
+	for _, l := range lengths {
+		if l > maxBits {
+			maxBits = l
+		}
+	}
+
+	// canonical codes: the longest codes come first, symbols of the same
+	// length in increasing order
+	codes := make([]huffmanCode, maxSymbol+1)
+	code := uint16(0)
+	for bits := maxBits; bits > 0; bits-- {
+		for s, l := range lengths {
+			if l == bits {
+				codes[s] = huffmanCode{code: code, bits: bits}
+				code++
+			}
+		}
+
+		code >>= 1
+	}
+
+	// the tree description: one 4 bit weight per symbol but the last
+	tree := []byte{byte(127 + maxSymbol)}
+	for s := 0; s < maxSymbol; s += 2 {
+		w := huffmanWeight(lengths[s], maxBits) << 4
+		if s+1 < maxSymbol {
+			w |= huffmanWeight(lengths[s+1], maxBits)
+		}
+
+		tree = append(tree, w)
+	}
+
+	var streams []byte
+	single := len(literals) <= maxSingleStream
+	if single {
+		streams = huffmanStream(literals, codes)
+	} else {
+		segment := (len(literals) + 3) / 4
+		var encoded [4][]byte
+		for i := range encoded {
+			start := i * segment
+			end := start + segment
+			if end > len(literals) {
+				end = len(literals)
+			}
+
+			encoded[i] = huffmanStream(literals[start:end], codes)
+		}
+
+		// the jump table holds the sizes of the first three streams
+		for _, e := range encoded[:3] {
+			streams = binary.LittleEndian.AppendUint16(streams, uint16(len(e)))
+		}
+
+		for _, e := range encoded {
+			streams = append(streams, e...)
+		}
+	}
+
+	regenerated := uint64(len(literals))
+	compressed := uint64(len(tree) + len(streams))
+	switch {
+	case single && compressed <= maxSingleStream:
+		h := uint64(literalsTypeCompressed) | regenerated<<4 | compressed<<14
+		out = append(out, byte(h), byte(h>>8), byte(h>>16))
+	case single:
+		return nil
+	case regenerated < 1<<14 && compressed < 1<<14:
+		h := uint64(literalsTypeCompressed) | 2<<2 | regenerated<<4 | compressed<<18
+		out = binary.LittleEndian.AppendUint32(out, uint32(h))
+	default:
+		h := uint64(literalsTypeCompressed) | 3<<2 | regenerated<<4 | compressed<<22
+		out = append(out, byte(h), byte(h>>8), byte(h>>16), byte(h>>24), byte(h>>32))
+	}
+
+	out = append(out, tree...)
+	return append(out, streams...)
+}
+
+func huffmanWeight(length uint, maxBits uint) byte {
+	if length == 0 {
+		return 0
+	}
+
+	return byte(maxBits + 1 - length)
+}
+
+// huffmanStream codes the literals last to first, decoders read the stream
+// backwards.
+func huffmanStream(literals []byte, codes []huffmanCode) []byte {
+	w := &bitWriter{}
+	for i := len(literals) - 1; i >= 0; i-- {
+		c := codes[literals[i]]
+		w.add(uint64(c.code), c.bits)
+	}
+
+	return w.close()
+}
@@ -0,0 +1,156 @@
+package zstd
+
+import (
+	"encoding/binary"
+)
+
+const (
+	magicNumber = 0xFD2FB528
+
+	// blocks are limited to 128KB of content
+	maxBlockSize = 128 << 10
+
+	blockTypeRaw        = 0
+	blockTypeCompressed = 2
+
+	minMatch  = 4
+	hashLog   = 16
+	maxOffset = 1 << 24
+)
+
+// Compress returns src as a single zstd frame (RFC 8878). The encoder is a
+// fast one: matches are found with a single hash table, sequences use the
+// predefined FSE tables and literals are Huffman coded when that pays off.
+// Blocks that don't compress are stored as they are.
+func Compress(src []byte) []byte {
+	out := make([]byte, 0, len(src)/2+32)
+	out = binary.LittleEndian.AppendUint32(out, magicNumber)
+	out = appendFrameHeader(out, uint64(len(src)))
+
+	if len(src) == 0 {
+		return appendBlockHeader(out, true, blockTypeRaw, 0)
+	}
+
+	m := newMatcher(src)
+	for start := 0; start < len(src); start += maxBlockSize {
+		end := start + maxBlockSize
+		if end > len(src) {
+			end = len(src)
+		}
+
+		last := end == len(src)
+		block := compressBlock(m, start, end)
+		if block == nil || len(block) >= end-start {
+			out = appendBlockHeader(out, last, blockTypeRaw, end-start)
+			out = append(out, src[start:end]...)
+			continue
+		}
+
+		out = appendBlockHeader(out, last, blockTypeCompressed, len(block))
+		out = append(out, block...)
+	}
+
+	return out
+}
+
+// appendFrameHeader writes a single segment frame header with the content
+// size, so the window is the whole content and no window descriptor is
+// needed.
+func appendFrameHeader(out []byte, size uint64) []byte {
+	const singleSegment = 1 << 5
+	switch {
+	case size < 256:
+		out = append(out, singleSegment, byte(size))
+	case size < 65536+256:
+		out = append(out, 1<<6|singleSegment)
+		out = binary.LittleEndian.AppendUint16(out, uint16(size-256))
+	case size <= 0xFFFFFFFF:
+		out = append(out, 2<<6|singleSegment)
+		out = binary.LittleEndian.AppendUint32(out, uint32(size))
+	default:
+		out = append(out, 3<<6|singleSegment)
+		out = binary.LittleEndian.AppendUint64(out, size)
+	}
+
+	return out
+}
+
+func appendBlockHeader(out []byte, last bool, blockType int, size int) []byte {
+	h := uint32(blockType<<1) | uint32(size)<<3
+	if last {
+		h |= 1
+	}
+
+	return append(out, byte(h), byte(h>>8), byte(h>>16))
+}
+
+type sequence struct {
+	litLen   uint32
+	matchLen uint32
+	offset   uint32
+}
+
+// matcher finds matches in the whole content, earlier blocks of the frame
+// can be referenced.
+type matcher struct {
+	src   []byte
+	table []int32
+}
+
+func newMatcher(src []byte) *matcher {
+	return &matcher{
+		src:   src,
+		table: make([]int32, 1<<hashLog),
+	}
+}
+
+func (m *matcher) hash(i int) uint32 {
+	return (binary.LittleEndian.Uint32(m.src[i:]) * 2654435761) >> (32 - hashLog)
+}
+
+// sequences greedily matches the content between start and end, the
+// literals of all sequences and the trailing literals are returned in order.
+func (m *matcher) sequences(start int, end int) ([]sequence, []byte) {
+	var seqs []sequence
+	var literals []byte
+	src := m.src
+	litStart := start
+	for i := start; i+minMatch <= end; {
+		h := m.hash(i)
+		// table entries are positions plus one, zero means empty
+		candidate := int(m.table[h]) - 1
+		m.table[h] = int32(i + 1)
+		if candidate < 0 || i-candidate > maxOffset ||
+			binary.LittleEndian.Uint32(src[candidate:]) != binary.LittleEndian.Uint32(src[i:]) {
+			i++
+			continue
+		}
+
+		length := minMatch
+		for i+length < end && src[candidate+length] == src[i+length] {
+			length++
+		}
+
+		literals = append(literals, src[litStart:i]...)
+		seqs = append(seqs, sequence{
+			litLen:   uint32(i - litStart),
+			matchLen: uint32(length),
+			offset:   uint32(i - candidate),
+		})
+
+		for j := i + 1; j < i+length && j+minMatch <= end; j++ {
+			m.table[m.hash(j)] = int32(j + 1)
+		}
+
+		i += length
+		litStart = i
+	}
+
+	return seqs, append(literals, src[litStart:end]...)
+}
+
+func compressBlock(m *matcher, start int, end int) []byte {
+	seqs, literals := m.sequences(start, end)
+	out := appendLiterals(nil, literals)
+	return appendSequences(out, seqs)
+}
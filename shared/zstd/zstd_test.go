@@ -0,0 +1,75 @@
+package zstd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math/rand"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+func testInputs() map[string][]byte {
+	r := rand.New(rand.NewSource(1))
+	random := make([]byte, 300<<10)
+	r.Read(random)
+
+	// few matches but skewed literals, which are Huffman coded
+	words := []string{"cpu", "memory", "network", "disk", "meter", "sample", "a", "e", " "}
+	text := &bytes.Buffer{}
+	for text.Len() < 64<<10 {
+		text.WriteString(words[r.Intn(len(words))])
+		text.WriteByte(byte('a' + r.Intn(26)))
+	}
+
+	sample := `{"meter_id":"meter","type":"usage_sample","data":{"cpu":{"total":123456,"per_core":[1,2,3]}}}` + "\n"
+	return map[string][]byte{
+		"empty":  {},
+		"byte":   []byte("a"),
+		"short":  []byte("abcdabcdabcdabcd"),
+		"random": random,
+		"text":   text.Bytes(),
+		// spans several blocks, matches reach into earlier ones
+		"samples": []byte(strings.Repeat(sample, 5000)),
+	}
+}
+
+func TestFrame(t *testing.T) {
+	for name, in := range testInputs() {
+		out := Compress(in)
+		if binary.LittleEndian.Uint32(out) != magicNumber {
+			t.Fatalf("%s: expected the frame to start with the magic number, got %x", name, out[:4])
+		}
+
+		// incompressible blocks are stored, adding only the headers
+		if max := len(in) + 6 + 3*(len(in)/maxBlockSize+1) + 8; len(out) > max {
+			t.Errorf("%s: expected at most %d bytes, got %d", name, max, len(out))
+		}
+	}
+
+	if out := Compress([]byte(strings.Repeat("usage ", 1000))); len(out) > 100 {
+		t.Fatalf("expected repeated content to compress, got %d bytes", len(out))
+	}
+}
+
+// TestDecompress checks the frames decompress with the reference
+// implementation when the zstd command is installed.
+func TestDecompress(t *testing.T) {
+	if _, err := exec.LookPath("zstd"); err != nil {
+		t.Skip("zstd command not found")
+	}
+
+	for name, in := range testInputs() {
+		cmd := exec.Command("zstd", "-d", "-c", "-q")
+		cmd.Stdin = bytes.NewReader(Compress(in))
+		out, err := cmd.Output()
+		if err != nil {
+			t.Errorf("%s: error decompressing: %v", name, err)
+			continue
+		}
+
+		if !bytes.Equal(out, in) {
+			t.Errorf("%s: expected the original %d bytes, got %d different ones", name, len(in), len(out))
+		}
+	}
+}